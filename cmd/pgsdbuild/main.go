@@ -1,15 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/pgsdf/pgsdbuild/internal/audit"
 	"github.com/pgsdf/pgsdbuild/internal/build"
+	"github.com/pgsdf/pgsdbuild/internal/cache"
+	"github.com/pgsdf/pgsdbuild/internal/catalog"
 	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
 	"github.com/pgsdf/pgsdbuild/internal/image"
 	"github.com/pgsdf/pgsdbuild/internal/iso"
+	"github.com/pgsdf/pgsdbuild/internal/lint"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/pkglist"
+	"github.com/pgsdf/pgsdbuild/internal/repro"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
 	"github.com/pgsdf/pgsdbuild/internal/util"
 )
 
@@ -26,6 +41,7 @@ func main() {
 func run() int {
 	// Initialize configuration
 	buildConfig = build.NewDefaultConfig()
+	buildConfig.BuilderVersion = "pgsdbuild " + Version
 	buildConfig.LoadFromEnv()
 
 	// Parse global flags
@@ -33,6 +49,14 @@ func run() int {
 		verbose  = flag.Bool("v", false, "Enable verbose output")
 		quiet    = flag.Bool("q", false, "Suppress all output except errors")
 		keepWork = flag.Bool("keep-work", false, "Keep work directory after build")
+		strict   = flag.Bool("strict", buildConfig.Strict, "Treat recipe warnings as errors")
+		dryRun   = flag.Bool("dry-run", false, "Print host commands instead of running them")
+		record   = flag.String("record", "", "Record host commands and their results to `file`")
+		replay   = flag.String("replay", "", "Replay host commands from a recorded or scripted `file`")
+		resume   = flag.Bool("resume", false, "Skip build stages completed by an earlier run")
+		from     = flag.String("from-stage", "", "Start the build at `stage`; earlier stages must be complete")
+		until    = flag.String("until-stage", "", "Stop the build after `stage`")
+		noCache  = flag.Bool("no-cache", buildConfig.NoCache, "Do not restore or save cached build stages")
 		version  = flag.Bool("version", false, "Show version information")
 		help     = flag.Bool("h", false, "Show help information")
 
@@ -42,6 +66,14 @@ func run() int {
 		artifactsDir = flag.String("artifacts-dir", buildConfig.ArtifactsDir, "Directory for build artifacts")
 		workDir      = flag.String("work-dir", buildConfig.WorkDir, "Working directory for builds")
 		isoDir       = flag.String("iso-dir", buildConfig.ISODir, "Directory for ISO outputs")
+		cacheDir     = flag.String("cache-dir", buildConfig.CacheDir, "Directory for cached build stages")
+		keysDir      = flag.String("keys-dir", buildConfig.KeysDir, "Directory of signing keys; public keys are shipped in ISOs")
+		signingKey   = flag.String("signing-key", buildConfig.SigningKey, "Sign image manifests with the private key in `file`")
+		vulnDB       = flag.String("vuln-db", buildConfig.VulnDB, "Fail image builds with vulnerable packages, checked against the VuXML `file`")
+		auditFailOn  = flag.String("audit-fail-on", buildConfig.AuditFailOn, "Lowest advisory `severity` that fails a build (low|medium|high|critical|none)")
+		auditIgnore  = flag.String("audit-ignore", strings.Join(buildConfig.AuditIgnore, ","), "Comma-separated advisory `vids` the build audit ignores")
+		pkgRepo      = flag.String("pkg-repo", buildConfig.PkgRepo, "Package repository URL overriding recipe repositories (e.g. file:///srv/pkg)")
+		pkgCatalog   = flag.String("pkg-catalog", buildConfig.PkgCatalog, "Package catalog (packagesite.yaml, packagesite.pkg or repository directory) for plan and lint")
 	)
 
 	flag.Usage = usage
@@ -65,7 +97,20 @@ func run() int {
 	buildConfig.ArtifactsDir = *artifactsDir
 	buildConfig.WorkDir = *workDir
 	buildConfig.ISODir = *isoDir
+	buildConfig.CacheDir = *cacheDir
+	buildConfig.NoCache = *noCache
+	buildConfig.KeysDir = *keysDir
+	buildConfig.SigningKey = *signingKey
+	buildConfig.VulnDB = *vulnDB
+	buildConfig.AuditFailOn = *auditFailOn
+	buildConfig.AuditIgnore = build.SplitList(*auditIgnore)
+	buildConfig.PkgRepo = *pkgRepo
+	buildConfig.PkgCatalog = *pkgCatalog
 	buildConfig.KeepWork = *keepWork
+	buildConfig.Resume = *resume
+	buildConfig.FromStage = *from
+	buildConfig.UntilStage = *until
+	buildConfig.Strict = *strict
 	buildConfig.Verbose = *verbose
 
 	// Initialize logger
@@ -91,16 +136,92 @@ func run() int {
 		return 1
 	}
 
+	// Select how host commands are run
+	finish, err := setupExecutor(*dryRun, *record, *replay)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	ctx, stop := signalContext()
+	defer stop()
+
+	status := runCommand(ctx, args)
+	err = finish()
+	if ctx.Err() != nil {
+		// A replay stopped early always has commands left over
+		if err != nil {
+			logger.Warn("%v", err)
+		}
+		return exitInterrupted
+	}
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	return status
+}
+
+// exitInterrupted is the exit status after a build was stopped by a signal,
+// as a shell reports a process killed by SIGINT.
+const exitInterrupted = 130
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+// Builds then kill the running command and release what they created; a
+// second signal exits immediately without cleaning up.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn("Received %s, stopping and cleaning up (repeat to exit immediately)", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		sig := <-signals
+		logger.Error("Received %s again, exiting without cleanup", sig)
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// runCommand dispatches to the subcommand named by args[0].
+func runCommand(ctx context.Context, args []string) int {
 	cmd := args[0]
 	switch cmd {
 	case "image":
-		return cmdImage(args[1:])
+		return cmdImage(ctx, args[1:])
 	case "iso":
-		return cmdISO(args[1:])
+		return cmdISO(ctx, args[1:])
 	case "list-images":
 		return cmdListImages(args[1:])
 	case "list-variants":
 		return cmdListVariants(args[1:])
+	case "lint":
+		return cmdLint(args[1:])
+	case "plan":
+		return cmdPlan(args[1:])
+	case "cache":
+		return cmdCache(args[1:])
+	case "verify-repro":
+		return cmdVerifyRepro(ctx, args[1:])
+	case "keygen":
+		return cmdKeygen(args[1:])
+	case "sign":
+		return cmdSign(args[1:])
+	case "verify-image":
+		return cmdVerifyImage(args[1:])
+	case "audit":
+		return cmdAudit(args[1:])
+	case "inspect-iso":
+		return cmdInspectISO(args[1:])
 	case "version":
 		fmt.Println(VersionInfo())
 		return 0
@@ -123,6 +244,15 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  iso <variant-id>         Build a bootable ISO\n")
 	fmt.Fprintf(os.Stderr, "  list-images              List available images\n")
 	fmt.Fprintf(os.Stderr, "  list-variants            List available variants\n")
+	fmt.Fprintf(os.Stderr, "  lint [--json]            Check recipes, overlays and package lists\n")
+	fmt.Fprintf(os.Stderr, "  plan [--json] <id>       Resolve an image or variant against the package catalog\n")
+	fmt.Fprintf(os.Stderr, "  cache ls|prune|verify    Manage cached build stages\n")
+	fmt.Fprintf(os.Stderr, "  verify-repro image|iso <id>  Build twice and compare the artifacts\n")
+	fmt.Fprintf(os.Stderr, "  keygen <name>            Generate an image signing key pair\n")
+	fmt.Fprintf(os.Stderr, "  sign <image-id>          Sign an image's manifest\n")
+	fmt.Fprintf(os.Stderr, "  verify-image <image-id>  Check an image's signature and checksums\n")
+	fmt.Fprintf(os.Stderr, "  audit <image-id>         Check an image's packages against a VuXML file\n")
+	fmt.Fprintf(os.Stderr, "  inspect-iso <variant-id> Report an ISO's boot catalog, partition tables and root mount\n")
 	fmt.Fprintf(os.Stderr, "  version                  Show version information\n")
 	fmt.Fprintf(os.Stderr, "  help                     Show this help message\n\n")
 	fmt.Fprintf(os.Stderr, "Flags:\n")
@@ -133,16 +263,45 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  PGSD_ARTIFACTS_DIR       Override artifacts directory\n")
 	fmt.Fprintf(os.Stderr, "  PGSD_WORK_DIR            Override work directory\n")
 	fmt.Fprintf(os.Stderr, "  PGSD_ISO_DIR             Override ISO directory\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_OVERLAYS_DIR        Override overlays directory\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_PKGLISTS_DIR        Override package lists directory\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_PKG_REPO            Override package repositories (e.g. file:///srv/pkg)\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_PKG_CATALOG         Package catalog for plan and lint\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_CACHE_DIR           Override stage cache directory\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_NO_CACHE            Do not use the stage cache (1|true)\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_SIGNING_KEY         Sign image manifests with this private key\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_KEYS_DIR            Override signing keys directory\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_VULN_DB             Audit image builds against this VuXML file\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_AUDIT_FAIL_ON       Lowest advisory severity that fails a build (default high)\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_AUDIT_IGNORE        Comma-separated advisory vids the build audit ignores\n")
+	fmt.Fprintf(os.Stderr, "  SOURCE_DATE_EPOCH        Build reproducibly with this timestamp (seconds since 1970)\n")
 	fmt.Fprintf(os.Stderr, "  PGSD_VERBOSE             Enable verbose output (1|true)\n")
-	fmt.Fprintf(os.Stderr, "  PGSD_KEEP_WORK           Keep work directory (1|true)\n\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_KEEP_WORK           Keep work directory (1|true)\n")
+	fmt.Fprintf(os.Stderr, "  PGSD_STRICT              Treat recipe warnings as errors (1|true)\n\n")
+	fmt.Fprintf(os.Stderr, "Build Stages:\n")
+	fmt.Fprintf(os.Stderr, "  image  disk, packages, overlays, system, dataset-overlays, efi, export, sbom, manifest\n")
+	fmt.Fprintf(os.Stderr, "  iso    base, packages, boot, overlays, bootloader, images, arcan, sbom, assemble\n\n")
 	fmt.Fprintf(os.Stderr, "Examples:\n")
 	fmt.Fprintf(os.Stderr, "  pgsdbuild image base\n")
 	fmt.Fprintf(os.Stderr, "  pgsdbuild -v iso desktop\n")
 	fmt.Fprintf(os.Stderr, "  pgsdbuild --keep-work image server\n")
-	fmt.Fprintf(os.Stderr, "  pgsdbuild list-images\n\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --strict image base\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --dry-run image pgsd-desktop\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --resume iso pgsd-bootenv-arcan\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --from-stage overlays --until-stage bootloader iso pgsd-bootenv-arcan\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --replay tests/image.json image pgsd-desktop\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --pkg-repo file:///srv/pkg image base\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild list-images\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --pkg-catalog packagesite.yaml plan pgsd-desktop\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild keygen release && pgsdbuild -signing-key keys/release.key image pgsd-desktop\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild audit --vuln-db /var/db/pkg/vuln.xml --fail-on medium pgsd-desktop\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild inspect-iso pgsd-bootenv-arcan\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild cache prune --older-than 720h --max-size 20G\n")
+	fmt.Fprintf(os.Stderr, "  SOURCE_DATE_EPOCH=$(git log -1 --format=%%ct) pgsdbuild verify-repro iso pgsd-bootenv-arcan\n")
+	fmt.Fprintf(os.Stderr, "  pgsdbuild --strict lint --json\n\n")
 }
 
-func cmdImage(args []string) int {
+func cmdImage(ctx context.Context, args []string) int {
 	if len(args) < 1 {
 		logger.Error("Missing image-id argument")
 		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild image <image-id>\n")
@@ -166,28 +325,48 @@ func cmdImage(args []string) int {
 		logger.Error("Failed to load image config: %v", err)
 		return 1
 	}
+	if !checkRecipeWarnings(cfg.Warnings) {
+		return 1
+	}
 
 	// Display build information
 	logger.Info("Building image: %s (version %s)", cfg.ID, cfg.Version)
+	if len(cfg.Extends) > 0 {
+		logger.Debug("  Extends: %v", cfg.Extends)
+	}
 	logger.Debug("  ZFS pool: %s", cfg.ZpoolName)
 	logger.Debug("  Root dataset: %s", cfg.RootDS)
 	logger.Debug("  Package lists: %v", cfg.PkgLists)
 	logger.Debug("  Overlays: %v", cfg.Overlays)
+	if cfg.System.Hostname != "" {
+		logger.Debug("  Hostname: %s", cfg.System.Hostname)
+	}
+	if len(cfg.System.Services) > 0 {
+		logger.Debug("  Services: %v", cfg.System.Services)
+	}
 
 	// Build the image
 	builder := image.NewBuilder(buildConfig, logger)
-	if err := builder.Build(*cfg); err != nil {
+	if err := builder.Build(ctx, *cfg); err != nil {
+		if ctx.Err() != nil {
+			logger.Error("Image build interrupted")
+			return exitInterrupted
+		}
 		logger.Error("Image build failed: %v", err)
 		return 1
 	}
 
+	if buildConfig.UntilStage != "" {
+		logger.Info("Image %s built up to stage %s", cfg.ID, buildConfig.UntilStage)
+		return 0
+	}
 	logger.Info("Image %s built successfully", cfg.ID)
 	artifactPath := filepath.Join(buildConfig.GetArtifactsDir(), cfg.ID)
 	logger.Info("Artifacts available in: %s", artifactPath)
 	return 0
 }
 
-func cmdISO(args []string) int {
+func cmdISO(ctx context.Context, args []string) int {
 	if len(args) < 1 {
 		logger.Error("Missing variant-id argument")
 		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild iso <variant-id>\n")
@@ -211,26 +390,399 @@ func cmdISO(args []string) int {
 		logger.Error("Failed to load variant config: %v", err)
 		return 1
 	}
+	if !checkRecipeWarnings(cfg.Warnings) {
+		return 1
+	}
 
 	// Display build information
 	logger.Info("Building bootenv ISO: %s (%s)", cfg.ID, cfg.Name)
+	if len(cfg.Extends) > 0 {
+		logger.Debug("  Extends: %v", cfg.Extends)
+	}
 	logger.Debug("  Package lists: %v", cfg.PkgLists)
 	logger.Debug("  Overlays: %v", cfg.Overlays)
 	logger.Debug("  Images dir: %s", cfg.ImagesDir)
 
 	// Build the ISO
 	builder := iso.NewBuilder(buildConfig, logger)
-	if err := builder.Build(*cfg); err != nil {
+	if err := builder.Build(ctx, *cfg); err != nil {
+		if ctx.Err() != nil {
+			logger.Error("ISO build interrupted")
+			return exitInterrupted
+		}
 		logger.Error("ISO build failed: %v", err)
 		return 1
 	}
 
+	if buildConfig.UntilStage != "" {
+		logger.Info("Bootenv ISO %s built up to stage %s", cfg.ID, buildConfig.UntilStage)
+		return 0
+	}
 	logger.Info("Bootenv ISO %s built successfully", cfg.ID)
 	isoPath := filepath.Join(buildConfig.GetISODir(), cfg.ID+".iso")
 	logger.Info("ISO available at: %s", isoPath)
 	return 0
 }
 
+// cmdVerifyRepro builds an image or ISO twice in separate directories with
+// the same SOURCE_DATE_EPOCH and no stage cache, and compares the results
+// file by file.
+func cmdVerifyRepro(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("verify-repro", flag.ContinueOnError)
+	keep := fs.Bool("keep", false, "Keep both builds even if they match")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 || (fs.Arg(0) != "image" && fs.Arg(0) != "iso") {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild verify-repro [--keep] image|iso <id>\n")
+		return 1
+	}
+	kind, id := fs.Arg(0), fs.Arg(1)
+
+	if executor.IsDryRun(buildConfig.GetExecutor()) {
+		logger.Error("verify-repro needs real builds and cannot be combined with --dry-run")
+		return 1
+	}
+	if !buildConfig.Reproducible() {
+		// Both builds and the tools they run must see the same epoch
+		epoch := time.Now().UTC().Truncate(time.Second)
+		buildConfig.SourceDateEpoch = epoch
+		os.Setenv(repro.EnvVar, fmt.Sprintf("%d", epoch.Unix()))
+		logger.Warn("%s not set, using %d for both builds", repro.EnvVar, epoch.Unix())
+	}
+
+	base := filepath.Join(buildConfig.GetWorkDir(), "repro", id)
+	if err := buildConfig.CleanupWorkPath(base); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	orig := buildConfig
+	defer func() { buildConfig = orig }()
+
+	var outputs [2]string
+	for n := range outputs {
+		cfg := *orig
+		dir := filepath.Join(base, fmt.Sprintf("build%d", n+1))
+		cfg.WorkDir = filepath.Join(dir, "work")
+		cfg.ISODir = filepath.Join(dir, "iso")
+		cfg.Resume, cfg.FromStage, cfg.UntilStage = false, "", ""
+		cfg.NoCache = true
+		cfg.KeepWork = false
+		buildConfig = &cfg
+
+		logger.Info("Reproducibility build %d of 2 in %s", n+1, dir)
+		var status int
+		if kind == "image" {
+			cfg.ArtifactsDir = filepath.Join(dir, "artifacts")
+			outputs[n] = filepath.Join(cfg.GetArtifactsDir(), id)
+			status = cmdImage(ctx, []string{id})
+		} else {
+			// Embedded images are still read from the real artifacts
+			outputs[n] = cfg.GetISODir()
+			status = cmdISO(ctx, []string{id})
+		}
+		if status != 0 {
+			return status
+		}
+	}
+	buildConfig = orig
+
+	diffs, err := repro.CompareDirs(outputs[0], outputs[1])
+	if err != nil {
+		logger.Error("Failed to compare builds: %v", err)
+		return 1
+	}
+	if len(diffs) > 0 {
+		fmt.Printf("%s %s is not reproducible, %d file(s) differ:\n", kind, id, len(diffs))
+		for _, d := range diffs {
+			fmt.Printf("  %s\n", d)
+		}
+		fmt.Printf("\nBoth builds kept for inspection (e.g. with diffoscope):\n  %s\n  %s\n", outputs[0], outputs[1])
+		return 1
+	}
+
+	fmt.Printf("%s %s is reproducible (SOURCE_DATE_EPOCH=%d)\n", kind, id, buildConfig.SourceDateEpoch.Unix())
+	if *keep {
+		fmt.Printf("Builds kept in %s\n", base)
+		return 0
+	}
+	if err := buildConfig.CleanupWorkPath(base); err != nil {
+		logger.Warn("Failed to remove %s: %v", base, err)
+	}
+	return 0
+}
+
+func cmdKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Replace an existing key pair")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild keygen [--force] <name>\n")
+		return 1
+	}
+
+	dir := buildConfig.GetKeysDir()
+	key, err := sign.GenerateKey(dir, fs.Arg(0), *force)
+	if err != nil {
+		logger.Error("Failed to generate key: %v", err)
+		return 1
+	}
+	keyPath := filepath.Join(dir, key.Name+sign.PrivateKeyExt)
+	fmt.Printf("Generated key %s\n", key.ID)
+	fmt.Printf("  private: %s (keep it secret, never commit it)\n", keyPath)
+	fmt.Printf("  public:  %s (shipped in boot ISOs as a trusted key)\n", filepath.Join(dir, key.Name+sign.PublicKeyExt))
+	fmt.Printf("\nSign images with: pgsdbuild -signing-key %s image <image-id>\n", keyPath)
+	return 0
+}
+
+// imageDir returns the artifact directory of an image given by ID or path.
+func imageDir(arg string) string {
+	if util.FileExists(filepath.Join(arg, manifest.FileName)) {
+		return arg
+	}
+	return filepath.Join(buildConfig.GetArtifactsDir(), arg)
+}
+
+func cmdSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	keyPath := fs.String("key", buildConfig.SigningKey, "Private key to sign with")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild sign [--key <file>] <image-id|image-dir>\n")
+		return 1
+	}
+	if *keyPath == "" {
+		logger.Error("No signing key given; use --key, -signing-key or PGSD_SIGNING_KEY")
+		return 1
+	}
+	key, err := sign.LoadPrivateKey(*keyPath)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	// The signature vouches for the artifacts, so check them first
+	dir := imageDir(fs.Arg(0))
+	manifestPath := filepath.Join(dir, manifest.FileName)
+	m, err := manifest.Load(manifestPath)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if err := m.Verify(dir, func(a manifest.Artifact) { logger.Debug("Verifying %s...", a.Path) }); err != nil {
+		logger.Error("Refusing to sign %s: %v", dir, err)
+		return 1
+	}
+	if err := sign.SignFile(key, manifestPath); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	logger.Info("Signed %s with key %s (%s)", manifestPath, key.ID, key.Name)
+	return 0
+}
+
+func cmdVerifyImage(args []string) int {
+	fs := flag.NewFlagSet("verify-image", flag.ContinueOnError)
+	keysDir := fs.String("keys", buildConfig.GetKeysDir(), "Directory of trusted public keys")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild verify-image [--keys <dir>] <image-id|image-dir>\n")
+		return 1
+	}
+	keys, err := sign.LoadKeyring(*keysDir)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if len(keys) == 0 {
+		logger.Error("No public keys in %s", *keysDir)
+		return 1
+	}
+
+	dir := imageDir(fs.Arg(0))
+	manifestPath := filepath.Join(dir, manifest.FileName)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		logger.Error("Cannot read manifest: %v", err)
+		return 1
+	}
+	signer, err := sign.VerifyFile(keys, manifestPath, data)
+	if err != nil {
+		logger.Error("%s: %v", manifestPath, err)
+		return 1
+	}
+	m, err := manifest.Decode(data)
+	if err != nil {
+		logger.Error("Invalid manifest %s: %v", manifestPath, err)
+		return 1
+	}
+	if err := m.Verify(dir, func(a manifest.Artifact) { logger.Debug("Verifying %s...", a.Path) }); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	fmt.Printf("%s: signed by %s (%s), %d artifact(s) verified\n", dir, signer.ID, signer.Name, len(m.Artifacts))
+	return 0
+}
+
+func cmdAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	dbPath := fs.String("vuln-db", buildConfig.VulnDB, "VuXML `file` to check against")
+	failOn := fs.String("fail-on", buildConfig.AuditFailOn, "Lowest advisory `severity` that fails the audit (low|medium|high|critical|none)")
+	ignore := fs.String("ignore", strings.Join(buildConfig.AuditIgnore, ","), "Comma-separated advisory `vids` to ignore")
+	jsonOut := fs.Bool("json", false, "Write the report as JSON")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild audit [--vuln-db <file>] [--fail-on <severity>] [--ignore <vids>] [--json] <image-id|image-dir>\n")
+		return 1
+	}
+	if *dbPath == "" {
+		logger.Error("No vulnerability database given; use --vuln-db, -vuln-db or PGSD_VULN_DB")
+		return 1
+	}
+	threshold, err := audit.ParseThreshold(*failOn)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	db, err := audit.Load(*dbPath)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	dir := imageDir(fs.Arg(0))
+	m, err := manifest.Load(filepath.Join(dir, manifest.FileName))
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	report := db.Image(m, build.SplitList(*ignore))
+	failing := report.Failing(threshold)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logger.Error("Failed to write audit report: %v", err)
+			return 1
+		}
+	} else {
+		for _, f := range report.Findings {
+			fmt.Println(f)
+			fmt.Printf("         affected: %s, %s\n", f.Range, f.URL)
+		}
+		if len(report.Unversioned) > 0 {
+			logger.Warn("%d package(s) have no version in the manifest and were not checked: %s",
+				len(report.Unversioned), strings.Join(report.Unversioned, ", "))
+		}
+		fmt.Printf("Checked %d package(s) of %s against %d advisories: %d vulnerable, %d at or above %s\n",
+			report.Packages, report.Image, report.Advisories, len(report.Findings), len(failing), threshold)
+	}
+
+	if len(failing) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func cmdInspectISO(args []string) int {
+	fs := flag.NewFlagSet("inspect-iso", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Write the report as JSON")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild inspect-iso [--json] <variant-id|iso-file>\n")
+		return 1
+	}
+
+	path := fs.Arg(0)
+	if !util.FileExists(path) {
+		path = filepath.Join(buildConfig.GetISODir(), path+".iso")
+	}
+	report, err := iso.Inspect(path)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logger.Error("Failed to write ISO report: %v", err)
+			return 1
+		}
+	} else {
+		printISOReport(report)
+	}
+
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printISOReport(r *iso.Report) {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	valid := func(b bool) string {
+		if b {
+			return "valid"
+		}
+		return "INVALID"
+	}
+
+	fmt.Printf("%s\n", r.Path)
+	fmt.Printf("Volume:      %s (system %q, publisher %q)\n", r.VolumeID, r.System, r.Publisher)
+	fmt.Printf("Size:        %d sectors of 2048 bytes, file %d bytes\n", r.Sectors, r.Size)
+	fmt.Printf("Extensions:  Rock Ridge %s, Joliet %s\n", yesNo(r.RockRidge), yesNo(r.Joliet))
+
+	if r.BootCatalog == 0 {
+		fmt.Printf("El Torito:   no boot record\n")
+	} else {
+		fmt.Printf("El Torito:   catalog at sector %d, BIOS %s, EFI %s\n", r.BootCatalog, yesNo(r.BIOS), yesNo(r.EFI))
+		for _, e := range r.BootEntries {
+			segment := fmt.Sprintf("0x%04x", e.LoadSegment)
+			if e.LoadSegment == 0 && e.Platform == "x86 BIOS" {
+				segment = "default (0x07c0)"
+			}
+			fmt.Printf("  %-9s bootable %s, emulation %d, load segment %s, %d sectors at %d\n",
+				e.Platform, yesNo(e.Bootable), e.Emulation, segment, e.LoadSectors, e.Sector)
+		}
+	}
+
+	if r.MBR == nil {
+		fmt.Printf("MBR:         none\n")
+	} else {
+		fmt.Printf("MBR:         boot code %s\n", yesNo(r.MBR.BootCode))
+		for _, p := range r.MBR.Partitions {
+			fmt.Printf("  %d: type %s, active %s, sectors %d-%d\n",
+				p.Index, p.Type, yesNo(p.Active), p.Start, uint64(p.Start)+uint64(p.Sectors)-1)
+		}
+	}
+
+	for _, t := range []struct {
+		name string
+		g    *iso.GPTReport
+	}{{"GPT primary", r.GPT}, {"GPT backup", r.GPTBackup}} {
+		if t.g == nil {
+			fmt.Printf("%-12s none\n", t.name+":")
+			continue
+		}
+		fmt.Printf("%-12s LBA %d, header CRC %s, entries CRC %s, disk %s\n",
+			t.name+":", t.g.LBA, valid(t.g.HeaderCRCValid), valid(t.g.EntriesCRCValid), t.g.DiskGUID)
+		for _, p := range t.g.Partitions {
+			fmt.Printf("  %-12s %-10s sectors %d-%d\n", p.Type, p.Name, p.Start, p.Start+p.Sectors-1)
+		}
+	}
+
+	fmt.Printf("Root mount:  %q, expected %q\n", r.RootMount, r.ExpectedRootMount)
+
+	if len(r.Problems) == 0 {
+		fmt.Printf("No problems found\n")
+		return
+	}
+	for _, p := range r.Problems {
+		logger.Error("%s", p)
+	}
+}
+
 func cmdListImages(args []string) int {
 	imagesDir := buildConfig.GetImagesDir()
 	logger.Debug("Scanning for images in: %s", imagesDir)
@@ -246,9 +798,22 @@ func cmdListImages(args []string) int {
 		return 0
 	}
 
+	failed := false
+	for _, cfg := range configs {
+		if !checkRecipeWarnings(cfg.Warnings) {
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+
 	fmt.Printf("Available images (%d):\n\n", len(configs))
 	for _, cfg := range configs {
 		fmt.Printf("  %s (version %s)\n", cfg.ID, cfg.Version)
+		if len(cfg.Extends) > 0 {
+			fmt.Printf("    Extends: %v\n", cfg.Extends)
+		}
 		fmt.Printf("    ZFS pool: %s\n", cfg.ZpoolName)
 		fmt.Printf("    Root dataset: %s\n", cfg.RootDS)
 		if len(cfg.PkgLists) > 0 {
@@ -278,9 +843,22 @@ func cmdListVariants(args []string) int {
 		return 0
 	}
 
+	failed := false
+	for _, cfg := range configs {
+		if !checkRecipeWarnings(cfg.Warnings) {
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+
 	fmt.Printf("Available variants (%d):\n\n", len(configs))
 	for _, cfg := range configs {
 		fmt.Printf("  %s (%s)\n", cfg.ID, cfg.Name)
+		if len(cfg.Extends) > 0 {
+			fmt.Printf("    Extends: %v\n", cfg.Extends)
+		}
 		if len(cfg.PkgLists) > 0 {
 			fmt.Printf("    Package lists: %v\n", cfg.PkgLists)
 		}
@@ -293,3 +871,316 @@ func cmdListVariants(args []string) int {
 
 	return 0
 }
+
+func cmdLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Write findings as JSON")
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild lint [--json]\n")
+		return 1
+	}
+
+	report := lint.Run(buildConfig)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logger.Error("Failed to write lint report: %v", err)
+			return 1
+		}
+	} else {
+		for _, f := range report.Findings {
+			fmt.Println(f)
+		}
+		fmt.Printf("Checked %d image(s) and %d variant(s): %d error(s), %d warning(s)\n",
+			report.Images, report.Variants, report.Errors(), report.Warnings())
+	}
+
+	// Warnings only fail the run in strict mode
+	if report.Errors() > 0 || (buildConfig.Strict && report.Warnings() > 0) {
+		return 1
+	}
+	return 0
+}
+
+func cmdPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "Write the plan as JSON")
+	listPkgs := fs.Bool("packages", false, "List every package in the plan")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pgsdbuild plan [--json] [--packages] <image-id|variant-id>\n")
+		return 1
+	}
+	id := fs.Arg(0)
+
+	catalogPath := buildConfig.GetPkgCatalog()
+	if catalogPath == "" {
+		logger.Error("No package catalog configured")
+		logger.Info("Pass --pkg-catalog <packagesite.yaml|repo-dir> or set PGSD_PKG_CATALOG")
+		return 1
+	}
+
+	// Images and variants share the command; images are looked up first
+	var (
+		kind     string
+		pkgLists []string
+		warnings []config.Diagnostic
+	)
+	imagePath := filepath.Join(buildConfig.GetImagesDir(), id+".lua")
+	variantPath := filepath.Join(buildConfig.GetVariantsDir(), id+".lua")
+	switch {
+	case util.FileExists(imagePath):
+		cfg, err := config.LoadImageConfig(imagePath)
+		if err != nil {
+			logger.Error("Failed to load image config: %v", err)
+			return 1
+		}
+		kind, pkgLists, warnings = "image", cfg.PkgLists, cfg.Warnings
+	case util.FileExists(variantPath):
+		cfg, err := config.LoadVariantConfig(variantPath)
+		if err != nil {
+			logger.Error("Failed to load variant config: %v", err)
+			return 1
+		}
+		kind, pkgLists, warnings = "variant", cfg.PkgLists, cfg.Warnings
+	default:
+		logger.Error("No image or variant named %q (looked in %s and %s)", id, imagePath, variantPath)
+		return 1
+	}
+	if !checkRecipeWarnings(warnings) {
+		return 1
+	}
+
+	set, err := pkglist.NewResolver(buildConfig.GetPkgListsDir(), buildConfig.FreeBSDArch).Resolve(pkgLists)
+	if err != nil {
+		logger.Error("Failed to resolve package lists: %v", err)
+		return 1
+	}
+
+	logger.Debug("Loading package catalog: %s", catalogPath)
+	cat, err := catalog.Load(catalogPath)
+	if err != nil {
+		logger.Error("Failed to load package catalog: %v", err)
+		return 1
+	}
+
+	requests := make([]catalog.Request, len(set.Packages))
+	for i, p := range set.Packages {
+		requests[i] = catalog.Request{Name: p.Name, From: p.Origin()}
+	}
+	plan := cat.Resolve(requests)
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plan); err != nil {
+			logger.Error("Failed to write plan: %v", err)
+			return 1
+		}
+	} else {
+		fmt.Printf("Plan for %s %s (%s, %d packages in catalog):\n\n", kind, id, catalogPath, cat.Len())
+		fmt.Printf("  Requested:      %d packages from %d lists\n", plan.Requested, len(pkgLists))
+		fmt.Printf("  Total:          %d packages (%d dependencies)\n",
+			len(plan.Packages), plan.Pulled)
+		fmt.Printf("  Download size:  %s\n", util.FormatSize(plan.PkgSize))
+		fmt.Printf("  Installed size: %s\n", util.FormatSize(plan.FlatSize))
+
+		if *listPkgs {
+			fmt.Printf("\nPackages:\n")
+			for _, p := range plan.Packages {
+				fmt.Printf("  %-40s %10s\n", p.NameVersion(), util.FormatSize(p.FlatSize))
+			}
+		}
+		if len(plan.Missing) > 0 {
+			fmt.Printf("\nMissing (%d):\n", len(plan.Missing))
+			for _, m := range plan.Missing {
+				fmt.Printf("  %s (required by %s)\n", m.Name, m.RequiredBy)
+			}
+		}
+		if len(plan.Conflicts) > 0 {
+			fmt.Printf("\nConflicts (%d):\n", len(plan.Conflicts))
+			for _, c := range plan.Conflicts {
+				fmt.Printf("  %s: %s\n", c.Package, c.Reason)
+			}
+		}
+	}
+
+	if !plan.OK() {
+		return 1
+	}
+	return 0
+}
+
+func cmdCache(args []string) int {
+	const cacheUsage = "Usage: pgsdbuild cache ls [--json] | prune [--all] [--older-than <duration>] [--max-size <size>] | verify [--delete]\n"
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 1
+	}
+	store := buildConfig.OpenCache(logger)
+
+	switch args[0] {
+	case "ls", "list":
+		fs := flag.NewFlagSet("cache ls", flag.ContinueOnError)
+		jsonOut := fs.Bool("json", false, "Write entries as JSON")
+		if err := fs.Parse(args[1:]); err != nil {
+			fmt.Fprint(os.Stderr, cacheUsage)
+			return 1
+		}
+		entries, err := store.List()
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		if *jsonOut {
+			if entries == nil {
+				entries = []*cache.Entry{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(entries); err != nil {
+				logger.Error("Failed to write cache entries: %v", err)
+				return 1
+			}
+			return 0
+		}
+		if len(entries) == 0 {
+			fmt.Printf("Cache %s is empty\n", store.Dir)
+			return 0
+		}
+		fmt.Printf("%-12s  %-10s  %-28s  %10s  %-16s  %-16s\n", "KEY", "STAGE", "BUILD", "SIZE", "CREATED", "LAST USED")
+		for _, e := range entries {
+			if e.SHA256 == "" {
+				fmt.Printf("%-12s  (unreadable, removed by prune)\n", cache.ShortKey(e.Key))
+				continue
+			}
+			fmt.Printf("%-12s  %-10s  %-28s  %10s  %-16s  %-16s\n", cache.ShortKey(e.Key), e.Stage, e.Build,
+				util.FormatSize(e.Size), e.Created.Local().Format("2006-01-02 15:04"), e.LastUsed.Local().Format("2006-01-02 15:04"))
+		}
+		fmt.Printf("\n%d entries, %s in %s\n", len(entries), util.FormatSize(cache.Size(entries)), store.Dir)
+		return 0
+
+	case "prune":
+		fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+		all := fs.Bool("all", false, "Remove every entry")
+		olderThan := fs.Duration("older-than", 0, "Remove entries not used for `duration` (e.g. 720h)")
+		maxSize := fs.String("max-size", "", "Then remove least recently used entries until the cache fits in `size` (e.g. 20G)")
+		if err := fs.Parse(args[1:]); err != nil {
+			fmt.Fprint(os.Stderr, cacheUsage)
+			return 1
+		}
+		opts := cache.PruneOptions{All: *all, OlderThan: *olderThan}
+		if *maxSize != "" {
+			size, err := util.ParseSize(*maxSize)
+			if err != nil {
+				logger.Error("--max-size: %v", err)
+				return 1
+			}
+			opts.MaxSize = size
+		}
+		removed, err := store.Prune(opts)
+		for _, e := range removed {
+			logger.Debug("Removed %s (%s %s)", cache.ShortKey(e.Key), e.Build, e.Stage)
+		}
+		if err != nil {
+			logger.Error("Failed to prune cache: %v", err)
+			return 1
+		}
+		logger.Info("Removed %d cache entries, freed %s", len(removed), util.FormatSize(cache.Size(removed)))
+		return 0
+
+	case "verify":
+		fs := flag.NewFlagSet("cache verify", flag.ContinueOnError)
+		del := fs.Bool("delete", false, "Remove corrupt entries")
+		if err := fs.Parse(args[1:]); err != nil {
+			fmt.Fprint(os.Stderr, cacheUsage)
+			return 1
+		}
+		entries, err := store.List()
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		bad := 0
+		for _, e := range entries {
+			err := store.Verify(e)
+			if e.SHA256 == "" {
+				err = fmt.Errorf("cache entry %s has no readable entry.json", cache.ShortKey(e.Key))
+			}
+			if err == nil {
+				continue
+			}
+			bad++
+			logger.Error("%v", err)
+			if *del {
+				if err := store.Remove(e); err != nil {
+					logger.Error("Failed to remove %s: %v", cache.ShortKey(e.Key), err)
+				}
+			}
+		}
+		logger.Info("Verified %d cache entries, %d corrupt", len(entries), bad)
+		if bad > 0 && !*del {
+			return 1
+		}
+		return 0
+
+	default:
+		logger.Error("Unknown cache command: %s", args[0])
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 1
+	}
+}
+
+// setupExecutor installs the executor selected by the --dry-run, --record
+// and --replay flags. The returned function saves the recording or checks
+// that the replay script was used up once the command has finished.
+func setupExecutor(dryRun bool, record, replay string) (func() error, error) {
+	selected := 0
+	for _, set := range []bool{dryRun, record != "", replay != ""} {
+		if set {
+			selected++
+		}
+	}
+	if selected > 1 {
+		return nil, fmt.Errorf("--dry-run, --record and --replay are mutually exclusive")
+	}
+
+	switch {
+	case dryRun:
+		buildConfig.Exec = executor.DryRun{Out: os.Stdout}
+	case record != "":
+		recorder := executor.NewRecorder(executor.Real{})
+		buildConfig.Exec = recorder
+		return func() error {
+			logger.Info("Recorded %d command(s) to %s", len(recorder.Recording.Commands), record)
+			return recorder.Recording.Save(record)
+		}, nil
+	case replay != "":
+		rec, err := executor.LoadRecording(replay)
+		if err != nil {
+			return nil, err
+		}
+		replayer := executor.NewReplayer(rec)
+		buildConfig.Exec = replayer
+		return replayer.Done, nil
+	}
+	return func() error { return nil }, nil
+}
+
+// checkRecipeWarnings logs recipe schema warnings. It returns false if the
+// warnings should stop the command, which is the case in strict mode.
+func checkRecipeWarnings(warnings []config.Diagnostic) bool {
+	for _, w := range warnings {
+		if buildConfig.Strict {
+			logger.Error("%s", w)
+		} else {
+			logger.Warn("%s", w)
+		}
+	}
+	if buildConfig.Strict && len(warnings) > 0 {
+		logger.Error("Recipe has %d warning(s) and --strict is set", len(warnings))
+		return false
+	}
+	return true
+}
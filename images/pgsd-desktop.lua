@@ -77,9 +77,10 @@ return {
     "arcan",
   },
 
-  -- Boot configuration (optional metadata for documentation)
+  -- Boot configuration
   boot = {
-    -- EFI loader configuration
+    -- Tunables merged into /boot/loader.conf after overlays are applied
+    -- Existing lines keep their position and comments; new ones are appended
     loader_conf = {
       -- Enable ZFS root
       ["vfs.root.mountfrom"] = "zfs:pgsd/ROOT/default",
@@ -95,7 +96,8 @@ return {
     },
   },
 
-  -- ZFS dataset layout (optional metadata for documentation)
+  -- ZFS dataset layout (created in the image pool, exported with the image
+  -- and recreated by the installer; parents such as pgsd/usr are implied)
   datasets = {
     -- Root dataset (boot environment)
     { name = "pgsd/ROOT/default", mountpoint = "/", canmount = "noauto" },
@@ -112,7 +114,9 @@ return {
     { name = "pgsd/usr/local", mountpoint = "/usr/local", canmount = "on" },
   },
 
-  -- System configuration hints (optional metadata)
+  -- System configuration (applied to the image root after overlays)
+  -- hostname and services are written to /etc/rc.conf, timezone installs
+  -- /etc/localtime, users are added to master.passwd and group
   system = {
     hostname = "pgsd-desktop",
     timezone = "UTC",
@@ -126,7 +130,8 @@ return {
       "wpa_supplicant",
     },
 
-    -- Default users to create (handled by overlay scripts)
+    -- Default users to create
+    -- Optional per-user fields: uid, shell, home, comment, password_hash
     users = {
       { name = "pgsd", groups = { "wheel", "operator", "video", "audio" } },
     },
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +10,9 @@ import (
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/pgsdf/pgsdbuild/installer/internal/install"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
 )
 
 // Installation states
@@ -25,8 +29,11 @@ const (
 // ImageInfo represents a system image available for installation
 type ImageInfo struct {
 	ID           string
+	Version      string
 	Path         string
 	ManifestPath string
+	Manifest     *manifest.Manifest
+	Err          error // why the image cannot be installed, if it cannot
 }
 
 // DiskInfo represents a disk available for installation
@@ -119,6 +126,9 @@ func (m model) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				m.cursor++
 			}
 		case "enter":
+			if m.images[m.cursor].Err != nil {
+				return m, nil
+			}
 			m.selectedImg = m.cursor
 			m.cursor = 0
 			// Load available disks
@@ -214,7 +224,14 @@ func (m model) viewImageSelect() string {
 		if i == m.cursor {
 			cursor = ">"
 		}
-		b.WriteString(fmt.Sprintf(" %s %s\n", cursor, img.ID))
+		switch {
+		case img.Err != nil:
+			b.WriteString(fmt.Sprintf(" %s %s (unusable: %v)\n", cursor, img.ID, img.Err))
+		case img.Version != "":
+			b.WriteString(fmt.Sprintf(" %s %s %s\n", cursor, img.ID, img.Version))
+		default:
+			b.WriteString(fmt.Sprintf(" %s %s\n", cursor, img.ID))
+		}
 	}
 
 	b.WriteString("\n")
@@ -345,16 +362,28 @@ func loadImages() ([]ImageInfo, error) {
 		}
 
 		imgPath := filepath.Join(imagesDir, entry.Name())
-		manifestPath := filepath.Join(imgPath, "manifest.toml")
+		manifestPath := filepath.Join(imgPath, manifest.FileName)
 
 		// Check if manifest exists
-		if _, err := os.Stat(manifestPath); err == nil {
-			images = append(images, ImageInfo{
-				ID:           entry.Name(),
-				Path:         imgPath,
-				ManifestPath: manifestPath,
-			})
+		if _, err := os.Stat(manifestPath); err != nil {
+			continue
+		}
+
+		// Damaged, outdated or untrusted images are listed but cannot be
+		// selected; checksums are verified when the installation starts
+		img := ImageInfo{
+			ID:           entry.Name(),
+			Path:         imgPath,
+			ManifestPath: manifestPath,
+		}
+		mf, _, err := install.LoadImage(imgPath, sign.TrustedKeysDir, requireSignature())
+		if err != nil {
+			img.Err = err
+		} else {
+			img.Manifest = mf
+			img.Version = mf.Image.Version
 		}
+		images = append(images, img)
 	}
 
 	return images, nil
@@ -536,6 +565,18 @@ func formatBytes(bytesStr string) string {
 	}
 }
 
+// logWriter appends each written line to the installation log.
+type logWriter struct {
+	logs *[]string
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		*w.logs = append(*w.logs, line)
+	}
+	return len(p), nil
+}
+
 // performInstallation executes the installation pipeline and returns a command
 func (m model) performInstallation() tea.Cmd {
 	image := m.images[m.selectedImg]
@@ -554,6 +595,14 @@ func (m model) performInstallation() tea.Cmd {
 			LogFunc: func(msg string) {
 				logs = append(logs, msg)
 			},
+			RequireSignature: requireSignature(),
+		}
+
+		// PGSD_INST_DRY_RUN=1 shows the commands in the log instead of
+		// touching the disk
+		if v := os.Getenv("PGSD_INST_DRY_RUN"); v == "1" || v == "true" {
+			cfg.Exec = executor.DryRun{Out: logWriter{logs: &logs}}
+			logs = append(logs, "Dry run: no changes will be made")
 		}
 
 		// Add initial log messages
@@ -562,7 +611,7 @@ func (m model) performInstallation() tea.Cmd {
 		logs = append(logs, fmt.Sprintf("Target disk: %s", disk.Device))
 
 		// Run installation
-		installErr = install.Install(cfg)
+		installErr = install.Install(context.Background(), cfg)
 
 		// Build a batch of log messages to send
 		var cmds []tea.Cmd
@@ -598,6 +647,13 @@ func (m model) performInstallation() tea.Cmd {
 	}
 }
 
+// requireSignature reports whether PGSD_INST_REQUIRE_SIGNATURE=1 asks for
+// signed images even when no trusted keys are installed.
+func requireSignature() bool {
+	v := os.Getenv("PGSD_INST_REQUIRE_SIGNATURE")
+	return v == "1" || v == "true"
+}
+
 func main() {
 	if _, err := tea.NewProgram(initialModel()).Run(); err != nil {
 		fmt.Fprintln(os.Stderr, "error running TUI:", err)
@@ -1,12 +1,17 @@
 package install
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
+	"github.com/pgsdf/pgsdbuild/internal/util"
 )
 
 // LogFunc is a function that logs installation progress
@@ -18,15 +23,31 @@ type Config struct {
 	TargetDisk string // Target disk device (e.g., "ada0")
 	ZpoolName  string // Name of the ZFS pool to create
 	LogFunc    LogFunc
+
+	// TrustedKeysDir holds the public keys image signatures are checked
+	// against. Defaults to sign.TrustedKeysDir.
+	TrustedKeysDir string
+
+	// RequireSignature refuses images that are not signed by a trusted key
+	// even when TrustedKeysDir holds no keys, so a missing keyring cannot
+	// turn signature checks off.
+	RequireSignature bool
+
+	// Exec runs the gpart/zpool/zfs commands. Defaults to running them on
+	// the host; executor.DryRun prints the plan instead.
+	Exec executor.Executor
 }
 
-// Install performs the full ZFS-based installation pipeline
-func Install(cfg Config) error {
+// Install performs the full ZFS-based installation pipeline. Cancelling ctx
+// kills the running command; the partially created pool is still exported.
+func Install(ctx context.Context, cfg Config) error {
 	log := cfg.LogFunc
 	if log == nil {
 		log = func(s string) {} // No-op logger
 	}
 
+	x := executor.OrDefault(cfg.Exec)
+
 	// Normalize device path (remove /dev/ prefix if present)
 	cfg.TargetDisk = normalizeDevicePath(cfg.TargetDisk)
 
@@ -36,9 +57,35 @@ func Install(cfg Config) error {
 		return fmt.Errorf("invalid installation configuration: %w", err)
 	}
 
+	// A modified or damaged image must be caught before the disk is
+	// partitioned: the signature covers the manifest, and the manifest
+	// pins the checksum of every artifact
+	keysDir := cfg.TrustedKeysDir
+	if keysDir == "" {
+		keysDir = sign.TrustedKeysDir
+	}
+	log("Verifying image signature...")
+	m, signer, err := LoadImage(cfg.ImagePath, keysDir, cfg.RequireSignature)
+	if err != nil {
+		return fmt.Errorf("invalid image: %w", err)
+	}
+	if signer != nil {
+		log(fmt.Sprintf("Image signed by trusted key %s (%s)", signer.ID, signer.Name))
+	} else {
+		log(fmt.Sprintf("WARNING: no trusted keys in %s, image signature not checked", keysDir))
+	}
+
+	log("Verifying image checksums...")
+	err = m.Verify(cfg.ImagePath, func(a manifest.Artifact) {
+		log(fmt.Sprintf("Verifying %s (%s)...", a.Path, util.FormatSize(a.Size)))
+	})
+	if err != nil {
+		return fmt.Errorf("image verification failed: %w\nHint: Copy or rebuild the image", err)
+	}
+
 	// Check for required tools
 	log("Checking system requirements...")
-	if err := checkRequirements(); err != nil {
+	if err := checkRequirements(x); err != nil {
 		return fmt.Errorf("system requirements not met: %w", err)
 	}
 
@@ -51,7 +98,7 @@ func Install(cfg Config) error {
 		if !installComplete && poolCreated {
 			// Best-effort cleanup: forcefully export the pool
 			log("Installation failed, cleaning up ZFS pool...")
-			if err := exec.Command("zpool", "export", "-f", cfg.ZpoolName).Run(); err != nil {
+			if _, err := x.Run(context.WithoutCancel(ctx), executor.Cmd("zpool", "export", "-f", cfg.ZpoolName)); err != nil {
 				// Ignore cleanup errors, just log them
 				log(fmt.Sprintf("Warning: Failed to cleanup ZFS pool: %v", err))
 			}
@@ -60,48 +107,48 @@ func Install(cfg Config) error {
 
 	// Step 1: Partition the disk
 	log("Partitioning disk...")
-	if err := partitionDisk(cfg.TargetDisk); err != nil {
+	if err := partitionDisk(ctx, x, cfg.TargetDisk); err != nil {
 		return fmt.Errorf("disk partitioning failed: %w\nHint: Ensure the disk is not in use and you have root privileges", err)
 	}
 
 	// Step 2: Create EFI filesystem
 	log("Creating EFI system partition...")
 	efiPart := "/dev/" + cfg.TargetDisk + "p1"
-	if err := createEFIFilesystem(efiPart); err != nil {
+	if err := createEFIFilesystem(ctx, x, efiPart); err != nil {
 		return fmt.Errorf("EFI filesystem creation failed: %w\nHint: The partition may not be properly created", err)
 	}
 
 	// Step 3: Create ZFS pool
 	log("Creating ZFS pool...")
 	zfsPart := "/dev/" + cfg.TargetDisk + "p2"
-	if err := createZFSPool(cfg.ZpoolName, zfsPart); err != nil {
+	if err := createZFSPool(ctx, x, cfg.ZpoolName, zfsPart); err != nil {
 		return fmt.Errorf("ZFS pool creation failed: %w\nHint: Ensure ZFS kernel module is loaded (kldload zfs)", err)
 	}
 	poolCreated = true // Mark pool as created for cleanup
 
-	// Step 4: Extract root filesystem
+	// Step 4: Recreate the dataset layout and extract the root filesystem
 	log("Extracting root filesystem (this may take several minutes)...")
-	rootZFS := filepath.Join(cfg.ImagePath, "root.zfs.xz")
-	if err := extractZFSStream(rootZFS, cfg.ZpoolName); err != nil {
+	rootDS, err := restoreDatasets(ctx, x, cfg, m.Datasets, log)
+	if err != nil {
 		return fmt.Errorf("root filesystem extraction failed: %w\nHint: Ensure the ZFS stream file is not corrupted", err)
 	}
 
 	// Step 5: Copy EFI partition
 	log("Installing EFI partition...")
 	efiImg := filepath.Join(cfg.ImagePath, "efi.img")
-	if err := copyEFIPartition(efiImg, efiPart); err != nil {
+	if err := copyEFIPartition(ctx, x, efiImg, efiPart); err != nil {
 		return fmt.Errorf("EFI partition installation failed: %w", err)
 	}
 
 	// Step 6: Install bootloader
 	log("Installing bootloader...")
-	if err := installBootloader(cfg.TargetDisk, cfg.ZpoolName); err != nil {
+	if err := installBootloader(ctx, x, cfg.TargetDisk, cfg.ZpoolName); err != nil {
 		return fmt.Errorf("bootloader installation failed: %w\nHint: Ensure /boot/boot1.efifat exists on the system", err)
 	}
 
 	// Step 7: Finalize
 	log("Finalizing installation...")
-	if err := finalizeInstallation(cfg.ZpoolName); err != nil {
+	if err := finalizeInstallation(ctx, x, cfg.ZpoolName, rootDS); err != nil {
 		return fmt.Errorf("installation finalization failed: %w", err)
 	}
 
@@ -113,7 +160,7 @@ func Install(cfg Config) error {
 }
 
 // partitionDisk creates a GPT partition table with EFI and ZFS partitions
-func partitionDisk(disk string) error {
+func partitionDisk(ctx context.Context, x executor.Executor, disk string) error {
 	// On FreeBSD:
 	// gpart destroy -F disk (if exists)
 	// gpart create -s gpt disk
@@ -128,8 +175,7 @@ func partitionDisk(disk string) error {
 	}
 
 	for _, args := range commands {
-		cmd := exec.Command(args[0], args[1:]...)
-		if output, err := cmd.CombinedOutput(); err != nil {
+		if output, err := x.Run(ctx, executor.Cmd(args[0], args[1:]...)); err != nil {
 			// Ignore error on destroy if partition table doesn't exist
 			if args[1] != "destroy" {
 				return fmt.Errorf("command %v failed: %w\nOutput: %s",
@@ -142,12 +188,11 @@ func partitionDisk(disk string) error {
 }
 
 // createEFIFilesystem creates a FAT32 filesystem on the EFI partition
-func createEFIFilesystem(efiPart string) error {
+func createEFIFilesystem(ctx context.Context, x executor.Executor, efiPart string) error {
 	// On FreeBSD:
 	// newfs_msdos -F 32 -c 1 efiPart
 
-	cmd := exec.Command("newfs_msdos", "-F", "32", "-c", "1", efiPart)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, executor.Cmd("newfs_msdos", "-F", "32", "-c", "1", efiPart)); err != nil {
 		return fmt.Errorf("newfs_msdos failed: %w\nOutput: %s", err, output)
 	}
 
@@ -155,77 +200,97 @@ func createEFIFilesystem(efiPart string) error {
 }
 
 // createZFSPool creates a ZFS pool on the ZFS partition
-func createZFSPool(poolName, zfsPart string) error {
+func createZFSPool(ctx context.Context, x executor.Executor, poolName, zfsPart string) error {
 	// On FreeBSD:
 	// zpool create -f -o altroot=/mnt -O compression=lz4 -O atime=off poolName zfsPart
 
-	cmd := exec.Command("zpool", "create", "-f",
+	cmd := executor.Cmd("zpool", "create", "-f",
 		"-o", "altroot=/mnt",
 		"-O", "compression=lz4",
 		"-O", "atime=off",
 		poolName, zfsPart)
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, cmd); err != nil {
 		return fmt.Errorf("zpool create failed: %w\nOutput: %s", err, output)
 	}
 
 	return nil
 }
 
-// extractZFSStream extracts a compressed ZFS stream to the pool
-func extractZFSStream(rootZFS, poolName string) error {
-	// On FreeBSD:
-	// xzcat rootZFS | zfs receive -F poolName/ROOT/default
-
-	// Check if source file exists
-	if _, err := os.Stat(rootZFS); err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("ZFS stream file not found: %s", rootZFS)
-		}
-		return fmt.Errorf("cannot access ZFS stream file: %w", err)
+// restoreDatasets recreates the image's dataset layout in the new pool and
+// returns the full name of the root dataset. Containers are created empty,
+// every other dataset is received from its stream. Manifests without a
+// dataset layout get the default pool/ROOT/default layout.
+func restoreDatasets(ctx context.Context, x executor.Executor, cfg Config, datasets []manifest.Dataset, log LogFunc) (string, error) {
+	if len(datasets) == 0 {
+		datasets = defaultDatasets
 	}
 
-	// Build the pipeline: xzcat | zfs receive
-	xzcat := exec.Command("xzcat", rootZFS)
-	zfsRecv := exec.Command("zfs", "receive", "-F",
-		fmt.Sprintf("%s/ROOT/default", poolName))
+	rootDS := ""
+	for _, ds := range datasets {
+		target := cfg.ZpoolName + "/" + ds.Name
 
-	// Connect the pipeline
-	pipe, err := xzcat.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create pipe between xzcat and zfs receive: %w", err)
-	}
-	zfsRecv.Stdin = pipe
+		var props []string
+		if ds.Mountpoint != "" {
+			props = append(props, "-o", "mountpoint="+ds.Mountpoint)
+		}
+		if ds.CanMount != "" {
+			props = append(props, "-o", "canmount="+ds.CanMount)
+		}
 
-	// Capture stderr for better error messages
-	xzcatStderr, _ := xzcat.StderrPipe()
-	zfsStderr, _ := zfsRecv.StderrPipe()
+		if ds.Stream == "" {
+			log(fmt.Sprintf("Creating dataset %s...", target))
+			args := append([]string{"create"}, props...)
+			args = append(args, target)
+			if output, err := x.Run(ctx, executor.Cmd("zfs", args...)); err != nil {
+				return "", fmt.Errorf("zfs create %s failed: %w\nOutput: %s", target, err, output)
+			}
+			continue
+		}
 
-	// Start both commands
-	if err := zfsRecv.Start(); err != nil {
-		return fmt.Errorf("failed to start zfs receive command: %w", err)
+		log(fmt.Sprintf("Receiving dataset %s...", target))
+		if err := extractZFSStream(ctx, x, filepath.Join(cfg.ImagePath, ds.Stream), target, props); err != nil {
+			return "", fmt.Errorf("dataset %s: %w", target, err)
+		}
+		if ds.Role == manifest.RoleRoot {
+			rootDS = target
+		}
 	}
 
-	if err := xzcat.Start(); err != nil {
-		return fmt.Errorf("failed to start xzcat command: %w", err)
+	if rootDS == "" {
+		return "", fmt.Errorf("image manifest does not contain a root dataset")
 	}
+	return rootDS, nil
+}
 
-	// Wait for completion
-	if err := xzcat.Wait(); err != nil {
-		stderr := readPipe(xzcatStderr)
-		return fmt.Errorf("xzcat decompression failed: %w\nDetails: %s", err, stderr)
+// extractZFSStream extracts a compressed ZFS stream into the target dataset
+func extractZFSStream(ctx context.Context, x executor.Executor, stream, target string, props []string) error {
+	// On FreeBSD:
+	// xzcat stream | zfs receive -F -u [-o prop=value ...] target
+
+	// Check if source file exists
+	if _, err := os.Stat(stream); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("ZFS stream file not found: %s", stream)
+		}
+		return fmt.Errorf("cannot access ZFS stream file: %w", err)
 	}
 
-	if err := zfsRecv.Wait(); err != nil {
-		stderr := readPipe(zfsStderr)
-		return fmt.Errorf("zfs receive failed: %w\nDetails: %s", err, stderr)
+	recvArgs := append([]string{"receive", "-F", "-u"}, props...)
+	recvArgs = append(recvArgs, target)
+	output, err := x.Pipe(ctx,
+		executor.Cmd("xzcat", stream),
+		executor.Cmd("zfs", recvArgs...),
+	)
+	if err != nil {
+		return fmt.Errorf("zfs receive failed: %w\nDetails: %s", err, output)
 	}
 
 	return nil
 }
 
 // copyEFIPartition copies the EFI image to the EFI partition
-func copyEFIPartition(efiImg, efiPart string) error {
+func copyEFIPartition(ctx context.Context, x executor.Executor, efiImg, efiPart string) error {
 	// On FreeBSD:
 	// dd if=efiImg of=efiPart bs=1M
 
@@ -237,12 +302,12 @@ func copyEFIPartition(efiImg, efiPart string) error {
 		return fmt.Errorf("cannot access EFI image file: %w", err)
 	}
 
-	cmd := exec.Command("dd",
+	cmd := executor.Cmd("dd",
 		"if="+efiImg,
 		"of="+efiPart,
 		"bs=1M")
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, cmd); err != nil {
 		return fmt.Errorf("failed to copy EFI partition: %w\nOutput: %s", err, output)
 	}
 
@@ -250,26 +315,30 @@ func copyEFIPartition(efiImg, efiPart string) error {
 }
 
 // installBootloader installs the FreeBSD bootloader
-func installBootloader(disk, poolName string) error {
-	// Verify EFI partition exists first
-	efiPartDev := "/dev/" + disk + "p1"
-	if err := verifyEFIPartition(efiPartDev); err != nil {
-		return fmt.Errorf("EFI partition verification failed: %w", err)
-	}
-
-	// Check if boot1.efifat exists
+func installBootloader(ctx context.Context, x executor.Executor, disk, poolName string) error {
 	bootFile := "/boot/boot1.efifat"
-	if _, err := os.Stat(bootFile); err != nil {
-		return fmt.Errorf("bootloader file not found: %s\nThe system may be missing EFI boot files", bootFile)
+
+	// A dry run never creates the partition, so there is nothing to verify
+	if !executor.IsDryRun(x) {
+		// Verify EFI partition exists first
+		efiPartDev := "/dev/" + disk + "p1"
+		if err := verifyEFIPartition(ctx, x, efiPartDev); err != nil {
+			return fmt.Errorf("EFI partition verification failed: %w", err)
+		}
+
+		// Check if boot1.efifat exists; a replay need not run on FreeBSD
+		if _, err := os.Stat(bootFile); err != nil && !executor.Simulated(x) {
+			return fmt.Errorf("bootloader file not found: %s\nThe system may be missing EFI boot files", bootFile)
+		}
 	}
 
 	// Install bootloader: gpart bootcode -p /boot/boot1.efifat -i 1 disk
-	cmd := exec.Command("gpart", "bootcode",
+	cmd := executor.Cmd("gpart", "bootcode",
 		"-p", bootFile,
 		"-i", "1",
 		disk)
 
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, cmd); err != nil {
 		return fmt.Errorf("gpart bootcode failed: %w\nOutput: %s", err, output)
 	}
 
@@ -277,26 +346,84 @@ func installBootloader(disk, poolName string) error {
 }
 
 // finalizeInstallation performs final cleanup and configuration
-func finalizeInstallation(poolName string) error {
+func finalizeInstallation(ctx context.Context, x executor.Executor, poolName, rootDS string) error {
 	// Set bootfs property
-	cmd := exec.Command("zpool", "set",
-		fmt.Sprintf("bootfs=%s/ROOT/default", poolName),
-		poolName)
-
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, executor.Cmd("zpool", "set", "bootfs="+rootDS, poolName)); err != nil {
 		return fmt.Errorf("zpool set bootfs failed: %w\nOutput: %s", err, output)
 	}
 
 	// Export the pool
-	cmd = exec.Command("zpool", "export", poolName)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, executor.Cmd("zpool", "export", poolName)); err != nil {
 		return fmt.Errorf("zpool export failed: %w\nOutput: %s", err, output)
 	}
 
 	return nil
 }
 
-// validateConfig validates the installation configuration
+// defaultDatasets is the layout of images whose manifest lists no datasets.
+var defaultDatasets = []manifest.Dataset{
+	{Name: "ROOT", Role: manifest.RoleContainer, Mountpoint: "none", CanMount: "off"},
+	{Name: "ROOT/default", Role: manifest.RoleRoot, Mountpoint: "/", CanMount: "noauto", Stream: "root.zfs.xz"},
+}
+
+// LoadImage reads the manifest of the image in imagePath, checks its
+// signature against the public keys in keysDir and checks that every
+// artifact exists with its recorded size. It returns the key that signed
+// the manifest, or nil when keysDir holds no keys: until keys are
+// installed nothing is trusted, so development images need no signature.
+// Once keys are installed, unsigned images are refused. With
+// requireSignature an empty keyring is an error rather than a reason to
+// skip the check.
+//
+// Artifact checksums are not verified here, because hashing a large image
+// takes a while; see manifest.Verify.
+func LoadImage(imagePath, keysDir string, requireSignature bool) (*manifest.Manifest, *sign.PublicKey, error) {
+	manifestPath := filepath.Join(imagePath, manifest.FileName)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+
+	keys, err := sign.LoadKeyring(keysDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load trusted keys: %w", err)
+	}
+	if len(keys) == 0 && requireSignature {
+		return nil, nil, fmt.Errorf("a signature is required but %s holds no trusted keys\nHint: Install the public key the image was signed with in %s", keysDir, keysDir)
+	}
+	var signer *sign.PublicKey
+	if len(keys) > 0 {
+		key, err := sign.VerifyFile(keys, manifestPath, data)
+		if errors.Is(err, sign.ErrUnsigned) {
+			return nil, nil, fmt.Errorf("image is not signed and %s holds trusted keys", keysDir)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad signature on %s: %w", manifest.FileName, err)
+		}
+		signer = &key
+	}
+
+	// The manifest is decoded from the bytes that were verified
+	m, err := manifest.Decode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest %s: %w", manifestPath, err)
+	}
+	required := []string{"efi.img"}
+	if len(m.Datasets) == 0 {
+		required = append(required, "root.zfs.xz")
+	}
+	for _, file := range required {
+		if m.Artifact(file) == nil {
+			return nil, nil, fmt.Errorf("image manifest does not list %s", file)
+		}
+	}
+	if err := m.Check(imagePath); err != nil {
+		return nil, nil, fmt.Errorf("%w\nThe image directory must contain every artifact listed in %s", err, manifest.FileName)
+	}
+	return m, signer, nil
+}
+
+// validateConfig validates the installation configuration.
 func validateConfig(cfg *Config) error {
 	if cfg.ImagePath == "" {
 		return fmt.Errorf("image path is required")
@@ -338,18 +465,6 @@ func validateConfig(cfg *Config) error {
 		return fmt.Errorf("cannot access image directory: %w", err)
 	}
 
-	// Check for required files
-	requiredFiles := []string{"root.zfs.xz", "efi.img", "manifest.toml"}
-	for _, file := range requiredFiles {
-		path := filepath.Join(cfg.ImagePath, file)
-		if _, err := os.Stat(path); err != nil {
-			if os.IsNotExist(err) {
-				return fmt.Errorf("required file missing: %s\nThe image directory must contain: %v", file, requiredFiles)
-			}
-			return fmt.Errorf("cannot access required file %s: %w", file, err)
-		}
-	}
-
 	// Validate zpool name
 	if len(cfg.ZpoolName) > 63 {
 		return fmt.Errorf("zpool name too long (max 63 characters): %s", cfg.ZpoolName)
@@ -362,12 +477,12 @@ func validateConfig(cfg *Config) error {
 }
 
 // checkRequirements checks if required system commands are available
-func checkRequirements() error {
+func checkRequirements(x executor.Executor) error {
 	required := []string{"gpart", "newfs_msdos", "zpool", "zfs", "xzcat", "dd"}
 	var missing []string
 
 	for _, cmd := range required {
-		if _, err := exec.LookPath(cmd); err != nil {
+		if _, err := x.LookPath(cmd); err != nil {
 			missing = append(missing, cmd)
 		}
 	}
@@ -376,33 +491,15 @@ func checkRequirements() error {
 		return fmt.Errorf("required commands not found: %v\nPlease ensure these tools are installed and in PATH", missing)
 	}
 
-	// Check if running as root
-	if os.Geteuid() != 0 {
+	// Check if running as root; dry runs and replays change nothing and do
+	// not need it
+	if os.Geteuid() != 0 && !executor.Simulated(x) {
 		return fmt.Errorf("installation must be run as root\nTry: sudo pgsd-inst")
 	}
 
 	return nil
 }
 
-// readPipe reads all data from a pipe and returns it as a string
-func readPipe(pipe interface{}) string {
-	if pipe == nil {
-		return ""
-	}
-
-	// Type assert to io.ReadCloser
-	if rc, ok := pipe.(io.ReadCloser); ok {
-		defer rc.Close()
-		data, err := io.ReadAll(rc)
-		if err != nil {
-			return fmt.Sprintf("error reading pipe: %v", err)
-		}
-		return string(data)
-	}
-
-	return ""
-}
-
 // normalizeDevicePath removes /dev/ prefix from device paths
 func normalizeDevicePath(device string) string {
 	return strings.TrimPrefix(device, "/dev/")
@@ -410,9 +507,9 @@ func normalizeDevicePath(device string) string {
 
 // verifyEFIPartition checks if the EFI partition exists and is properly formatted
 // efiPartDev should be the full device path (e.g., "/dev/ada0p1")
-func verifyEFIPartition(efiPartDev string) error {
-	// Check if the device exists
-	if _, err := os.Stat(efiPartDev); err != nil {
+func verifyEFIPartition(ctx context.Context, x executor.Executor, efiPartDev string) error {
+	// Check if the device exists; a replay never created it
+	if _, err := os.Stat(efiPartDev); err != nil && !executor.Simulated(x) {
 		return fmt.Errorf("EFI partition device not found: %s", efiPartDev)
 	}
 
@@ -420,8 +517,7 @@ func verifyEFIPartition(efiPartDev string) error {
 	partName := strings.TrimPrefix(efiPartDev, "/dev/")
 
 	// Try to get partition info using gpart show
-	cmd := exec.Command("gpart", "show", "-p", partName)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := x.Run(ctx, executor.Cmd("gpart", "show", "-p", partName)); err != nil {
 		return fmt.Errorf("failed to verify EFI partition: %w\nOutput: %s", err, output)
 	}
 
@@ -0,0 +1,242 @@
+package install
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
+)
+
+// writeImage writes an unsigned image with a root and a home stream to
+// dir/image and changes to dir, so the replayed commands name the image by
+// the same relative path on every host.
+func writeImage(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	image := filepath.Join(dir, "image")
+	if err := os.Mkdir(image, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &manifest.Manifest{
+		Version: manifest.Version,
+		Image:   manifest.Image{ID: "pgsd-test", Version: "0.1.0", ZpoolName: "pgsd", RootDataset: "pgsd/ROOT/default"},
+		Build:   manifest.Build{Builder: "pgsdbuild test", Date: time.Unix(1740832210, 0).UTC()},
+		Datasets: []manifest.Dataset{
+			{Name: "ROOT", Role: manifest.RoleContainer, Mountpoint: "none", CanMount: "off"},
+			{Name: "ROOT/default", Role: manifest.RoleRoot, Mountpoint: "/", CanMount: "noauto", Stream: "root.zfs.xz"},
+			{Name: "home", Role: manifest.RoleData, Mountpoint: "/home", Stream: "home.zfs.xz"},
+		},
+	}
+	for _, name := range []string{"efi.img", "home.zfs.xz", "root.zfs.xz"} {
+		if err := os.WriteFile(filepath.Join(image, name), []byte(name+" contents\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, err := manifest.NewArtifact(image, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Artifacts = append(m.Artifacts, a)
+	}
+	if err := m.Write(filepath.Join(image, manifest.FileName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replay installs the image with the commands in testdata/name.
+func replay(t *testing.T, name string) (*executor.Replayer, []string, error) {
+	t.Helper()
+	rec, err := executor.LoadRecording(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// testdata is read before writeImage leaves the package directory
+	writeImage(t)
+
+	var logs []string
+	x := executor.NewReplayer(rec)
+	err = Install(context.Background(), Config{
+		ImagePath:      "image",
+		TargetDisk:     "/dev/ada0",
+		ZpoolName:      "pgsd",
+		TrustedKeysDir: t.TempDir(),
+		LogFunc:        func(s string) { logs = append(logs, s) },
+		Exec:           x,
+	})
+	return x, logs, err
+}
+
+// An installation runs the recorded commands in order, receiving every
+// dataset stream of the manifest.
+func TestInstallReplay(t *testing.T) {
+	x, logs, err := replay(t, "install.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Done(); err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{"Creating dataset pgsd/ROOT...", "Receiving dataset pgsd/home...", "Installation complete!"} {
+		found := false
+		for _, l := range logs {
+			found = found || l == want
+		}
+		if !found {
+			t.Errorf("log is missing %q:\n%s", want, strings.Join(logs, "\n"))
+		}
+	}
+}
+
+// A failure after the pool was created exports it again.
+func TestInstallReplayFailure(t *testing.T) {
+	x, _, err := replay(t, "receive-fails.json")
+	if err == nil {
+		t.Fatal("installation succeeded")
+	}
+	for _, want := range []string{"root filesystem extraction failed", "zfs receive failed", "invalid backup stream"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if err := x.Done(); err != nil {
+		t.Errorf("pool was not exported: %v", err)
+	}
+}
+
+// Missing tools are reported before the disk is touched.
+func TestInstallMissingTools(t *testing.T) {
+	writeImage(t)
+	x := executor.NewReplayer(&executor.Recording{Tools: map[string]string{"xzcat": "", "dd": ""}})
+	err := Install(context.Background(), Config{
+		ImagePath:      "image",
+		TargetDisk:     "ada0",
+		ZpoolName:      "pgsd",
+		TrustedKeysDir: t.TempDir(),
+		Exec:           x,
+	})
+	if err == nil || !strings.Contains(err.Error(), "required commands not found: [xzcat dd]") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// LoadImage refuses images whose signature does not check out against the
+// trusted keys, and unsigned images once keys are trusted or a signature
+// is required.
+func TestLoadImage(t *testing.T) {
+	keys := t.TempDir()
+	release, err := sign.GenerateKey(keys, "release", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sign.GenerateKey(t.TempDir(), "other", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noKeys := t.TempDir()
+	manifestPath := filepath.Join("image", manifest.FileName)
+
+	tests := []struct {
+		name    string
+		keysDir string
+		require bool
+		prepare func(t *testing.T) // changes the image before it is loaded
+		signer  string             // ID of the key that should verify it
+		err     string
+	}{
+		{name: "unsigned without keys", keysDir: noKeys},
+		{name: "unsigned without keys required", keysDir: noKeys, require: true, err: "a signature is required but " + noKeys + " holds no trusted keys"},
+		{name: "missing key directory required", keysDir: filepath.Join(noKeys, "missing"), require: true, err: "holds no trusted keys"},
+		{name: "unsigned with keys", keysDir: keys, err: "image is not signed and " + keys + " holds trusted keys"},
+		{name: "signed", keysDir: keys, prepare: signWith(release), signer: release.ID},
+		{name: "signed required", keysDir: keys, require: true, prepare: signWith(release), signer: release.ID},
+		{
+			name:    "tampered manifest",
+			keysDir: keys,
+			prepare: func(t *testing.T) {
+				signWith(release)(t)
+				f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if _, err := f.WriteString("# changed after signing\n"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "bad signature on manifest.toml: signature by key " + release.ID + " (release) does not match",
+		},
+		{name: "untrusted key", keysDir: keys, prepare: signWith(other), err: "signed by key " + other.ID + ", which is not trusted"},
+		{
+			name:    "malformed signature",
+			keysDir: keys,
+			prepare: func(t *testing.T) {
+				if err := os.WriteFile(manifestPath+sign.SignatureExt, []byte("not a signature\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "bad signature on manifest.toml: malformed signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeImage(t)
+			if tt.prepare != nil {
+				tt.prepare(t)
+			}
+			m, signer, err := LoadImage("image", tt.keysDir, tt.require)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Image.ID != "pgsd-test" {
+				t.Errorf("image = %q", m.Image.ID)
+			}
+			switch {
+			case tt.signer == "" && signer != nil:
+				t.Errorf("signed by %s, want no signer", signer.ID)
+			case tt.signer != "" && (signer == nil || signer.ID != tt.signer):
+				t.Errorf("signer = %v, want %s", signer, tt.signer)
+			}
+		})
+	}
+}
+
+// signWith signs the manifest written by writeImage with key.
+func signWith(key *sign.PrivateKey) func(t *testing.T) {
+	return func(t *testing.T) {
+		t.Helper()
+		if err := sign.SignFile(key, filepath.Join("image", manifest.FileName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Install stops before touching the disk when a signature is required and
+// no keys are trusted.
+func TestInstallRequireSignature(t *testing.T) {
+	writeImage(t)
+	x := executor.NewReplayer(&executor.Recording{})
+	err := Install(context.Background(), Config{
+		ImagePath:        "image",
+		TargetDisk:       "ada0",
+		ZpoolName:        "pgsd",
+		TrustedKeysDir:   t.TempDir(),
+		RequireSignature: true,
+		Exec:             x,
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid image: a signature is required") {
+		t.Errorf("got %v", err)
+	}
+}
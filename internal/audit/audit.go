@@ -0,0 +1,258 @@
+// Package audit checks the packages of an image against a VuXML
+// vulnerability database, the vuln.xml maintained by the FreeBSD ports
+// security team and used by pkg-audit(8). It works on a local copy of the
+// file, so images can be audited and release builds gated without network
+// access.
+//
+// Versions are compared as pkg(8) compares them (see CompareVersions). The
+// FreeBSD base system recorded in the manifest is checked against the
+// <system> entries for FreeBSD and FreeBSD-kernel.
+//
+// VuXML does not rate advisories, so each matched advisory is given a
+// severity from its topic and description (see Classify).
+package audit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+)
+
+// Severity is the rating of an advisory.
+type Severity string
+
+// Severities from most to least severe.
+const (
+	SeverityCritical Severity = "critical"
+	SeverityHigh     Severity = "high"
+	SeverityMedium   Severity = "medium"
+	SeverityLow      Severity = "low"
+	SeverityUnknown  Severity = "unknown" // nothing in the advisory says
+	SeverityNone     Severity = "none"    // as a threshold: never fail
+)
+
+// rank orders severities. An advisory that cannot be rated ranks as high,
+// so an unrecognised description never lets a vulnerable package through a
+// gate set at high.
+func (s Severity) rank() int {
+	switch s {
+	case SeverityCritical:
+		return 4
+	case SeverityHigh, SeverityUnknown:
+		return 3
+	case SeverityMedium:
+		return 2
+	case SeverityLow:
+		return 1
+	case SeverityNone:
+		return 5
+	}
+	return 0
+}
+
+// AtLeast reports whether s reaches the threshold t.
+func (s Severity) AtLeast(t Severity) bool {
+	return s.rank() >= t.rank()
+}
+
+// ParseThreshold parses a severity to fail at: low, medium, high, critical,
+// or none to report advisories without failing.
+func ParseThreshold(s string) (Severity, error) {
+	switch sev := Severity(strings.ToLower(s)); sev {
+	case SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical, SeverityNone:
+		return sev, nil
+	}
+	return "", fmt.Errorf("invalid severity %q (want low, medium, high, critical or none)", s)
+}
+
+// keywords rate advisories by phrases in their topic and description. The
+// first level with a matching phrase wins.
+var keywords = []struct {
+	severity Severity
+	phrases  []string
+}{
+	{SeverityCritical, []string{
+		"remote code execution", "remote command execution", "remote arbitrary code",
+		"remotely execute arbitrary", "unauthenticated remote", "remote root",
+	}},
+	{SeverityHigh, []string{
+		"arbitrary code", "code execution", "command execution", "command injection",
+		"privilege escalation", "escalate privileges", "elevation of privilege",
+		"buffer overflow", "heap overflow", "stack overflow", "out-of-bounds write",
+		"use-after-free", "use after free", "double free", "memory corruption",
+		"authentication bypass", "sql injection",
+	}},
+	{SeverityMedium, []string{
+		"denial of service", "information disclosure", "information leak",
+		"out-of-bounds read", "cross-site", "xss", "csrf", "request smuggling",
+		"path traversal", "directory traversal", "spoofing", "bypass",
+		"null pointer", "injection", "crash",
+	}},
+	{SeverityLow, []string{
+		"timing", "side channel", "side-channel", "weak", "minor",
+	}},
+}
+
+// Classify rates an advisory by the phrases in its topic and description.
+// This is a heuristic: it errs towards the more severe rating and returns
+// SeverityUnknown when nothing matches.
+func Classify(v *Vuln) Severity {
+	text := strings.ToLower(v.Topic + " " + v.Description)
+	for _, k := range keywords {
+		for _, p := range k.phrases {
+			if strings.Contains(text, p) {
+				return k.severity
+			}
+		}
+	}
+	return SeverityUnknown
+}
+
+// Package is an installed package to check.
+type Package struct {
+	Name    string
+	Version string
+}
+
+// Finding is an installed package matched by an advisory.
+type Finding struct {
+	Package  string   `json:"package"`
+	Version  string   `json:"version"`
+	VID      string   `json:"vid"`
+	Topic    string   `json:"topic"`
+	Severity Severity `json:"severity"`
+	Range    string   `json:"range"` // the affected range that matched
+	CVEs     []string `json:"cves,omitempty"`
+	URL      string   `json:"url"`
+}
+
+// String formats the finding for a terminal.
+func (f Finding) String() string {
+	s := fmt.Sprintf("%-8s %s-%s: %s (%s)", f.Severity, f.Package, f.Version, f.Topic, f.VID)
+	if len(f.CVEs) > 0 {
+		s += " " + strings.Join(f.CVEs, ", ")
+	}
+	return s
+}
+
+// Check returns the advisories matching pkgs and, if system is not empty,
+// the FreeBSD base system of that version (e.g. "14.1-RELEASE-p3").
+// Cancelled advisories and those named in ignore are skipped. Findings are
+// sorted by severity, package and advisory.
+func (db *Database) Check(pkgs []Package, system string, ignore []string) []Finding {
+	skip := make(map[string]bool, len(ignore))
+	for _, vid := range ignore {
+		skip[vid] = true
+	}
+
+	var findings []Finding
+	check := func(name, version, cmpVersion string, system bool) {
+		seen := make(map[string]bool)
+		for _, m := range db.byName[name] {
+			v := m.vuln
+			if m.system != system || v.Cancelled || skip[v.VID] || seen[v.VID] {
+				continue
+			}
+			r, ok := matchRanges(m.ranges, cmpVersion)
+			if !ok {
+				continue
+			}
+			seen[v.VID] = true
+			findings = append(findings, Finding{
+				Package:  name,
+				Version:  version,
+				VID:      v.VID,
+				Topic:    v.Topic,
+				Severity: Classify(v),
+				Range:    r.String(),
+				CVEs:     v.CVEs,
+				URL:      v.URL(),
+			})
+		}
+	}
+
+	for _, p := range pkgs {
+		check(p.Name, p.Version, p.Version, false)
+	}
+	if system != "" {
+		for _, name := range []string{"FreeBSD", "FreeBSD-kernel"} {
+			check(name, system, SystemVersion(system), true)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Severity.rank() != b.Severity.rank() {
+			return a.Severity.rank() > b.Severity.rank()
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.VID < b.VID
+	})
+	return findings
+}
+
+// matchRanges returns the first range containing version. An entry without
+// ranges affects every version.
+func matchRanges(ranges []Range, version string) (Range, bool) {
+	if len(ranges) == 0 {
+		return Range{}, true
+	}
+	for _, r := range ranges {
+		if r.Contains(version) {
+			return r, true
+		}
+	}
+	return Range{}, false
+}
+
+// Report is the result of auditing an image.
+type Report struct {
+	Image       string    `json:"image"`
+	Version     string    `json:"version,omitempty"`
+	System      string    `json:"system,omitempty"`
+	Advisories  int       `json:"advisories"` // entries in the database
+	Packages    int       `json:"packages"`   // packages checked
+	Unversioned []string  `json:"unversioned,omitempty"`
+	Findings    []Finding `json:"findings"`
+}
+
+// Image audits the packages and base system recorded in an image's
+// manifest. Packages recorded without a version, as in dry-run builds,
+// cannot be checked and are listed in Unversioned.
+func (db *Database) Image(m *manifest.Manifest, ignore []string) *Report {
+	r := &Report{
+		Image:      m.Image.ID,
+		Version:    m.Image.Version,
+		System:     m.Build.FreeBSDVersion,
+		Advisories: len(db.Vulns),
+	}
+	var pkgs []Package
+	for _, p := range m.Packages {
+		if p.Version == "" {
+			r.Unversioned = append(r.Unversioned, p.Name)
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: p.Name, Version: p.Version})
+	}
+	r.Packages = len(pkgs)
+	r.Findings = db.Check(pkgs, r.System, ignore)
+	if r.Findings == nil {
+		r.Findings = []Finding{}
+	}
+	return r
+}
+
+// Failing returns the findings at or above threshold.
+func (r *Report) Failing(threshold Severity) []Finding {
+	var failing []Finding
+	for _, f := range r.Findings {
+		if f.Severity.AtLeast(threshold) {
+			failing = append(failing, f)
+		}
+	}
+	return failing
+}
@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares two FreeBSD package versions the way pkg(8)
+// does and returns -1, 0 or 1. A version has the form
+// VERSION[_REVISION][,EPOCH]: the epoch is compared first, then the
+// version, component by component, then the port revision.
+//
+// A component is a number optionally followed by letters and a patch level,
+// as in "2a3". Letters sort after the bare number ("1.0a" > "1.0"), except
+// in a component that does not start with a number, where "alpha", "beta",
+// "pre" and "rc" sort before it ("1.0.rc1" < "1.0"). "*" sorts before
+// everything, and "+" keeps the parts on either side of it aligned.
+func CompareVersions(a, b string) int {
+	va, ra, ea := splitVersion(a)
+	vb, rb, eb := splitVersion(b)
+
+	if ea != eb {
+		return cmpInt(ea, eb)
+	}
+	if !strings.EqualFold(va, vb) {
+		for va != "" || vb != "" {
+			var ca, cb component
+			blockA := va == "" || va[0] == '+'
+			blockB := vb == "" || vb[0] == '+'
+			if !blockA {
+				ca, va = nextComponent(va)
+			}
+			if !blockB {
+				cb, vb = nextComponent(vb)
+			}
+			if blockA && blockB {
+				if va != "" {
+					va = va[1:]
+				}
+				if vb != "" {
+					vb = vb[1:]
+				}
+				continue
+			}
+			if c := cmpInt(ca.n, cb.n); c != 0 {
+				return c
+			}
+			if c := cmpInt(ca.a, cb.a); c != 0 {
+				return c
+			}
+			if c := cmpInt(ca.pl, cb.pl); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmpInt(ra, rb)
+}
+
+// splitVersion splits a version into the version proper, the port
+// revision and the epoch.
+func splitVersion(v string) (string, int64, int64) {
+	var revision, epoch int64
+	end := len(v)
+	if i := strings.LastIndexByte(v, '_'); i >= 0 {
+		revision = leadingInt(v[i+1:])
+		end = i
+		if j := strings.LastIndexByte(v[i+1:], ','); j >= 0 {
+			epoch = leadingInt(v[i+1+j+1:])
+		}
+	} else if i := strings.LastIndexByte(v, ','); i >= 0 {
+		epoch = leadingInt(v[i+1:])
+		end = i
+	}
+	return v[:end], revision, epoch
+}
+
+// component is one dot-separated part of a version.
+type component struct {
+	n  int64 // leading number; -1 if there is none, -2 for "*"
+	a  int64 // letter value; 0 if there is none
+	pl int64 // patch level after the letters; -1 if there is none
+}
+
+// stages are the pre-release names recognised in components that do not
+// start with a number, with the letter value they sort as.
+var stages = []struct {
+	name  string
+	value int64
+}{
+	{"pl", 0},
+	{"alpha", 'a' - 'a' + 1},
+	{"beta", 'b' - 'a' + 1},
+	{"pre", 'p' - 'a' + 1},
+	{"rc", 'r' - 'a' + 1},
+}
+
+// nextComponent parses the component at the start of s and returns it with
+// the rest of s, past any separators.
+func nextComponent(s string) (component, string) {
+	var c component
+	hasStage := false
+
+	switch {
+	case s != "" && isDigit(s[0]):
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		c.n, _ = strconv.ParseInt(s[:i], 10, 64)
+		s = s[i:]
+	case s != "" && s[0] == '*':
+		c.n = -2
+		s = s[1:]
+		for s != "" && !isDigit(s[0]) && !isAlpha(s[0]) && s[0] != '.' && s[0] != '+' {
+			s = s[1:]
+		}
+	default:
+		c.n = -1
+		hasStage = true
+	}
+
+	if s != "" && isAlpha(s[0]) {
+		matched := false
+		if hasStage {
+			for _, st := range stages {
+				if len(s) >= len(st.name) && strings.EqualFold(s[:len(st.name)], st.name) &&
+					(len(s) == len(st.name) || !isAlpha(s[len(st.name)])) {
+					c.a = st.value
+					s = s[len(st.name):]
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			c.a = int64(toLower(s[0]) - 'a' + 1)
+			for s != "" && isAlpha(s[0]) {
+				s = s[1:]
+			}
+		}
+		// A letter may be followed by a patch level
+		c.pl = -1
+		if s != "" && isDigit(s[0]) {
+			i := 0
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+			c.pl, _ = strconv.ParseInt(s[:i], 10, 64)
+			s = s[i:]
+		}
+	}
+
+	for s != "" && !isDigit(s[0]) && !isAlpha(s[0]) && s[0] != '+' && s[0] != '*' {
+		s = s[1:]
+	}
+	return c, s
+}
+
+func leadingInt(s string) int64 {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	n, _ := strconv.ParseInt(s[:i], 10, 64)
+	return n
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// SystemVersion converts a FreeBSD release name as reported by
+// freebsd-version(1) to the form VuXML uses in <system> ranges:
+// "14.1-RELEASE-p3" becomes "14.1_3", and pre-releases sort before the
+// release ("15.0-RC4" becomes "15.0.rc4"). Development branches
+// (-CURRENT, -STABLE) are compared by their version number alone.
+func SystemVersion(v string) string {
+	base, rest, _ := strings.Cut(v, "-")
+	branch, patch, _ := strings.Cut(rest, "-p")
+	switch {
+	case branch == "RELEASE" && patch != "":
+		return base + "_" + patch
+	case strings.HasPrefix(branch, "RC"), strings.HasPrefix(branch, "BETA"), strings.HasPrefix(branch, "ALPHA"):
+		return base + "." + strings.ToLower(branch)
+	}
+	return base
+}
@@ -0,0 +1,107 @@
+package audit
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		// Numbers compare numerically, missing components as zero
+		{"1.0", "1.0", 0},
+		{"1.0", "1", 0},
+		{"1.9", "1.10", -1},
+		{"1.0.1", "1.0", 1},
+		{"2", "10", -1},
+		{"1.0", "1-0", 0},
+
+		// Port revision, then epoch
+		{"1.0", "1.0_1", -1},
+		{"1.0_2", "1.0_10", -1},
+		{"1.1", "1.0_5", 1},
+		{"1.0_1", "1.0,1", -1},
+		{"2.0", "1.0,1", -1},
+		{"1.0,1", "1.0_1,1", -1},
+		{"1.0_1,1", "1.0,1", 1},
+		{"1.0,2", "9.0_9,1", 1},
+
+		// Letters sort after the bare number
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.0A", "1.0a", 0},
+		{"1.0a", "1.0a1", -1},
+		{"1.0a1", "1.0a2", -1},
+		{"1.0a9", "1.0b1", -1},
+		{"1.0alpha", "1.0a", 0},
+		{"1.0alpha", "1.0", 1},
+		{"1.0b", "1.0.1", 1},
+
+		// Pre-release stages sort before the release
+		{"1.0.alpha1", "1.0", -1},
+		{"1.0.alpha1", "1.0.beta1", -1},
+		{"1.0.beta1", "1.0.pre1", -1},
+		{"1.0.pre1", "1.0.rc1", -1},
+		{"1.0.rc1", "1.0", -1},
+		{"1.0.rc1", "1.0.rc2", -1},
+		{"1.0.rc9", "1.0.1", -1},
+		{"1.0.RC1", "1.0.rc1", 0},
+		{"1.0.beta", "1.0.beta1", -1},
+		{"1.0.pl1", "1.0.alpha1", -1},
+		{"1.0.pl1", "1.0.pl2", -1},
+		// Other words sort by their first letter, as the stages do
+		{"1.0.rcx", "1.0.rc", 0},
+		{"1.0.rc", "1.0.s", -1},
+
+		// "*" sorts before everything
+		{"*", "0", -1},
+		{"1.*", "1.0", -1},
+		{"1.*", "1.a", -1},
+		{"1.*", "1.*", 0},
+
+		// "+" keeps the parts on either side aligned
+		{"1.0+9", "1.0.1+1", -1},
+		{"1.0+2", "1.0+10", -1},
+		{"1+2", "1.0+2", 0},
+		{"1.0+1", "1.0", 1},
+	} {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestSystemVersion(t *testing.T) {
+	for _, tt := range []struct {
+		release, want string
+	}{
+		{"14.1-RELEASE", "14.1"},
+		{"14.1-RELEASE-p3", "14.1_3"},
+		{"14.1-RELEASE-p12", "14.1_12"},
+		{"15.0-RC4", "15.0.rc4"},
+		{"15.0-RC1-p1", "15.0.rc1"},
+		{"15.0-BETA2", "15.0.beta2"},
+		{"15.0-ALPHA1", "15.0.alpha1"},
+		{"15.0-CURRENT", "15.0"},
+		{"14.2-STABLE", "14.2"},
+		{"14.1", "14.1"},
+	} {
+		if got := SystemVersion(tt.release); got != tt.want {
+			t.Errorf("SystemVersion(%q) = %q, want %q", tt.release, got, tt.want)
+		}
+	}
+
+	// The mapped versions order releases the way VuXML ranges expect
+	order := []string{
+		"15.0-ALPHA1", "15.0-ALPHA2", "15.0-BETA1", "15.0-BETA3", "15.0-RC1", "15.0-RC4",
+		"15.0-RELEASE", "15.0-RELEASE-p1", "15.0-RELEASE-p2", "15.0-RELEASE-p10", "15.1-BETA1",
+	}
+	for i := 1; i < len(order); i++ {
+		a, b := SystemVersion(order[i-1]), SystemVersion(order[i])
+		if CompareVersions(a, b) >= 0 {
+			t.Errorf("%s (%s) does not sort before %s (%s)", order[i-1], a, order[i], b)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Database is a parsed VuXML document.
+type Database struct {
+	Vulns []Vuln
+
+	byName map[string][]match // package and system names to affected ranges
+}
+
+// match is an affected entry of a vulnerability.
+type match struct {
+	vuln   *Vuln
+	ranges []Range
+	system bool
+}
+
+// Vuln is a vulnerability entry.
+type Vuln struct {
+	VID         string
+	Topic       string
+	Description string // plain text
+	CVEs        []string
+	URLs        []string
+	Discovery   string // dates as YYYY-MM-DD
+	Entry       string
+	Modified    string
+	Cancelled   bool
+}
+
+// URL returns the entry's page on vuxml.freebsd.org.
+func (v *Vuln) URL() string {
+	return "https://vuxml.freebsd.org/freebsd/" + v.VID + ".html"
+}
+
+// Range is a version range of an affected package. Every bound that is set
+// must hold; a range without bounds matches every version.
+type Range struct {
+	LT string `xml:"lt"`
+	LE string `xml:"le"`
+	EQ string `xml:"eq"`
+	GE string `xml:"ge"`
+	GT string `xml:"gt"`
+}
+
+// Contains reports whether version lies in the range.
+func (r Range) Contains(version string) bool {
+	bounds := []struct {
+		bound string
+		ok    func(c int) bool
+	}{
+		{r.LT, func(c int) bool { return c < 0 }},
+		{r.LE, func(c int) bool { return c <= 0 }},
+		{r.EQ, func(c int) bool { return c == 0 }},
+		{r.GE, func(c int) bool { return c >= 0 }},
+		{r.GT, func(c int) bool { return c > 0 }},
+	}
+	for _, b := range bounds {
+		if b.bound != "" && !b.ok(CompareVersions(version, b.bound)) {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the range as in "ge 2.0, lt 2.3_1".
+func (r Range) String() string {
+	var parts []string
+	for _, b := range []struct{ op, bound string }{
+		{"gt", r.GT}, {"ge", r.GE}, {"eq", r.EQ}, {"le", r.LE}, {"lt", r.LT},
+	} {
+		if b.bound != "" {
+			parts = append(parts, b.op+" "+b.bound)
+		}
+	}
+	if len(parts) == 0 {
+		return "all versions"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// XML structure of vuln.xml (https://www.vuxml.org/). Element names are
+// matched without their namespace.
+type xmlVuxml struct {
+	Vulns []xmlVuln `xml:"vuln"`
+}
+
+type xmlVuln struct {
+	VID     string `xml:"vid,attr"`
+	Topic   string `xml:"topic"`
+	Affects struct {
+		Packages []xmlAffected `xml:"package"`
+		Systems  []xmlAffected `xml:"system"`
+	} `xml:"affects"`
+	Description struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"description"`
+	References struct {
+		CVEs []string `xml:"cvename"`
+		URLs []string `xml:"url"`
+	} `xml:"references"`
+	Dates struct {
+		Discovery string `xml:"discovery"`
+		Entry     string `xml:"entry"`
+		Modified  string `xml:"modified"`
+	} `xml:"dates"`
+	Cancelled *struct{} `xml:"cancelled"`
+}
+
+type xmlAffected struct {
+	Names  []string `xml:"name"`
+	Ranges []Range  `xml:"range"`
+}
+
+// Load reads a VuXML file such as the vuln.xml kept by pkg-audit(8) in
+// /var/db/pkg. Compressed files must be decompressed first.
+func Load(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read vulnerability database: %w", err)
+	}
+	defer f.Close()
+
+	// Catch the compressed download (vuln.xml.xz or .bz2) early with a
+	// better message than an XML syntax error
+	var magic [6]byte
+	n, _ := io.ReadFull(f, magic[:])
+	switch {
+	case n >= 6 && string(magic[:6]) == "\xfd7zXZ\x00",
+		n >= 3 && string(magic[:3]) == "BZh":
+		return nil, fmt.Errorf("%s is compressed; decompress it first (xz -d, bunzip2)", path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	db, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Parse reads a VuXML document. Descriptions are XHTML, so HTML entities
+// are accepted.
+func Parse(r io.Reader) (*Database, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	d.AutoClose = xml.HTMLAutoClose
+
+	var doc xmlVuxml
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid VuXML: %w", err)
+	}
+	if len(doc.Vulns) == 0 {
+		return nil, fmt.Errorf("invalid VuXML: no <vuln> entries")
+	}
+
+	db := &Database{
+		Vulns:  make([]Vuln, len(doc.Vulns)),
+		byName: make(map[string][]match),
+	}
+	for i, xv := range doc.Vulns {
+		v := &db.Vulns[i]
+		*v = Vuln{
+			VID:         xv.VID,
+			Topic:       collapseSpace(xv.Topic),
+			Description: plainText(xv.Description.Inner),
+			CVEs:        trimAll(xv.References.CVEs),
+			URLs:        trimAll(xv.References.URLs),
+			Discovery:   strings.TrimSpace(xv.Dates.Discovery),
+			Entry:       strings.TrimSpace(xv.Dates.Entry),
+			Modified:    strings.TrimSpace(xv.Dates.Modified),
+			Cancelled:   xv.Cancelled != nil,
+		}
+		add := func(affected []xmlAffected, system bool) {
+			for _, a := range affected {
+				for _, name := range a.Names {
+					name = strings.TrimSpace(name)
+					db.byName[name] = append(db.byName[name], match{vuln: v, ranges: trimRanges(a.Ranges), system: system})
+				}
+			}
+		}
+		add(xv.Affects.Packages, false)
+		add(xv.Affects.Systems, true)
+	}
+	return db, nil
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips the markup from an XHTML fragment.
+func plainText(s string) string {
+	return collapseSpace(html.UnescapeString(tagPattern.ReplaceAllString(s, " ")))
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func trimAll(ss []string) []string {
+	var out []string
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func trimRanges(ranges []Range) []Range {
+	out := make([]Range, len(ranges))
+	for i, r := range ranges {
+		out[i] = Range{
+			LT: strings.TrimSpace(r.LT),
+			LE: strings.TrimSpace(r.LE),
+			EQ: strings.TrimSpace(r.EQ),
+			GE: strings.TrimSpace(r.GE),
+			GT: strings.TrimSpace(r.GT),
+		}
+	}
+	return out
+}
@@ -1,8 +1,18 @@
 package build
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/audit"
+	"github.com/pgsdf/pgsdbuild/internal/cache"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/pipeline"
+	"github.com/pgsdf/pgsdbuild/internal/repro"
+	"github.com/pgsdf/pgsdbuild/internal/util"
 )
 
 // Config holds the build system configuration.
@@ -14,20 +24,66 @@ type Config struct {
 	WorkDir      string
 	ISODir       string
 	OverlaysDir  string
+	PkgListsDir  string
 
 	// Build options
 	Verbose    bool
 	KeepWork   bool
+	Strict     bool // Treat recipe warnings (e.g. unknown fields) as errors
 	DiskSizeGB int
 
+	// Stage selection for resumable builds (see internal/pipeline)
+	Resume     bool   // skip stages completed by an earlier run
+	FromStage  string // start at this stage
+	UntilStage string // stop after this stage
+
+	// SourceDateEpoch makes the build reproducible: it is used instead of
+	// the current time and file times are clamped to it. Zero disables
+	// reproducible mode. Read from SOURCE_DATE_EPOCH.
+	SourceDateEpoch time.Time
+	epochErr        error // a malformed SOURCE_DATE_EPOCH fails Validate
+
+	// Stage cache (see internal/cache)
+	CacheDir string
+	NoCache  bool // neither restore nor save cached stages
+
+	// Image signing (see internal/sign). Images are signed when SigningKey
+	// names a private key; the public keys in KeysDir are shipped in boot
+	// ISOs for the installer to trust.
+	SigningKey string
+	KeysDir    string
+
+	// Vulnerability audit (see internal/audit). When VulnDB names a VuXML
+	// file, image builds fail if a package matches an advisory rated
+	// AuditFailOn or worse, except the advisories listed in AuditIgnore.
+	VulnDB      string
+	AuditFailOn string
+	AuditIgnore []string
+
 	// FreeBSD distribution settings
 	FreeBSDVersion string // FreeBSD version to use (e.g., "15.0-RELEASE")
 	FreeBSDArch    string // Architecture (e.g., "amd64")
 	FreeBSDMirror  string // Mirror URL (optional, uses default if empty)
 	AutoFetch      bool   // Automatically fetch FreeBSD archives if missing
 
+	// Package repository override (e.g. "file:///srv/pkg" for air-gapped
+	// builds). Replaces the repositories declared in recipes when set.
+	PkgRepo string
+
+	// Package catalog used for offline planning: a packagesite.yaml,
+	// packagesite.pkg or repository directory. Defaults to the PkgRepo
+	// directory when that is a file:// repository.
+	PkgCatalog string
+
 	// Runtime paths
 	RootDir string
+
+	// BuilderVersion is recorded in image manifests, e.g. "pgsdbuild 0.1.0".
+	BuilderVersion string
+
+	// Exec runs host commands. nil runs them on the host; the CLI sets a
+	// dry-run, recording or replaying executor here.
+	Exec executor.Executor
 }
 
 // NewDefaultConfig creates a Config with default values.
@@ -39,6 +95,10 @@ func NewDefaultConfig() *Config {
 		WorkDir:        "work",
 		ISODir:         "iso",
 		OverlaysDir:    "overlays",
+		PkgListsDir:    "pkglists",
+		CacheDir:       "cache",
+		KeysDir:        "keys",
+		AuditFailOn:    "high",
 		Verbose:        false,
 		KeepWork:       false,
 		DiskSizeGB:     10,
@@ -83,11 +143,83 @@ func (c *Config) GetISODir() string {
 	return c.ResolveDir(c.ISODir)
 }
 
+// Reproducible reports whether timestamps are clamped to SourceDateEpoch.
+func (c *Config) Reproducible() bool {
+	return !c.SourceDateEpoch.IsZero()
+}
+
+// BuildTime returns the time recorded in generated files: SourceDateEpoch
+// in reproducible mode, the current time otherwise.
+func (c *Config) BuildTime() time.Time {
+	if c.Reproducible() {
+		return c.SourceDateEpoch
+	}
+	return time.Now()
+}
+
+// GetCacheDir returns the absolute path to the stage cache.
+func (c *Config) GetCacheDir() string {
+	return c.ResolveDir(c.CacheDir)
+}
+
+// GetKeysDir returns the absolute path to the signing keys directory.
+func (c *Config) GetKeysDir() string {
+	return c.ResolveDir(c.KeysDir)
+}
+
+// OpenCache returns the stage cache.
+func (c *Config) OpenCache(logger *util.Logger) *cache.Store {
+	return cache.Open(c.GetCacheDir(), c.GetExecutor(), logger)
+}
+
+// CleanupWorkPath removes a directory below the work directory. Anything
+// outside the work directory is refused.
+func (c *Config) CleanupWorkPath(path string) error {
+	return util.CleanupDirWithin(c.GetWorkDir(), path)
+}
+
 // GetOverlaysDir returns the absolute path to the overlays directory.
 func (c *Config) GetOverlaysDir() string {
 	return c.ResolveDir(c.OverlaysDir)
 }
 
+// GetPkgListsDir returns the absolute path to the package lists directory.
+func (c *Config) GetPkgListsDir() string {
+	return c.ResolveDir(c.PkgListsDir)
+}
+
+// GetPkgCatalog returns the package catalog to plan against, or "" if none
+// is configured.
+func (c *Config) GetPkgCatalog() string {
+	if c.PkgCatalog != "" {
+		return c.PkgCatalog
+	}
+	if path, ok := strings.CutPrefix(c.PkgRepo, "file://"); ok {
+		return path
+	}
+	return ""
+}
+
+// GetExecutor returns the executor for host commands.
+func (c *Config) GetExecutor() executor.Executor {
+	return executor.OrDefault(c.Exec)
+}
+
+// StageOptions returns the stage selection for a build. Dry runs never
+// record completed stages or use the cache.
+func (c *Config) StageOptions(logger *util.Logger) pipeline.Options {
+	opts := pipeline.Options{
+		Resume: c.Resume,
+		From:   c.FromStage,
+		Until:  c.UntilStage,
+		DryRun: executor.IsDryRun(c.GetExecutor()),
+	}
+	if !c.NoCache && !opts.DryRun {
+		opts.Cache = c.OpenCache(logger)
+	}
+	return opts
+}
+
 // LoadFromEnv loads configuration from environment variables.
 func (c *Config) LoadFromEnv() {
 	if v := os.Getenv("PGSD_IMAGES_DIR"); v != "" {
@@ -108,12 +240,18 @@ func (c *Config) LoadFromEnv() {
 	if v := os.Getenv("PGSD_OVERLAYS_DIR"); v != "" {
 		c.OverlaysDir = v
 	}
+	if v := os.Getenv("PGSD_PKGLISTS_DIR"); v != "" {
+		c.PkgListsDir = v
+	}
 	if v := os.Getenv("PGSD_VERBOSE"); v == "1" || v == "true" {
 		c.Verbose = true
 	}
 	if v := os.Getenv("PGSD_KEEP_WORK"); v == "1" || v == "true" {
 		c.KeepWork = true
 	}
+	if v := os.Getenv("PGSD_STRICT"); v == "1" || v == "true" {
+		c.Strict = true
+	}
 	if v := os.Getenv("FREEBSD_VERSION"); v != "" {
 		c.FreeBSDVersion = v
 	}
@@ -123,13 +261,61 @@ func (c *Config) LoadFromEnv() {
 	if v := os.Getenv("FREEBSD_MIRROR"); v != "" {
 		c.FreeBSDMirror = v
 	}
+	if v := os.Getenv("PGSD_PKG_REPO"); v != "" {
+		c.PkgRepo = v
+	}
+	if v := os.Getenv("PGSD_PKG_CATALOG"); v != "" {
+		c.PkgCatalog = v
+	}
 	if v := os.Getenv("PGSD_AUTO_FETCH"); v == "0" || v == "false" {
 		c.AutoFetch = false
 	}
+	if v := os.Getenv(repro.EnvVar); v != "" {
+		c.SourceDateEpoch, c.epochErr = repro.ParseEpoch(v)
+	}
+	if v := os.Getenv("PGSD_CACHE_DIR"); v != "" {
+		c.CacheDir = v
+	}
+	if v := os.Getenv("PGSD_NO_CACHE"); v == "1" || v == "true" {
+		c.NoCache = true
+	}
+	if v := os.Getenv("PGSD_SIGNING_KEY"); v != "" {
+		c.SigningKey = v
+	}
+	if v := os.Getenv("PGSD_KEYS_DIR"); v != "" {
+		c.KeysDir = v
+	}
+	if v := os.Getenv("PGSD_VULN_DB"); v != "" {
+		c.VulnDB = v
+	}
+	if v := os.Getenv("PGSD_AUDIT_FAIL_ON"); v != "" {
+		c.AuditFailOn = v
+	}
+	if v := os.Getenv("PGSD_AUDIT_IGNORE"); v != "" {
+		c.AuditIgnore = SplitList(v)
+	}
 }
 
 // Validate checks that the configuration is valid.
 func (c *Config) Validate() error {
-	// All validation is currently optional since directories are created as needed
+	// Directories are created as needed. A malformed SOURCE_DATE_EPOCH
+	// must stop the build rather than silently produce a different one.
+	if c.epochErr != nil {
+		return c.epochErr
+	}
+	if _, err := audit.ParseThreshold(c.AuditFailOn); err != nil {
+		return fmt.Errorf("audit threshold: %w", err)
+	}
 	return nil
 }
+
+// SplitList splits a comma-separated list, dropping empty entries.
+func SplitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,311 @@
+// Package cache stores the output of build stages under a content-addressed
+// key, so a rebuild whose inputs did not change can restore a stage instead
+// of running it again.
+//
+// Each entry is a directory named after its key holding entry.json and the
+// stage output as a gzip-compressed tarball:
+//
+//	<cache>/ab/ab12.../entry.json
+//	<cache>/ab/ab12.../root.tar.gz
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// ErrCorrupt is returned by Verify and Restore when an entry's payload
+// does not match its recorded hash.
+var ErrCorrupt = errors.New("cache entry is corrupt")
+
+const (
+	entryFile   = "entry.json"
+	payloadFile = "root.tar.gz"
+	tmpPrefix   = "tmp-"
+)
+
+// Entry describes a cached stage output.
+type Entry struct {
+	Key      string    `json:"key"`
+	Stage    string    `json:"stage"`
+	Build    string    `json:"build"` // e.g. "iso/pgsd-bootenv-arcan"
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"` // of the payload
+
+	dir string
+}
+
+// Path returns the entry's payload.
+func (e *Entry) Path() string {
+	return filepath.Join(e.dir, payloadFile)
+}
+
+// Store is a cache directory.
+type Store struct {
+	Dir string
+
+	// Command builds the tar(1) invocations used to save and restore
+	// entries. Builders that need to preserve file ownership wrap it in
+	// sudo; it defaults to executor.Cmd.
+	Command func(name string, args ...string) *executor.Command
+
+	exec   executor.Executor
+	logger *util.Logger
+}
+
+// Open returns the store in dir. The directory is created when the first
+// entry is saved.
+func Open(dir string, x executor.Executor, logger *util.Logger) *Store {
+	return &Store{Dir: dir, Command: executor.Cmd, exec: x, logger: logger}
+}
+
+func (s *Store) entryDir(key string) string {
+	return filepath.Join(s.Dir, key[:2], key)
+}
+
+// Lookup returns the entry for key, or nil if there is none.
+func (s *Store) Lookup(key string) *Entry {
+	e, err := readEntry(s.entryDir(key))
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// Save archives srcDir as the entry for key. An existing entry is kept.
+func (s *Store) Save(ctx context.Context, key, stage, build, srcDir string) (*Entry, error) {
+	if e := s.Lookup(key); e != nil {
+		return e, nil
+	}
+	if err := util.EnsureDir(s.Dir); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(s.Dir, tmpPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache entry: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	payload := filepath.Join(tmp, payloadFile)
+	cmd := s.Command("tar", "-czf", payload, "--numeric-owner", "-C", srcDir, ".")
+	if output, err := s.exec.Run(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("failed to archive %s: %w\nOutput: %s", srcDir, err, output)
+	}
+
+	sum, size, err := hashFile(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	e := &Entry{Key: key, Stage: stage, Build: build, Created: now, LastUsed: now, Size: size, SHA256: sum}
+	if err := writeEntry(tmp, e); err != nil {
+		return nil, err
+	}
+
+	dir := s.entryDir(key)
+	if err := util.EnsureDir(filepath.Dir(dir)); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if s.Lookup(key) != nil {
+			// Saved concurrently by another build
+			return s.Lookup(key), nil
+		}
+		return nil, fmt.Errorf("failed to store cache entry: %w", err)
+	}
+	e.dir = dir
+	s.logger.Debug("Cached stage %s as %s (%s)", stage, ShortKey(key), util.FormatSize(size))
+	return e, nil
+}
+
+// Restore extracts the entry's payload into dstDir, which should be empty.
+// The payload is verified first.
+func (s *Store) Restore(ctx context.Context, e *Entry, dstDir string) error {
+	if err := s.Verify(e); err != nil {
+		return err
+	}
+	if err := util.EnsureDir(dstDir); err != nil {
+		return err
+	}
+	cmd := s.Command("tar", "-xpzf", e.Path(), "--numeric-owner", "-C", dstDir)
+	if output, err := s.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to restore cache entry %s: %w\nOutput: %s", ShortKey(e.Key), err, output)
+	}
+
+	e.LastUsed = time.Now().UTC()
+	if err := writeEntry(e.dir, e); err != nil {
+		s.logger.Warn("Failed to update cache entry %s: %v", ShortKey(e.Key), err)
+	}
+	return nil
+}
+
+// Verify checks the entry's payload against its recorded size and hash.
+func (s *Store) Verify(e *Entry) error {
+	sum, size, err := hashFile(e.Path())
+	if err != nil {
+		return fmt.Errorf("cache entry %s: %w", ShortKey(e.Key), err)
+	}
+	if size != e.Size || sum != e.SHA256 {
+		return fmt.Errorf("%w: %s: payload is %d bytes with sha256 %s, expected %d bytes with %s",
+			ErrCorrupt, ShortKey(e.Key), size, sum, e.Size, e.SHA256)
+	}
+	return nil
+}
+
+// List returns every entry, most recently used first. Unreadable entries
+// are returned with only their key set so they can be pruned.
+func (s *Store) List() ([]*Entry, error) {
+	prefixes, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cache %s: %w", s.Dir, err)
+	}
+
+	var entries []*Entry
+	for _, p := range prefixes {
+		if !p.IsDir() || len(p.Name()) != 2 {
+			continue
+		}
+		keys, err := os.ReadDir(filepath.Join(s.Dir, p.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			dir := filepath.Join(s.Dir, p.Name(), k.Name())
+			e, err := readEntry(dir)
+			if err != nil {
+				e = &Entry{Key: k.Name(), dir: dir}
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+	return entries, nil
+}
+
+// Remove deletes an entry.
+func (s *Store) Remove(e *Entry) error {
+	return util.CleanupDirWithin(s.Dir, e.dir)
+}
+
+// PruneOptions select the entries Prune removes.
+type PruneOptions struct {
+	All       bool          // remove every entry
+	OlderThan time.Duration // remove entries not used for this long (0: keep)
+	MaxSize   int64         // then remove least recently used entries until the cache fits (0: no limit)
+}
+
+// Prune removes entries selected by opts, as well as unreadable entries and
+// leftovers of interrupted saves, and returns the removed entries.
+func (s *Store) Prune(opts PruneOptions) ([]*Entry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*Entry
+	var kept []*Entry
+	now := time.Now()
+	for _, e := range entries {
+		stale := opts.OlderThan > 0 && now.Sub(e.LastUsed) > opts.OlderThan
+		if opts.All || e.SHA256 == "" || stale {
+			if err := s.Remove(e); err != nil {
+				return removed, err
+			}
+			removed = append(removed, e)
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	if opts.MaxSize > 0 {
+		var total int64
+		for _, e := range kept {
+			total += e.Size
+		}
+		// kept is most recently used first
+		for i := len(kept) - 1; i >= 0 && total > opts.MaxSize; i-- {
+			if err := s.Remove(kept[i]); err != nil {
+				return removed, err
+			}
+			removed = append(removed, kept[i])
+			total -= kept[i].Size
+		}
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(s.Dir, tmpPrefix+"*"))
+	for _, tmp := range tmps {
+		if err := util.CleanupDirWithin(s.Dir, tmp); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Size returns the total payload size of entries.
+func Size(entries []*Entry) int64 {
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	return total
+}
+
+func readEntry(dir string) (*Entry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, entryFile))
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %s: %w", dir, err)
+	}
+	e.dir = dir
+	return e, nil
+}
+
+func writeEntry(dir string, e *Entry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteStringToFile(filepath.Join(dir, entryFile), string(data)+"\n", 0644)
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// ShortKey abbreviates a key for display.
+func ShortKey(key string) string {
+	if len(key) > 12 {
+		return key[:12]
+	}
+	return key
+}
@@ -0,0 +1,386 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+var testLogger = util.NewLogger(io.Discard, util.LevelError, false, "")
+
+// fakeTar implements the two tar(1) invocations the store makes, behind
+// the "sudo" its Command adds, with archive/tar so tests need no host tar.
+type fakeTar struct {
+	calls []string
+	fail  bool
+}
+
+func (f *fakeTar) Run(ctx context.Context, c *executor.Command) ([]byte, error) {
+	argv := c.Argv()
+	f.calls = append(f.calls, strings.Join(argv, " "))
+	if len(argv) < 3 || argv[0] != "sudo" || argv[1] != "tar" {
+		return nil, fmt.Errorf("unexpected command %s", c)
+	}
+	if f.fail {
+		return []byte("tar: write error\n"), &executor.ExitError{Code: 1}
+	}
+	args := argv[2:]
+	switch {
+	case args[0] == "-czf" && len(args) == 6:
+		return nil, writeTar(args[1], args[4])
+	case args[0] == "-xpzf" && len(args) == 5:
+		return nil, readTar(args[1], args[4])
+	}
+	return nil, fmt.Errorf("unexpected tar arguments %q", args)
+}
+
+func (f *fakeTar) Pipe(ctx context.Context, cmds ...*executor.Command) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeTar) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func writeTar(archive, dir string) error {
+	out, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: rel, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func readTar(archive, dir string) error {
+	in, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, h.Name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+}
+
+// newStore returns a store in a temporary directory that archives with
+// fakeTar through a sudo wrapper, as builders that keep ownership do.
+func newStore(t *testing.T) (*Store, *fakeTar) {
+	t.Helper()
+	x := &fakeTar{}
+	s := Open(filepath.Join(t.TempDir(), "cache"), x, testLogger)
+	s.Command = func(name string, args ...string) *executor.Command {
+		return executor.Cmd("sudo", append([]string{name}, args...)...)
+	}
+	return s, x
+}
+
+// readTree returns the regular files below dir and their contents.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		data, err := os.ReadFile(path)
+		files[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+const testKey = "ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12cd34ef56ab12"
+
+// A saved directory is found by its key and restored with the same files.
+func TestSaveRestore(t *testing.T) {
+	s, x := newStore(t)
+	src := t.TempDir()
+	want := map[string]string{"boot/loader.conf": "autoboot_delay=3\n", "etc/rc.conf": "hostname=pgsd\n"}
+	for name, data := range want {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Lookup(testKey) != nil {
+		t.Fatal("empty cache has an entry")
+	}
+	saved, err := s.Save(context.Background(), testKey, "base", "iso/pgsd-test", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(x.calls[0], "sudo tar -czf ") {
+		t.Errorf("saved with %q", x.calls[0])
+	}
+
+	e := s.Lookup(testKey)
+	if e == nil {
+		t.Fatal("saved entry not found")
+	}
+	if e.Key != testKey || e.Stage != "base" || e.Build != "iso/pgsd-test" || e.Size != saved.Size || e.SHA256 != saved.SHA256 || e.Size == 0 {
+		t.Errorf("entry = %+v, saved %+v", e, saved)
+	}
+	if want := filepath.Join(s.Dir, "ab", testKey, payloadFile); e.Path() != want {
+		t.Errorf("payload at %s, want %s", e.Path(), want)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(s.Dir, tmpPrefix+"*")); len(tmps) != 0 {
+		t.Errorf("temporary directories left: %v", tmps)
+	}
+
+	// Saving the key again keeps the entry without archiving
+	if _, err := s.Save(context.Background(), testKey, "base", "iso/pgsd-test", src); err != nil {
+		t.Fatal(err)
+	}
+	if len(x.calls) != 1 {
+		t.Errorf("second save ran %q", x.calls[1:])
+	}
+
+	dst := filepath.Join(t.TempDir(), "root")
+	e.LastUsed = time.Time{}
+	if err := s.Restore(context.Background(), e, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	if e := s.Lookup(testKey); e.LastUsed.IsZero() || e.LastUsed.Before(saved.LastUsed) {
+		t.Errorf("last used = %v, not updated by the restore", e.LastUsed)
+	}
+}
+
+// A failed archive leaves no entry behind.
+func TestSaveFailure(t *testing.T) {
+	s, x := newStore(t)
+	x.fail = true
+	_, err := s.Save(context.Background(), testKey, "base", "iso/pgsd-test", t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "failed to archive") || !strings.Contains(err.Error(), "tar: write error") {
+		t.Errorf("err = %v", err)
+	}
+	if s.Lookup(testKey) != nil {
+		t.Error("failed save left an entry")
+	}
+	if entries, _ := os.ReadDir(s.Dir); len(entries) != 0 {
+		t.Errorf("cache holds %d files after a failed save", len(entries))
+	}
+}
+
+// A payload that no longer matches its entry is reported as corrupt and
+// never extracted.
+func TestRestoreCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(path string) error
+		err     error
+	}{
+		{
+			name:    "changed",
+			corrupt: func(path string) error { return flipByte(path) },
+			err:     ErrCorrupt,
+		},
+		{
+			name:    "truncated",
+			corrupt: func(path string) error { return os.Truncate(path, 10) },
+			err:     ErrCorrupt,
+		},
+		{
+			name:    "missing",
+			corrupt: os.Remove,
+			err:     os.ErrNotExist,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, x := newStore(t)
+			src := t.TempDir()
+			if err := os.WriteFile(filepath.Join(src, "file"), []byte("contents\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			e, err := s.Save(context.Background(), testKey, "base", "", src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.corrupt(e.Path()); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := t.TempDir()
+			if err := s.Restore(context.Background(), e, dst); !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			if len(x.calls) != 1 {
+				t.Errorf("corrupt entry was extracted: %q", x.calls[1:])
+			}
+			if files := readTree(t, dst); len(files) != 0 {
+				t.Errorf("restored %v", files)
+			}
+		})
+	}
+}
+
+func flipByte(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data[len(data)/2] ^= 0xff
+	return os.WriteFile(path, data, 0644)
+}
+
+// Prune removes entries by age, then the least recently used ones until
+// the cache fits, along with unreadable entries and interrupted saves.
+func TestPrune(t *testing.T) {
+	now := time.Now().UTC()
+	day := 24 * time.Hour
+	// Keys sort the other way round from their age, so the test does not
+	// pass by walking the directory in order
+	entries := []struct {
+		key  string
+		age  time.Duration
+		size int64
+	}{
+		{"ff01", 0, 400},
+		{"ee02", 2 * day, 300},
+		{"dd03", 10 * day, 200},
+		{"cc04", 40 * day, 100},
+	}
+	tests := []struct {
+		name    string
+		opts    PruneOptions
+		removed []string // sorted
+	}{
+		{name: "nothing selected", removed: []string{"bad"}},
+		{name: "all", opts: PruneOptions{All: true}, removed: []string{"bad", "cc04", "dd03", "ee02", "ff01"}},
+		{name: "older than", opts: PruneOptions{OlderThan: 7 * day}, removed: []string{"bad", "cc04", "dd03"}},
+		{name: "max size", opts: PruneOptions{MaxSize: 750}, removed: []string{"bad", "cc04", "dd03"}},
+		{name: "max size fits", opts: PruneOptions{MaxSize: 1000}, removed: []string{"bad"}},
+		{name: "max size after age", opts: PruneOptions{OlderThan: 30 * day, MaxSize: 700}, removed: []string{"bad", "cc04", "dd03"}},
+		{name: "max size below newest", opts: PruneOptions{MaxSize: 100}, removed: []string{"bad", "cc04", "dd03", "ee02", "ff01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newStore(t)
+			for _, e := range entries {
+				dir := s.entryDir(e.key)
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				entry := &Entry{Key: e.key, Stage: "base", Created: now.Add(-e.age), LastUsed: now.Add(-e.age), Size: e.size, SHA256: "00"}
+				if err := writeEntry(dir, entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bad := s.entryDir("bad")
+			if err := os.MkdirAll(bad, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(bad, entryFile), []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tmp := filepath.Join(s.Dir, tmpPrefix+"123")
+			if err := os.MkdirAll(tmp, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			removed, err := s.Prune(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, e := range removed {
+				keys = append(keys, e.Key)
+				if util.DirExists(e.dir) {
+					t.Errorf("entry %s is still on disk", e.Key)
+				}
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.removed) {
+				t.Errorf("removed %v, want %v", keys, tt.removed)
+			}
+			if util.DirExists(tmp) {
+				t.Error("interrupted save was not removed")
+			}
+
+			left, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left)+len(removed) != len(entries)+1 {
+				t.Errorf("%d entries left after removing %d", len(left), len(removed))
+			}
+			for i := 1; i < len(left); i++ {
+				if left[i].LastUsed.After(left[i-1].LastUsed) {
+					t.Errorf("List is not most recently used first: %s before %s", left[i-1].Key, left[i].Key)
+				}
+			}
+		})
+	}
+}
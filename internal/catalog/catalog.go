@@ -0,0 +1,343 @@
+// Package catalog reads a pkg(8) repository catalog (packagesite.yaml) and
+// resolves package sets against it without running pkg, so package lists
+// can be checked on any host.
+package catalog
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// catalogEntry is the name of the catalog inside packagesite.pkg/.txz.
+const catalogEntry = "packagesite.yaml"
+
+// Dep is a dependency as recorded in the catalog.
+type Dep struct {
+	Origin  string `json:"origin"`
+	Version string `json:"version"`
+}
+
+// Package is a single catalog entry. Only the fields needed for planning
+// are decoded.
+type Package struct {
+	Name      string         `json:"name"`
+	Origin    string         `json:"origin"`
+	Version   string         `json:"version"`
+	ABI       string         `json:"abi,omitempty"`
+	Comment   string         `json:"comment,omitempty"`
+	FlatSize  int64          `json:"flatsize"`
+	PkgSize   int64          `json:"pkgsize"`
+	Deps      map[string]Dep `json:"deps,omitempty"`
+	Conflicts []string       `json:"conflicts,omitempty"`
+}
+
+// NameVersion returns name-version as pkg prints it.
+func (p *Package) NameVersion() string {
+	return p.Name + "-" + p.Version
+}
+
+// Catalog is an in-memory package catalog.
+type Catalog struct {
+	byName   map[string]*Package
+	byOrigin map[string][]*Package
+}
+
+// Len returns the number of packages in the catalog.
+func (c *Catalog) Len() int {
+	return len(c.byName)
+}
+
+// Lookup finds a package by name or by ports origin.
+func (c *Catalog) Lookup(nameOrOrigin string) (*Package, bool) {
+	if p, ok := c.byName[nameOrOrigin]; ok {
+		return p, true
+	}
+	if ps := c.byOrigin[nameOrOrigin]; len(ps) > 0 {
+		return ps[0], true
+	}
+	return nil, false
+}
+
+// Parse reads a packagesite.yaml stream. Despite the name, pkg writes one
+// JSON object per line.
+func Parse(r io.Reader) (*Catalog, error) {
+	c := &Catalog{
+		byName:   make(map[string]*Package),
+		byOrigin: make(map[string][]*Package),
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Entries with long descriptions and file lists can be large
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		p := &Package{}
+		if err := json.Unmarshal(line, p); err != nil {
+			return nil, fmt.Errorf("catalog line %d: %w", lineNo, err)
+		}
+		if p.Name == "" {
+			return nil, fmt.Errorf("catalog line %d: entry has no name", lineNo)
+		}
+		c.byName[p.Name] = p
+		if p.Origin != "" {
+			c.byOrigin[p.Origin] = append(c.byOrigin[p.Origin], p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	return c, nil
+}
+
+// Load reads a catalog from path, which may be a packagesite.yaml file, a
+// packagesite.pkg/.txz archive, or a repository directory containing one
+// of them. A file:// prefix is accepted so repository URLs can be passed
+// directly.
+func Load(path string) (*Catalog, error) {
+	path = strings.TrimPrefix(path, "file://")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access catalog %s: %w", path, err)
+	}
+	if info.IsDir() {
+		found := ""
+		for _, name := range []string{"packagesite.yaml", "packagesite.pkg", "packagesite.txz", "packagesite.tzst"} {
+			if candidate := filepath.Join(path, name); fileExists(candidate) {
+				found = candidate
+				break
+			}
+		}
+		if found == "" {
+			return nil, fmt.Errorf("no packagesite.yaml or packagesite.pkg in %s", path)
+		}
+		path = found
+	}
+
+	if filepath.Ext(path) == ".yaml" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open catalog: %w", err)
+		}
+		defer f.Close()
+		return Parse(f)
+	}
+	return loadArchive(path)
+}
+
+// loadArchive extracts packagesite.yaml from a (compressed) tar archive.
+// gzip and plain tar are handled in Go; xz and zstd are piped through the
+// host tools.
+func loadArchive(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open catalog: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var stream io.Reader = f
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", path, err)
+		}
+		defer gz.Close()
+		stream = gz
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return decompressWith(path, "xz", f)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return decompressWith(path, "zstd", f)
+	}
+	return parseTar(path, stream)
+}
+
+// decompressWith pipes the archive through an external decompressor.
+func decompressWith(path, tool string, r io.Reader) (*Catalog, error) {
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("catalog %s is %s-compressed but %s is not installed\nHint: Extract packagesite.yaml and pass it instead", path, tool, tool)
+	}
+	cmd := exec.Command(tool, "-dc")
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", tool, err)
+	}
+	c, parseErr := parseTar(path, out)
+	// Drain so the decompressor can exit if the entry came early
+	_, _ = io.Copy(io.Discard, out)
+	if err := cmd.Wait(); err != nil && parseErr == nil {
+		return nil, fmt.Errorf("%s failed on %s: %w", tool, path, err)
+	}
+	return c, parseErr
+}
+
+// parseTar finds packagesite.yaml in a tar stream and parses it.
+func parseTar(path string, r io.Reader) (*Catalog, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("catalog %s does not contain %s", path, catalogEntry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read catalog %s: %w", path, err)
+		}
+		if filepath.Base(hdr.Name) == catalogEntry {
+			return Parse(tr)
+		}
+	}
+}
+
+// Missing is a package that could not be found in the catalog.
+type Missing struct {
+	Name       string `json:"name"`
+	RequiredBy string `json:"required_by"` // package list or package that asked for it
+}
+
+// Conflict is a problem between two packages of a plan.
+type Conflict struct {
+	Package string `json:"package"`
+	With    string `json:"with"`
+	Reason  string `json:"reason"`
+}
+
+// Request is a package to resolve and where it came from.
+type Request struct {
+	Name string
+	From string // package list name, for reporting
+}
+
+// Plan is the result of resolving a package set against a catalog.
+type Plan struct {
+	Requested int        `json:"requested"`
+	Packages  []*Package `json:"packages"`     // full closure sorted by name
+	Pulled    int        `json:"dependencies"` // packages only in the plan as dependencies
+	Missing   []Missing  `json:"missing"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+	FlatSize  int64      `json:"flat_size"` // installed size
+	PkgSize   int64      `json:"pkg_size"`  // download size
+}
+
+// OK reports whether the plan has no missing or conflicting packages.
+func (p *Plan) OK() bool {
+	return len(p.Missing) == 0 && len(p.Conflicts) == 0
+}
+
+// Resolve computes the transitive dependency closure of the requested
+// packages and reports anything pkg would fail on.
+func (c *Catalog) Resolve(requests []Request) *Plan {
+	plan := &Plan{Requested: len(requests), Packages: []*Package{}, Missing: []Missing{}, Conflicts: []Conflict{}}
+	selected := make(map[string]*Package)
+	requested := make(map[string]bool)
+	missing := make(map[string]bool)
+
+	var visit func(p *Package)
+	visit = func(p *Package) {
+		if _, ok := selected[p.Name]; ok {
+			return
+		}
+		selected[p.Name] = p
+
+		names := make([]string, 0, len(p.Deps))
+		for name := range p.Deps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dep := p.Deps[name]
+			d, ok := c.byName[name]
+			if !ok && dep.Origin != "" {
+				d, ok = c.Lookup(dep.Origin)
+			}
+			if !ok {
+				if !missing[name] {
+					missing[name] = true
+					plan.Missing = append(plan.Missing, Missing{Name: name, RequiredBy: p.NameVersion()})
+				}
+				continue
+			}
+			if dep.Version != "" && dep.Version != d.Version {
+				plan.Conflicts = append(plan.Conflicts, Conflict{
+					Package: p.NameVersion(),
+					With:    d.NameVersion(),
+					Reason:  fmt.Sprintf("depends on %s-%s but the catalog has %s", name, dep.Version, d.Version),
+				})
+			}
+			visit(d)
+		}
+	}
+
+	for _, r := range requests {
+		p, ok := c.Lookup(r.Name)
+		if !ok {
+			if !missing[r.Name] {
+				missing[r.Name] = true
+				plan.Missing = append(plan.Missing, Missing{Name: r.Name, RequiredBy: r.From})
+			}
+			continue
+		}
+		requested[p.Name] = true
+		visit(p)
+	}
+
+	for _, p := range selected {
+		plan.Packages = append(plan.Packages, p)
+		plan.FlatSize += p.FlatSize
+		plan.PkgSize += p.PkgSize
+		if !requested[p.Name] {
+			plan.Pulled++
+		}
+	}
+	sort.Slice(plan.Packages, func(i, j int) bool { return plan.Packages[i].Name < plan.Packages[j].Name })
+
+	// Declared conflicts are globs against package names
+	for _, p := range plan.Packages {
+		for _, pattern := range p.Conflicts {
+			for _, other := range plan.Packages {
+				if other == p {
+					continue
+				}
+				if ok, _ := filepath.Match(pattern, other.Name); ok {
+					plan.Conflicts = append(plan.Conflicts, Conflict{
+						Package: p.NameVersion(),
+						With:    other.NameVersion(),
+						Reason:  fmt.Sprintf("%s declares a conflict with %s", p.Name, pattern),
+					})
+				}
+			}
+		}
+	}
+
+	return plan
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
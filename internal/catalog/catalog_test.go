@@ -0,0 +1,219 @@
+package catalog
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadTestCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	c, err := Load(filepath.Join("testdata", "packagesite.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Resolve follows dependencies, reports what pkg would fail on and totals
+// the sizes of the closure.
+func TestResolve(t *testing.T) {
+	c := loadTestCatalog(t)
+	tests := []struct {
+		name      string
+		requests  []Request
+		packages  []string
+		pulled    int
+		missing   []Missing
+		conflicts []Conflict
+		flatSize  int64
+		pkgSize   int64
+	}{
+		{
+			name:     "transitive",
+			requests: []Request{{Name: "sudo", From: "base"}},
+			packages: []string{"gettext-runtime-0.22.5", "indexinfo-0.3.1", "sudo-1.9.16p2"},
+			pulled:   2,
+			flatSize: 6500000 + 1200000 + 12000,
+			pkgSize:  1800000 + 200000 + 6000,
+		},
+		{
+			name:     "by origin",
+			requests: []Request{{Name: "security/sudo", From: "base"}},
+			packages: []string{"gettext-runtime-0.22.5", "indexinfo-0.3.1", "sudo-1.9.16p2"},
+			pulled:   2,
+			flatSize: 6500000 + 1200000 + 12000,
+			pkgSize:  1800000 + 200000 + 6000,
+		},
+		{
+			// A dependency recorded under an old name is found by origin
+			name:     "dependency by origin",
+			requests: []Request{{Name: "curl", From: "base"}},
+			packages: []string{"curl-8.11.1", "libnghttp2-1.64.0"},
+			pulled:   1,
+			flatSize: 4800000 + 300000,
+			pkgSize:  1500000 + 90000,
+		},
+		{
+			name:     "requested dependency",
+			requests: []Request{{Name: "sudo", From: "base"}, {Name: "gettext-runtime", From: "base"}},
+			packages: []string{"gettext-runtime-0.22.5", "indexinfo-0.3.1", "sudo-1.9.16p2"},
+			pulled:   1,
+			flatSize: 6500000 + 1200000 + 12000,
+			pkgSize:  1800000 + 200000 + 6000,
+		},
+		{
+			name:     "missing request",
+			requests: []Request{{Name: "fish", From: "shells"}, {Name: "indexinfo", From: "base"}, {Name: "fish", From: "desktop"}},
+			packages: []string{"indexinfo-0.3.1"},
+			missing:  []Missing{{Name: "fish", RequiredBy: "shells"}},
+			flatSize: 12000,
+			pkgSize:  6000,
+		},
+		{
+			// p5-Error is needed by both but reported once
+			name:     "missing dependency",
+			requests: []Request{{Name: "hub", From: "dev"}, {Name: "git", From: "dev"}},
+			packages: []string{"curl-8.11.1", "expat-2.6.4", "git-2.47.1", "hub-2.14.2", "libnghttp2-1.64.0"},
+			pulled:   3,
+			missing:  []Missing{{Name: "p5-Error", RequiredBy: "git-2.47.1"}},
+			flatSize: 4800000 + 300000 + 500000 + 40000000 + 9000000,
+			pkgSize:  1500000 + 90000 + 150000 + 9000000 + 3000000,
+		},
+		{
+			name:     "version conflict",
+			requests: []Request{{Name: "zsh", From: "shells"}},
+			packages: []string{"pcre2-10.44", "zsh-5.9_6"},
+			pulled:   1,
+			conflicts: []Conflict{{
+				Package: "zsh-5.9_6",
+				With:    "pcre2-10.44",
+				Reason:  "depends on pcre2-10.43 but the catalog has 10.44",
+			}},
+			flatSize: 20000000 + 3000000,
+			pkgSize:  4000000 + 900000,
+		},
+		{
+			name:     "declared conflict",
+			requests: []Request{{Name: "vim", From: "editors"}, {Name: "vim-tiny", From: "base"}},
+			packages: []string{"vim-9.1.0707", "vim-tiny-9.1.0707"},
+			conflicts: []Conflict{{
+				Package: "vim-9.1.0707",
+				With:    "vim-tiny-9.1.0707",
+				Reason:  "vim declares a conflict with vim-tiny*",
+			}},
+			flatSize: 38000000 + 3500000,
+			pkgSize:  8000000 + 1000000,
+		},
+		{
+			name:     "dependency cycle",
+			requests: []Request{{Name: "py311-pip", From: "dev"}},
+			packages: []string{"py311-pip-24.3.1", "py311-setuptools-63.1.0"},
+			pulled:   1,
+			flatSize: 10000000 + 4000000,
+			pkgSize:  2000000 + 1000000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := c.Resolve(tt.requests)
+			var packages []string
+			for _, p := range plan.Packages {
+				packages = append(packages, p.NameVersion())
+			}
+			if !reflect.DeepEqual(packages, tt.packages) {
+				t.Errorf("packages = %v, want %v", packages, tt.packages)
+			}
+			if plan.Requested != len(tt.requests) || plan.Pulled != tt.pulled {
+				t.Errorf("requested, pulled = %d, %d; want %d, %d", plan.Requested, plan.Pulled, len(tt.requests), tt.pulled)
+			}
+			if len(plan.Missing) != 0 || len(tt.missing) != 0 {
+				if !reflect.DeepEqual(plan.Missing, tt.missing) {
+					t.Errorf("missing = %+v, want %+v", plan.Missing, tt.missing)
+				}
+			}
+			if len(plan.Conflicts) != 0 || len(tt.conflicts) != 0 {
+				if !reflect.DeepEqual(plan.Conflicts, tt.conflicts) {
+					t.Errorf("conflicts = %+v, want %+v", plan.Conflicts, tt.conflicts)
+				}
+			}
+			if ok := len(tt.missing) == 0 && len(tt.conflicts) == 0; plan.OK() != ok {
+				t.Errorf("OK = %v, want %v", plan.OK(), ok)
+			}
+			if plan.FlatSize != tt.flatSize || plan.PkgSize != tt.pkgSize {
+				t.Errorf("sizes = %d, %d; want %d, %d", plan.FlatSize, plan.PkgSize, tt.flatSize, tt.pkgSize)
+			}
+		})
+	}
+}
+
+// A catalog is found from a repository directory or URL and read out of a
+// packagesite.pkg archive.
+func TestLoad(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "packagesite.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(repo, "packagesite.yaml"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	archived := t.TempDir()
+	writeArchive(t, filepath.Join(archived, "packagesite.pkg"), data)
+
+	for _, path := range []string{repo, "file://" + repo, archived, filepath.Join(archived, "packagesite.pkg")} {
+		c, err := Load(path)
+		if err != nil {
+			t.Errorf("Load(%s): %v", path, err)
+			continue
+		}
+		if c.Len() != 14 {
+			t.Errorf("Load(%s): %d packages, want 14", path, c.Len())
+		}
+		if p, ok := c.Lookup("editors/vim@tiny"); !ok || p.Name != "vim-tiny" {
+			t.Errorf("Load(%s): lookup by origin = %v, %v", path, p, ok)
+		}
+	}
+
+	if _, err := Load(t.TempDir()); err == nil || !strings.Contains(err.Error(), "no packagesite.yaml or packagesite.pkg") {
+		t.Errorf("empty directory: err = %v", err)
+	}
+	bad := filepath.Join(t.TempDir(), "packagesite.yaml")
+	if err := os.WriteFile(bad, []byte(`{"name":"sudo"}`+"\n"+`{"origin":"shells/zsh"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(bad); err == nil || err.Error() != "catalog line 2: entry has no name" {
+		t.Errorf("entry without a name: err = %v", err)
+	}
+}
+
+// writeArchive writes data as packagesite.yaml in a gzip-compressed tar
+// archive, as pkg repo creates packagesite.pkg.
+func writeArchive(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for name, body := range map[string][]byte{"packagesite.yaml.pub": []byte("signature\n"), catalogEntry: data} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,11 +3,23 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 
+	"github.com/pgsdf/pgsdbuild/internal/iso9660"
 	lua "github.com/yuin/gopher-lua"
 )
 
+var (
+	hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,62})(\.[A-Za-z0-9]([A-Za-z0-9-]{0,62}))*$`)
+	namePattern     = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	userPattern     = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*$`)
+	tunablePattern  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
 type ImageConfig struct {
 	ID              string
 	Version         string
@@ -16,6 +28,28 @@ type ImageConfig struct {
 	PkgLists        []string
 	Overlays        []string
 	DatasetOverlays []DatasetOverlay
+	Datasets        []Dataset
+	System          SystemConfig
+	Boot            BootConfig
+	Pkg             PkgConfig
+
+	// Extends lists the recipes this image inherits from, root ancestor first.
+	Extends []string
+
+	// Path is the recipe file the configuration was loaded from.
+	Path string
+
+	// Warnings holds schema problems that did not prevent loading, such as
+	// unknown fields. Callers decide whether to fail on them (strict mode).
+	Warnings []Diagnostic
+}
+
+// Dataset describes a ZFS dataset created in the image pool.
+type Dataset struct {
+	Name       string
+	Mountpoint string
+	CanMount   string
+	Properties map[string]string
 }
 
 // DatasetOverlay represents a ZFS dataset snapshot to receive into the image.
@@ -27,39 +61,116 @@ type DatasetOverlay struct {
 	Properties map[string]string
 }
 
+// SystemConfig holds host settings applied to the image root.
+type SystemConfig struct {
+	Hostname string
+	Timezone string
+	Services []string
+	Users    []UserConfig
+}
+
+// UserConfig describes a local user account created in the image.
+type UserConfig struct {
+	Name         string
+	UID          int
+	Groups       []string
+	Shell        string
+	Home         string
+	Comment      string
+	PasswordHash string
+}
+
+// PkgConfig controls how packages are installed into the target root.
+type PkgConfig struct {
+	// Mode is "rootdir" (pkg -r, the default) or "chroot" (pkg -c).
+	Mode string
+
+	// Repositories replace the default FreeBSD repository when set.
+	Repositories []Repository
+}
+
+// Repository is a pkg(8) repository definition, see pkg.conf(5).
+type Repository struct {
+	Name          string
+	URL           string
+	MirrorType    string // "srv", "http" or "none"
+	SignatureType string // "none", "fingerprints" or "pubkey"
+	Fingerprints  string // directory of trusted fingerprints
+	PubKey        string // public key file for signature_type "pubkey"
+	Priority      int
+}
+
+// BootConfig holds boot loader settings.
+type BootConfig struct {
+	// LoaderConf holds loader.conf(5) tunables merged into /boot/loader.conf.
+	LoaderConf map[string]string
+}
+
+// ISOConfig holds the ISO settings of a variant, from its bootenv.iso
+// block.
+type ISOConfig struct {
+	// VolumeID is the ISO 9660 volume label, which the kernel also mounts
+	// the root from. Empty means the default, "PGSD".
+	VolumeID  string
+	Publisher string
+
+	// BootMode is "hybrid" (BIOS and UEFI, the default), "uefi" or "bios".
+	BootMode string
+
+	// LegacyBoot adds BIOS boot to boot_mode "uefi". Nil when unset.
+	LegacyBoot *bool
+}
+
+// BIOS reports whether the ISO gets a BIOS boot entry.
+func (c ISOConfig) BIOS() bool {
+	if c.BootMode == "uefi" {
+		return c.LegacyBoot != nil && *c.LegacyBoot
+	}
+	return true
+}
+
+// UEFI reports whether the ISO gets a UEFI boot entry.
+func (c ISOConfig) UEFI() bool {
+	return c.BootMode != "bios"
+}
+
 type VariantConfig struct {
-	ID        string
-	Name      string
-	PkgLists  []string
-	Overlays  []string
-	ImagesDir string
+	ID             string
+	Name           string
+	PkgLists       []string
+	Overlays       []string
+	ImagesDir      string
+	EmbeddedImages []string
+	Boot           BootConfig
+	Pkg            PkgConfig
+	ISO            ISOConfig
+
+	// Extends lists the recipes this variant inherits from, root ancestor first.
+	Extends []string
+
+	// Path is the recipe file the configuration was loaded from.
+	Path string
+
+	// Warnings holds schema problems that did not prevent loading.
+	Warnings []Diagnostic
 }
 
 // LoadImageConfig loads an image configuration from a Lua file.
+// If the recipe sets extends, the named parent recipe in the same
+// directory is loaded first and the child is merged on top of it.
 func LoadImageConfig(path string) (*ImageConfig, error) {
-	// Check if file exists
-	if _, err := os.Stat(path); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("image config file not found: %s", path)
-		}
-		return nil, fmt.Errorf("cannot access image config file %s: %w", path, err)
-	}
-
 	L := lua.NewState()
 	defer L.Close()
 
-	if err := L.DoFile(path); err != nil {
-		return nil, fmt.Errorf("failed to parse Lua config %s: %w\nHint: Check for syntax errors in the Lua file", path, err)
+	tbl, chain, diags, err := loadRecipe(L, path, "image")
+	if err != nil {
+		return nil, err
 	}
-
-	// The Lua file should return a table
-	ret := L.Get(-1)
-	if ret.Type() != lua.LTTable {
-		return nil, fmt.Errorf("invalid image config %s: must return a Lua table\nExample: return { id = \"my-image\", ... }", path)
+	errs, warnings := splitDiagnostics(diags)
+	if len(errs) > 0 {
+		return nil, diagnosticsError("image", path, errs)
 	}
 
-	tbl := ret.(*lua.LTable)
-
 	cfg := &ImageConfig{
 		ID:              getStringField(tbl, "id"),
 		Version:         getStringField(tbl, "version"),
@@ -68,6 +179,13 @@ func LoadImageConfig(path string) (*ImageConfig, error) {
 		PkgLists:        getStringArrayField(tbl, "pkg_lists"),
 		Overlays:        getStringArrayField(tbl, "overlays"),
 		DatasetOverlays: getDatasetOverlays(tbl, "dataset_overlays"),
+		Datasets:        getDatasets(tbl, "datasets"),
+		System:          getSystemConfig(tbl, "system"),
+		Boot:            getBootConfig(tbl, "boot"),
+		Pkg:             getPkgConfig(tbl, "pkg"),
+		Extends:         chain,
+		Path:            path,
+		Warnings:        warnings,
 	}
 
 	// Validate required fields
@@ -79,36 +197,33 @@ func LoadImageConfig(path string) (*ImageConfig, error) {
 }
 
 // LoadVariantConfig loads a variant configuration from a Lua file.
+// Inheritance via extends works the same way as for images.
 func LoadVariantConfig(path string) (*VariantConfig, error) {
-	// Check if file exists
-	if _, err := os.Stat(path); err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("variant config file not found: %s", path)
-		}
-		return nil, fmt.Errorf("cannot access variant config file %s: %w", path, err)
-	}
-
 	L := lua.NewState()
 	defer L.Close()
 
-	if err := L.DoFile(path); err != nil {
-		return nil, fmt.Errorf("failed to parse Lua config %s: %w\nHint: Check for syntax errors in the Lua file", path, err)
+	tbl, chain, diags, err := loadRecipe(L, path, "variant")
+	if err != nil {
+		return nil, err
 	}
-
-	// The Lua file should return a table
-	ret := L.Get(-1)
-	if ret.Type() != lua.LTTable {
-		return nil, fmt.Errorf("invalid variant config %s: must return a Lua table\nExample: return { id = \"my-variant\", ... }", path)
+	errs, warnings := splitDiagnostics(diags)
+	if len(errs) > 0 {
+		return nil, diagnosticsError("variant", path, errs)
 	}
 
-	tbl := ret.(*lua.LTable)
-
 	cfg := &VariantConfig{
-		ID:        getStringField(tbl, "id"),
-		Name:      getStringField(tbl, "name"),
-		PkgLists:  getStringArrayField(tbl, "pkg_lists"),
-		Overlays:  getStringArrayField(tbl, "overlays"),
-		ImagesDir: getStringField(tbl, "images_dir"),
+		ID:             getStringField(tbl, "id"),
+		Name:           getStringField(tbl, "name"),
+		PkgLists:       getStringArrayField(tbl, "pkg_lists"),
+		Overlays:       getStringArrayField(tbl, "overlays"),
+		ImagesDir:      getStringField(tbl, "images_dir"),
+		EmbeddedImages: getStringArrayField(tbl, "embedded_images"),
+		Boot:           getBootConfig(tbl, "boot"),
+		Pkg:            getPkgConfig(tbl, "pkg"),
+		ISO:            getISOConfig(tbl, "bootenv"),
+		Extends:        chain,
+		Path:           path,
+		Warnings:       warnings,
 	}
 
 	// Validate required fields
@@ -135,7 +250,7 @@ func ListImages(imagesDir string) ([]*ImageConfig, error) {
 	}
 
 	var configs []*ImageConfig
-	var errors []string
+	loadErr := &LoadError{Kind: "image"}
 
 	for _, entry := range entries {
 		if entry.IsDir() || filepath.Ext(entry.Name()) != ".lua" {
@@ -146,14 +261,14 @@ func ListImages(imagesDir string) ([]*ImageConfig, error) {
 		cfg, err := LoadImageConfig(path)
 		if err != nil {
 			// Collect all errors instead of failing on first one
-			errors = append(errors, fmt.Sprintf("  - %s: %v", entry.Name(), err))
+			loadErr.Files = append(loadErr.Files, FileError{Path: path, Err: err})
 			continue
 		}
 		configs = append(configs, cfg)
 	}
 
-	if len(errors) > 0 {
-		return configs, fmt.Errorf("errors loading some image configs:\n%s", joinErrors(errors))
+	if len(loadErr.Files) > 0 {
+		return configs, loadErr
 	}
 
 	return configs, nil
@@ -175,7 +290,7 @@ func ListVariants(variantsDir string) ([]*VariantConfig, error) {
 	}
 
 	var configs []*VariantConfig
-	var errors []string
+	loadErr := &LoadError{Kind: "variant"}
 
 	for _, entry := range entries {
 		if entry.IsDir() || filepath.Ext(entry.Name()) != ".lua" {
@@ -186,14 +301,14 @@ func ListVariants(variantsDir string) ([]*VariantConfig, error) {
 		cfg, err := LoadVariantConfig(path)
 		if err != nil {
 			// Collect all errors instead of failing on first one
-			errors = append(errors, fmt.Sprintf("  - %s: %v", entry.Name(), err))
+			loadErr.Files = append(loadErr.Files, FileError{Path: path, Err: err})
 			continue
 		}
 		configs = append(configs, cfg)
 	}
 
-	if len(errors) > 0 {
-		return configs, fmt.Errorf("errors loading some variant configs:\n%s", joinErrors(errors))
+	if len(loadErr.Files) > 0 {
+		return configs, loadErr
 	}
 
 	return configs, nil
@@ -226,6 +341,177 @@ func getStringArrayField(tbl *lua.LTable, key string) []string {
 	return result
 }
 
+// getIntField extracts an integer value from a Lua table.
+func getIntField(tbl *lua.LTable, key string) int {
+	lv := tbl.RawGetString(key)
+	if n, ok := lv.(lua.LNumber); ok {
+		return int(n)
+	}
+	return 0
+}
+
+// getBootConfig extracts the boot block from a Lua table.
+func getBootConfig(tbl *lua.LTable, key string) BootConfig {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return BootConfig{}
+	}
+	return BootConfig{
+		LoaderConf: getTunablesField(lv.(*lua.LTable), "loader_conf"),
+	}
+}
+
+// getISOConfig extracts the iso block of the bootenv block from a Lua
+// table.
+func getISOConfig(tbl *lua.LTable, key string) ISOConfig {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return ISOConfig{}
+	}
+	lv = lv.(*lua.LTable).RawGetString("iso")
+	if lv.Type() != lua.LTTable {
+		return ISOConfig{}
+	}
+	t := lv.(*lua.LTable)
+
+	ic := ISOConfig{
+		VolumeID:  getStringField(t, "volume_id"),
+		Publisher: getStringField(t, "publisher"),
+		BootMode:  getStringField(t, "boot_mode"),
+	}
+	if b, ok := t.RawGetString("legacy_boot").(lua.LBool); ok {
+		legacy := bool(b)
+		ic.LegacyBoot = &legacy
+	}
+	return ic
+}
+
+// getPkgConfig extracts the pkg block from a Lua table.
+func getPkgConfig(tbl *lua.LTable, key string) PkgConfig {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return PkgConfig{}
+	}
+	t := lv.(*lua.LTable)
+
+	pc := PkgConfig{Mode: getStringField(t, "mode")}
+	if r := t.RawGetString("repositories"); r.Type() == lua.LTTable {
+		r.(*lua.LTable).ForEach(func(_, v lua.LValue) {
+			if v.Type() != lua.LTTable {
+				return
+			}
+			rt := v.(*lua.LTable)
+			pc.Repositories = append(pc.Repositories, Repository{
+				Name:          getStringField(rt, "name"),
+				URL:           getStringField(rt, "url"),
+				MirrorType:    getStringField(rt, "mirror_type"),
+				SignatureType: getStringField(rt, "signature_type"),
+				Fingerprints:  getStringField(rt, "fingerprints"),
+				PubKey:        getStringField(rt, "pubkey"),
+				Priority:      getIntField(rt, "priority"),
+			})
+		})
+	}
+
+	return pc
+}
+
+// getTunablesField extracts a string map from a Lua table. Booleans are
+// converted to "YES"/"NO" and numbers to their decimal form, matching the
+// conventions of loader.conf and rc.conf.
+func getTunablesField(tbl *lua.LTable, key string) map[string]string {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return nil
+	}
+
+	result := map[string]string{}
+	lv.(*lua.LTable).ForEach(func(k, v lua.LValue) {
+		if k.Type() != lua.LTString {
+			return
+		}
+		switch v.Type() {
+		case lua.LTString, lua.LTNumber:
+			result[k.String()] = v.String()
+		case lua.LTBool:
+			if lua.LVAsBool(v) {
+				result[k.String()] = "YES"
+			} else {
+				result[k.String()] = "NO"
+			}
+		}
+	})
+
+	return result
+}
+
+// getSystemConfig extracts the system block from a Lua table.
+func getSystemConfig(tbl *lua.LTable, key string) SystemConfig {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return SystemConfig{}
+	}
+	t := lv.(*lua.LTable)
+
+	sys := SystemConfig{
+		Hostname: getStringField(t, "hostname"),
+		Timezone: getStringField(t, "timezone"),
+		Services: getStringArrayField(t, "services"),
+	}
+
+	if u := t.RawGetString("users"); u.Type() == lua.LTTable {
+		u.(*lua.LTable).ForEach(func(_, v lua.LValue) {
+			if v.Type() != lua.LTTable {
+				return
+			}
+			ut := v.(*lua.LTable)
+			sys.Users = append(sys.Users, UserConfig{
+				Name:         getStringField(ut, "name"),
+				UID:          getIntField(ut, "uid"),
+				Groups:       getStringArrayField(ut, "groups"),
+				Shell:        getStringField(ut, "shell"),
+				Home:         getStringField(ut, "home"),
+				Comment:      getStringField(ut, "comment"),
+				PasswordHash: getStringField(ut, "password_hash"),
+			})
+		})
+	}
+
+	return sys
+}
+
+// getDatasets extracts the datasets list from a Lua table.
+func getDatasets(tbl *lua.LTable, key string) []Dataset {
+	lv := tbl.RawGetString(key)
+	if lv.Type() != lua.LTTable {
+		return nil
+	}
+
+	var result []Dataset
+	lv.(*lua.LTable).ForEach(func(_, v lua.LValue) {
+		if v.Type() != lua.LTTable {
+			return
+		}
+		t := v.(*lua.LTable)
+
+		props := map[string]string{}
+		if p := t.RawGetString("properties"); p.Type() == lua.LTTable {
+			p.(*lua.LTable).ForEach(func(k, v lua.LValue) {
+				props[k.String()] = v.String()
+			})
+		}
+
+		result = append(result, Dataset{
+			Name:       getStringField(t, "name"),
+			Mountpoint: getStringField(t, "mountpoint"),
+			CanMount:   getStringField(t, "canmount"),
+			Properties: props,
+		})
+	})
+
+	return result
+}
+
 // getDatasetOverlays extracts dataset_overlays from Lua table
 func getDatasetOverlays(tbl *lua.LTable, key string) []DatasetOverlay {
 	lv := tbl.RawGetString(key)
@@ -289,6 +575,204 @@ func validateImageConfig(cfg *ImageConfig, path string) error {
 		return fmt.Errorf("image config %s: id too long (max 64 characters)", path)
 	}
 
+	if err := validateSystemConfig(&cfg.System); err != nil {
+		return fmt.Errorf("image config %s: %w", path, err)
+	}
+	if err := validateBootConfig(&cfg.Boot); err != nil {
+		return fmt.Errorf("image config %s: %w", path, err)
+	}
+	if err := validatePkgConfig(&cfg.Pkg); err != nil {
+		return fmt.Errorf("image config %s: %w", path, err)
+	}
+	if err := validateDatasets(cfg); err != nil {
+		return fmt.Errorf("image config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// validateDatasets validates the datasets list of an image configuration
+func validateDatasets(cfg *ImageConfig) error {
+	if !strings.HasPrefix(cfg.RootDS, cfg.ZpoolName+"/") {
+		return fmt.Errorf("root_dataset %q must be inside pool %q", cfg.RootDS, cfg.ZpoolName)
+	}
+
+	seen := make(map[string]bool)
+	for i, ds := range cfg.Datasets {
+		if ds.Name == "" {
+			return fmt.Errorf("datasets[%d] missing required field: name", i+1)
+		}
+		if !strings.HasPrefix(ds.Name, cfg.ZpoolName+"/") {
+			return fmt.Errorf("datasets[%d]: %q must be inside pool %q", i+1, ds.Name, cfg.ZpoolName)
+		}
+		if strings.Contains(ds.Name, "//") || strings.HasSuffix(ds.Name, "/") || strings.ContainsAny(ds.Name, " @#") {
+			return fmt.Errorf("datasets[%d]: %q is not a valid dataset name", i+1, ds.Name)
+		}
+		if seen[ds.Name] {
+			return fmt.Errorf("datasets: duplicate dataset %q", ds.Name)
+		}
+		seen[ds.Name] = true
+
+		switch ds.CanMount {
+		case "", "on", "off", "noauto":
+		default:
+			return fmt.Errorf("datasets[%d]: canmount must be on, off or noauto (got %q)", i+1, ds.CanMount)
+		}
+		if ds.Mountpoint != "" && ds.Mountpoint != "none" && ds.Mountpoint != "legacy" && !strings.HasPrefix(ds.Mountpoint, "/") {
+			return fmt.Errorf("datasets[%d]: mountpoint must be absolute, none or legacy (got %q)", i+1, ds.Mountpoint)
+		}
+	}
+
+	return nil
+}
+
+// validateBootConfig validates the boot block of a recipe
+func validateBootConfig(boot *BootConfig) error {
+	for k, v := range boot.LoaderConf {
+		if !tunablePattern.MatchString(k) {
+			return fmt.Errorf("boot.loader_conf: %q is not a valid tunable name", k)
+		}
+		if strings.ContainsAny(v, "\"\n") {
+			return fmt.Errorf("boot.loader_conf[%q]: value must not contain quotes or newlines", k)
+		}
+	}
+	return nil
+}
+
+// validatePkgConfig validates the pkg block of a recipe
+func validatePkgConfig(pc *PkgConfig) error {
+	switch pc.Mode {
+	case "", "rootdir", "chroot":
+	default:
+		return fmt.Errorf("pkg.mode must be rootdir or chroot (got %q)", pc.Mode)
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range pc.Repositories {
+		if r.Name == "" || r.URL == "" {
+			return fmt.Errorf("pkg.repositories[%d] missing required fields: name, url", i+1)
+		}
+		if !repoNamePattern.MatchString(r.Name) {
+			return fmt.Errorf("pkg.repositories[%d]: %q is not a valid repository name", i+1, r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("pkg.repositories: duplicate repository %q", r.Name)
+		}
+		seen[r.Name] = true
+
+		scheme, _, _ := strings.Cut(r.URL, "://")
+		switch scheme {
+		case "pkg+https", "pkg+http", "https", "http", "file":
+		default:
+			return fmt.Errorf("pkg.repositories[%d]: unsupported url %q (expected http(s)://, pkg+http(s):// or file://)", i+1, r.URL)
+		}
+		if scheme == "file" && pc.Mode == "chroot" {
+			return fmt.Errorf("pkg.repositories[%d]: file:// repositories require pkg.mode = \"rootdir\"", i+1)
+		}
+		if strings.ContainsAny(r.URL, "\"\n") {
+			return fmt.Errorf("pkg.repositories[%d]: url must not contain quotes or newlines", i+1)
+		}
+
+		switch r.MirrorType {
+		case "", "srv", "http", "none":
+		default:
+			return fmt.Errorf("pkg.repositories[%d]: mirror_type must be srv, http or none (got %q)", i+1, r.MirrorType)
+		}
+		switch r.SignatureType {
+		case "", "none":
+		case "fingerprints":
+			if r.Fingerprints == "" {
+				return fmt.Errorf("pkg.repositories[%d]: signature_type fingerprints requires fingerprints", i+1)
+			}
+		case "pubkey":
+			if r.PubKey == "" {
+				return fmt.Errorf("pkg.repositories[%d]: signature_type pubkey requires pubkey", i+1)
+			}
+		default:
+			return fmt.Errorf("pkg.repositories[%d]: signature_type must be none, fingerprints or pubkey (got %q)", i+1, r.SignatureType)
+		}
+		if strings.ContainsAny(r.Fingerprints+r.PubKey, "\"\n") {
+			return fmt.Errorf("pkg.repositories[%d]: paths must not contain quotes or newlines", i+1)
+		}
+	}
+
+	return nil
+}
+
+// validateISOConfig validates the bootenv.iso block of a variant
+func validateISOConfig(ic *ISOConfig) error {
+	if ic.VolumeID != "" {
+		if err := iso9660.ValidVolumeID(ic.VolumeID); err != nil {
+			return fmt.Errorf("bootenv.iso.volume_id: %w", err)
+		}
+	}
+	if len(ic.Publisher) > 128 {
+		return fmt.Errorf("bootenv.iso.publisher is longer than 128 characters")
+	}
+	for _, r := range ic.Publisher {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("bootenv.iso.publisher %q may only contain printable ASCII", ic.Publisher)
+		}
+	}
+
+	switch ic.BootMode {
+	case "", "hybrid", "uefi", "bios":
+	default:
+		return fmt.Errorf("bootenv.iso.boot_mode must be hybrid, uefi or bios (got %q)", ic.BootMode)
+	}
+	if ic.LegacyBoot != nil && !*ic.LegacyBoot && ic.BootMode != "uefi" {
+		return fmt.Errorf("bootenv.iso.legacy_boot = false requires boot_mode = \"uefi\"")
+	}
+	return nil
+}
+
+// validateSystemConfig validates the system block of an image configuration
+func validateSystemConfig(sys *SystemConfig) error {
+	if sys.Hostname != "" && !hostnamePattern.MatchString(sys.Hostname) {
+		return fmt.Errorf("system.hostname %q is not a valid hostname", sys.Hostname)
+	}
+	if sys.Timezone != "" {
+		if strings.HasPrefix(sys.Timezone, "/") || strings.Contains(sys.Timezone, "..") {
+			return fmt.Errorf("system.timezone %q must be a zoneinfo name such as \"Europe/Berlin\"", sys.Timezone)
+		}
+	}
+	for _, svc := range sys.Services {
+		if !namePattern.MatchString(svc) {
+			return fmt.Errorf("system.services: %q is not a valid rc.d service name", svc)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, u := range sys.Users {
+		if u.Name == "" {
+			return fmt.Errorf("system.users[%d] missing required field: name", i+1)
+		}
+		if !userPattern.MatchString(u.Name) || len(u.Name) > 32 {
+			return fmt.Errorf("system.users[%d]: %q is not a valid user name", i+1, u.Name)
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("system.users: duplicate user %q", u.Name)
+		}
+		seen[u.Name] = true
+		if u.UID < 0 || u.UID > 65533 {
+			return fmt.Errorf("system.users[%d]: uid %d out of range", i+1, u.UID)
+		}
+		for _, g := range u.Groups {
+			if !userPattern.MatchString(g) {
+				return fmt.Errorf("system.users[%d]: %q is not a valid group name", i+1, g)
+			}
+		}
+		if strings.ContainsAny(u.Comment, ":\n") || strings.ContainsAny(u.Home, ":\n") ||
+			strings.ContainsAny(u.Shell, ":\n") || strings.ContainsAny(u.PasswordHash, ":\n") {
+			return fmt.Errorf("system.users[%d]: fields must not contain ':' or newlines", i+1)
+		}
+		// The home directory is created and chowned below the image root,
+		// so it must not be able to point anywhere else
+		if u.Home != "" && (!path.IsAbs(u.Home) || path.Clean(u.Home) != u.Home || u.Home == "/") {
+			return fmt.Errorf("system.users[%d]: home %q must be a clean absolute path such as \"/home/%s\"", i+1, u.Home, u.Name)
+		}
+	}
+
 	return nil
 }
 
@@ -313,9 +797,40 @@ func validateVariantConfig(cfg *VariantConfig, path string) error {
 		return fmt.Errorf("variant config %s: id too long (max 64 characters)", path)
 	}
 
+	if err := validateBootConfig(&cfg.Boot); err != nil {
+		return fmt.Errorf("variant config %s: %w", path, err)
+	}
+	if err := validatePkgConfig(&cfg.Pkg); err != nil {
+		return fmt.Errorf("variant config %s: %w", path, err)
+	}
+	if err := validateISOConfig(&cfg.ISO); err != nil {
+		return fmt.Errorf("variant config %s: %w", path, err)
+	}
+
 	return nil
 }
 
+// FileError is a recipe file that failed to load.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+// LoadError is returned by ListImages and ListVariants when some recipe
+// files fail to load. The configs that did load are still returned.
+type LoadError struct {
+	Kind  string // "image" or "variant"
+	Files []FileError
+}
+
+func (e *LoadError) Error() string {
+	var errors []string
+	for _, f := range e.Files {
+		errors = append(errors, fmt.Sprintf("  - %s: %v", filepath.Base(f.Path), f.Err))
+	}
+	return fmt.Sprintf("errors loading some %s configs:\n%s", e.Kind, joinErrors(errors))
+}
+
 // joinErrors joins error messages with newlines
 func joinErrors(errors []string) string {
 	result := ""
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// A user's home must stay below the image root it is created in.
+func TestValidateUserHome(t *testing.T) {
+	for _, tt := range []struct {
+		home string
+		ok   bool
+	}{
+		{"", true},
+		{"/home/alice", true},
+		{"/usr/home/alice", true},
+		{"/", false},
+		{"home/alice", false},
+		{"../../../../tmp/x", false},
+		{"/home/../../tmp/x", false},
+		{"/home/alice/", false},
+		{"/home//alice", false},
+		{"/home/./alice", false},
+	} {
+		sys := &SystemConfig{Users: []UserConfig{{Name: "alice", Home: tt.home}}}
+		err := validateSystemConfig(sys)
+		if tt.ok && err != nil {
+			t.Errorf("home %q: %v", tt.home, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), "must be a clean absolute path")) {
+			t.Errorf("home %q: got %v", tt.home, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Severity classifies a Diagnostic.
+type Severity int
+
+const (
+	// SeverityWarning marks a problem that does not stop the build, such as
+	// an unknown field. Strict mode treats warnings as errors.
+	SeverityWarning Severity = iota
+	// SeverityError marks a problem that makes the recipe unusable, such as
+	// a field of the wrong type.
+	SeverityError
+)
+
+// String returns "warning" or "error".
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found while checking a recipe against its schema.
+type Diagnostic struct {
+	Severity Severity
+	File     string // recipe file the field was read from
+	Line     int    // source line of the field, 0 if unknown
+	Field    string // dotted field path, e.g. "system.users[1].uid"
+	Message  string
+}
+
+// String formats the diagnostic as file:line: field: message.
+func (d Diagnostic) String() string {
+	loc := d.File
+	if d.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", d.File, d.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", loc, d.Field, d.Message)
+}
+
+// splitDiagnostics separates errors from warnings.
+func splitDiagnostics(diags []Diagnostic) (errs, warnings []Diagnostic) {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			errs = append(errs, d)
+		} else {
+			warnings = append(warnings, d)
+		}
+	}
+	return errs, warnings
+}
+
+// diagnosticsError formats schema errors for a recipe as a single error.
+func diagnosticsError(kind, path string, errs []Diagnostic) error {
+	var sb strings.Builder
+	for _, d := range errs {
+		sb.WriteString("\n    ")
+		sb.WriteString(d.String())
+	}
+	return fmt.Errorf("%s config %s: invalid fields:%s", kind, path, sb.String())
+}
+
+// fieldLines maps the field paths of the table returned by a recipe file to
+// the line they appear on. Recipes that build their table dynamically yield
+// a partial (or empty) map; positions are a convenience, not a requirement.
+func fieldLines(path string) map[string]int {
+	lines := make(map[string]int)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return lines
+	}
+
+	// Top-level locals let "local r = { ... } return r" resolve too
+	locals := make(map[string]ast.Expr)
+	for _, stmt := range chunk {
+		switch s := stmt.(type) {
+		case *ast.LocalAssignStmt:
+			for i, name := range s.Names {
+				if i < len(s.Exprs) {
+					locals[name] = s.Exprs[i]
+				}
+			}
+		case *ast.ReturnStmt:
+			if len(s.Exprs) == 0 {
+				continue
+			}
+			expr := s.Exprs[0]
+			if ident, ok := expr.(*ast.IdentExpr); ok {
+				expr = locals[ident.Value]
+			}
+			if tbl, ok := expr.(*ast.TableExpr); ok {
+				collectFieldLines(lines, "", tbl)
+			}
+		}
+	}
+	return lines
+}
+
+// collectFieldLines records the line of every field in tbl, recursing into
+// nested table constructors.
+func collectFieldLines(lines map[string]int, prefix string, tbl *ast.TableExpr) {
+	index := 0
+	for _, field := range tbl.Fields {
+		var path string
+		switch key := field.Key.(type) {
+		case nil:
+			index++
+			path = fmt.Sprintf("%s[%d]", prefix, index)
+		case *ast.StringExpr:
+			path = joinPath(prefix, key.Value)
+		default:
+			continue
+		}
+
+		lines[path] = field.Value.Line()
+		if nested, ok := field.Value.(*ast.TableExpr); ok {
+			collectFieldLines(lines, path, nested)
+		}
+	}
+}
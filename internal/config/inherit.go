@@ -0,0 +1,278 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxExtendsDepth bounds the length of a recipe inheritance chain.
+const maxExtendsDepth = 16
+
+// List merge directive keys. A child recipe may replace a list field with a
+// table made only of these keys to modify the inherited list instead of
+// overriding it:
+//
+//	pkg_lists = { append = { "dev/tools" }, remove = { "desktop/apps" } }
+//	overlays  = { replace = { "common" } }
+const (
+	directiveAppend  = "append"
+	directiveRemove  = "remove"
+	directiveReplace = "replace"
+)
+
+// loadRecipe evaluates a recipe file and resolves its extends chain.
+// Parents are looked up as <name>.lua in the same directory as path.
+// It returns the fully merged table, the names of all ancestors (root
+// ancestor first) and the schema diagnostics of every file in the chain.
+func loadRecipe(L *lua.LState, path, kind string) (*lua.LTable, []string, []Diagnostic, error) {
+	return loadRecipeChain(L, path, kind, nil)
+}
+
+// loadRecipeChain is the recursive worker for loadRecipe. visiting holds the
+// recipe names currently being resolved, used for cycle detection.
+func loadRecipeChain(L *lua.LState, path, kind string, visiting []string) (*lua.LTable, []string, []Diagnostic, error) {
+	name := strings.TrimSuffix(filepath.Base(path), ".lua")
+	for _, v := range visiting {
+		if v == name {
+			return nil, nil, nil, fmt.Errorf("%s config %s: extends cycle detected: %s -> %s",
+				kind, path, strings.Join(visiting, " -> "), name)
+		}
+	}
+	if len(visiting) >= maxExtendsDepth {
+		return nil, nil, nil, fmt.Errorf("%s config %s: extends chain too deep (max %d levels)", kind, path, maxExtendsDepth)
+	}
+	visiting = append(visiting, name)
+
+	tbl, err := evalRecipe(L, path, kind)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Each file is checked on its own so diagnostics point at the file and
+	// line that introduced the field
+	diags := checkSchema(path, tbl, recipeSchema(kind), fieldLines(path))
+
+	ext := tbl.RawGetString("extends")
+	if ext == lua.LNil {
+		return mergeRecipe(L, L.NewTable(), tbl), nil, diags, nil
+	}
+	if ext.Type() != lua.LTString || ext.String() == "" {
+		return nil, nil, nil, fmt.Errorf("%s config %s: extends must be a non-empty string naming a %s in the same directory", kind, path, kind)
+	}
+
+	// Only names are accepted, so a recipe cannot inherit from a file
+	// outside its directory
+	if strings.ContainsAny(ext.String(), `/\`) || strings.Contains(ext.String(), "..") {
+		return nil, nil, nil, fmt.Errorf("%s config %s: extends %q must name a %s in the same directory, not a path", kind, path, ext.String(), kind)
+	}
+
+	parentName := strings.TrimSuffix(ext.String(), ".lua")
+	parentPath := filepath.Join(filepath.Dir(path), parentName+".lua")
+	if _, err := os.Stat(parentPath); os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("%s config %s: extends %q but %s does not exist", kind, path, parentName, parentPath)
+	}
+	parent, chain, parentDiags, err := loadRecipeChain(L, parentPath, kind, visiting)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return mergeRecipe(L, parent, tbl), append(chain, parentName), append(parentDiags, diags...), nil
+}
+
+// evalRecipe runs a single recipe file and returns the table it yields.
+func evalRecipe(L *lua.LState, path, kind string) (*lua.LTable, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s config file not found: %s", kind, path)
+		}
+		return nil, fmt.Errorf("cannot access %s config file %s: %w", kind, path, err)
+	}
+
+	top := L.GetTop()
+	if err := L.DoFile(path); err != nil {
+		return nil, fmt.Errorf("failed to parse Lua config %s: %w\nHint: Check for syntax errors in the Lua file", path, err)
+	}
+	defer L.SetTop(top)
+
+	// The Lua file should return a table
+	ret := L.Get(-1)
+	if ret.Type() != lua.LTTable {
+		return nil, fmt.Errorf("invalid %s config %s: must return a Lua table\nExample: return { id = \"my-%s\", ... }", kind, path, kind)
+	}
+
+	return ret.(*lua.LTable), nil
+}
+
+// mergeRecipe overlays child on top of parent and returns a new table.
+// The parent's id is never inherited and the extends key is dropped.
+//
+// Merge rules:
+//   - scalars in the child replace the parent value
+//   - maps are merged key by key, recursively
+//   - a plain list in the child replaces the parent list
+//   - a directive table (append/remove/replace) edits the parent list
+func mergeRecipe(L *lua.LState, parent, child *lua.LTable) *lua.LTable {
+	out := L.NewTable()
+	parent.ForEach(func(k, v lua.LValue) {
+		if k.Type() == lua.LTString && (k.String() == "id" || k.String() == "extends") {
+			return
+		}
+		out.RawSet(k, v)
+	})
+	child.ForEach(func(k, v lua.LValue) {
+		if k.Type() == lua.LTString && k.String() == "extends" {
+			return
+		}
+		out.RawSet(k, mergeValue(L, out.RawGet(k), v))
+	})
+	return out
+}
+
+// mergeValue merges a single child value over the inherited base value.
+func mergeValue(L *lua.LState, base, override lua.LValue) lua.LValue {
+	ot, ok := override.(*lua.LTable)
+	if !ok {
+		return override
+	}
+
+	if isListDirective(ot) {
+		return applyListDirective(L, base, ot)
+	}
+
+	bt, ok := base.(*lua.LTable)
+	if !ok || isArray(ot) || isArray(bt) {
+		return resolveDirectives(L, ot)
+	}
+
+	merged := L.NewTable()
+	bt.ForEach(func(k, v lua.LValue) {
+		merged.RawSet(k, v)
+	})
+	ot.ForEach(func(k, v lua.LValue) {
+		merged.RawSet(k, mergeValue(L, merged.RawGet(k), v))
+	})
+	return merged
+}
+
+// resolveDirectives applies any nested list directives in tbl against an
+// empty base, so recipes without a parent may use the same syntax.
+func resolveDirectives(L *lua.LState, tbl *lua.LTable) lua.LValue {
+	if isArray(tbl) {
+		return tbl
+	}
+	out := L.NewTable()
+	tbl.ForEach(func(k, v lua.LValue) {
+		out.RawSet(k, mergeValue(L, lua.LNil, v))
+	})
+	return out
+}
+
+// applyListDirective edits the base list according to the directive table.
+// replace is applied first, then remove, then append (skipping entries that
+// are already present).
+func applyListDirective(L *lua.LState, base lua.LValue, directive *lua.LTable) lua.LValue {
+	var items []lua.LValue
+	if r, ok := directive.RawGetString(directiveReplace).(*lua.LTable); ok {
+		items = listValues(r)
+	} else if bt, ok := base.(*lua.LTable); ok {
+		items = listValues(bt)
+	}
+
+	if r, ok := directive.RawGetString(directiveRemove).(*lua.LTable); ok {
+		remove := listValues(r)
+		kept := items[:0:0]
+		for _, item := range items {
+			if !containsEntry(remove, item) {
+				kept = append(kept, item)
+			}
+		}
+		items = kept
+	}
+
+	if a, ok := directive.RawGetString(directiveAppend).(*lua.LTable); ok {
+		for _, item := range listValues(a) {
+			if !containsEntry(items, item) {
+				items = append(items, item)
+			}
+		}
+	}
+
+	out := L.NewTable()
+	for _, item := range items {
+		out.Append(item)
+	}
+	return out
+}
+
+// isListDirective reports whether tbl consists solely of list directive keys.
+func isListDirective(tbl *lua.LTable) bool {
+	found := false
+	onlyDirectives := true
+	tbl.ForEach(func(k, _ lua.LValue) {
+		if k.Type() != lua.LTString {
+			onlyDirectives = false
+			return
+		}
+		switch k.String() {
+		case directiveAppend, directiveRemove, directiveReplace:
+			found = true
+		default:
+			onlyDirectives = false
+		}
+	})
+	return found && onlyDirectives
+}
+
+// isArray reports whether tbl only has integer keys (an empty table counts).
+func isArray(tbl *lua.LTable) bool {
+	array := true
+	tbl.ForEach(func(k, _ lua.LValue) {
+		if k.Type() != lua.LTNumber {
+			array = false
+		}
+	})
+	return array
+}
+
+// listValues returns the array part of tbl in order.
+func listValues(tbl *lua.LTable) []lua.LValue {
+	var values []lua.LValue
+	tbl.ForEach(func(k, v lua.LValue) {
+		if k.Type() == lua.LTNumber {
+			values = append(values, v)
+		}
+	})
+	return values
+}
+
+// containsEntry reports whether list holds an entry matching v. Strings match
+// by value; tables match by their name field (e.g. datasets, users).
+func containsEntry(list []lua.LValue, v lua.LValue) bool {
+	key := entryKey(v)
+	if key == "" {
+		return false
+	}
+	for _, item := range list {
+		if entryKey(item) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// entryKey returns the identity used to compare list entries.
+func entryKey(v lua.LValue) string {
+	switch t := v.(type) {
+	case lua.LString:
+		return string(t)
+	case *lua.LTable:
+		if name := t.RawGetString("name"); name.Type() == lua.LTString {
+			return name.String()
+		}
+	}
+	return ""
+}
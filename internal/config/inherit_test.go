@@ -0,0 +1,238 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRecipes writes each recipe body to dir/<name>.lua.
+func writeRecipes(t *testing.T, recipes map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range recipes {
+		if err := os.WriteFile(filepath.Join(dir, name+".lua"), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const baseRecipe = `return {
+  id = "base",
+  version = "1.0",
+  zpool_name = "pgsd",
+  root_dataset = "pgsd/ROOT/default",
+  pkg_lists = { "base", "desktop/apps", "desktop/fonts" },
+  overlays = { "common", "desktop" },
+  datasets = {
+    { name = "pgsd/home", mountpoint = "/home" },
+    { name = "pgsd/var", mountpoint = "/var" },
+  },
+  system = { hostname = "pgsd", services = { "sshd" } },
+}
+`
+
+// A child recipe replaces scalars and plain lists, merges maps and edits
+// inherited lists with append, remove and replace.
+func TestExtends(t *testing.T) {
+	tests := []struct {
+		name     string
+		child    string
+		pkgLists []string
+		overlays []string
+		datasets []string
+		hostname string
+		services []string
+	}{
+		{
+			name:     "inherit",
+			child:    `return { extends = "base", id = "child" }`,
+			pkgLists: []string{"base", "desktop/apps", "desktop/fonts"},
+			overlays: []string{"common", "desktop"},
+			datasets: []string{"pgsd/home", "pgsd/var"},
+			hostname: "pgsd",
+			services: []string{"sshd"},
+		},
+		{
+			name: "append and remove",
+			child: `return { extends = "base", id = "child",
+  pkg_lists = { append = { "dev/tools", "base" }, remove = { "desktop/apps" } } }`,
+			pkgLists: []string{"base", "desktop/fonts", "dev/tools"},
+			overlays: []string{"common", "desktop"},
+			datasets: []string{"pgsd/home", "pgsd/var"},
+			hostname: "pgsd",
+			services: []string{"sshd"},
+		},
+		{
+			name: "replace then append",
+			child: `return { extends = "base", id = "child",
+  overlays = { replace = { "server" }, append = { "ssh" } } }`,
+			pkgLists: []string{"base", "desktop/apps", "desktop/fonts"},
+			overlays: []string{"server", "ssh"},
+			datasets: []string{"pgsd/home", "pgsd/var"},
+			hostname: "pgsd",
+			services: []string{"sshd"},
+		},
+		{
+			name: "plain list and map",
+			child: `return { extends = "base.lua", id = "child",
+  pkg_lists = { "minimal" },
+  system = { hostname = "server", services = { append = { "ntpd" } } } }`,
+			pkgLists: []string{"minimal"},
+			overlays: []string{"common", "desktop"},
+			datasets: []string{"pgsd/home", "pgsd/var"},
+			hostname: "server",
+			services: []string{"sshd", "ntpd"},
+		},
+		{
+			// Table entries are matched by name
+			name: "remove dataset",
+			child: `return { extends = "base", id = "child",
+  datasets = { remove = { { name = "pgsd/var" } } } }`,
+			pkgLists: []string{"base", "desktop/apps", "desktop/fonts"},
+			overlays: []string{"common", "desktop"},
+			datasets: []string{"pgsd/home"},
+			hostname: "pgsd",
+			services: []string{"sshd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRecipes(t, map[string]string{"base": baseRecipe, "child": tt.child})
+			cfg, err := LoadImageConfig(filepath.Join(dir, "child.lua"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var datasets []string
+			for _, d := range cfg.Datasets {
+				datasets = append(datasets, d.Name)
+			}
+			for _, c := range []struct {
+				field     string
+				got, want any
+			}{
+				{"extends", cfg.Extends, []string{"base"}},
+				{"pkg_lists", cfg.PkgLists, tt.pkgLists},
+				{"overlays", cfg.Overlays, tt.overlays},
+				{"datasets", datasets, tt.datasets},
+				{"hostname", cfg.System.Hostname, tt.hostname},
+				{"services", cfg.System.Services, tt.services},
+				{"version", cfg.Version, "1.0"},
+			} {
+				if !reflect.DeepEqual(c.got, c.want) {
+					t.Errorf("%s = %v, want %v", c.field, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// The id is never inherited, and ancestors are listed root first.
+func TestExtendsChain(t *testing.T) {
+	dir := writeRecipes(t, map[string]string{
+		"base":   baseRecipe,
+		"middle": `return { extends = "base", id = "middle", version = "2.0" }`,
+		"child":  `return { extends = "middle" }`,
+	})
+	_, err := LoadImageConfig(filepath.Join(dir, "child.lua"))
+	if err == nil || !strings.Contains(err.Error(), "missing required fields: [id]") {
+		t.Fatalf("err = %v, want the id to be missing", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "child.lua"), []byte(`return { extends = "middle", id = "child" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadImageConfig(filepath.Join(dir, "child.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"base", "middle"}; !reflect.DeepEqual(cfg.Extends, want) {
+		t.Errorf("extends = %v, want %v", cfg.Extends, want)
+	}
+	if cfg.ID != "child" || cfg.Version != "2.0" {
+		t.Errorf("id, version = %q, %q", cfg.ID, cfg.Version)
+	}
+}
+
+// Broken extends chains are reported with the recipe that caused them.
+func TestExtendsErrors(t *testing.T) {
+	// a0 extends a1, ..., each one level deeper than the last
+	deep := map[string]string{}
+	for i := 0; i <= maxExtendsDepth; i++ {
+		deep[fmt.Sprintf("a%d", i)] = fmt.Sprintf(`return { extends = "a%d", id = "a%d" }`, i+1, i)
+	}
+	deep[fmt.Sprintf("a%d", maxExtendsDepth+1)] = baseRecipe
+
+	tests := []struct {
+		name    string
+		recipes map[string]string
+		err     string
+	}{
+		{
+			name: "cycle",
+			recipes: map[string]string{
+				"child": `return { extends = "a", id = "child" }`,
+				"a":     `return { extends = "b" }`,
+				"b":     `return { extends = "a" }`,
+			},
+			err: "extends cycle detected: child -> a -> b -> a",
+		},
+		{
+			name:    "self",
+			recipes: map[string]string{"child": `return { extends = "child", id = "child" }`},
+			err:     "extends cycle detected: child -> child",
+		},
+		{
+			name:    "too deep",
+			recipes: deep,
+			err:     fmt.Sprintf("extends chain too deep (max %d levels)", maxExtendsDepth),
+		},
+		{
+			name:    "missing parent",
+			recipes: map[string]string{"child": `return { extends = "nothing", id = "child" }`},
+			err:     `extends "nothing" but`,
+		},
+		{
+			name:    "not a string",
+			recipes: map[string]string{"child": `return { extends = { "base" }, id = "child" }`},
+			err:     "extends must be a non-empty string",
+		},
+		{name: "parent directory", recipes: map[string]string{"child": `return { extends = "../base", id = "child" }`}, err: "not a path"},
+		{name: "subdirectory", recipes: map[string]string{"child": `return { extends = "sub/base", id = "child" }`}, err: "not a path"},
+		{name: "backslash", recipes: map[string]string{"child": `return { extends = "sub\\base", id = "child" }`}, err: "not a path"},
+		{name: "dots", recipes: map[string]string{"child": `return { extends = "..", id = "child" }`}, err: "not a path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRecipes(t, tt.recipes)
+			start := "child"
+			if _, ok := tt.recipes[start]; !ok {
+				start = "a0"
+			}
+			_, err := LoadImageConfig(filepath.Join(dir, start+".lua"))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	// A parent outside the directory is refused even when it exists
+	outer := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outer, "base.lua"), []byte(baseRecipe), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(outer, "images")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "child.lua"), []byte(`return { extends = "../base", id = "child" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadImageConfig(filepath.Join(sub, "child.lua")); err == nil {
+		t.Error("recipe inherited from a parent directory")
+	}
+}
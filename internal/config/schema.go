@@ -0,0 +1,414 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fieldType is the expected Lua type of a recipe field.
+type fieldType int
+
+const (
+	typeString     fieldType = iota // a string
+	typeInt                         // an integral number
+	typeBool                        // true or false
+	typeStringList                  // a list of strings
+	typeRecord                      // a table with the keys described by Fields
+	typeRecordList                  // a list of records described by Fields
+	typeScalarMap                   // a table of string keys to strings, numbers or booleans
+)
+
+// fieldSpec describes one field of a recipe table.
+type fieldSpec struct {
+	Type   fieldType
+	Fields schema // keys of a record or of each record in a list
+}
+
+// schema maps the keys of a recipe table to their specs.
+type schema map[string]fieldSpec
+
+// bootSchema is shared by image and variant recipes.
+var bootSchema = schema{
+	"loader_conf": {Type: typeScalarMap},
+}
+
+// pkgSchema is shared by image and variant recipes.
+var pkgSchema = schema{
+	"mode": {Type: typeString},
+	"repositories": {Type: typeRecordList, Fields: schema{
+		"name":           {Type: typeString},
+		"url":            {Type: typeString},
+		"mirror_type":    {Type: typeString},
+		"signature_type": {Type: typeString},
+		"fingerprints":   {Type: typeString},
+		"pubkey":         {Type: typeString},
+		"priority":       {Type: typeInt},
+	}},
+}
+
+// imageSchema describes the fields understood in image recipes.
+var imageSchema = schema{
+	"id":           {Type: typeString},
+	"version":      {Type: typeString},
+	"extends":      {Type: typeString},
+	"zpool_name":   {Type: typeString},
+	"root_dataset": {Type: typeString},
+	"pkg_lists":    {Type: typeStringList},
+	"overlays":     {Type: typeStringList},
+	"dataset_overlays": {Type: typeRecordList, Fields: schema{
+		"name":       {Type: typeString},
+		"source":     {Type: typeString},
+		"mountpoint": {Type: typeString},
+		"canmount":   {Type: typeString},
+		"properties": {Type: typeScalarMap},
+	}},
+	"datasets": {Type: typeRecordList, Fields: schema{
+		"name":       {Type: typeString},
+		"mountpoint": {Type: typeString},
+		"canmount":   {Type: typeString},
+		"properties": {Type: typeScalarMap},
+	}},
+	"system": {Type: typeRecord, Fields: schema{
+		"hostname": {Type: typeString},
+		"timezone": {Type: typeString},
+		"services": {Type: typeStringList},
+		"users": {Type: typeRecordList, Fields: schema{
+			"name":          {Type: typeString},
+			"uid":           {Type: typeInt},
+			"groups":        {Type: typeStringList},
+			"shell":         {Type: typeString},
+			"home":          {Type: typeString},
+			"comment":       {Type: typeString},
+			"password_hash": {Type: typeString},
+		}},
+	}},
+	"boot": {Type: typeRecord, Fields: bootSchema},
+	"pkg":  {Type: typeRecord, Fields: pkgSchema},
+}
+
+// variantSchema describes the fields understood in variant recipes. Apart
+// from bootenv.iso, the bootenv, system_requirements and build blocks are
+// metadata for now but are still checked so typos are caught early.
+var variantSchema = schema{
+	"id":              {Type: typeString},
+	"name":            {Type: typeString},
+	"version":         {Type: typeString},
+	"extends":         {Type: typeString},
+	"pkg_lists":       {Type: typeStringList},
+	"overlays":        {Type: typeStringList},
+	"images_dir":      {Type: typeString},
+	"embedded_images": {Type: typeStringList},
+	"boot":            {Type: typeRecord, Fields: bootSchema},
+	"pkg":             {Type: typeRecord, Fields: pkgSchema},
+	"bootenv": {Type: typeRecord, Fields: schema{
+		"live_user": {Type: typeRecord, Fields: schema{
+			"username":   {Type: typeString},
+			"password":   {Type: typeString},
+			"shell":      {Type: typeString},
+			"groups":     {Type: typeStringList},
+			"auto_login": {Type: typeBool},
+		}},
+		"iso": {Type: typeRecord, Fields: schema{
+			"volume_id":   {Type: typeString},
+			"publisher":   {Type: typeString},
+			"boot_mode":   {Type: typeString},
+			"legacy_boot": {Type: typeBool},
+		}},
+		"services": {Type: typeStringList},
+		"arcan_target": {Type: typeRecord, Fields: schema{
+			"name":        {Type: typeString},
+			"type":        {Type: typeString},
+			"path":        {Type: typeString},
+			"icon":        {Type: typeString},
+			"description": {Type: typeString},
+			"categories":  {Type: typeStringList},
+		}},
+	}},
+	"system_requirements": {Type: typeRecord, Fields: schema{
+		"ram_min":         {Type: typeString},
+		"ram_recommended": {Type: typeString},
+		"disk_space":      {Type: typeString},
+	}},
+	"build": {Type: typeRecord, Fields: schema{
+		"iso_size":          {Type: typeString},
+		"compression":       {Type: typeString},
+		"compression_level": {Type: typeInt},
+		"include_sources":   {Type: typeBool},
+	}},
+}
+
+// recipeSchema returns the schema for a recipe kind ("image" or "variant").
+func recipeSchema(kind string) schema {
+	if kind == "variant" {
+		return variantSchema
+	}
+	return imageSchema
+}
+
+// String describes the type for use in diagnostics.
+func (t fieldType) String() string {
+	switch t {
+	case typeString:
+		return "a string"
+	case typeInt:
+		return "an integer"
+	case typeBool:
+		return "a boolean"
+	case typeStringList:
+		return "a list of strings"
+	case typeRecord:
+		return "a table"
+	case typeRecordList:
+		return "a list of tables"
+	case typeScalarMap:
+		return "a table of key = value pairs"
+	}
+	return "unknown"
+}
+
+// schemaChecker walks a recipe table and records diagnostics.
+type schemaChecker struct {
+	file  string
+	lines map[string]int
+	diags []Diagnostic
+}
+
+// checkSchema validates a single recipe table (before inheritance is applied)
+// against s. lines maps field paths to source lines and may be nil.
+func checkSchema(file string, tbl *lua.LTable, s schema, lines map[string]int) []Diagnostic {
+	c := &schemaChecker{file: file, lines: lines}
+	c.checkRecord("", tbl, s)
+	sortDiagnostics(c.diags)
+	return c.diags
+}
+
+// report records a diagnostic for the field at path.
+func (c *schemaChecker) report(sev Severity, path, format string, args ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{
+		Severity: sev,
+		File:     c.file,
+		Line:     c.lineOf(path),
+		Field:    path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// lineOf returns the source line of path, falling back to the closest
+// enclosing field that has a known position.
+func (c *schemaChecker) lineOf(path string) int {
+	for p := path; p != ""; p = parentPath(p) {
+		if line, ok := c.lines[p]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// checkRecord validates the keys of a record table.
+func (c *schemaChecker) checkRecord(path string, tbl *lua.LTable, s schema) {
+	tbl.ForEach(func(k, v lua.LValue) {
+		if k.Type() != lua.LTString {
+			c.report(SeverityError, path, "unexpected list entry %s; expected key = value fields", describeValue(v))
+			return
+		}
+		key := k.String()
+		fieldPath := joinPath(path, key)
+		spec, ok := s[key]
+		if !ok {
+			if suggestion := suggestKey(key, s); suggestion != "" {
+				c.report(SeverityWarning, fieldPath, "unknown field (did you mean %q?)", suggestion)
+			} else {
+				c.report(SeverityWarning, fieldPath, "unknown field")
+			}
+			return
+		}
+		c.checkValue(fieldPath, v, spec)
+	})
+}
+
+// checkValue validates a single value against its spec.
+func (c *schemaChecker) checkValue(path string, v lua.LValue, spec fieldSpec) {
+	switch spec.Type {
+	case typeString:
+		if v.Type() != lua.LTString {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+		}
+	case typeInt:
+		n, ok := v.(lua.LNumber)
+		if !ok {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+		} else if float64(n) != float64(int64(n)) {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, n)
+		}
+	case typeBool:
+		if v.Type() != lua.LTBool {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+		}
+	case typeRecord:
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+			return
+		}
+		c.checkRecord(path, t, spec.Fields)
+	case typeScalarMap:
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+			return
+		}
+		t.ForEach(func(k, ev lua.LValue) {
+			if k.Type() != lua.LTString {
+				c.report(SeverityError, path, "unexpected list entry %s; expected key = value pairs", describeValue(ev))
+				return
+			}
+			switch ev.Type() {
+			case lua.LTString, lua.LTNumber, lua.LTBool:
+			default:
+				c.report(SeverityError, joinPath(path, k.String()), "expected a string, number or boolean, got %s", describeValue(ev))
+			}
+		})
+	case typeStringList, typeRecordList:
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			if spec.Type == typeStringList && v.Type() == lua.LTString {
+				c.report(SeverityError, path, "expected %s, got a string (write { %q })", spec.Type, v.String())
+			} else {
+				c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+			}
+			return
+		}
+		if isListDirective(t) {
+			t.ForEach(func(k, dv lua.LValue) {
+				c.checkList(joinPath(path, k.String()), dv, spec, k.String() == directiveRemove)
+			})
+			return
+		}
+		c.checkList(path, t, spec, false)
+	}
+}
+
+// checkList validates the entries of a list field. Entries of a remove
+// directive may name a record instead of spelling it out.
+func (c *schemaChecker) checkList(path string, v lua.LValue, spec fieldSpec, byName bool) {
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		c.report(SeverityError, path, "expected %s, got %s", spec.Type, describeValue(v))
+		return
+	}
+
+	index := 0
+	t.ForEach(func(k, ev lua.LValue) {
+		if k.Type() != lua.LTNumber {
+			c.report(SeverityError, joinPath(path, k.String()), "unexpected key in %s", spec.Type)
+			return
+		}
+		index++
+		entryPath := fmt.Sprintf("%s[%d]", path, index)
+		if spec.Type == typeStringList || (byName && ev.Type() == lua.LTString) {
+			if ev.Type() != lua.LTString {
+				c.report(SeverityError, entryPath, "expected a string, got %s", describeValue(ev))
+			}
+			return
+		}
+		c.checkValue(entryPath, ev, fieldSpec{Type: typeRecord, Fields: spec.Fields})
+	})
+}
+
+// describeValue names the Lua type of v for diagnostics.
+func describeValue(v lua.LValue) string {
+	switch v.Type() {
+	case lua.LTString:
+		return "a string"
+	case lua.LTNumber:
+		return "a number"
+	case lua.LTBool:
+		return "a boolean"
+	case lua.LTTable:
+		return "a table"
+	case lua.LTFunction:
+		return "a function"
+	case lua.LTNil:
+		return "nil"
+	}
+	return v.Type().String()
+}
+
+// joinPath appends key to a dotted field path.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// parentPath strips the last element from a field path.
+func parentPath(path string) string {
+	if strings.HasSuffix(path, "]") {
+		if i := strings.LastIndexByte(path, '['); i >= 0 {
+			return path[:i]
+		}
+	}
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// suggestKey returns the known key closest to key, or "" if none is close
+// enough to be a likely typo.
+func suggestKey(key string, s schema) string {
+	best := ""
+	bestDist := 0
+	for known := range s {
+		d := editDistance(key, known)
+		limit := 2
+		if len(known) <= 4 {
+			limit = 1
+		}
+		if d > limit {
+			continue
+		}
+		if best == "" || d < bestDist || (d == bestDist && known < best) {
+			best, bestDist = known, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// sortDiagnostics orders diagnostics by file, line and field.
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Field < diags[j].Field
+	})
+}
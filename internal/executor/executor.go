@@ -0,0 +1,295 @@
+// Package executor runs host commands for the image and ISO builders and
+// the installer. Everything that shells out goes through an Executor so a
+// build can be printed as a command plan (DryRun), captured (Recorder) and
+// played back against a script on hosts without FreeBSD tools (Replayer).
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command describes a single host command.
+type Command struct {
+	Name string
+	Args []string
+	Dir  string   // working directory, current directory if empty
+	Env  []string // added to the inherited environment
+
+	// Stdin is connected to the command's standard input. In a pipeline
+	// only the first command's Stdin is used.
+	Stdin io.Reader
+
+	// Stdout receives standard output when set; the output returned by Run
+	// then only contains standard error. In a pipeline only the last
+	// command's Stdout is used.
+	Stdout io.Writer
+}
+
+// Cmd returns a Command for name and args.
+func Cmd(name string, args ...string) *Command {
+	return &Command{Name: name, Args: args}
+}
+
+// Argv returns the command name followed by its arguments.
+func (c *Command) Argv() []string {
+	return append([]string{c.Name}, c.Args...)
+}
+
+// String renders the command as it would be typed into sh(1).
+func (c *Command) String() string {
+	argv := c.Argv()
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		quoted[i] = shellQuote(a)
+	}
+	s := strings.Join(quoted, " ")
+	if len(c.Env) > 0 {
+		env := make([]string, len(c.Env))
+		for i, e := range c.Env {
+			env[i] = shellQuote(e)
+		}
+		s = strings.Join(env, " ") + " " + s
+	}
+	if c.Dir != "" {
+		s = fmt.Sprintf("(cd %s && %s)", shellQuote(c.Dir), s)
+	}
+	return s
+}
+
+// Executor runs host commands. Commands are killed when ctx is cancelled;
+// a command that has not started yet fails with ctx.Err().
+type Executor interface {
+	// Run runs cmd and returns its combined output, or only its standard
+	// error if cmd.Stdout is set.
+	Run(ctx context.Context, cmd *Command) ([]byte, error)
+
+	// Pipe runs cmds with the standard output of each connected to the
+	// standard input of the next, and returns the standard error of all
+	// of them.
+	Pipe(ctx context.Context, cmds ...*Command) ([]byte, error)
+
+	// LookPath searches for an executable like exec.LookPath.
+	LookPath(file string) (string, error)
+}
+
+// ExitError is returned by executors that do not run real processes when a
+// command is scripted to fail.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code in err, 0 if err is nil and -1 if err did
+// not come from a command exiting.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var scripted *ExitError
+	if errors.As(err, &scripted) {
+		return scripted.Code
+	}
+	return -1
+}
+
+// PipeString renders a pipeline as it would be typed into sh(1).
+func PipeString(cmds []*Command) string {
+	parts := make([]string, len(cmds))
+	for i, c := range cmds {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, " | ")
+}
+
+// Real runs commands on the host.
+type Real struct{}
+
+// Run implements Executor.
+func (Real) Run(ctx context.Context, c *Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cmd := c.exec(ctx)
+	if c.Stdout == nil {
+		return cmd.CombinedOutput()
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stderr.Bytes(), err
+}
+
+// Pipe implements Executor.
+func (Real) Pipe(ctx context.Context, cmds ...*Command) ([]byte, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// os/exec copies each process's standard error in its own goroutine,
+	// so every process gets its own buffer; they are joined in pipeline
+	// order once all of them have exited
+	stderrs := make([]bytes.Buffer, len(cmds))
+	procs := make([]*exec.Cmd, len(cmds))
+	for i, c := range cmds {
+		procs[i] = c.exec(ctx)
+		procs[i].Stderr = &stderrs[i]
+	}
+	procs[0].Stdin = cmds[0].Stdin
+	procs[len(procs)-1].Stdout = cmds[len(cmds)-1].Stdout
+
+	// Connect the stages with OS pipes so data does not pass through Go
+	var closers []io.Closer
+	for i := 0; i < len(procs)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pipe: %w", err)
+		}
+		procs[i].Stdout = w
+		procs[i+1].Stdin = r
+		closers = append(closers, r, w)
+	}
+
+	started := 0
+	var startErr error
+	for _, p := range procs {
+		if err := p.Start(); err != nil {
+			startErr = fmt.Errorf("failed to start %s: %w", p.Path, err)
+			break
+		}
+		started++
+	}
+	// The parent's copies of the pipe ends must be closed so each stage
+	// sees EOF when its writer exits
+	for _, c := range closers {
+		c.Close()
+	}
+
+	var waitErr error
+	for i := 0; i < started; i++ {
+		if err := procs[i].Wait(); err != nil && waitErr == nil {
+			waitErr = fmt.Errorf("%s: %w", cmds[i].Name, err)
+		}
+	}
+	var stderr []byte
+	for i := range stderrs {
+		stderr = append(stderr, stderrs[i].Bytes()...)
+	}
+	if startErr != nil {
+		return stderr, startErr
+	}
+	return stderr, waitErr
+}
+
+// LookPath implements Executor.
+func (Real) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+// killWaitDelay bounds how long a cancelled command's output is drained.
+const killWaitDelay = 5 * time.Second
+
+func (c *Command) exec(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	// A killed command's children may hold its output open; do not wait
+	// for them indefinitely
+	cmd.WaitDelay = killWaitDelay
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	if len(c.Env) > 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	return cmd
+}
+
+// DryRun prints every command instead of running it. Every tool is assumed
+// to be installed and every command succeeds with no output, so the
+// printed plan is the one a successful build on FreeBSD would run.
+type DryRun struct {
+	Out io.Writer
+}
+
+// Run implements Executor.
+func (d DryRun) Run(ctx context.Context, c *Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(d.Out, "+ %s\n", c)
+	return nil, nil
+}
+
+// Pipe implements Executor.
+func (d DryRun) Pipe(ctx context.Context, cmds ...*Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(d.Out, "+ %s\n", PipeString(cmds))
+	return nil, nil
+}
+
+// LookPath implements Executor.
+func (d DryRun) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// IsDryRun reports whether e only prints commands. Callers use it to skip
+// checks on files that a dry run never creates.
+func IsDryRun(e Executor) bool {
+	_, ok := e.(DryRun)
+	return ok
+}
+
+// Simulated reports whether e runs nothing on the host, as in a dry run
+// or a replay. Callers use it to skip checks of the host itself, such as
+// for root privileges or device nodes, which a simulated run never uses.
+func Simulated(e Executor) bool {
+	switch e.(type) {
+	case DryRun, *Replayer:
+		return true
+	}
+	return false
+}
+
+// OrDefault returns e, or the real executor if e is nil.
+func OrDefault(e Executor) Executor {
+	if e == nil {
+		return Real{}
+	}
+	return e
+}
+
+// shellQuote quotes s for sh(1) if it contains anything but safe characters.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
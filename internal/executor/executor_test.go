@@ -0,0 +1,68 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func requireShell(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+}
+
+// Every process of a pipeline may write to standard error at the same
+// time. Run with -race to check that their outputs are collected safely.
+func TestRealPipeStderr(t *testing.T) {
+	requireShell(t)
+	const lines = 200
+	script := func(name string) *Command {
+		return Cmd("sh", "-c", `i=0; while [ $i -lt `+strconv.Itoa(lines)+` ]; do echo "`+name+` $i" >&2; i=$((i+1)); done; cat`)
+	}
+	var out bytes.Buffer
+	last := script("third")
+	last.Stdout = &out
+	first := script("first")
+	first.Stdin = strings.NewReader("payload\n")
+
+	stderr, err := Real{}.Pipe(context.Background(), first, script("second"), last)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, stderr)
+	}
+	if out.String() != "payload\n" {
+		t.Errorf("stdout = %q, want %q", out.String(), "payload\n")
+	}
+
+	// Each process's output is kept whole, in pipeline order
+	got := strings.Split(strings.TrimSuffix(string(stderr), "\n"), "\n")
+	if len(got) != 3*lines {
+		t.Fatalf("got %d stderr lines, want %d", len(got), 3*lines)
+	}
+	for i, name := range []string{"first", "second", "third"} {
+		for j := 0; j < lines; j++ {
+			if want := name + " " + strconv.Itoa(j); got[i*lines+j] != want {
+				t.Fatalf("line %d = %q, want %q", i*lines+j, got[i*lines+j], want)
+			}
+		}
+	}
+}
+
+// A failing stage is reported by name along with its standard error.
+func TestRealPipeFailure(t *testing.T) {
+	requireShell(t)
+	stderr, err := Real{}.Pipe(context.Background(),
+		Cmd("sh", "-c", "echo sending >&2"),
+		Cmd("sh", "-c", "cat >/dev/null; echo 'bad stream' >&2; exit 3"),
+	)
+	if err == nil || !strings.HasPrefix(err.Error(), "sh: ") || ExitCode(err) != 3 {
+		t.Errorf("err = %v, want exit status 3 of sh", err)
+	}
+	if string(stderr) != "sending\nbad stream\n" {
+		t.Errorf("stderr = %q", stderr)
+	}
+}
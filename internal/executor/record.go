@@ -0,0 +1,275 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Wildcards in replay scripts.
+const (
+	Wildcard     = "*"  // matches any single argument
+	WildcardRest = "**" // as the last argument, matches any remaining arguments
+)
+
+// Recording is a captured or hand-written sequence of commands. It is
+// stored as JSON:
+//
+//	{
+//	  "tools": {"zpool": "/sbin/zpool", "mkimg": ""},
+//	  "commands": [
+//	    {"argv": [["zpool", "create", "*", "pgsd", "/dev/md0p2"]]},
+//	    {"argv": [["zfs", "send", "pgsd@install"], ["xz", "-9"]], "exit_code": 1, "output": "..."}
+//	  ]
+//	}
+//
+// Each entry holds one argv per pipeline stage. "*" matches any argument
+// and a final "**" any number of remaining arguments, which keeps scripts
+// independent of temporary paths and package sets. A tool mapped to "" is
+// reported as not installed.
+type Recording struct {
+	Tools    map[string]string `json:"tools,omitempty"`
+	Commands []Entry           `json:"commands"`
+}
+
+// Entry is one command or pipeline in a recording.
+type Entry struct {
+	Argv     [][]string `json:"argv"`
+	Dir      string     `json:"dir,omitempty"`
+	Output   string     `json:"output,omitempty"`
+	Stdout   string     `json:"stdout,omitempty"` // written to the command's Stdout on replay
+	ExitCode int        `json:"exit_code,omitempty"`
+}
+
+// LoadRecording reads a recording from path.
+func LoadRecording(path string) (*Recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read recording: %w", err)
+	}
+	rec := &Recording{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %w", path, err)
+	}
+	return rec, nil
+}
+
+// Save writes the recording to path.
+func (r *Recording) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write recording: %w", err)
+	}
+	return nil
+}
+
+// Recorder runs commands with another executor and records each one,
+// including tool lookups, so the run can be replayed later.
+type Recorder struct {
+	Exec      Executor
+	Recording Recording
+	mu        sync.Mutex
+}
+
+// NewRecorder records the commands run by e.
+func NewRecorder(e Executor) *Recorder {
+	return &Recorder{Exec: e, Recording: Recording{Tools: map[string]string{}, Commands: []Entry{}}}
+}
+
+// Run implements Executor.
+func (r *Recorder) Run(ctx context.Context, c *Command) ([]byte, error) {
+	stdout := &captureWriter{w: c.Stdout}
+	if c.Stdout != nil {
+		c.Stdout = stdout
+		defer func() { c.Stdout = stdout.w }()
+	}
+	output, err := r.Exec.Run(ctx, c)
+	r.add(Entry{Argv: [][]string{c.Argv()}, Dir: c.Dir, Output: string(output), Stdout: stdout.String(), ExitCode: ExitCode(err)})
+	return output, err
+}
+
+// Pipe implements Executor.
+func (r *Recorder) Pipe(ctx context.Context, cmds ...*Command) ([]byte, error) {
+	argv := make([][]string, len(cmds))
+	for i, c := range cmds {
+		argv[i] = c.Argv()
+	}
+	output, err := r.Exec.Pipe(ctx, cmds...)
+	r.add(Entry{Argv: argv, Output: string(output), ExitCode: ExitCode(err)})
+	return output, err
+}
+
+// LookPath implements Executor.
+func (r *Recorder) LookPath(file string) (string, error) {
+	path, err := r.Exec.LookPath(file)
+	r.mu.Lock()
+	r.Recording.Tools[file] = path
+	r.mu.Unlock()
+	return path, err
+}
+
+func (r *Recorder) add(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Recording.Commands = append(r.Recording.Commands, e)
+}
+
+// captureWriter keeps a copy of small outputs written to w. Large streams
+// (ZFS sends, images) are not worth replaying byte for byte.
+type captureWriter struct {
+	w   io.Writer
+	buf strings.Builder
+}
+
+const maxCapture = 64 * 1024
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.buf.Len()+len(p) <= maxCapture {
+		c.buf.Write(p)
+	}
+	return c.w.Write(p)
+}
+
+func (c *captureWriter) String() string {
+	return c.buf.String()
+}
+
+// Replayer plays a recording back. Commands must be run in the recorded
+// order; a command that does not match the next entry is an error.
+type Replayer struct {
+	rec  *Recording
+	next int
+	mu   sync.Mutex
+}
+
+// NewReplayer replays rec.
+func NewReplayer(rec *Recording) *Replayer {
+	return &Replayer{rec: rec}
+}
+
+// Run implements Executor.
+func (r *Replayer) Run(ctx context.Context, c *Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e, err := r.expect([][]string{c.Argv()})
+	if err != nil {
+		return nil, err
+	}
+	if c.Stdout != nil && e.Stdout != "" {
+		if _, err := io.WriteString(c.Stdout, e.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(e.Output), exitError(e.ExitCode)
+}
+
+// Pipe implements Executor.
+func (r *Replayer) Pipe(ctx context.Context, cmds ...*Command) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	argv := make([][]string, len(cmds))
+	for i, c := range cmds {
+		argv[i] = c.Argv()
+	}
+	e, err := r.expect(argv)
+	if err != nil {
+		return nil, err
+	}
+	if last := cmds[len(cmds)-1]; last.Stdout != nil && e.Stdout != "" {
+		if _, err := io.WriteString(last.Stdout, e.Stdout); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(e.Output), exitError(e.ExitCode)
+}
+
+// LookPath implements Executor. Tools missing from the recording are
+// reported as installed so scripts only need to list the absent ones.
+func (r *Replayer) LookPath(file string) (string, error) {
+	path, ok := r.rec.Tools[file]
+	if !ok {
+		return file, nil
+	}
+	if path == "" {
+		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+	}
+	return path, nil
+}
+
+// Done returns an error if recorded commands were never run.
+func (r *Replayer) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if left := len(r.rec.Commands) - r.next; left > 0 {
+		return fmt.Errorf("replay: %d recorded command(s) not run, next: %s", left, formatArgv(r.rec.Commands[r.next].Argv))
+	}
+	return nil
+}
+
+func (r *Replayer) expect(argv [][]string) (Entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next >= len(r.rec.Commands) {
+		return Entry{}, fmt.Errorf("replay: unexpected command after end of recording: %s", formatArgv(argv))
+	}
+	e := r.rec.Commands[r.next]
+	if !matchArgv(e.Argv, argv) {
+		return Entry{}, fmt.Errorf("replay: command %d: expected %s, got %s", r.next+1, formatArgv(e.Argv), formatArgv(argv))
+	}
+	r.next++
+	return e, nil
+}
+
+func matchArgv(want, got [][]string) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if n := len(w); n > 0 && w[n-1] == WildcardRest {
+			w = w[:n-1]
+			if len(g) < len(w) {
+				return false
+			}
+			g = g[:len(w)]
+		}
+		if len(w) != len(g) {
+			return false
+		}
+		for j := range w {
+			if w[j] != Wildcard && w[j] != g[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func formatArgv(argv [][]string) string {
+	cmds := make([]*Command, len(argv))
+	for i, a := range argv {
+		if len(a) == 0 {
+			cmds[i] = &Command{}
+			continue
+		}
+		cmds[i] = Cmd(a[0], a[1:]...)
+	}
+	return PipeString(cmds)
+}
+
+func exitError(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return &ExitError{Code: code}
+}
@@ -0,0 +1,331 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const dirEntrySize = 32
+
+// Directory entry attributes.
+const (
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0f
+)
+
+// entry is a file or directory in the image.
+type entry struct {
+	name     string
+	short    [11]byte // 8.3 name, space padded
+	long     []uint16 // long name, nil if the short name says it all
+	dir      bool
+	label    bool // the root directory holds the volume label
+	src      string
+	size     int64
+	parent   *entry
+	children []*entry // sorted by name
+
+	cluster, clusters uint32
+}
+
+// buildTree arranges files into directories, checking names and sizes.
+func buildTree(files []File) (*entry, error) {
+	root := &entry{dir: true}
+	for _, f := range files {
+		parts := strings.Split(strings.Trim(f.Path, "/"), "/")
+		dir := root
+		for i, name := range parts {
+			if err := checkName(name); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Path, err)
+			}
+			child := dir.child(name)
+			last := i == len(parts)-1
+			switch {
+			case child == nil && last:
+				info, err := os.Stat(f.Src)
+				if err != nil {
+					return nil, err
+				}
+				if !info.Mode().IsRegular() {
+					return nil, fmt.Errorf("%s is not a regular file", f.Src)
+				}
+				if info.Size() > 0xffffffff {
+					return nil, fmt.Errorf("%s is too large for FAT", f.Src)
+				}
+				child = &entry{name: name, src: f.Src, size: info.Size(), parent: dir}
+				dir.children = append(dir.children, child)
+			case child == nil:
+				child = &entry{name: name, dir: true, parent: dir}
+				dir.children = append(dir.children, child)
+			case last || !child.dir:
+				return nil, fmt.Errorf("%s is listed twice or below a file", f.Path)
+			}
+			dir = child
+		}
+	}
+	root.assignNames()
+	return root, nil
+}
+
+func (e *entry) child(name string) *entry {
+	for _, c := range e.children {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// checkName rejects names FAT cannot hold.
+func checkName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("invalid name %q", name)
+	case len(utf16.Encode([]rune(name))) > 255:
+		return fmt.Errorf("name %q is longer than 255 characters", name)
+	case strings.ContainsAny(name, `"*/:<>?\|`):
+		return fmt.Errorf("name %q contains a character FAT does not allow", name)
+	}
+	for _, r := range name {
+		if r < 0x20 {
+			return fmt.Errorf("name %q contains a control character", name)
+		}
+	}
+	return nil
+}
+
+// assignNames sorts the tree and gives every entry a short name, unique
+// within its directory, and a long name where the short name differs.
+func (e *entry) assignNames() {
+	sort.Slice(e.children, func(i, j int) bool { return e.children[i].name < e.children[j].name })
+	used := make(map[[11]byte]bool)
+	for _, c := range e.children {
+		c.short, c.long = shortName(c.name, used)
+		used[c.short] = true
+		if c.dir {
+			c.assignNames()
+		}
+	}
+}
+
+// shortName returns the 8.3 name for name, with a numeric tail if name
+// does not fit 8.3 or its short form is taken, and the long name to store
+// if the short name does not reproduce name exactly.
+func shortName(name string, used map[[11]byte]bool) ([11]byte, []uint16) {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, lossyBase := shortChars(strings.ReplaceAll(base, ".", ""))
+	ext, lossyExt := shortChars(ext)
+	lossy := lossyBase || lossyExt || strings.Count(name, ".") > 1 || strings.HasPrefix(name, ".")
+	if len(ext) > 3 {
+		ext, lossy = ext[:3], true
+	}
+
+	format := func(b string) [11]byte {
+		var s [11]byte
+		copy(s[:], fmt.Sprintf("%-8s%-3s", b, ext))
+		if s[0] == 0xe5 {
+			s[0] = 0x05
+		}
+		return s
+	}
+
+	var short [11]byte
+	if !lossy && base != "" && len(base) <= 8 && !used[format(base)] {
+		short = format(base)
+	} else {
+		if base == "" {
+			base = "_"
+		}
+		for i := 1; ; i++ {
+			tail := fmt.Sprintf("~%d", i)
+			b := base
+			if len(b) > 8-len(tail) {
+				b = b[:8-len(tail)]
+			}
+			if short = format(b + tail); !used[short] {
+				break
+			}
+		}
+	}
+
+	display := strings.TrimRight(string(short[:8]), " ")
+	if e := strings.TrimRight(string(short[8:]), " "); e != "" {
+		display += "." + e
+	}
+	if display == name {
+		return short, nil
+	}
+	return short, utf16.Encode([]rune(name))
+}
+
+// shortChars upper-cases s for a short name, replacing characters short
+// names cannot hold, and reports whether it had to.
+func shortChars(s string) (string, bool) {
+	var sb strings.Builder
+	lossy := false
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r == ' ':
+			lossy = true
+		case shortNameChar(r):
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+			lossy = true
+		}
+	}
+	return sb.String(), lossy
+}
+
+func shortNameChar(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("!#$%&'()-@^_`{}~", r)
+}
+
+// dirEntries returns the number of 32-byte entries in a directory.
+func (e *entry) dirEntries() uint32 {
+	n := uint32(2) // "." and ".."
+	if e.parent == nil {
+		n = 0
+		if e.label {
+			n = 1
+		}
+	}
+	for _, c := range e.children {
+		n += 1 + uint32(len(longEntries(c.long)))
+	}
+	return n
+}
+
+// directory returns the encoded directory e, padded to its clusters.
+func (g *geometry) directory(e *entry, label [11]byte, t time.Time) []byte {
+	size := e.clusters * g.clusterBytes()
+	if e.parent == nil && g.typ != 32 {
+		size = g.rootSectors() * SectorSize
+	}
+	b := make([]byte, 0, size)
+
+	if e.parent == nil {
+		if e.label {
+			b = append(b, shortEntry(label, attrVolumeID, 0, 0, t)...)
+		}
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], ".          ")
+		copy(dotdot[:], "..         ")
+		parent := e.parent.cluster
+		if e.parent.parent == nil {
+			parent = 0 // the root, whatever its cluster
+		}
+		b = append(b, shortEntry(dot, attrDirectory, e.cluster, 0, t)...)
+		b = append(b, shortEntry(dotdot, attrDirectory, parent, 0, t)...)
+	}
+
+	for _, c := range e.children {
+		for _, l := range longEntries(c.long) {
+			b = append(b, longEntry(l.ord, l.units, checksum(c.short))...)
+		}
+		attr, fileSize := byte(attrArchive), uint32(c.size)
+		if c.dir {
+			attr, fileSize = attrDirectory, 0
+		}
+		b = append(b, shortEntry(c.short, attr, c.cluster, fileSize, t)...)
+	}
+	return b[:size]
+}
+
+func shortEntry(name [11]byte, attr byte, cluster, size uint32, t time.Time) []byte {
+	d := make([]byte, dirEntrySize)
+	copy(d, name[:])
+	d[11] = attr
+	date, clock := dosTime(t)
+	binary.LittleEndian.PutUint16(d[14:], clock) // creation
+	binary.LittleEndian.PutUint16(d[16:], date)
+	binary.LittleEndian.PutUint16(d[18:], date) // last access
+	binary.LittleEndian.PutUint16(d[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(d[22:], clock) // modification
+	binary.LittleEndian.PutUint16(d[24:], date)
+	binary.LittleEndian.PutUint16(d[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(d[28:], size)
+	return d
+}
+
+type longPart struct {
+	ord   byte
+	units []uint16
+}
+
+// longEntries splits a long name into 13-character parts, last part
+// first as they are stored.
+func longEntries(name []uint16) []longPart {
+	if name == nil {
+		return nil
+	}
+	n := (len(name) + 12) / 13
+	parts := make([]longPart, n)
+	for i := 0; i < n; i++ {
+		units := make([]uint16, 13)
+		for j := range units {
+			k := i*13 + j
+			switch {
+			case k < len(name):
+				units[j] = name[k]
+			case k == len(name):
+				units[j] = 0
+			default:
+				units[j] = 0xffff
+			}
+		}
+		ord := byte(i + 1)
+		if i == n-1 {
+			ord |= 0x40
+		}
+		parts[n-1-i] = longPart{ord, units}
+	}
+	return parts
+}
+
+func longEntry(ord byte, units []uint16, sum byte) []byte {
+	d := make([]byte, dirEntrySize)
+	d[0] = ord
+	d[11] = attrLongName
+	d[13] = sum
+	offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(d[offsets[i]:], u)
+	}
+	return d
+}
+
+// checksum ties long name entries to their short entry.
+func checksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// dosTime encodes t as a FAT date and time, clamped to the years FAT
+// can record.
+func dosTime(t time.Time) (date, clock uint16) {
+	t = t.UTC()
+	switch {
+	case t.Year() < 1980:
+		return 0<<9 | 1<<5 | 1, 0
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, clock
+}
@@ -0,0 +1,413 @@
+// Package fat writes FAT12, FAT16 and FAT32 filesystem images without
+// external tools, for EFI system partitions and El Torito EFI boot images.
+//
+// An image holds a fixed list of files, laid out contiguously in the order
+// of their paths. Every timestamp comes from Options.Time, so the same
+// files always produce the same image.
+package fat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// SectorSize is the sector size of the images written.
+const SectorSize = 512
+
+// Options describe the filesystem.
+type Options struct {
+	Size     int64  // image size in bytes, a multiple of SectorSize
+	Label    string // volume label, up to 11 characters; empty for none
+	VolumeID uint32 // volume serial number
+
+	// Type is 12, 16 or 32; zero chooses the smallest type that fits
+	// Size. SectorsPerCluster is a power of two up to 64; zero chooses
+	// the smallest that gives a valid cluster count.
+	Type              int
+	SectorsPerCluster int
+
+	Time time.Time // recorded for every file and directory
+}
+
+// File is a file written into the image.
+type File struct {
+	Path string // slash-separated path in the image, e.g. "EFI/BOOT/BOOTX64.EFI"
+	Src  string // host file holding its contents
+}
+
+// Write creates a FAT image at path holding files. Directories are created
+// as the paths need them.
+func Write(ctx context.Context, path string, files []File, opts Options) error {
+	if opts.Size <= 0 || opts.Size%SectorSize != 0 {
+		return fmt.Errorf("image size %d is not a positive multiple of %d", opts.Size, SectorSize)
+	}
+	label, err := volumeLabel(opts.Label)
+	if err != nil {
+		return err
+	}
+	g, err := newGeometry(uint32(opts.Size/SectorSize), opts.Type, opts.SectorsPerCluster)
+	if err != nil {
+		return err
+	}
+
+	root, err := buildTree(files)
+	if err != nil {
+		return err
+	}
+	root.label = opts.Label != ""
+	if err := g.allocate(root); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = g.write(ctx, f, root, label, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// geometry is the layout of a filesystem.
+type geometry struct {
+	typ               int
+	totalSectors      uint32
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	fatSectors        uint32
+	rootEntries       uint32 // FAT12 and FAT16 only
+	clusters          uint32
+
+	next uint32 // next free cluster while allocating
+}
+
+// Cluster count limits of each type.
+const (
+	maxFAT12Clusters = 4084
+	maxFAT16Clusters = 65524
+	maxFAT32Clusters = 0x0ffffff4
+)
+
+func newGeometry(totalSectors uint32, typ, spc int) (*geometry, error) {
+	types := []int{typ}
+	if typ == 0 {
+		types = []int{12, 16, 32}
+	} else if typ != 12 && typ != 16 && typ != 32 {
+		return nil, fmt.Errorf("unsupported FAT type %d", typ)
+	}
+	spcs := []int{spc}
+	if spc == 0 {
+		spcs = []int{1, 2, 4, 8, 16, 32, 64}
+	} else if spc > 64 || spc&(spc-1) != 0 {
+		return nil, fmt.Errorf("sectors per cluster must be a power of two up to 64, not %d", spc)
+	}
+
+	for _, t := range types {
+		for _, s := range spcs {
+			if g := layout(totalSectors, t, uint32(s)); g != nil {
+				return g, nil
+			}
+		}
+	}
+	if typ == 0 {
+		return nil, fmt.Errorf("no FAT type fits %d sectors", totalSectors)
+	}
+	return nil, fmt.Errorf("%d sectors do not make a valid FAT%d filesystem", totalSectors, typ)
+}
+
+// layout sizes the FATs for a type and cluster size, returning nil if the
+// cluster count is out of range for the type.
+func layout(totalSectors uint32, typ int, spc uint32) *geometry {
+	g := &geometry{typ: typ, totalSectors: totalSectors, sectorsPerCluster: spc, reservedSectors: 1, rootEntries: 512}
+	if typ == 32 {
+		g.reservedSectors, g.rootEntries = 32, 0
+	}
+
+	// Growing the FATs shrinks the data area, so this settles quickly
+	g.fatSectors = 1
+	for {
+		meta := g.reservedSectors + 2*g.fatSectors + g.rootSectors()
+		if meta >= totalSectors {
+			return nil
+		}
+		g.clusters = (totalSectors - meta) / spc
+		need := (g.fatBytes(g.clusters+2) + SectorSize - 1) / SectorSize
+		if need <= g.fatSectors {
+			break
+		}
+		g.fatSectors = need
+	}
+
+	min, max := uint32(1), uint32(maxFAT12Clusters)
+	switch typ {
+	case 16:
+		min, max = maxFAT12Clusters+1, maxFAT16Clusters
+	case 32:
+		min, max = maxFAT16Clusters+1, maxFAT32Clusters
+	}
+	if g.clusters < min || g.clusters > max {
+		return nil
+	}
+	return g
+}
+
+// fatBytes returns the size of a FAT with n entries.
+func (g *geometry) fatBytes(n uint32) uint32 {
+	switch g.typ {
+	case 12:
+		return (n*3 + 1) / 2
+	case 16:
+		return n * 2
+	}
+	return n * 4
+}
+
+func (g *geometry) rootSectors() uint32 {
+	return g.rootEntries * dirEntrySize / SectorSize
+}
+
+func (g *geometry) clusterBytes() uint32 {
+	return g.sectorsPerCluster * SectorSize
+}
+
+// dataSector returns the first sector of the data area, cluster 2.
+func (g *geometry) dataSector() uint32 {
+	return g.reservedSectors + 2*g.fatSectors + g.rootSectors()
+}
+
+func (g *geometry) clusterOffset(c uint32) int64 {
+	return int64(g.dataSector()+(c-2)*g.sectorsPerCluster) * SectorSize
+}
+
+// allocate gives every directory and file its clusters, in tree order.
+// The FAT12 and FAT16 root directory has a fixed area of its own instead.
+func (g *geometry) allocate(root *entry) error {
+	g.next = 2
+	var walk func(e *entry) error
+	walk = func(e *entry) error {
+		size := e.size
+		if e.dir {
+			size = int64(e.dirEntries()) * dirEntrySize
+		}
+		if e.parent == nil && g.typ != 32 {
+			if e.dirEntries() > g.rootEntries {
+				return fmt.Errorf("root directory holds %d entries, at most %d fit", e.dirEntries(), g.rootEntries)
+			}
+		} else if size > 0 || e.dir {
+			n := uint32((size + int64(g.clusterBytes()) - 1) / int64(g.clusterBytes()))
+			if n == 0 {
+				n = 1 // an empty FAT32 root directory
+			}
+			if g.next-2+n > g.clusters {
+				return fmt.Errorf("files do not fit in a %d KB FAT%d image", int64(g.totalSectors)*SectorSize/1024, g.typ)
+			}
+			e.cluster, e.clusters = g.next, n
+			g.next += n
+		}
+		for _, c := range e.children {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// write writes the boot sector, the FATs, the directories and the file
+// data.
+func (g *geometry) write(ctx context.Context, f *os.File, root *entry, label [11]byte, opts Options) error {
+	if err := f.Truncate(int64(g.totalSectors) * SectorSize); err != nil {
+		return err
+	}
+
+	boot := g.bootSector(label, opts.VolumeID)
+	if _, err := f.WriteAt(boot, 0); err != nil {
+		return err
+	}
+	if g.typ == 32 {
+		// FSInfo and the backup boot sector
+		info := g.fsInfo()
+		for _, w := range []struct {
+			data   []byte
+			sector int64
+		}{{info, 1}, {boot, 6}, {info, 7}} {
+			if _, err := f.WriteAt(w.data, w.sector*SectorSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	fat := g.table(root)
+	for i := uint32(0); i < 2; i++ {
+		if _, err := f.WriteAt(fat, int64(g.reservedSectors+i*g.fatSectors)*SectorSize); err != nil {
+			return err
+		}
+	}
+
+	var walk func(e *entry) error
+	walk = func(e *entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case e.dir:
+			offset := int64(0)
+			if e.parent == nil && g.typ != 32 {
+				offset = int64(g.reservedSectors+2*g.fatSectors) * SectorSize
+			} else {
+				offset = g.clusterOffset(e.cluster)
+			}
+			if _, err := f.WriteAt(g.directory(e, label, opts.Time), offset); err != nil {
+				return err
+			}
+			for _, c := range e.children {
+				if err := walk(c); err != nil {
+					return err
+				}
+			}
+		case e.size > 0:
+			return copyFile(f, g.clusterOffset(e.cluster), e)
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+// copyFile copies a file's contents to offset, failing if it changed size
+// since the tree was built.
+func copyFile(f *os.File, offset int64, e *entry) error {
+	in, err := os.Open(e.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := io.CopyN(io.NewOffsetWriter(f, offset), in, e.size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s shrank while the image was written", e.src)
+		}
+		return fmt.Errorf("cannot copy %s: %w", e.src, err)
+	}
+	return nil
+}
+
+// Media descriptor of fixed disks, repeated in the first FAT entry.
+const mediaFixed = 0xf8
+
+func (g *geometry) bootSector(label [11]byte, volumeID uint32) []byte {
+	b := make([]byte, SectorSize)
+	b[0], b[2] = 0xeb, 0x90 // jump over the BPB
+	copy(b[3:11], "BSD4.4  ")
+	binary.LittleEndian.PutUint16(b[11:], SectorSize)
+	b[13] = byte(g.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:], uint16(g.reservedSectors))
+	b[16] = 2 // FATs
+	binary.LittleEndian.PutUint16(b[17:], uint16(g.rootEntries))
+	if g.totalSectors < 0x10000 && g.typ != 32 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(g.totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], g.totalSectors)
+	}
+	b[21] = mediaFixed
+	binary.LittleEndian.PutUint16(b[24:], 32) // sectors per track
+	binary.LittleEndian.PutUint16(b[26:], 64) // heads
+
+	ext := b[36:]
+	if g.typ == 32 {
+		b[1] = 0x58
+		binary.LittleEndian.PutUint32(b[36:], g.fatSectors)
+		binary.LittleEndian.PutUint32(b[44:], 2) // root directory cluster
+		binary.LittleEndian.PutUint16(b[48:], 1) // FSInfo sector
+		binary.LittleEndian.PutUint16(b[50:], 6) // backup boot sector
+		ext = b[64:]
+	} else {
+		b[1] = 0x3c
+		binary.LittleEndian.PutUint16(b[22:], uint16(g.fatSectors))
+	}
+	ext[0] = 0x80 // drive number
+	ext[2] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(ext[3:], volumeID)
+	copy(ext[7:18], label[:])
+	copy(ext[18:26], fmt.Sprintf("FAT%-5d", g.typ))
+
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func (g *geometry) fsInfo() []byte {
+	b := make([]byte, SectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], g.clusters-(g.next-2))
+	binary.LittleEndian.PutUint32(b[492:], g.next)
+	binary.LittleEndian.PutUint32(b[508:], 0xaa550000)
+	return b
+}
+
+// table returns the FAT, chaining the clusters of every directory and file.
+func (g *geometry) table(root *entry) []byte {
+	t := make([]byte, g.fatSectors*SectorSize)
+	set := func(c, v uint32) {
+		switch g.typ {
+		case 12:
+			off := c * 3 / 2
+			if c%2 == 0 {
+				t[off] = byte(v)
+				t[off+1] = t[off+1]&0xf0 | byte(v>>8)&0x0f
+			} else {
+				t[off] = t[off]&0x0f | byte(v<<4)
+				t[off+1] = byte(v >> 4)
+			}
+		case 16:
+			binary.LittleEndian.PutUint16(t[c*2:], uint16(v))
+		default:
+			binary.LittleEndian.PutUint32(t[c*4:], v)
+		}
+	}
+	eoc := map[int]uint32{12: 0xfff, 16: 0xffff, 32: 0x0fffffff}[g.typ]
+	set(0, eoc&^0xff|mediaFixed)
+	set(1, eoc)
+
+	var walk func(e *entry)
+	walk = func(e *entry) {
+		for i := uint32(0); i < e.clusters; i++ {
+			if i == e.clusters-1 {
+				set(e.cluster+i, eoc)
+			} else {
+				set(e.cluster+i, e.cluster+i+1)
+			}
+		}
+		for _, c := range e.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return t
+}
+
+// volumeLabel checks and pads a volume label.
+func volumeLabel(s string) ([11]byte, error) {
+	var label [11]byte
+	copy(label[:], "NO NAME    ")
+	if s == "" {
+		return label, nil
+	}
+	s = strings.ToUpper(s)
+	if len(s) > 11 {
+		return label, fmt.Errorf("volume label %q is longer than 11 characters", s)
+	}
+	for _, r := range s {
+		if !shortNameChar(r) && r != ' ' {
+			return label, fmt.Errorf("volume label %q contains %q", s, r)
+		}
+	}
+	copy(label[:], s+strings.Repeat(" ", 11-len(s)))
+	return label, nil
+}
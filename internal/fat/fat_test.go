@@ -0,0 +1,502 @@
+package fat
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+var buildTime = time.Date(2025, 3, 1, 12, 30, 10, 0, time.UTC)
+
+// volume is a FAT image read back independently of the writer, from its
+// BPB as the specification lays it out.
+type volume struct {
+	t   *testing.T
+	b   []byte
+	typ int
+
+	spc, reserved, fatSectors, rootEntries, total, clusters uint32
+	rootCluster                                             uint32
+
+	label  string
+	files  map[string][]byte // path to contents, by long name
+	shorts map[string]string // path to 8.3 name
+	dirs   map[string]bool
+	used   map[uint32]string // cluster to owning path
+}
+
+func readVolume(t *testing.T, path string) *volume {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		t.Fatal("no boot signature")
+	}
+	if n := binary.LittleEndian.Uint16(b[11:]); n != SectorSize {
+		t.Fatalf("%d bytes per sector", n)
+	}
+	if b[16] != 2 {
+		t.Fatalf("%d FATs", b[16])
+	}
+	v := &volume{
+		t:           t,
+		b:           b,
+		spc:         uint32(b[13]),
+		reserved:    uint32(binary.LittleEndian.Uint16(b[14:])),
+		rootEntries: uint32(binary.LittleEndian.Uint16(b[17:])),
+		total:       uint32(binary.LittleEndian.Uint16(b[19:])),
+		fatSectors:  uint32(binary.LittleEndian.Uint16(b[22:])),
+		files:       make(map[string][]byte),
+		shorts:      make(map[string]string),
+		dirs:        make(map[string]bool),
+		used:        make(map[uint32]string),
+	}
+	if v.total == 0 {
+		v.total = binary.LittleEndian.Uint32(b[32:])
+	}
+	if v.fatSectors == 0 {
+		v.fatSectors = binary.LittleEndian.Uint32(b[36:])
+		v.rootCluster = binary.LittleEndian.Uint32(b[44:])
+	}
+	if int64(v.total)*SectorSize != int64(len(b)) {
+		t.Fatalf("BPB gives %d sectors, image is %d bytes", v.total, len(b))
+	}
+
+	// The type follows from the cluster count alone
+	v.clusters = (v.total - v.dataSector()) / v.spc
+	ext := b[36:]
+	switch {
+	case v.clusters < 4085:
+		v.typ = 12
+	case v.clusters < 65525:
+		v.typ = 16
+	default:
+		v.typ = 32
+		ext = b[64:]
+	}
+	if got, want := string(ext[18:26]), fmt.Sprintf("FAT%-5d", v.typ); got != want {
+		t.Errorf("filesystem type %q, cluster count gives %q", got, want)
+	}
+	if ext[2] != 0x29 {
+		t.Error("no extended boot signature")
+	}
+
+	fat := v.fat(0)
+	if !bytes.Equal(fat, v.fat(1)) {
+		t.Error("the two FATs differ")
+	}
+	if e := v.next(0); e&0xff != mediaFixed {
+		t.Errorf("FAT entry 0 is %#x", e)
+	}
+
+	if v.typ == 32 {
+		v.walk(v.readChain(v.rootCluster, -1, "/"), "", v.rootCluster)
+	} else {
+		off := (v.reserved + 2*v.fatSectors) * SectorSize
+		v.walk(b[off:off+v.rootEntries*dirEntrySize], "", 0)
+	}
+	return v
+}
+
+func (v *volume) rootSectors() uint32 { return (v.rootEntries*32 + SectorSize - 1) / SectorSize }
+func (v *volume) dataSector() uint32 {
+	return v.reserved + 2*v.fatSectors + v.rootSectors()
+}
+
+func (v *volume) fat(i uint32) []byte {
+	off := (v.reserved + i*v.fatSectors) * SectorSize
+	return v.b[off : off+v.fatSectors*SectorSize]
+}
+
+// next returns the FAT entry of cluster c.
+func (v *volume) next(c uint32) uint32 {
+	fat := v.fat(0)
+	switch v.typ {
+	case 12:
+		e := uint32(binary.LittleEndian.Uint16(fat[c*3/2:]))
+		if c%2 == 1 {
+			return e >> 4
+		}
+		return e & 0xfff
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(fat[c*2:]))
+	}
+	return binary.LittleEndian.Uint32(fat[c*4:]) & 0x0fffffff
+}
+
+func (v *volume) eoc(e uint32) bool {
+	return e >= map[int]uint32{12: 0xff8, 16: 0xfff8, 32: 0x0ffffff8}[v.typ]
+}
+
+// readChain follows the chain from cluster c and returns its data, cut to
+// size unless size is negative.
+func (v *volume) readChain(c uint32, size int64, owner string) []byte {
+	v.t.Helper()
+	var data []byte
+	for n := uint32(0); ; n++ {
+		if c < 2 || c >= v.clusters+2 || n > v.clusters {
+			v.t.Fatalf("%s: bad cluster %d in chain", owner, c)
+		}
+		if prev, ok := v.used[c]; ok {
+			v.t.Fatalf("cluster %d belongs to %s and %s", c, prev, owner)
+		}
+		v.used[c] = owner
+		off := (v.dataSector() + (c-2)*v.spc) * SectorSize
+		data = append(data, v.b[off:off+v.spc*SectorSize]...)
+		e := v.next(c)
+		if v.eoc(e) {
+			break
+		}
+		if e != c+1 {
+			v.t.Errorf("%s: cluster %d is followed by %d; files are contiguous", owner, c, e)
+		}
+		c = e
+	}
+	if size >= 0 {
+		if int64(len(data))-int64(v.spc*SectorSize) >= size && size > 0 {
+			v.t.Errorf("%s: chain of %d bytes for %d bytes", owner, len(data), size)
+		}
+		data = data[:size]
+	}
+	return data
+}
+
+// walk reads the entries of a directory, checking the long names against
+// their short entries.
+func (v *volume) walk(dir []byte, prefix string, self uint32) {
+	v.t.Helper()
+	var long []uint16
+	var sum byte
+	want := byte(0)
+	for i := 0; i+dirEntrySize <= len(dir); i += dirEntrySize {
+		e := dir[i : i+dirEntrySize]
+		switch {
+		case e[0] == 0:
+			return
+		case e[0] == 0xe5:
+			v.t.Errorf("%s: deleted entry in a new image", prefix)
+			continue
+		case e[11] == attrLongName:
+			ord := e[0]
+			if ord&0x40 != 0 {
+				ord &^= 0x40
+				long = make([]uint16, 13*int(ord))
+				sum, want = e[13], ord
+			}
+			if ord != want || e[13] != sum {
+				v.t.Fatalf("%s: long name entries out of order", prefix)
+			}
+			for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				long[int(ord-1)*13+j] = binary.LittleEndian.Uint16(e[off:])
+			}
+			want--
+			continue
+		}
+
+		var short [11]byte
+		copy(short[:], e[:11])
+		shortName := strings.TrimRight(string(short[:8]), " ")
+		if x := strings.TrimRight(string(short[8:]), " "); x != "" {
+			shortName += "." + x
+		}
+		name := shortName
+		if long != nil {
+			if want != 0 || checksum(short) != sum {
+				v.t.Errorf("%s: long name does not belong to %s", prefix, shortName)
+			}
+			for j, u := range long {
+				if u == 0 {
+					long = long[:j]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		}
+
+		cluster := uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+		size := int64(binary.LittleEndian.Uint32(e[28:]))
+		if date, clock := dosTime(buildTime); binary.LittleEndian.Uint16(e[24:]) != date || binary.LittleEndian.Uint16(e[22:]) != clock {
+			v.t.Errorf("%s: time not taken from Options.Time", shortName)
+		}
+		switch {
+		case e[11]&attrVolumeID != 0:
+			if prefix != "" {
+				v.t.Errorf("volume label in %s", prefix)
+			}
+			v.label = strings.TrimRight(shortName, " ")
+		case shortName == "." || shortName == "..":
+			if shortName == "." && cluster != self {
+				v.t.Errorf("%s/.: cluster %d, want %d", prefix, cluster, self)
+			}
+		case e[11]&attrDirectory != 0:
+			path := prefix + "/" + name
+			v.dirs[path], v.shorts[path] = true, shortName
+			v.walk(v.readChain(cluster, -1, path), path, cluster)
+		default:
+			path := prefix + "/" + name
+			v.shorts[path] = shortName
+			if size == 0 {
+				if cluster != 0 {
+					v.t.Errorf("%s: empty file has cluster %d", path, cluster)
+				}
+				v.files[path] = []byte{}
+				continue
+			}
+			v.files[path] = v.readChain(cluster, size, path)
+		}
+	}
+}
+
+// writeFiles creates host files for contents and returns them as Files.
+func writeFiles(t *testing.T, contents map[string][]byte) []File {
+	t.Helper()
+	dir := t.TempDir()
+	var files []File
+	i := 0
+	for path, data := range contents {
+		src := filepath.Join(dir, fmt.Sprintf("src%d", i))
+		i++
+		if err := os.WriteFile(src, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, File{Path: path, Src: src})
+	}
+	return files
+}
+
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7) + seed
+	}
+	return b
+}
+
+func TestReadBack(t *testing.T) {
+	contents := map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI":                   pattern(70000, 1),
+		"EFI/FreeBSD/loader.efi":                 pattern(1, 2),
+		"EFI/FreeBSD/A long file name.conf":      pattern(4096, 3),
+		"EFI/FreeBSD/another long name.conf":     pattern(4097, 4),
+		"EFI/FreeBSD/empty":                      {},
+		"Ünïcödé name with a very long tail.txt": pattern(100, 5),
+		"readme.txt":                             pattern(512, 6),
+		".hidden":                                pattern(3, 7),
+	}
+	// A directory spanning several clusters
+	for i := 0; i < 40; i++ {
+		contents[fmt.Sprintf("many/file number %02d.dat", i)] = pattern(i, byte(i))
+	}
+
+	tests := []struct {
+		typ  int
+		size int64
+		spc  int
+	}{
+		{12, 2 << 20, 0},
+		{16, 16 << 20, 1},
+		{32, 40 << 20, 1},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("FAT%d", tc.typ), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "efi.img")
+			err := Write(context.Background(), path, writeFiles(t, contents), Options{
+				Size:              tc.size,
+				Label:             "efisys",
+				VolumeID:          0x12345678,
+				Type:              tc.typ,
+				SectorsPerCluster: tc.spc,
+				Time:              buildTime,
+			})
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			v := readVolume(t, path)
+			if v.typ != tc.typ {
+				t.Fatalf("read back as FAT%d", v.typ)
+			}
+			if v.label != "EFISYS" {
+				t.Errorf("label %q", v.label)
+			}
+
+			for name, want := range contents {
+				got, ok := v.files["/"+name]
+				if !ok {
+					t.Errorf("%s missing; have %d files", name, len(v.files))
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("%s: %d bytes read back differ from %d written", name, len(got), len(want))
+				}
+			}
+			if len(v.files) != len(contents) {
+				t.Errorf("%d files read back, %d written", len(v.files), len(contents))
+			}
+			if !v.dirs["/EFI/BOOT"] || !v.dirs["/many"] {
+				t.Errorf("directories %v", v.dirs)
+			}
+
+			for path, want := range map[string]string{
+				"/EFI/BOOT/BOOTX64.EFI":               "BOOTX64.EFI",
+				"/EFI/FreeBSD":                        "FREEBSD",
+				"/EFI/FreeBSD/A long file name.conf":  "ALONGF~1.CON",
+				"/EFI/FreeBSD/another long name.conf": "ANOTHE~1.CON",
+				"/.hidden":                            "HIDDEN~1",
+				"/readme.txt":                         "README.TXT",
+				"/many/file number 00.dat":            "FILENU~1.DAT",
+				"/many/file number 01.dat":            "FILENU~2.DAT",
+			} {
+				if got := v.shorts[path]; got != want {
+					t.Errorf("%s: short name %q, want %q", path, got, want)
+				}
+			}
+
+			// Clusters are used exactly by the chains above
+			for c := uint32(2); c < v.clusters+2; c++ {
+				if _, ok := v.used[c]; !ok && v.next(c) != 0 {
+					t.Errorf("cluster %d is allocated but unreachable", c)
+				}
+			}
+			if v.typ == 32 {
+				free := binary.LittleEndian.Uint32(v.b[SectorSize+488:])
+				if free != v.clusters-uint32(len(v.used)) {
+					t.Errorf("FSInfo free count %d, want %d", free, v.clusters-uint32(len(v.used)))
+				}
+				if !bytes.Equal(v.b[:SectorSize], v.b[6*SectorSize:7*SectorSize]) {
+					t.Error("backup boot sector differs")
+				}
+			}
+		})
+	}
+}
+
+func TestChooseType(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want int
+	}{
+		{1 << 20, 12},
+		{64 << 20, 12}, // 64-sector clusters
+		{300 << 20, 16},
+		{4 << 30, 32},
+	} {
+		g, err := newGeometry(uint32(tc.size/SectorSize), 0, 0)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tc.size, err)
+		}
+		if g.typ != tc.want {
+			t.Errorf("%d bytes: FAT%d, want FAT%d", tc.size, g.typ, tc.want)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	files := writeFiles(t, map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI": pattern(3000, 1),
+		"a long name.txt":      pattern(10, 2),
+	})
+	var images [][]byte
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(t.TempDir(), "efi.img")
+		if err := Write(context.Background(), path, files, Options{Size: 1 << 20, Label: "EFI", Time: buildTime}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, b)
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("the same files produced different images")
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	big := writeFiles(t, map[string][]byte{"big.bin": make([]byte, 100<<10)})
+	empty := writeFiles(t, map[string][]byte{"x": {}})[0].Src
+	huge := filepath.Join(t.TempDir(), "huge")
+	if err := os.WriteFile(huge, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(huge, 40<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	manyShort := make([]File, 520)
+	for i := range manyShort {
+		manyShort[i] = File{Path: fmt.Sprintf("F%03d.TXT", i), Src: empty}
+	}
+	manyLong := make([]File, 200)
+	for i := range manyLong {
+		manyLong[i] = File{Path: fmt.Sprintf("long file name %03d", i), Src: empty}
+	}
+
+	tests := []struct {
+		name  string
+		files []File
+		opts  Options
+		want  string
+	}{
+		{"too large", big, Options{Size: 64 << 10}, "files do not fit in a 64 KB FAT12 image"},
+		{"too large FAT32", []File{{Path: "huge", Src: huge}}, Options{Size: 34 << 20, Type: 32, SectorsPerCluster: 1},
+			"files do not fit in a 34816 KB FAT32 image"},
+		{"root entries", manyShort, Options{Size: 1 << 20, Label: "EFI"}, "root directory holds 521 entries, at most 512 fit"},
+		{"root long names", manyLong, Options{Size: 1 << 20}, "root directory holds 600 entries, at most 512 fit"},
+		{"size", nil, Options{Size: 1000}, "image size 1000 is not a positive multiple of 512"},
+		{"type", nil, Options{Size: 1 << 20, Type: 8}, "unsupported FAT type 8"},
+		{"cluster size", nil, Options{Size: 1 << 20, SectorsPerCluster: 3}, "sectors per cluster must be a power of two up to 64, not 3"},
+		{"FAT32 too small", nil, Options{Size: 1 << 20, Type: 32}, "2048 sectors do not make a valid FAT32 filesystem"},
+		{"label", nil, Options{Size: 1 << 20, Label: "much too long"}, `volume label "MUCH TOO LONG" is longer than 11 characters`},
+		{"label chars", nil, Options{Size: 1 << 20, Label: "a.b"}, `volume label "A.B" contains '.'`},
+		{"twice", []File{{Path: "a/b", Src: empty}, {Path: "A/B", Src: empty}}, Options{Size: 1 << 20}, "A/B is listed twice or below a file"},
+		{"below file", []File{{Path: "a", Src: empty}, {Path: "a/b", Src: empty}}, Options{Size: 1 << 20}, "a/b is listed twice or below a file"},
+		{"bad name", []File{{Path: "a:b", Src: empty}}, Options{Size: 1 << 20}, `a:b: name "a:b" contains a character FAT does not allow`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Write(context.Background(), filepath.Join(t.TempDir(), "efi.img"), tc.files, tc.opts)
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("Write error = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestFAT12Packing checks the 12-bit entries that share bytes, at both
+// parities and across a sector boundary.
+func TestFAT12Packing(t *testing.T) {
+	g := &geometry{typ: 12, fatSectors: 12, sectorsPerCluster: 1}
+	var entries []*entry
+	root := &entry{dir: true}
+	for _, n := range []uint32{1, 2, 3, 337, 339, 340} {
+		e := &entry{cluster: n + 1, clusters: 1, parent: root}
+		entries = append(entries, e)
+	}
+	root.children = entries
+	v := &volume{typ: 12, reserved: 0, fatSectors: 12}
+	v.b = g.table(root)
+	for _, e := range entries {
+		if got := v.next(e.cluster); got != 0xfff {
+			t.Errorf("cluster %d: entry %#x, want end of chain", e.cluster, got)
+		}
+	}
+	long := &entry{cluster: 340, clusters: 4}
+	v.b = g.table(&entry{dir: true, children: []*entry{long}})
+	for c := uint32(340); c < 343; c++ {
+		if got := v.next(c); got != c+1 {
+			t.Errorf("cluster %d: next %d, want %d", c, got, c+1)
+		}
+	}
+	if got := v.next(343); got != 0xfff {
+		t.Errorf("cluster 343: entry %#x, want end of chain", got)
+	}
+}
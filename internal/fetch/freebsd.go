@@ -2,6 +2,7 @@ package fetch
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -41,8 +42,9 @@ func NewFetcher(version, arch, mirror, destDir string, logger *util.Logger) *Fet
 }
 
 // FetchArchives downloads base.txz and kernel.txz if they don't exist locally.
-// Returns the paths to the archives.
-func (f *Fetcher) FetchArchives() (basePath, kernelPath string, err error) {
+// Returns the paths to the archives. Cancelling ctx aborts a running download
+// and removes its temporary file.
+func (f *Fetcher) FetchArchives(ctx context.Context) (basePath, kernelPath string, err error) {
 	f.logger.Info("Checking for FreeBSD %s (%s) distribution archives...", f.version, f.arch)
 
 	// Ensure destination directory exists
@@ -82,7 +84,7 @@ func (f *Fetcher) FetchArchives() (basePath, kernelPath string, err error) {
 	// Download missing archives
 	if !baseExists {
 		f.logger.Info("Downloading base.txz from %s...", baseURL)
-		if err := f.downloadFile(baseURL+"/base.txz", basePath); err != nil {
+		if err := f.downloadFile(ctx, baseURL+"/base.txz", basePath); err != nil {
 			return "", "", fmt.Errorf("failed to download base.txz: %w", err)
 		}
 		f.logger.Info("Downloaded base.txz successfully")
@@ -90,23 +92,26 @@ func (f *Fetcher) FetchArchives() (basePath, kernelPath string, err error) {
 
 	if !kernelExists {
 		f.logger.Info("Downloading kernel.txz from %s...", baseURL)
-		if err := f.downloadFile(baseURL+"/kernel.txz", kernelPath); err != nil {
+		if err := f.downloadFile(ctx, baseURL+"/kernel.txz", kernelPath); err != nil {
 			return "", "", fmt.Errorf("failed to download kernel.txz: %w", err)
 		}
 		f.logger.Info("Downloaded kernel.txz successfully")
 	}
 
 	// Optional: Download and verify checksums
-	if err := f.downloadAndVerifyChecksums(baseURL, basePath, kernelPath); err != nil {
+	if err := f.downloadAndVerifyChecksums(ctx, baseURL, basePath, kernelPath); err != nil {
 		f.logger.Warn("Checksum verification failed or unavailable: %v", err)
 		f.logger.Warn("Continuing anyway - archives may be corrupt")
 	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
 
 	return basePath, kernelPath, nil
 }
 
 // downloadFile downloads a file from URL to destination with progress reporting.
-func (f *Fetcher) downloadFile(url, destPath string) error {
+func (f *Fetcher) downloadFile(ctx context.Context, url, destPath string) error {
 	// Create temporary file
 	tmpPath := destPath + ".tmp"
 	defer os.Remove(tmpPath) // Clean up on error
@@ -123,7 +128,11 @@ func (f *Fetcher) downloadFile(url, destPath string) error {
 		Timeout: 30 * time.Minute, // Large files may take time
 	}
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to download: %w", err)
 	}
@@ -227,7 +236,7 @@ func (f *Fetcher) verifyArchive(path string) error {
 }
 
 // downloadAndVerifyChecksums downloads MANIFEST and verifies checksums.
-func (f *Fetcher) downloadAndVerifyChecksums(baseURL, basePath, kernelPath string) error {
+func (f *Fetcher) downloadAndVerifyChecksums(ctx context.Context, baseURL, basePath, kernelPath string) error {
 	// Download MANIFEST file
 	manifestURL := baseURL + "/MANIFEST"
 
@@ -235,7 +244,11 @@ func (f *Fetcher) downloadAndVerifyChecksums(baseURL, basePath, kernelPath strin
 
 	// Download MANIFEST
 	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(manifestURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to download MANIFEST: %w", err)
 	}
@@ -0,0 +1,255 @@
+// Package gpt writes GUID partition tables: a protective MBR carrying boot
+// code, the primary table at the start of the disk and the backup table at
+// its end. It writes tables only; partition contents are the caller's.
+// Read reads them back, checking their CRCs.
+//
+// Identifiers left zero are derived from the layout, so the same layout
+// always produces the same bytes.
+package gpt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// SectorSize is the logical sector size the tables are written for.
+const SectorSize = 512
+
+// Layout of the tables: the MBR at LBA 0, the header at LBA 1 and 128
+// entries of 128 bytes in the next 32 sectors, mirrored at the end of the
+// disk.
+const (
+	headerSize   = 92
+	entryCount   = 128
+	entrySize    = 128
+	entrySectors = entryCount * entrySize / SectorSize
+
+	// FirstUsableLBA is the first sector a partition may start at.
+	FirstUsableLBA = 2 + entrySectors
+)
+
+// GUID is a GUID in its on-disk byte order, with the first three fields
+// little-endian.
+type GUID [16]byte
+
+// Partition types.
+var (
+	TypeEFI         = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TypeFreeBSDBoot = MustParseGUID("83BD6B9D-7F41-11DC-BE0B-001560B84F0F")
+)
+
+// ParseGUID parses a GUID in its usual text form.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 ||
+		len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	copy(g[:], b)
+	reverse(g[0:4])
+	reverse(g[4:6])
+	reverse(g[6:8])
+	return g, nil
+}
+
+// MustParseGUID is ParseGUID for constants.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g GUID) String() string {
+	b := g
+	reverse(b[0:4])
+	reverse(b[4:6])
+	reverse(b[6:8])
+	h := strings.ToUpper(hex.EncodeToString(b[:]))
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// IsZero reports whether g is unset.
+func (g GUID) IsZero() bool { return g == GUID{} }
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// Partition is a table entry. Start and Sectors count 512-byte sectors.
+type Partition struct {
+	Type       GUID
+	GUID       GUID // derived from the disk GUID if zero
+	Name       string
+	Start      uint64
+	Sectors    uint64
+	Attributes uint64
+}
+
+// Table is a partition table for a disk of Sectors 512-byte sectors.
+type Table struct {
+	Sectors    uint64
+	DiskGUID   GUID   // derived from the layout if zero
+	BootCode   []byte // MBR boot code such as FreeBSD's pmbr; 440 bytes are used
+	Partitions []Partition
+}
+
+// LastUsableLBA returns the last sector a partition may end at, before the
+// backup table.
+func (t *Table) LastUsableLBA() uint64 {
+	return t.Sectors - entrySectors - 2
+}
+
+// Write writes the protective MBR, the primary table and the backup table
+// to w, which must be t.Sectors long or be extended by writing.
+func (t *Table) Write(w io.WriterAt) error {
+	if err := t.check(); err != nil {
+		return err
+	}
+	disk := t.DiskGUID
+	if disk.IsZero() {
+		disk = t.deriveGUID("disk")
+	}
+
+	entries := make([]byte, entryCount*entrySize)
+	for i, p := range t.Partitions {
+		if p.GUID.IsZero() {
+			p.GUID = t.deriveGUID(fmt.Sprintf("%s/%d", disk, i))
+		}
+		e := entries[i*entrySize : (i+1)*entrySize]
+		copy(e[0:16], p.Type[:])
+		copy(e[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:], p.Start)
+		binary.LittleEndian.PutUint64(e[40:], p.Start+p.Sectors-1)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for j, u := range utf16.Encode([]rune(p.Name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], u)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	last := t.Sectors - 1
+	writes := []struct {
+		data []byte
+		lba  uint64
+	}{
+		{t.protectiveMBR(), 0},
+		{t.header(disk, 1, last, 2, entriesCRC), 1},
+		{entries, 2},
+		{entries, last - entrySectors},
+		{t.header(disk, last, 1, last-entrySectors, entriesCRC), last},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.data, int64(wr.lba)*SectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check rejects tables that do not fit the disk or overlap.
+func (t *Table) check() error {
+	if t.Sectors < 2*FirstUsableLBA+1 {
+		return fmt.Errorf("disk of %d sectors is too small for a GPT", t.Sectors)
+	}
+	if len(t.Partitions) > entryCount {
+		return fmt.Errorf("%d partitions, at most %d fit", len(t.Partitions), entryCount)
+	}
+	if len(t.BootCode) > SectorSize {
+		return fmt.Errorf("boot code of %d bytes does not fit the MBR", len(t.BootCode))
+	}
+
+	sorted := make([]Partition, len(t.Partitions))
+	copy(sorted, t.Partitions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	for i, p := range sorted {
+		switch {
+		case p.Type.IsZero():
+			return fmt.Errorf("partition %q has no type", p.Name)
+		case len(utf16.Encode([]rune(p.Name))) > 36:
+			return fmt.Errorf("partition name %q is longer than 36 characters", p.Name)
+		case p.Sectors == 0:
+			return fmt.Errorf("partition %q is empty", p.Name)
+		case p.Start < FirstUsableLBA || p.Start+p.Sectors-1 > t.LastUsableLBA():
+			return fmt.Errorf("partition %q (sectors %d-%d) is outside the usable sectors %d-%d",
+				p.Name, p.Start, p.Start+p.Sectors-1, FirstUsableLBA, t.LastUsableLBA())
+		case i > 0 && p.Start < sorted[i-1].Start+sorted[i-1].Sectors:
+			return fmt.Errorf("partitions %q and %q overlap", sorted[i-1].Name, p.Name)
+		}
+	}
+	return nil
+}
+
+// protectiveMBR returns an MBR whose single entry of type 0xee covers the
+// disk, so MBR tools leave it alone, with the boot code in front.
+func (t *Table) protectiveMBR() []byte {
+	mbr := make([]byte, SectorSize)
+	code := t.BootCode
+	if len(code) > 440 {
+		code = code[:440]
+	}
+	copy(mbr, code)
+
+	e := mbr[446:462]
+	e[1], e[2], e[3] = 0x00, 0x02, 0x00 // CHS of LBA 1
+	e[4] = 0xee
+	e[5], e[6], e[7] = 0xff, 0xff, 0xff
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	size := t.Sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(e[12:], uint32(size))
+
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// header returns a GPT header located at lba, with its copy at alternate.
+func (t *Table) header(disk GUID, lba, alternate, entriesLBA uint64, entriesCRC uint32) []byte {
+	h := make([]byte, SectorSize)
+	copy(h[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(h[8:], 0x00010000) // revision 1.0
+	binary.LittleEndian.PutUint32(h[12:], headerSize)
+	binary.LittleEndian.PutUint64(h[24:], lba)
+	binary.LittleEndian.PutUint64(h[32:], alternate)
+	binary.LittleEndian.PutUint64(h[40:], FirstUsableLBA)
+	binary.LittleEndian.PutUint64(h[48:], t.LastUsableLBA())
+	copy(h[56:72], disk[:])
+	binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:], entryCount)
+	binary.LittleEndian.PutUint32(h[84:], entrySize)
+	binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+	binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:headerSize]))
+	return h
+}
+
+// deriveGUID returns a random-format (version 4) GUID computed from the
+// layout and a purpose.
+func (t *Table) deriveGUID(purpose string) GUID {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d\n", purpose, t.Sectors)
+	for _, p := range t.Partitions {
+		fmt.Fprintf(h, "%s %d %d %q\n", p.Type, p.Start, p.Sectors, p.Name)
+	}
+	var g GUID
+	copy(g[:], h.Sum(nil))
+	g[7] = g[7]&0x0f | 0x40 // version 4, in the little-endian third field
+	g[8] = g[8]&0x3f | 0x80 // RFC 4122 variant
+	return g
+}
@@ -0,0 +1,343 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// memDisk is a disk image held in memory.
+type memDisk []byte
+
+func (d memDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(d[off:], p), nil
+}
+
+func (d memDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d memDisk) sector(lba uint64) []byte {
+	return d[lba*SectorSize : (lba+1)*SectorSize]
+}
+
+// testTable is the layout of a hybrid ISO: a freebsd-boot partition and an
+// EFI system partition.
+func testTable() *Table {
+	code := make([]byte, 440)
+	for i := range code {
+		code[i] = byte(i)
+	}
+	return &Table{
+		Sectors:  4096,
+		BootCode: code,
+		Partitions: []Partition{
+			{Type: TypeFreeBSDBoot, Name: "gptboot", Start: 40, Sectors: 1024},
+			{Type: TypeEFI, Name: "efi", Start: 2048, Sectors: 1984},
+		},
+	}
+}
+
+func writeTable(t *testing.T, table *Table) memDisk {
+	t.Helper()
+	d := make(memDisk, table.Sectors*SectorSize)
+	if err := table.Write(d); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return d
+}
+
+func TestWriteGolden(t *testing.T) {
+	table := testTable()
+	d := writeTable(t, table)
+	last := table.Sectors - 1
+
+	var got bytes.Buffer
+	for _, s := range []struct {
+		name string
+		data []byte
+	}{
+		{"protective MBR", d.sector(0)},
+		{"primary header", d.sector(1)[:headerSize]},
+		{"primary entries", d[2*SectorSize : 2*SectorSize+2*entrySize]},
+		{"backup entries", d[(last-entrySectors)*SectorSize : (last-entrySectors)*SectorSize+2*entrySize]},
+		{"backup header", d.sector(last)[:headerSize]},
+	} {
+		got.WriteString("# " + s.name + "\n")
+		got.WriteString(hex.Dump(s.data))
+	}
+
+	golden := filepath.Join("testdata", "table.golden")
+	if *update {
+		if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("tables differ from %s:\n%s", golden, got.String())
+	}
+
+	// The fields the golden file holds, checked against the specification
+	mbr := d.sector(0)
+	if !bytes.Equal(mbr[:440], table.BootCode) {
+		t.Error("boot code not copied into the MBR")
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		t.Error("MBR has no boot signature")
+	}
+	if e := mbr[446:462]; e[4] != 0xee || binary.LittleEndian.Uint32(e[8:]) != 1 ||
+		binary.LittleEndian.Uint32(e[12:]) != uint32(table.Sectors-1) {
+		t.Errorf("protective MBR entry = % x", e)
+	}
+	for i := 1; i < 4; i++ {
+		if e := mbr[446+16*i : 446+16*(i+1)]; !bytes.Equal(e, make([]byte, 16)) {
+			t.Errorf("MBR entry %d is in use: % x", i+1, e)
+		}
+	}
+	for _, h := range []struct {
+		lba, alternate, entries uint64
+	}{{1, last, 2}, {last, 1, last - entrySectors}} {
+		b := d.sector(h.lba)
+		if string(b[0:8]) != "EFI PART" {
+			t.Fatalf("no GPT header at sector %d", h.lba)
+		}
+		fields := map[string][2]uint64{
+			"revision":     {uint64(binary.LittleEndian.Uint32(b[8:])), 0x00010000},
+			"header size":  {uint64(binary.LittleEndian.Uint32(b[12:])), 92},
+			"LBA":          {binary.LittleEndian.Uint64(b[24:]), h.lba},
+			"alternate":    {binary.LittleEndian.Uint64(b[32:]), h.alternate},
+			"first usable": {binary.LittleEndian.Uint64(b[40:]), 34},
+			"last usable":  {binary.LittleEndian.Uint64(b[48:]), table.Sectors - 34},
+			"entries LBA":  {binary.LittleEndian.Uint64(b[72:]), h.entries},
+			"entry count":  {uint64(binary.LittleEndian.Uint32(b[80:])), 128},
+			"entry size":   {uint64(binary.LittleEndian.Uint32(b[84:])), 128},
+		}
+		for name, f := range fields {
+			if f[0] != f[1] {
+				t.Errorf("header at sector %d: %s = %d, want %d", h.lba, name, f[0], f[1])
+			}
+		}
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	a := writeTable(t, testTable())
+	b := writeTable(t, testTable())
+	if !bytes.Equal(a, b) {
+		t.Error("the same layout produced different bytes")
+	}
+
+	other := testTable()
+	other.Partitions[1].Sectors--
+	c := writeTable(t, other)
+	if bytes.Equal(a.sector(1)[56:72], c.sector(1)[56:72]) {
+		t.Error("different layouts derived the same disk GUID")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	table := testTable()
+	table.DiskGUID = MustParseGUID("5A1D2C3B-4E5F-4061-8293-A4B5C6D7E8F9")
+	table.Partitions[1].Attributes = 1
+	d := writeTable(t, table)
+
+	disk, err := Read(d, int64(len(d)))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if disk.Sectors != table.Sectors {
+		t.Errorf("Sectors = %d, want %d", disk.Sectors, table.Sectors)
+	}
+	if disk.MBR == nil || !disk.MBR.BootCode || len(disk.MBR.Partitions) != 1 {
+		t.Fatalf("MBR = %+v", disk.MBR)
+	}
+	if p := disk.MBR.Partitions[0]; p.Type != 0xee || p.Start != 1 || p.Sectors != uint32(table.Sectors-1) {
+		t.Errorf("protective entry = %+v", p)
+	}
+
+	for name, h := range map[string]*Header{"primary": disk.Primary, "backup": disk.Backup} {
+		if h == nil {
+			t.Fatalf("%s header missing", name)
+		}
+		if !h.HeaderCRCValid || !h.EntriesCRCValid {
+			t.Errorf("%s: header CRC valid %v, entries CRC valid %v", name, h.HeaderCRCValid, h.EntriesCRCValid)
+		}
+		if h.DiskGUID != table.DiskGUID {
+			t.Errorf("%s: disk GUID %s, want %s", name, h.DiskGUID, table.DiskGUID)
+		}
+		if h.FirstUsable != FirstUsableLBA || h.LastUsable != table.LastUsableLBA() {
+			t.Errorf("%s: usable sectors %d-%d", name, h.FirstUsable, h.LastUsable)
+		}
+		if len(h.Partitions) != len(table.Partitions) {
+			t.Fatalf("%s: %d partitions, want %d", name, len(h.Partitions), len(table.Partitions))
+		}
+		for i, p := range h.Partitions {
+			want := table.Partitions[i]
+			if p.GUID.IsZero() {
+				t.Errorf("%s: partition %d has no GUID", name, i)
+			}
+			p.GUID = GUID{}
+			if p != want {
+				t.Errorf("%s: partition %d = %+v, want %+v", name, i, p, want)
+			}
+		}
+	}
+	if disk.Primary.Partitions[0].GUID == disk.Primary.Partitions[1].GUID {
+		t.Error("partitions derived the same GUID")
+	}
+	if disk.Primary.Alternate != disk.Backup.LBA || disk.Backup.Alternate != disk.Primary.LBA {
+		t.Errorf("headers do not point at each other: %d->%d, %d->%d",
+			disk.Primary.LBA, disk.Primary.Alternate, disk.Backup.LBA, disk.Backup.Alternate)
+	}
+}
+
+func TestReadDetectsCorruption(t *testing.T) {
+	table := testTable()
+
+	// A damaged primary entry array fails its CRC; the backup is intact
+	d := writeTable(t, table)
+	d[2*SectorSize+40] ^= 0xff
+	disk, err := Read(d, int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Primary.EntriesCRCValid || !disk.Primary.HeaderCRCValid {
+		t.Errorf("primary: header CRC valid %v, entries CRC valid %v", disk.Primary.HeaderCRCValid, disk.Primary.EntriesCRCValid)
+	}
+	if !disk.Backup.EntriesCRCValid || !disk.Backup.HeaderCRCValid {
+		t.Error("backup reported damaged")
+	}
+
+	// So does a damaged header
+	d = writeTable(t, table)
+	last := table.Sectors - 1
+	d.sector(last)[48]++
+	disk, err = Read(d, int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.Backup.HeaderCRCValid {
+		t.Error("backup header CRC valid after corruption")
+	}
+
+	// The header CRC covers exactly the header size
+	d = writeTable(t, table)
+	h := append([]byte(nil), d.sector(1)[:headerSize]...)
+	want := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	if got := crc32.ChecksumIEEE(h); got != want {
+		t.Errorf("header CRC = %08x, want %08x", want, got)
+	}
+
+	// Without tables there is nothing to report
+	blank := make(memDisk, 64*SectorSize)
+	disk, err = Read(blank, int64(len(blank)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.MBR != nil || disk.Primary != nil || disk.Backup != nil {
+		t.Errorf("blank disk read as %+v", disk)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Table)
+		want   string
+	}{
+		{"overlap", func(tb *Table) { tb.Partitions[1].Start = 1063 }, `partitions "gptboot" and "efi" overlap`},
+		{"overlap out of order", func(tb *Table) {
+			tb.Partitions[0], tb.Partitions[1] = tb.Partitions[1], tb.Partitions[0]
+			tb.Partitions[0].Start = 1000
+		}, `partitions "gptboot" and "efi" overlap`},
+		{"before first usable", func(tb *Table) { tb.Partitions[0].Start = 33 }, `partition "gptboot" (sectors 33-1056) is outside the usable sectors 34-4062`},
+		{"past last usable", func(tb *Table) { tb.Partitions[1].Sectors = 2016 }, `partition "efi" (sectors 2048-4063) is outside the usable sectors 34-4062`},
+		{"empty", func(tb *Table) { tb.Partitions[0].Sectors = 0 }, `partition "gptboot" is empty`},
+		{"no type", func(tb *Table) { tb.Partitions[0].Type = GUID{} }, `partition "gptboot" has no type`},
+		{"long name", func(tb *Table) { tb.Partitions[0].Name = strings.Repeat("x", 37) }, "is longer than 36 characters"},
+		{"small disk", func(tb *Table) { tb.Sectors = 68; tb.Partitions = nil }, "disk of 68 sectors is too small for a GPT"},
+		{"boot code", func(tb *Table) { tb.BootCode = make([]byte, 513) }, "boot code of 513 bytes does not fit the MBR"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			table := testTable()
+			tc.modify(table)
+			d := make(memDisk, 4096*SectorSize)
+			err := table.Write(d)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Write error = %v, want %q", err, tc.want)
+			}
+			if !bytes.Equal(d, make(memDisk, len(d))) {
+				t.Error("a rejected table was written")
+			}
+		})
+	}
+
+	// The smallest disk holds both tables and one sector
+	table := &Table{Sectors: 69, Partitions: []Partition{{Type: TypeEFI, Start: 34, Sectors: 1}}}
+	if err := table.Write(make(memDisk, 69*SectorSize)); err != nil {
+		t.Errorf("smallest disk: %v", err)
+	}
+}
+
+func TestProtectiveMBRClamp(t *testing.T) {
+	for _, tc := range []struct {
+		sectors uint64
+		want    uint32
+	}{
+		{4096, 4095},
+		{0xffffffff, 0xfffffffe},
+		{0x100000000, 0xffffffff},
+		{0x100000001, 0xffffffff},
+		{1 << 40, 0xffffffff},
+	} {
+		mbr := (&Table{Sectors: tc.sectors}).protectiveMBR()
+		if got := binary.LittleEndian.Uint32(mbr[446+12:]); got != tc.want {
+			t.Errorf("%d sectors: protective entry covers %#x sectors, want %#x", tc.sectors, got, tc.want)
+		}
+	}
+}
+
+func TestGUIDString(t *testing.T) {
+	const s = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	g := MustParseGUID(s)
+	// The first three fields are stored little-endian
+	if want := []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b}; !bytes.Equal(g[:10], want) {
+		t.Errorf("on-disk bytes % x, want % x", g[:10], want)
+	}
+	if g.String() != s {
+		t.Errorf("String() = %s, want %s", g, s)
+	}
+	if TypeName(TypeEFI) != "efi" || TypeName(TypeFreeBSDBoot) != "freebsd-boot" {
+		t.Error("TypeName does not name the known types")
+	}
+	for _, bad := range []string{"", "C12A7328F81F11D2BA4B00A0C93EC93B", "G12A7328-F81F-11D2-BA4B-00A0C93EC93B"} {
+		if _, err := ParseGUID(bad); err == nil {
+			t.Errorf("ParseGUID(%q) succeeded", bad)
+		}
+	}
+}
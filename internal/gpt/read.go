@@ -0,0 +1,162 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Disk is the partitioning of a disk image as read.
+type Disk struct {
+	Sectors uint64
+
+	// MBR is nil if sector 0 has no boot signature.
+	MBR *MBR
+
+	// Primary and Backup are nil if there is no GPT header at LBA 1 or at
+	// the location the primary header gives for its copy.
+	Primary, Backup *Header
+}
+
+// MBR is a master boot record.
+type MBR struct {
+	BootCode   bool // whether the boot code area is in use
+	Partitions []MBRPartition
+}
+
+// MBRPartition is a used MBR partition entry.
+type MBRPartition struct {
+	Index   int
+	Active  bool
+	Type    byte
+	Start   uint32
+	Sectors uint32
+}
+
+// Header is a GPT header with its partition entries.
+type Header struct {
+	LBA, Alternate          uint64
+	FirstUsable, LastUsable uint64
+	EntriesLBA              uint64
+	DiskGUID                GUID
+	HeaderCRCValid          bool
+	EntriesCRCValid         bool
+	Partitions              []Partition
+}
+
+// Read reads the MBR and both GPT headers of a disk image of size bytes.
+func Read(r io.ReaderAt, size int64) (*Disk, error) {
+	d := &Disk{Sectors: uint64(size) / SectorSize}
+	if d.Sectors < 2 {
+		return nil, fmt.Errorf("image of %d bytes is too small to be partitioned", size)
+	}
+
+	mbr := make([]byte, SectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("cannot read MBR: %w", err)
+	}
+	if mbr[510] == 0x55 && mbr[511] == 0xaa {
+		d.MBR = &MBR{BootCode: !bytes.Equal(mbr[:440], make([]byte, 440))}
+		for i := 0; i < 4; i++ {
+			e := mbr[446+16*i : 446+16*(i+1)]
+			if e[4] == 0 {
+				continue
+			}
+			d.MBR.Partitions = append(d.MBR.Partitions, MBRPartition{
+				Index:   i + 1,
+				Active:  e[0] == 0x80,
+				Type:    e[4],
+				Start:   binary.LittleEndian.Uint32(e[8:]),
+				Sectors: binary.LittleEndian.Uint32(e[12:]),
+			})
+		}
+	}
+
+	var err error
+	if d.Primary, err = readHeader(r, 1); err != nil {
+		return nil, err
+	}
+	backup := d.Sectors - 1
+	if d.Primary != nil && d.Primary.Alternate < d.Sectors {
+		backup = d.Primary.Alternate
+	}
+	if d.Backup, err = readHeader(r, backup); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readHeader reads the GPT header at lba, returning nil if there is none.
+func readHeader(r io.ReaderAt, lba uint64) (*Header, error) {
+	b := make([]byte, SectorSize)
+	if _, err := r.ReadAt(b, int64(lba)*SectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read sector %d: %w", lba, err)
+	}
+	if string(b[0:8]) != "EFI PART" {
+		return nil, nil
+	}
+	size := binary.LittleEndian.Uint32(b[12:])
+	if size < headerSize || size > SectorSize {
+		return nil, fmt.Errorf("GPT header at sector %d has invalid size %d", lba, size)
+	}
+	h := &Header{
+		LBA:         binary.LittleEndian.Uint64(b[24:]),
+		Alternate:   binary.LittleEndian.Uint64(b[32:]),
+		FirstUsable: binary.LittleEndian.Uint64(b[40:]),
+		LastUsable:  binary.LittleEndian.Uint64(b[48:]),
+		EntriesLBA:  binary.LittleEndian.Uint64(b[72:]),
+	}
+	copy(h.DiskGUID[:], b[56:72])
+
+	crc := binary.LittleEndian.Uint32(b[16:])
+	hb := make([]byte, size)
+	copy(hb, b[:size])
+	binary.LittleEndian.PutUint32(hb[16:], 0)
+	h.HeaderCRCValid = crc32.ChecksumIEEE(hb) == crc
+
+	count := binary.LittleEndian.Uint32(b[80:])
+	esize := binary.LittleEndian.Uint32(b[84:])
+	if esize < 128 || esize%8 != 0 || count > 1024 {
+		return h, nil
+	}
+	entries := make([]byte, count*esize)
+	if _, err := r.ReadAt(entries, int64(h.EntriesLBA)*SectorSize); err != nil {
+		return h, nil
+	}
+	h.EntriesCRCValid = crc32.ChecksumIEEE(entries) == binary.LittleEndian.Uint32(b[88:])
+
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*esize : (i+1)*esize]
+		var p Partition
+		copy(p.Type[:], e[0:16])
+		if p.Type.IsZero() {
+			continue
+		}
+		copy(p.GUID[:], e[16:32])
+		p.Start = binary.LittleEndian.Uint64(e[32:])
+		p.Sectors = binary.LittleEndian.Uint64(e[40:]) - p.Start + 1
+		p.Attributes = binary.LittleEndian.Uint64(e[48:])
+		units := make([]uint16, 36)
+		for j := range units {
+			units[j] = binary.LittleEndian.Uint16(e[56+2*j:])
+		}
+		p.Name, _, _ = strings.Cut(string(utf16.Decode(units)), "\x00")
+		h.Partitions = append(h.Partitions, p)
+	}
+	return h, nil
+}
+
+// TypeName returns a short name for a partition type, or the GUID.
+func TypeName(t GUID) string {
+	switch t {
+	case TypeEFI:
+		return "efi"
+	case TypeFreeBSDBoot:
+		return "freebsd-boot"
+	}
+	return t.String()
+}
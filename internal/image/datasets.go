@@ -0,0 +1,84 @@
+package image
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+)
+
+// Dataset roles recorded in the manifest.
+const (
+	datasetRoleRoot      = manifest.RoleRoot      // the boot environment, exported as root.zfs.xz
+	datasetRoleData      = manifest.RoleData      // a declared dataset with its own stream
+	datasetRoleContainer = manifest.RoleContainer // an implied parent that is never mounted
+)
+
+// plannedDataset is a dataset in the image pool together with how it is
+// exported.
+type plannedDataset struct {
+	config.Dataset
+	Role   string
+	Stream string // artifact-relative path of the stream, empty for containers
+}
+
+// datasetPlan returns the datasets to create in the image pool, parents
+// before children. The root dataset is always present; parents that the
+// recipe does not declare (such as pool/ROOT) are added as containers with
+// mountpoint=none and canmount=off so they never shadow the root.
+func datasetPlan(cfg config.ImageConfig) []plannedDataset {
+	declared := make(map[string]config.Dataset)
+	for _, ds := range cfg.Datasets {
+		declared[ds.Name] = ds
+	}
+	if _, ok := declared[cfg.RootDS]; !ok {
+		declared[cfg.RootDS] = config.Dataset{Name: cfg.RootDS, Mountpoint: "/", CanMount: "noauto"}
+	}
+
+	planned := make(map[string]plannedDataset)
+	for name, ds := range declared {
+		role := datasetRoleData
+		stream := "datasets/" + datasetStreamName(cfg.ZpoolName, name)
+		if name == cfg.RootDS {
+			role = datasetRoleRoot
+			stream = "root.zfs.xz"
+		}
+		planned[name] = plannedDataset{Dataset: ds, Role: role, Stream: stream}
+
+		for parent := path.Dir(name); parent != cfg.ZpoolName && parent != "."; parent = path.Dir(parent) {
+			if _, ok := declared[parent]; ok {
+				continue
+			}
+			planned[parent] = plannedDataset{
+				Dataset: config.Dataset{Name: parent, Mountpoint: "none", CanMount: "off"},
+				Role:    datasetRoleContainer,
+			}
+		}
+	}
+
+	// Lexical order puts every parent before its children
+	names := make([]string, 0, len(planned))
+	for name := range planned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	plan := make([]plannedDataset, 0, len(names))
+	for _, name := range names {
+		plan = append(plan, planned[name])
+	}
+	return plan
+}
+
+// relativeDatasetName strips the pool name so the installer can recreate the
+// layout under a differently named pool.
+func relativeDatasetName(pool, name string) string {
+	return strings.TrimPrefix(name, pool+"/")
+}
+
+// datasetStreamName returns the stream file name for a dataset.
+func datasetStreamName(pool, name string) string {
+	return strings.ReplaceAll(relativeDatasetName(pool, name), "/", "_") + ".zfs.xz"
+}
@@ -1,16 +1,28 @@
 package image
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/pgsdf/pgsdbuild/internal/audit"
 	"github.com/pgsdf/pgsdbuild/internal/build"
 	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/fat"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/pipeline"
+	"github.com/pgsdf/pgsdbuild/internal/pkginstall"
+	"github.com/pgsdf/pgsdbuild/internal/pkglist"
+	"github.com/pgsdf/pgsdbuild/internal/repro"
+	"github.com/pgsdf/pgsdbuild/internal/sbom"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
+	"github.com/pgsdf/pgsdbuild/internal/teardown"
 	"github.com/pgsdf/pgsdbuild/internal/util"
 )
 
@@ -18,6 +30,7 @@ import (
 type Builder struct {
 	config *build.Config
 	logger *util.Logger
+	exec   executor.Executor
 }
 
 // NewBuilder creates a new image Builder.
@@ -25,13 +38,33 @@ func NewBuilder(cfg *build.Config, logger *util.Logger) *Builder {
 	return &Builder{
 		config: cfg,
 		logger: logger,
+		exec:   cfg.GetExecutor(),
 	}
 }
 
-// Build implements the ZFS image build pipeline.
-func (b *Builder) Build(cfg config.ImageConfig) error {
+// Build implements the ZFS image build pipeline. When ctx is cancelled the
+// running command is killed and every host resource created so far is
+// released before Build returns.
+//
+// The build runs as the stages listed by Stages. Each completed stage is
+// recorded in the work directory; a failed or partial build keeps its work
+// directory so it can be continued with the config's stage options.
+func (b *Builder) Build(ctx context.Context, cfg config.ImageConfig) (err error) {
 	b.logger.Info("Starting build for %s", cfg.ID)
 
+	// Resolve package lists before touching any disks so a broken list
+	// fails the build immediately
+	resolver := pkglist.NewResolver(b.config.GetPkgListsDir(), b.config.FreeBSDArch)
+	packages, err := resolver.Resolve(cfg.PkgLists)
+	if err != nil {
+		return fmt.Errorf("failed to resolve package lists: %w", err)
+	}
+	b.logger.Debug("Resolved %d package lists to %d packages", len(cfg.PkgLists), len(packages.Packages))
+
+	if err := b.checkRequirements(); err != nil {
+		return err
+	}
+
 	// Create working directories
 	artifactPath := filepath.Join(b.config.GetArtifactsDir(), cfg.ID)
 	if err := util.EnsureDir(artifactPath); err != nil {
@@ -43,189 +76,638 @@ func (b *Builder) Build(cfg config.ImageConfig) error {
 		return err
 	}
 
-	if !b.config.KeepWork {
-		defer func() {
-			if err := util.CleanupDir(workPath); err != nil {
-				b.logger.Warn("Failed to cleanup work directory %s: %v", workPath, err)
-			}
-		}()
-	}
+	// Host resources (md device, pool, mounts) are released in reverse
+	// order when the build ends, before the work directory is removed. If
+	// any of them could not be released, datasets may still be mounted
+	// below the work directory, so it is left alone. A build that did not
+	// finish keeps its work directory for --resume.
+	td := teardown.New(b.logger)
+	opts := b.config.StageOptions(b.logger)
+	finished := false
+	defer func() {
+		tdErr := td.Run(ctx)
+		err = errors.Join(err, tdErr)
+		if b.config.KeepWork {
+			return
+		}
+		if tdErr != nil {
+			b.logger.Warn("Leaving work directory %s in place because teardown failed", workPath)
+			return
+		}
+		if !finished && !opts.DryRun {
+			b.logger.Info("Work directory kept for --resume: %s", workPath)
+			return
+		}
+		if err := b.config.CleanupWorkPath(workPath); err != nil {
+			b.logger.Warn("Failed to cleanup work directory %s: %v", workPath, err)
+		}
+	}()
 
-	// Step 1: Create md-backed disk
-	b.logger.Debug("Creating memory-backed disk...")
-	mdDevice, err := b.createMemoryDisk(workPath, b.config.DiskSizeGB)
+	// The pool is imported with an altroot inside the work directory so
+	// nothing is mounted over the host's own filesystems. Every path into
+	// the image is derived from it.
+	altroot, err := filepath.Abs(filepath.Join(workPath, "mnt"))
 	if err != nil {
-		return fmt.Errorf("failed to create memory disk: %w", err)
+		return err
 	}
-	defer b.destroyMemoryDisk(mdDevice)
-
-	// Step 2: Partition the disk
-	b.logger.Debug("Partitioning disk...")
-	efiPart, zfsPart, err := b.partitionDisk(mdDevice)
-	if err != nil {
-		return fmt.Errorf("failed to partition disk: %w", err)
+	if ok, err := util.IsWithin(b.config.GetWorkDir(), altroot); err != nil || !ok {
+		return fmt.Errorf("altroot %s is not inside the work directory %s", altroot, b.config.GetWorkDir())
 	}
 
-	// Step 3: Create filesystems
-	b.logger.Debug("Creating EFI filesystem...")
-	if err := b.createEFIFilesystem(efiPart); err != nil {
-		return fmt.Errorf("failed to create EFI filesystem: %w", err)
+	run := &imageRun{
+		cfg:          cfg,
+		packages:     packages,
+		td:           td,
+		workPath:     workPath,
+		artifactPath: artifactPath,
+		altroot:      altroot,
+		// The root dataset is mounted at / below the altroot
+		rootMount: altroot,
 	}
+	p := pipeline.New(workPath, b.logger)
+	p.Add(b.stages(run)...)
 
-	b.logger.Debug("Creating ZFS pool and datasets...")
-	if err := b.createZFSPool(cfg, zfsPart); err != nil {
-		return fmt.Errorf("failed to create ZFS pool: %w", err)
+	finished, err = p.Run(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if !finished {
+		return nil
 	}
-	defer b.destroyZFSPool(cfg.ZpoolName)
 
-	// Step 4: Install packages and overlays
-	rootMount := fmt.Sprintf("/%s/ROOT/default", cfg.ZpoolName)
+	b.logger.Info("Build complete! Artifacts in %s/", artifactPath)
+	return nil
+}
 
-	b.logger.Debug("Installing packages...")
-	if err := b.installPackages(cfg, rootMount); err != nil {
-		return fmt.Errorf("failed to install packages: %w", err)
+// imageRun is the state shared by the stages of one image build.
+type imageRun struct {
+	cfg          config.ImageConfig
+	packages     *pkglist.Set
+	td           *teardown.Stack
+	workPath     string
+	artifactPath string
+	altroot      string
+	rootMount    string
+
+	// Set by the disk stage, or when it is reopened
+	md      string
+	efiPart string
+	zfsPart string
+}
+
+// stages lists the image pipeline.
+func (b *Builder) stages(r *imageRun) []pipeline.Stage {
+	cfg := r.cfg
+	diskImage := filepath.Join(r.workPath, "disk.img")
+
+	// Changing the signing key signs the manifest again
+	manifestOutputs := []string{filepath.Join(r.artifactPath, manifest.FileName)}
+	var manifestInputs []string
+	if b.config.SigningKey != "" {
+		manifestOutputs = append(manifestOutputs, manifestOutputs[0]+sign.SignatureExt)
+		manifestInputs = []string{b.config.SigningKey}
+	}
+	// So does a new vulnerability database
+	var auditParams []any
+	if b.config.VulnDB != "" {
+		manifestInputs = append(manifestInputs, b.config.VulnDB)
+		auditParams = []any{b.config.AuditFailOn, b.config.AuditIgnore}
 	}
 
-	b.logger.Debug("Applying overlays...")
-	if err := b.applyOverlays(cfg, rootMount); err != nil {
-		return fmt.Errorf("failed to apply overlays: %w", err)
+	return []pipeline.Stage{
+		{
+			Name:    "disk",
+			Params:  []any{b.config.DiskSizeGB, cfg.ZpoolName, cfg.RootDS, datasetPlan(cfg)},
+			Outputs: []string{diskImage},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Creating memory-backed disk...")
+				md, err := b.createMemoryDisk(ctx, r.td, diskImage, b.config.DiskSizeGB)
+				if err != nil {
+					return fmt.Errorf("failed to create memory disk: %w", err)
+				}
+				r.md = md
+
+				b.logger.Debug("Partitioning disk...")
+				if r.efiPart, r.zfsPart, err = b.partitionDisk(ctx, md); err != nil {
+					return fmt.Errorf("failed to partition disk: %w", err)
+				}
+
+				b.logger.Debug("Creating ZFS pool and datasets...")
+				if err := b.createZFSPool(ctx, r.td, cfg, r.zfsPart, r.altroot); err != nil {
+					return fmt.Errorf("failed to create ZFS pool: %w", err)
+				}
+				return nil
+			},
+			Reopen: func(ctx context.Context) error {
+				md, err := b.attachMemoryDisk(ctx, r.td, diskImage)
+				if err != nil {
+					return err
+				}
+				r.md = md
+				r.efiPart, r.zfsPart = partitions(md)
+				return b.importZFSPool(ctx, r.td, cfg, r.zfsPart, r.altroot)
+			},
+		},
+		{
+			Name:   "packages",
+			Params: []any{r.packages.Names(), cfg.Pkg, b.config.PkgRepo},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Installing packages...")
+				if err := b.installPackages(ctx, cfg, r.packages, r.rootMount, r.workPath); err != nil {
+					return fmt.Errorf("failed to install packages: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "overlays",
+			Inputs: overlayPaths(b.config.GetOverlaysDir(), cfg.Overlays),
+			Params: cfg.Overlays,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Applying overlays...")
+				if err := b.applyOverlays(cfg, r.rootMount); err != nil {
+					return fmt.Errorf("failed to apply overlays: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "system",
+			Params: []any{cfg.System, cfg.Boot},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Applying system configuration...")
+				if err := b.applySystemConfig(ctx, cfg, r.rootMount); err != nil {
+					return fmt.Errorf("failed to apply system configuration: %w", err)
+				}
+
+				b.logger.Debug("Configuring boot loader...")
+				if err := b.applyLoaderConf(cfg, r.rootMount); err != nil {
+					return fmt.Errorf("failed to configure boot loader: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "dataset-overlays",
+			Params: cfg.DatasetOverlays,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Applying dataset overlays...")
+				if err := b.applyDatasetOverlays(ctx, cfg); err != nil {
+					return fmt.Errorf("failed to apply dataset overlays: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "efi",
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Installing EFI loader...")
+				if err := b.populateEFIPartition(ctx, r.efiPart, r.rootMount, r.workPath); err != nil {
+					return fmt.Errorf("failed to install EFI loader: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			// Snapshot every dataset in the pool and export the streams
+			// and the EFI partition
+			Name:    "export",
+			Outputs: []string{filepath.Join(r.artifactPath, "root.zfs.xz"), filepath.Join(r.artifactPath, "efi.img")},
+			Run: func(ctx context.Context) error {
+				if err := b.normalizeRoot(r.rootMount); err != nil {
+					return err
+				}
+
+				b.logger.Debug("Creating ZFS snapshot...")
+				if err := b.createSnapshot(ctx, fmt.Sprintf("%s@install", cfg.ZpoolName)); err != nil {
+					return fmt.Errorf("failed to create snapshot: %w", err)
+				}
+
+				b.logger.Debug("Exporting ZFS streams...")
+				if err := b.exportDatasetStreams(ctx, cfg, r.artifactPath); err != nil {
+					return fmt.Errorf("failed to export ZFS stream: %w", err)
+				}
+
+				b.logger.Debug("Exporting EFI partition...")
+				if err := b.exportEFIPartition(ctx, r.efiPart, filepath.Join(r.artifactPath, "efi.img")); err != nil {
+					return fmt.Errorf("failed to export EFI partition: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			// The SBOMs are written before the manifest, which lists them
+			Name:    "sbom",
+			Inputs:  overlayPaths(b.config.GetOverlaysDir(), cfg.Overlays),
+			Outputs: []string{filepath.Join(r.artifactPath, sbom.SPDXFile), filepath.Join(r.artifactPath, sbom.CycloneDXFile)},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Creating SBOM...")
+				installed, err := b.queryPackages(ctx, cfg, r.rootMount, r.workPath)
+				if err != nil {
+					return err
+				}
+				if err := b.createSBOM(cfg, r.packages, installed, r.artifactPath); err != nil {
+					return fmt.Errorf("failed to create SBOM: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			// The audit runs before signing, so a vulnerable image is
+			// never signed
+			Name:    "manifest",
+			Inputs:  manifestInputs,
+			Params:  auditParams,
+			Outputs: manifestOutputs,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Creating manifest...")
+				installed, err := b.queryPackages(ctx, cfg, r.rootMount, r.workPath)
+				if err != nil {
+					return err
+				}
+				m, err := b.createManifest(cfg, r.packages, installed, r.artifactPath)
+				if err != nil {
+					return fmt.Errorf("failed to create manifest: %w", err)
+				}
+				if err := b.auditImage(cfg, m, r.artifactPath); err != nil {
+					return fmt.Errorf("package audit failed: %w", err)
+				}
+				if err := b.signManifest(r.artifactPath); err != nil {
+					return fmt.Errorf("failed to sign manifest: %w", err)
+				}
+				return nil
+			},
+		},
 	}
+}
 
-	// Apply ZFS dataset overlays
-	b.logger.Debug("Applying dataset overlays...")
-	if err := b.applyDatasetOverlays(cfg); err != nil {
-		return fmt.Errorf("failed to apply dataset overlays: %w", err)
+// signManifest writes manifest.toml.sig with the configured signing key. A
+// signature left by an earlier build is removed when no key is configured,
+// since it would no longer match.
+func (b *Builder) signManifest(artifactPath string) error {
+	manifestPath := filepath.Join(artifactPath, manifest.FileName)
+	if executor.IsDryRun(b.exec) {
+		if b.config.SigningKey != "" {
+			b.logger.Info("Would sign %s with %s", manifest.FileName, b.config.SigningKey)
+		}
+		return nil
 	}
+	if b.config.SigningKey == "" {
+		if err := os.Remove(manifestPath + sign.SignatureExt); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	key, err := sign.LoadPrivateKey(b.config.SigningKey)
+	if err != nil {
+		return err
+	}
+	if err := sign.SignFile(key, manifestPath); err != nil {
+		return err
+	}
+	b.logger.Info("Signed %s with key %s (%s)", manifest.FileName, key.ID, key.Name)
+	return nil
+}
 
-	// Step 5: Create snapshot
-	b.logger.Debug("Creating ZFS snapshot...")
-	snapshot := fmt.Sprintf("%s@install", cfg.RootDS)
-	if err := b.createSnapshot(snapshot); err != nil {
-		return fmt.Errorf("failed to create snapshot: %w", err)
+// auditImage checks the packages recorded in m against the configured
+// VuXML file and fails on advisories rated at or above the threshold.
+// Without a database it does nothing.
+func (b *Builder) auditImage(cfg config.ImageConfig, m *manifest.Manifest, artifactPath string) error {
+	if b.config.VulnDB == "" {
+		return nil
+	}
+	threshold, err := audit.ParseThreshold(b.config.AuditFailOn)
+	if err != nil {
+		return err
+	}
+	db, err := audit.Load(b.config.VulnDB)
+	if err != nil {
+		return err
 	}
 
-	// Step 6: Export artifacts
-	b.logger.Debug("Exporting ZFS stream...")
-	zfsArtifact := filepath.Join(artifactPath, "root.zfs.xz")
-	if err := b.exportZFSStream(snapshot, zfsArtifact); err != nil {
-		return fmt.Errorf("failed to export ZFS stream: %w", err)
+	b.logger.Debug("Auditing packages against %s...", b.config.VulnDB)
+	report := db.Image(m, b.config.AuditIgnore)
+	if len(report.Unversioned) > 0 && !executor.IsDryRun(b.exec) {
+		b.logger.Warn("%d package(s) have no version and were not audited", len(report.Unversioned))
+	}
+	for _, f := range report.Findings {
+		b.logger.Warn("%s", f)
 	}
 
-	b.logger.Debug("Exporting EFI partition...")
-	efiArtifact := filepath.Join(artifactPath, "efi.img")
-	if err := b.exportEFIPartition(efiPart, efiArtifact); err != nil {
-		return fmt.Errorf("failed to export EFI partition: %w", err)
+	if failing := report.Failing(threshold); len(failing) > 0 {
+		// A signature left by an earlier build would still match an
+		// identical manifest
+		sigPath := filepath.Join(artifactPath, manifest.FileName+sign.SignatureExt)
+		if executor.IsDryRun(b.exec) {
+			b.logger.Info("Would remove %s", sigPath)
+		} else if err := os.Remove(sigPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("%d advisory match(es) rated %s or worse; run 'pgsdbuild audit %s' for details",
+			len(failing), threshold, cfg.ID)
 	}
+	b.logger.Info("Audited %d package(s) against %d advisories: %d below %s",
+		report.Packages, report.Advisories, len(report.Findings), threshold)
+	return nil
+}
 
-	// Step 7: Create manifest
-	b.logger.Debug("Creating manifest...")
-	manifestPath := filepath.Join(artifactPath, "manifest.toml")
-	if err := b.createManifest(cfg, manifestPath); err != nil {
-		return fmt.Errorf("failed to create manifest: %w", err)
+// overlayPaths returns the directories of the named overlays.
+func overlayPaths(overlaysDir string, overlays []string) []string {
+	paths := make([]string, len(overlays))
+	for i, o := range overlays {
+		paths[i] = filepath.Join(overlaysDir, o)
 	}
+	return paths
+}
 
-	b.logger.Info("Build complete! Artifacts in %s/", artifactPath)
+// requiredTools are the FreeBSD commands the image pipeline runs.
+var requiredTools = []string{"mdconfig", "gpart", "zpool", "zfs", "xz", "dd"}
+
+// checkRequirements verifies that the FreeBSD tools used by the pipeline
+// are available before any resource is created.
+func (b *Builder) checkRequirements() error {
+	var missing []string
+	for _, tool := range requiredTools {
+		if _, err := b.exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("image builds require FreeBSD; commands not found: %s\nHint: Use --dry-run to print the build commands on this host", strings.Join(missing, ", "))
+	}
 	return nil
 }
 
-// createMemoryDisk creates an md-backed disk and returns the device name.
-func (b *Builder) createMemoryDisk(workPath string, sizeGB int) (string, error) {
-	diskPath := filepath.Join(workPath, "disk.img")
-
+// createMemoryDisk creates a sparse disk image at diskPath, attaches it as
+// a vnode-backed md device and returns the device name (e.g. "md0"). The
+// device is detached by the teardown stack.
+func (b *Builder) createMemoryDisk(ctx context.Context, td *teardown.Stack, diskPath string, sizeGB int) (string, error) {
 	// Create a sparse file
 	size := int64(sizeGB) * 1024 * 1024 * 1024
 	if err := util.CreateSparseFile(diskPath, size); err != nil {
 		return "", err
 	}
 
-	// On FreeBSD, we would use: mdconfig -a -t vnode -f diskPath
-	// For this prototype, we'll simulate it
-	b.logger.Debug("Created sparse disk: %s (%d GB)", diskPath, sizeGB)
-	return diskPath, nil
+	md, err := b.attachMemoryDisk(ctx, td, diskPath)
+	if err != nil {
+		return "", err
+	}
+	b.logger.Debug("Attached %s to %s (%d GB)", diskPath, md, sizeGB)
+	return md, nil
 }
 
-// destroyMemoryDisk destroys the memory disk.
-func (b *Builder) destroyMemoryDisk(mdDevice string) {
-	// On FreeBSD: mdconfig -d -u <unit>
-	// For prototype, just remove the file
-	os.Remove(mdDevice)
-}
+// attachMemoryDisk attaches an existing disk image as an md device.
+func (b *Builder) attachMemoryDisk(ctx context.Context, td *teardown.Stack, diskPath string) (string, error) {
+	// On FreeBSD: mdconfig -a -t vnode -f diskPath
+	output, err := b.exec.Run(ctx, executor.Cmd("mdconfig", "-a", "-t", "vnode", "-f", diskPath))
+	if err != nil {
+		return "", fmt.Errorf("mdconfig failed: %w\nOutput: %s", err, output)
+	}
+	md := strings.TrimSpace(string(output))
+	if md == "" {
+		if !executor.IsDryRun(b.exec) {
+			return "", fmt.Errorf("mdconfig did not report a device name")
+		}
+		md = "md0" // placeholder so the printed plan is complete
+	}
 
-// partitionDisk partitions the disk with GPT, EFI, and ZFS partitions.
-func (b *Builder) partitionDisk(mdDevice string) (efi, zfs string, err error) {
-	// On FreeBSD, we would use gpart:
-	// gpart create -s gpt mdDevice
-	// gpart add -t efi -s 200M mdDevice
-	// gpart add -t freebsd-zfs mdDevice
+	td.Push("memory disk "+md, func(ctx context.Context) error { return b.destroyMemoryDisk(ctx, md) })
+	return md, nil
+}
 
-	// For prototype, we'll create dummy partition files
-	efi = mdDevice + ".p1"
-	zfs = mdDevice + ".p2"
+// destroyMemoryDisk detaches the md device.
+func (b *Builder) destroyMemoryDisk(ctx context.Context, md string) error {
+	// On FreeBSD: mdconfig -d -u <unit>
+	if output, err := b.exec.Run(ctx, executor.Cmd("mdconfig", "-d", "-u", md)); err != nil {
+		return fmt.Errorf("mdconfig -d failed: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
 
-	// Create dummy partition files
-	if err := util.CreateSparseFile(efi, 200*1024*1024); err != nil {
-		return "", "", err
+// partitionDisk partitions the disk with GPT, EFI, and ZFS partitions and
+// returns the partition device paths.
+func (b *Builder) partitionDisk(ctx context.Context, md string) (efi, zfs string, err error) {
+	// The layout matches what pgsd-inst creates on the target disk
+	commands := [][]string{
+		{"gpart", "create", "-s", "gpt", md},
+		{"gpart", "add", "-t", "efi", "-s", fmt.Sprintf("%dM", efiPartitionSize>>20), "-l", "efiboot0", md},
+		{"gpart", "add", "-t", "freebsd-zfs", "-l", "zfsroot0", md},
 	}
-	if err := util.CreateSparseFile(zfs, 9*1024*1024*1024); err != nil {
-		return "", "", err
+	for _, args := range commands {
+		if output, err := b.exec.Run(ctx, executor.Cmd(args[0], args[1:]...)); err != nil {
+			return "", "", fmt.Errorf("%s failed: %w\nOutput: %s", strings.Join(args, " "), err, output)
+		}
 	}
 
+	efi, zfs = partitions(md)
 	b.logger.Debug("Created partitions: %s, %s", efi, zfs)
 	return efi, zfs, nil
 }
 
-// createEFIFilesystem creates a FAT32 filesystem on the EFI partition.
-func (b *Builder) createEFIFilesystem(efiPart string) error {
-	// On FreeBSD: newfs_msdos -F 32 efiPart
-	// For prototype, we'll just note it was created
-	b.logger.Debug("EFI filesystem created on %s", efiPart)
-	return nil
+// partitions returns the EFI and ZFS partition devices of md.
+func partitions(md string) (efi, zfs string) {
+	return "/dev/" + md + "p1", "/dev/" + md + "p2"
 }
 
-// createZFSPool creates a ZFS pool and datasets.
-func (b *Builder) createZFSPool(cfg config.ImageConfig, zfsPart string) error {
+// createZFSPool creates the image pool with its altroot, creates every
+// planned dataset and mounts the root dataset and the mounted data
+// datasets below the altroot. The pool is exported by the teardown stack.
+func (b *Builder) createZFSPool(ctx context.Context, td *teardown.Stack, cfg config.ImageConfig, zfsPart, altroot string) error {
+	if err := b.checkPoolName(ctx, cfg.ZpoolName); err != nil {
+		return err
+	}
+	if err := util.EnsureDir(altroot); err != nil {
+		return err
+	}
+
 	// On FreeBSD:
-	// zpool create -o altroot=/mnt -O compression=lz4 -O atime=off poolName zfsPart
-	// zfs create -o mountpoint=none poolName/ROOT
-	// zfs create -o mountpoint=/ poolName/ROOT/default
+	// zpool create -f -R altroot -O compression=lz4 -O atime=off -O mountpoint=none poolName zfsPart
+	cmd := executor.Cmd("zpool", "create", "-f",
+		"-R", altroot,
+		"-O", "compression=lz4",
+		"-O", "atime=off",
+		"-O", "mountpoint=none",
+		cfg.ZpoolName, zfsPart)
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("zpool create failed: %w\nOutput: %s", err, output)
+	}
+	td.Push("pool "+cfg.ZpoolName, func(ctx context.Context) error { return b.exportZFSPool(ctx, cfg.ZpoolName) })
+
+	// Datasets are created unmounted; parents come before children
+	plan := datasetPlan(cfg)
+	for _, ds := range plan {
+		args := []string{"create", "-u"}
+		if ds.Mountpoint != "" {
+			args = append(args, "-o", "mountpoint="+ds.Mountpoint)
+		}
+		if ds.CanMount != "" {
+			args = append(args, "-o", "canmount="+ds.CanMount)
+		}
+		for _, k := range sortedKeys(ds.Properties) {
+			args = append(args, "-o", fmt.Sprintf("%s=%s", k, ds.Properties[k]))
+		}
+		args = append(args, ds.Name)
+		if output, err := b.exec.Run(ctx, executor.Cmd("zfs", args...)); err != nil {
+			return fmt.Errorf("zfs create %s failed: %w\nOutput: %s", ds.Name, err, output)
+		}
+		b.logger.Debug("Created dataset %s (%s, mountpoint=%s, canmount=%s)",
+			ds.Name, ds.Role, ds.Mountpoint, ds.CanMount)
+	}
 
-	// For prototype, we'll create a directory structure
-	rootMount := fmt.Sprintf("/%s/ROOT/default", cfg.ZpoolName)
-	if err := util.EnsureDir(rootMount); err != nil {
+	if err := b.mountDatasets(ctx, cfg); err != nil {
 		return err
 	}
 
-	b.logger.Debug("Created pool %s with root dataset %s", cfg.ZpoolName, cfg.RootDS)
+	b.logger.Debug("Created pool %s with root dataset %s at %s", cfg.ZpoolName, cfg.RootDS, altroot)
 	return nil
 }
 
-// destroyZFSPool destroys the ZFS pool.
-func (b *Builder) destroyZFSPool(poolName string) {
-	// On FreeBSD: zpool destroy -f poolName
-	// For prototype, remove the directory
-	_ = util.CleanupDir(fmt.Sprintf("/%s", poolName))
-}
+// importZFSPool imports the pool of a disk image created by an earlier run
+// of the build and mounts its datasets as createZFSPool does.
+func (b *Builder) importZFSPool(ctx context.Context, td *teardown.Stack, cfg config.ImageConfig, zfsPart, altroot string) error {
+	if err := b.checkPoolName(ctx, cfg.ZpoolName); err != nil {
+		return err
+	}
 
-// installPackages installs packages into the root mount.
-func (b *Builder) installPackages(cfg config.ImageConfig, rootMount string) error {
-	// On FreeBSD:
-	// pkg -r rootMount install -y <packages>
+	// On FreeBSD: zpool import -N -R altroot -d zfsPart poolName
+	cmd := executor.Cmd("zpool", "import", "-N", "-R", altroot, "-d", zfsPart, cfg.ZpoolName)
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("zpool import failed: %w\nOutput: %s", err, output)
+	}
+	td.Push("pool "+cfg.ZpoolName, func(ctx context.Context) error { return b.exportZFSPool(ctx, cfg.ZpoolName) })
+
+	if err := b.mountDatasets(ctx, cfg); err != nil {
+		return err
+	}
+	b.logger.Debug("Imported pool %s at %s", cfg.ZpoolName, altroot)
+	return nil
+}
 
-	// For prototype, we'll create a marker file showing what packages would be installed
-	pkgList := filepath.Join(rootMount, "installed-packages.txt")
-	content := fmt.Sprintf("# Image: %s\n# Package sets installed:\n", cfg.ID)
-	for _, pkgSet := range cfg.PkgLists {
-		content += fmt.Sprintf("# - %s\n", pkgSet)
+// checkPoolName refuses to touch a pool of the same name on the build host.
+func (b *Builder) checkPoolName(ctx context.Context, pool string) error {
+	output, err := b.exec.Run(ctx, executor.Cmd("zpool", "list", "-H", "-o", "name"))
+	if err != nil {
+		return fmt.Errorf("zpool list failed: %w\nOutput: %s", err, output)
+	}
+	for _, name := range strings.Fields(string(output)) {
+		if name == pool {
+			return fmt.Errorf("a pool named %s is already imported on this host\nHint: Export it or build on another host", pool)
+		}
 	}
+	return nil
+}
 
-	if err := util.WriteStringToFile(pkgList, content, 0644); err != nil {
+// mountDatasets mounts the root dataset first, then the mounted data
+// datasets by mountpoint depth so nested mountpoints land inside their
+// parents.
+func (b *Builder) mountDatasets(ctx context.Context, cfg config.ImageConfig) error {
+	if err := b.mountDataset(ctx, cfg.RootDS); err != nil {
 		return err
 	}
+	var mounted []plannedDataset
+	for _, ds := range datasetPlan(cfg) {
+		if ds.Role == datasetRoleData && strings.HasPrefix(ds.Mountpoint, "/") &&
+			ds.CanMount != "off" && ds.CanMount != "noauto" {
+			mounted = append(mounted, ds)
+		}
+	}
+	sort.Slice(mounted, func(i, j int) bool { return mounted[i].Mountpoint < mounted[j].Mountpoint })
+	for _, ds := range mounted {
+		if err := b.mountDataset(ctx, ds.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	b.logger.Debug("Installed package lists: %v", cfg.PkgLists)
+// mountDataset mounts a dataset of the image pool below its altroot.
+func (b *Builder) mountDataset(ctx context.Context, name string) error {
+	if output, err := b.exec.Run(ctx, executor.Cmd("zfs", "mount", name)); err != nil {
+		return fmt.Errorf("zfs mount %s failed: %w\nOutput: %s", name, err, output)
+	}
 	return nil
 }
 
+// exportZFSPool exports the image pool, unmounting its datasets. The pool
+// stays on the disk image so an unfinished build can be resumed.
+func (b *Builder) exportZFSPool(ctx context.Context, poolName string) error {
+	if output, err := b.exec.Run(ctx, executor.Cmd("zpool", "export", "-f", poolName)); err != nil {
+		return fmt.Errorf("zpool export failed: %w\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// efiPartitionSize is the size of the EFI system partition, as pgsd-inst
+// creates it on the target disk.
+const efiPartitionSize = 200 << 20
+
+// populateEFIPartition writes a FAT32 filesystem holding the root's EFI
+// loader, as the removable-media default EFI/BOOT/BOOTX64.EFI and as
+// EFI/FreeBSD/loader.efi, and copies it onto the EFI partition.
+func (b *Builder) populateEFIPartition(ctx context.Context, efiPart, rootMount, workPath string) error {
+	imgPath := filepath.Join(workPath, "efi.img")
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would write EFI filesystem %s", imgPath)
+	} else {
+		var files []fat.File
+		loader := filepath.Join(rootMount, "boot", "loader.efi")
+		if util.FileExists(loader) {
+			files = []fat.File{
+				{Path: "EFI/BOOT/BOOTX64.EFI", Src: loader},
+				{Path: "EFI/FreeBSD/loader.efi", Src: loader},
+			}
+		} else {
+			b.logger.Warn("No EFI loader at %s, efi.img will not be bootable", loader)
+		}
+		err := fat.Write(ctx, imgPath, files, fat.Options{
+			Size:              efiPartitionSize,
+			Label:             "EFISYS",
+			VolumeID:          uint32(b.config.BuildTime().Unix()),
+			Type:              32,
+			SectorsPerCluster: 1,
+			Time:              b.config.BuildTime(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write EFI filesystem: %w", err)
+		}
+		defer os.Remove(imgPath)
+	}
+
+	cmd := executor.Cmd("dd", "if="+imgPath, "of="+efiPart, "bs=1m")
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("dd failed: %w\nOutput: %s", err, output)
+	}
+	b.logger.Debug("EFI filesystem written to %s", efiPart)
+	return nil
+}
+
+// installPackages installs the resolved package set into the root mount
+// with pkg -r rootMount -R <repos> install -y <packages>.
+func (b *Builder) installPackages(ctx context.Context, cfg config.ImageConfig, packages *pkglist.Set, rootMount, workPath string) error {
+	if !pkginstall.Available(b.exec) {
+		return fmt.Errorf("pkg(8) not found on this host; it is needed to install %d packages\nHint: Use --dry-run to check the build without it", len(packages.Packages))
+	}
+
+	installer := pkginstall.New(b.exec, rootMount, workPath, cfg.Pkg, b.logger)
+	if b.config.PkgRepo != "" {
+		b.logger.Info("Using package repository override: %s", b.config.PkgRepo)
+		if err := installer.OverrideRepository(b.config.PkgRepo); err != nil {
+			return err
+		}
+	}
+	return installer.Install(ctx, packages.Names())
+}
+
+// queryPackages returns the package database of the root.
+func (b *Builder) queryPackages(ctx context.Context, cfg config.ImageConfig, rootMount, workPath string) ([]pkginstall.InstalledPackage, error) {
+	installed, err := pkginstall.New(b.exec, rootMount, workPath, cfg.Pkg, b.logger).Query(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installed packages: %w", err)
+	}
+	b.logger.Debug("Installed package lists: %v (%d packages including dependencies)", cfg.PkgLists, len(installed))
+	return installed, nil
+}
+
 // applyOverlays copies overlay files into the root mount.
 func (b *Builder) applyOverlays(cfg config.ImageConfig, rootMount string) error {
 	overlaysDir := b.config.GetOverlaysDir()
@@ -249,7 +731,7 @@ func (b *Builder) applyOverlays(cfg config.ImageConfig, rootMount string) error
 }
 
 // applyDatasetOverlays receives ZFS datasets into the image pool.
-func (b *Builder) applyDatasetOverlays(cfg config.ImageConfig) error {
+func (b *Builder) applyDatasetOverlays(ctx context.Context, cfg config.ImageConfig) error {
 	if len(cfg.DatasetOverlays) == 0 {
 		b.logger.Debug("No dataset overlays configured")
 		return nil
@@ -257,12 +739,19 @@ func (b *Builder) applyDatasetOverlays(cfg config.ImageConfig) error {
 
 	pool := cfg.ZpoolName
 
+	// Overlays are received below an unmounted container
+	container := pool + "/OVERLAYS"
+	cmd := executor.Cmd("zfs", "create", "-o", "mountpoint=none", "-o", "canmount=off", container)
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("zfs create %s failed: %w\nOutput: %s", container, err, output)
+	}
+
 	for _, o := range cfg.DatasetOverlays {
 		if o.Source == "" || o.Name == "" {
 			return fmt.Errorf("dataset overlay missing source or name")
 		}
 
-		target := fmt.Sprintf("%s/OVERLAYS/%s", pool, o.Name)
+		target := fmt.Sprintf("%s/%s", container, o.Name)
 
 		b.logger.Info("Receiving dataset overlay: %s -> %s", o.Source, target)
 
@@ -274,40 +763,18 @@ func (b *Builder) applyDatasetOverlays(cfg config.ImageConfig) error {
 		if o.CanMount != "" {
 			recvArgs = append(recvArgs, "-o", "canmount="+o.CanMount)
 		}
-		for k, v := range o.Properties {
-			recvArgs = append(recvArgs, "-o", fmt.Sprintf("%s=%s", k, v))
+		for _, k := range sortedKeys(o.Properties) {
+			recvArgs = append(recvArgs, "-o", fmt.Sprintf("%s=%s", k, o.Properties[k]))
 		}
 		recvArgs = append(recvArgs, target)
 
 		// Pipe: zfs send source | zfs recv target
-		send := exec.Command("zfs", "send", "-p", o.Source)
-		recv := exec.Command("zfs", recvArgs...)
-
-		pipe, err := send.StdoutPipe()
+		output, err := b.exec.Pipe(ctx,
+			executor.Cmd("zfs", "send", "-p", o.Source),
+			executor.Cmd("zfs", recvArgs...),
+		)
 		if err != nil {
-			return fmt.Errorf("failed to create pipe for %s: %w", o.Name, err)
-		}
-		recv.Stdin = pipe
-
-		// Capture stderr for debugging
-		sendErr, _ := send.StderrPipe()
-		recvErr, _ := recv.StderrPipe()
-
-		if err := send.Start(); err != nil {
-			return fmt.Errorf("failed to start zfs send for %s: %w", o.Source, err)
-		}
-		if err := recv.Start(); err != nil {
-			return fmt.Errorf("failed to start zfs recv for %s: %w", target, err)
-		}
-
-		// Wait for both commands to complete
-		if err := send.Wait(); err != nil {
-			stderr, _ := io.ReadAll(sendErr)
-			return fmt.Errorf("zfs send failed for %s: %w\nOutput: %s", o.Source, err, string(stderr))
-		}
-		if err := recv.Wait(); err != nil {
-			stderr, _ := io.ReadAll(recvErr)
-			return fmt.Errorf("zfs recv failed for %s: %w\nOutput: %s", target, err, string(stderr))
+			return fmt.Errorf("zfs send/recv failed for %s -> %s: %w\nOutput: %s", o.Source, target, err, output)
 		}
 
 		b.logger.Debug("Applied dataset overlay: %s", o.Name)
@@ -316,78 +783,239 @@ func (b *Builder) applyDatasetOverlays(cfg config.ImageConfig) error {
 	return nil
 }
 
-// createSnapshot creates a ZFS snapshot.
-func (b *Builder) createSnapshot(snapshot string) error {
-	// On FreeBSD: zfs snapshot snapshot
+// normalizeRoot clamps file times in the mounted root to SOURCE_DATE_EPOCH
+// before it is snapshotted. It does nothing unless the build is
+// reproducible.
+func (b *Builder) normalizeRoot(rootMount string) error {
+	if !b.config.Reproducible() || executor.IsDryRun(b.exec) {
+		return nil
+	}
+	st, err := repro.NormalizeTree(rootMount, b.config.SourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	b.logger.Debug("Normalized %s: %d file times clamped", rootMount, st.Clamped)
+	if st.Skipped > 0 {
+		b.logger.Warn("%d files in %s could not be normalized", st.Skipped, rootMount)
+	}
+	return nil
+}
+
+// createSnapshot creates a recursive ZFS snapshot.
+func (b *Builder) createSnapshot(ctx context.Context, snapshot string) error {
+	if output, err := b.exec.Run(ctx, executor.Cmd("zfs", "snapshot", "-r", snapshot)); err != nil {
+		return fmt.Errorf("zfs snapshot failed: %w\nOutput: %s", err, output)
+	}
 	b.logger.Debug("Created snapshot: %s", snapshot)
 	return nil
 }
 
-// exportZFSStream exports a ZFS snapshot as a compressed stream.
-func (b *Builder) exportZFSStream(snapshot, outputPath string) error {
-	// On FreeBSD: zfs send snapshot | xz -9 > outputPath
+// exportDatasetStreams exports the root dataset and every declared dataset
+// as separate compressed streams in the artifact directory.
+func (b *Builder) exportDatasetStreams(ctx context.Context, cfg config.ImageConfig, artifactPath string) error {
+	for _, ds := range datasetPlan(cfg) {
+		if ds.Stream == "" {
+			continue
+		}
 
-	// For prototype, create a dummy compressed file
-	content := fmt.Sprintf("# ZFS snapshot: %s\n# Created: %s\n",
-		snapshot, time.Now().Format(time.RFC3339))
+		outputPath := filepath.Join(artifactPath, ds.Stream)
+		if err := b.exportZFSStream(ctx, ds.Name+"@install", outputPath); err != nil {
+			return fmt.Errorf("%s: %w", ds.Name, err)
+		}
+	}
+	return nil
+}
 
-	if err := util.WriteStringToFile(outputPath, content, 0644); err != nil {
+// exportZFSStream exports a ZFS snapshot as an xz-compressed stream.
+func (b *Builder) exportZFSStream(ctx context.Context, snapshot, outputPath string) error {
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would export %s to %s", snapshot, outputPath)
+		return nil
+	}
+	if err := util.EnsureDir(filepath.Dir(outputPath)); err != nil {
 		return err
 	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", outputPath, err)
+	}
+	defer out.Close()
+
+	// On FreeBSD: zfs send -p snapshot | xz -9 -T0 > outputPath
+	xz := executor.Cmd("xz", "-9", "-T0")
+	xz.Stdout = out
+	if output, err := b.exec.Pipe(ctx, executor.Cmd("zfs", "send", "-p", snapshot), xz); err != nil {
+		return fmt.Errorf("zfs send failed: %w\nOutput: %s", err, output)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outputPath, err)
+	}
 
 	b.logger.Debug("Exported ZFS stream to %s", outputPath)
 	return nil
 }
 
 // exportEFIPartition exports the EFI partition as an image.
-func (b *Builder) exportEFIPartition(efiPart, outputPath string) error {
-	// On FreeBSD: dd if=efiPart of=outputPath bs=1M
-
-	// For prototype, copy the dummy partition file
-	data, err := os.ReadFile(efiPart)
-	if err != nil {
-		return fmt.Errorf("failed to read EFI partition: %w", err)
-	}
-	if err := os.WriteFile(outputPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write EFI image: %w", err)
+func (b *Builder) exportEFIPartition(ctx context.Context, efiPart, outputPath string) error {
+	cmd := executor.Cmd("dd", "if="+efiPart, "of="+outputPath, "bs=1m")
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("dd failed: %w\nOutput: %s", err, output)
 	}
 
 	b.logger.Debug("Exported EFI partition to %s", outputPath)
 	return nil
 }
 
-// createManifest creates a TOML manifest file.
-func (b *Builder) createManifest(cfg config.ImageConfig, manifestPath string) error {
-	var sb strings.Builder
-
-	sb.WriteString("# PGSD Image Manifest\n")
-	sb.WriteString(fmt.Sprintf("# Generated: %s\n\n", time.Now().Format(time.RFC3339)))
-	sb.WriteString("[image]\n")
-	sb.WriteString(fmt.Sprintf("id = %q\n", cfg.ID))
-	sb.WriteString(fmt.Sprintf("version = %q\n", cfg.Version))
-	sb.WriteString(fmt.Sprintf("zpool_name = %q\n", cfg.ZpoolName))
-	sb.WriteString(fmt.Sprintf("root_dataset = %q\n", cfg.RootDS))
-	sb.WriteString("\n[artifacts]\n")
-	sb.WriteString("root_zfs = \"root.zfs.xz\"\n")
-	sb.WriteString("efi_image = \"efi.img\"\n")
-	sb.WriteString("\n[[package_lists]]\n")
-	sb.WriteString(fmt.Sprintf("sets = %s\n", formatStringArray(cfg.PkgLists)))
-	sb.WriteString("\n[[overlays]]\n")
-	sb.WriteString(fmt.Sprintf("applied = %s\n", formatStringArray(cfg.Overlays)))
-
-	if err := util.WriteStringToFile(manifestPath, sb.String(), 0644); err != nil {
-		return err
+// createManifest writes manifest.toml for the artifacts in artifactPath and
+// returns it. Artifacts are hashed here, after the export stage wrote them;
+// a dry run writes none, so it records only their paths and leaves the
+// artifact directory untouched.
+func (b *Builder) createManifest(cfg config.ImageConfig, packages *pkglist.Set, installed []pkginstall.InstalledPackage, artifactPath string) (*manifest.Manifest, error) {
+	m := &manifest.Manifest{
+		Version: manifest.Version,
+		Image: manifest.Image{
+			ID:           cfg.ID,
+			Version:      cfg.Version,
+			ZpoolName:    cfg.ZpoolName,
+			RootDataset:  cfg.RootDS,
+			Extends:      cfg.Extends,
+			PackageLists: cfg.PkgLists,
+			Overlays:     cfg.Overlays,
+		},
+		Build: manifest.Build{
+			Builder:        b.config.BuilderVersion,
+			FreeBSDVersion: b.config.FreeBSDVersion,
+			FreeBSDArch:    b.config.FreeBSDArch,
+			Date:           b.config.BuildTime().UTC().Truncate(time.Second),
+		},
+		Packages: manifestPackages(packages, installed),
+	}
+
+	artifacts := []string{"efi.img"}
+	if util.FileExists(filepath.Join(artifactPath, sbom.SPDXFile)) {
+		m.SBOM = manifest.SBOM{SPDX: sbom.SPDXFile, CycloneDX: sbom.CycloneDXFile}
+		artifacts = append(artifacts, sbom.SPDXFile, sbom.CycloneDXFile)
+	}
+	for _, ds := range datasetPlan(cfg) {
+		m.Datasets = append(m.Datasets, manifest.Dataset{
+			Name:       relativeDatasetName(cfg.ZpoolName, ds.Name),
+			Role:       ds.Role,
+			Mountpoint: ds.Mountpoint,
+			CanMount:   ds.CanMount,
+			Stream:     ds.Stream,
+		})
+		if ds.Stream != "" {
+			artifacts = append(artifacts, ds.Stream)
+		}
+	}
+	sort.Strings(artifacts)
+
+	for _, rel := range artifacts {
+		if executor.IsDryRun(b.exec) {
+			m.Artifacts = append(m.Artifacts, manifest.Artifact{Path: rel})
+			continue
+		}
+		b.logger.Debug("Hashing %s...", rel)
+		a, err := manifest.NewArtifact(artifactPath, rel)
+		if err != nil {
+			return nil, err
+		}
+		m.Artifacts = append(m.Artifacts, a)
+	}
+
+	manifestPath := filepath.Join(artifactPath, manifest.FileName)
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would write manifest %s (%d packages, %d artifacts)", manifestPath, len(m.Packages), len(m.Artifacts))
+		return m, nil
+	}
+	if err := m.Write(manifestPath); err != nil {
+		return nil, err
 	}
 
 	b.logger.Debug("Created manifest: %s", manifestPath)
+	return m, nil
+}
+
+// createSBOM writes the SPDX and CycloneDX SBOMs for the image. Images are
+// built from packages only, so no distribution archives are listed.
+func (b *Builder) createSBOM(cfg config.ImageConfig, packages *pkglist.Set, installed []pkginstall.InstalledPackage, artifactPath string) error {
+	files, err := sbom.OverlayFiles(b.config.GetOverlaysDir(), cfg.Overlays)
+	if err != nil {
+		return err
+	}
+	doc := &sbom.Document{
+		Name:     cfg.ID,
+		Version:  cfg.Version,
+		Kind:     "image",
+		Created:  b.config.BuildTime(),
+		Tool:     b.config.BuilderVersion,
+		Base:     sbom.Base{Version: b.config.FreeBSDVersion, Arch: b.config.FreeBSDArch},
+		Packages: sbom.Packages(installed, packages.Names()),
+		Files:    files,
+	}
+	spdxPath := filepath.Join(artifactPath, sbom.SPDXFile)
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would write SBOM %s (%d packages, %d overlay files)", spdxPath, len(doc.Packages), len(doc.Files))
+		return nil
+	}
+	if err := doc.Write(spdxPath, filepath.Join(artifactPath, sbom.CycloneDXFile)); err != nil {
+		return err
+	}
+	b.logger.Debug("Created SBOM: %s (%d packages, %d overlay files)", spdxPath, len(doc.Packages), len(doc.Files))
 	return nil
 }
 
-// formatStringArray formats a string slice as a TOML array.
-func formatStringArray(arr []string) string {
-	quoted := make([]string, len(arr))
-	for i, s := range arr {
-		quoted[i] = fmt.Sprintf("%q", s)
+// manifestPackages joins the resolved package lists with the root's package
+// database. Requested packages come first in list order, followed by
+// dependencies sorted by name. Without a database only the requested
+// packages are listed, without versions.
+func manifestPackages(packages *pkglist.Set, installed []pkginstall.InstalledPackage) []manifest.Package {
+	byName := make(map[string]pkginstall.InstalledPackage)
+	byOrigin := make(map[string]pkginstall.InstalledPackage)
+	for _, p := range installed {
+		byName[p.Name] = p
+		byOrigin[p.Origin] = p
+	}
+
+	var result []manifest.Package
+	requested := make(map[string]bool)
+	for _, p := range packages.Packages {
+		entry := manifest.Package{Name: p.Name, Lists: p.Origins}
+		// List entries may be package names or category/port origins
+		db, ok := byName[p.Name]
+		if !ok {
+			db, ok = byOrigin[p.Name]
+		}
+		if ok {
+			entry.Name = db.Name
+			entry.Version = db.Version
+			entry.Origin = db.Origin
+			requested[db.Name] = true
+		}
+		result = append(result, entry)
+	}
+
+	for _, p := range installed {
+		if requested[p.Name] {
+			continue
+		}
+		result = append(result, manifest.Package{
+			Name:       p.Name,
+			Version:    p.Version,
+			Origin:     p.Origin,
+			Dependency: true,
+		})
+	}
+	return result
+}
+
+// sortedKeys returns the keys of m in sorted order so generated commands
+// are stable.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	return "[" + strings.Join(quoted, ", ") + "]"
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,151 @@
+package image
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/build"
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/manifest"
+	"github.com/pgsdf/pgsdbuild/internal/sbom"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+var testImage = config.ImageConfig{
+	ID:        "pgsd-test",
+	Version:   "0.1.0",
+	ZpoolName: "pgsd",
+	RootDS:    "pgsd/ROOT/default",
+	PkgLists:  []string{"test"},
+	Datasets:  []config.Dataset{{Name: "pgsd/home", Mountpoint: "/home", CanMount: "on"}},
+}
+
+// replayBuild builds testImage in a temporary directory with the commands
+// in testdata/name and returns the builder's configuration.
+func replayBuild(t *testing.T, name string) (*build.Config, *executor.Replayer, error) {
+	t.Helper()
+	rec, err := executor.LoadRecording(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := build.NewDefaultConfig()
+	cfg.RootDir = t.TempDir()
+	cfg.NoCache = true
+	cfg.DiskSizeGB = 1
+	cfg.BuilderVersion = "pgsdbuild test"
+	cfg.FreeBSDVersion = "15.0-RELEASE"
+	cfg.SourceDateEpoch = time.Unix(1740832210, 0).UTC()
+	x := executor.NewReplayer(rec)
+	cfg.Exec = x
+
+	if err := os.MkdirAll(cfg.GetPkgListsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.GetPkgListsDir(), "test.txt"), []byte("sudo\nzsh # shell\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A replay cannot write the EFI partition dd exports, so the test
+	// puts it in place
+	artifacts := filepath.Join(cfg.GetArtifactsDir(), testImage.ID)
+	if err := os.MkdirAll(artifacts, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(artifacts, "efi.img"), []byte("efi partition\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := util.NewLogger(io.Discard, util.LevelDebug, false, "")
+	err = NewBuilder(cfg, logger).Build(context.Background(), testImage)
+	return cfg, x, err
+}
+
+// A build runs every stage with the recorded commands and writes a
+// manifest that matches the artifacts and the package database.
+func TestBuildReplay(t *testing.T) {
+	cfg, x, err := replayBuild(t, "build.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Done(); err != nil {
+		t.Error(err)
+	}
+
+	dir := filepath.Join(cfg.GetArtifactsDir(), testImage.ID)
+	m, err := manifest.Load(filepath.Join(dir, manifest.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(dir, nil); err != nil {
+		t.Error(err)
+	}
+
+	// The streams hold what the replayed xz wrote
+	for file, want := range map[string]string{"root.zfs.xz": "root stream\n", "datasets/home.zfs.xz": "home stream\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", file, data, err, want)
+		}
+	}
+
+	var paths []string
+	for _, a := range m.Artifacts {
+		paths = append(paths, a.Path)
+	}
+	wantPaths := []string{"datasets/home.zfs.xz", "efi.img", "root.zfs.xz", sbom.CycloneDXFile, sbom.SPDXFile}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("artifacts = %v, want %v", paths, wantPaths)
+	}
+
+	wantDatasets := []manifest.Dataset{
+		{Name: "ROOT", Role: manifest.RoleContainer, Mountpoint: "none", CanMount: "off"},
+		{Name: "ROOT/default", Role: manifest.RoleRoot, Mountpoint: "/", CanMount: "noauto", Stream: "root.zfs.xz"},
+		{Name: "home", Role: manifest.RoleData, Mountpoint: "/home", CanMount: "on", Stream: "datasets/home.zfs.xz"},
+	}
+	if !reflect.DeepEqual(m.Datasets, wantDatasets) {
+		t.Errorf("datasets = %+v, want %+v", m.Datasets, wantDatasets)
+	}
+
+	// Requested packages come first, then dependencies
+	wantPackages := []manifest.Package{
+		{Name: "sudo", Version: "1.9.16p2", Origin: "security/sudo", Lists: []string{"test"}},
+		{Name: "zsh", Version: "5.9_6", Origin: "shells/zsh", Lists: []string{"test"}},
+		{Name: "gettext-runtime", Version: "0.22.5", Origin: "devel/gettext-runtime", Dependency: true},
+	}
+	if !reflect.DeepEqual(m.Packages, wantPackages) {
+		t.Errorf("packages = %+v, want %+v", m.Packages, wantPackages)
+	}
+	if !m.Build.Date.Equal(cfg.SourceDateEpoch) || m.Build.FreeBSDVersion != "15.0-RELEASE" {
+		t.Errorf("build = %+v", m.Build)
+	}
+
+	// A finished build removes its work directory
+	if _, err := os.Stat(filepath.Join(cfg.GetWorkDir(), testImage.ID)); !os.IsNotExist(err) {
+		t.Errorf("work directory was kept: %v", err)
+	}
+}
+
+// A failed stage still exports the pool and detaches the memory disk, and
+// the work directory is kept for --resume.
+func TestBuildReplayFailure(t *testing.T) {
+	cfg, x, err := replayBuild(t, "install-fails.json")
+	if err == nil {
+		t.Fatal("build succeeded")
+	}
+	if want := "packages not found in any repository"; !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "zsh") {
+		t.Errorf("error %q does not name the missing package", err)
+	}
+	if err := x.Done(); err != nil {
+		t.Errorf("teardown did not run: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.GetWorkDir(), testImage.ID)); err != nil {
+		t.Errorf("work directory was removed: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/sysconf"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// applySystemConfig applies the recipe's system block to the root mount.
+// It runs after overlays so the recipe takes precedence over overlay files.
+func (b *Builder) applySystemConfig(ctx context.Context, cfg config.ImageConfig, rootMount string) error {
+	sys := cfg.System
+
+	if sys.Hostname != "" || len(sys.Services) > 0 {
+		if err := b.configureRCConf(sys, rootMount); err != nil {
+			return err
+		}
+	}
+
+	if sys.Timezone != "" {
+		if err := b.configureTimezone(sys.Timezone, rootMount); err != nil {
+			return err
+		}
+	}
+
+	if len(sys.Users) > 0 {
+		if err := b.configureUsers(ctx, sys.Users, rootMount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureRCConf writes the hostname and service enable knobs to /etc/rc.conf.
+func (b *Builder) configureRCConf(sys config.SystemConfig, rootMount string) error {
+	rcConfPath := filepath.Join(rootMount, "etc", "rc.conf")
+	if err := util.EnsureDir(filepath.Dir(rcConfPath)); err != nil {
+		return err
+	}
+
+	rc, err := sysconf.Load(rcConfPath)
+	if err != nil {
+		return err
+	}
+
+	if sys.Hostname != "" {
+		rc.Set("hostname", sys.Hostname)
+		b.logger.Debug("Set hostname: %s", sys.Hostname)
+	}
+	for _, svc := range sys.Services {
+		rc.Set(svc+"_enable", "YES")
+		b.logger.Debug("Enabled service: %s", svc)
+	}
+
+	return rc.Write(rcConfPath, 0644)
+}
+
+// configureTimezone installs /etc/localtime from the zoneinfo database in the
+// root and records the zone name in /var/db/zoneinfo, as tzsetup(8) does.
+func (b *Builder) configureTimezone(tz, rootMount string) error {
+	zoneinfoDir := filepath.Join(rootMount, "usr", "share", "zoneinfo")
+	if !util.DirExists(zoneinfoDir) {
+		b.logger.Warn("No zoneinfo database in %s, skipping timezone %s", zoneinfoDir, tz)
+		return nil
+	}
+
+	zoneFile := filepath.Join(zoneinfoDir, tz)
+	if !util.FileExists(zoneFile) {
+		return fmt.Errorf("timezone %q not found in %s", tz, zoneinfoDir)
+	}
+
+	localtime := filepath.Join(rootMount, "etc", "localtime")
+	os.Remove(localtime)
+	if err := util.CopyFile(zoneFile, localtime, 0444); err != nil {
+		return err
+	}
+
+	dbDir := filepath.Join(rootMount, "var", "db")
+	if err := util.EnsureDir(dbDir); err != nil {
+		return err
+	}
+	if err := util.WriteStringToFile(filepath.Join(dbDir, "zoneinfo"), tz+"\n", 0644); err != nil {
+		return err
+	}
+
+	b.logger.Debug("Set timezone: %s", tz)
+	return nil
+}
+
+// configureUsers adds the recipe's users and groups to master.passwd and
+// group, creates home directories from /etc/skel and regenerates the
+// password databases.
+func (b *Builder) configureUsers(ctx context.Context, users []config.UserConfig, rootMount string) error {
+	db, err := sysconf.LoadUserDB(rootMount)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		uid := u.UID
+		if existing := db.User(u.Name); existing != nil && uid == 0 {
+			uid = existing.UID
+		}
+		if uid == 0 {
+			uid = db.NextUID()
+		}
+
+		// Each user gets a primary group of the same name
+		gid := uid
+		if g := db.Group(u.Name); g != nil {
+			gid = g.GID
+		} else {
+			if db.GroupByGID(gid) != nil {
+				gid = db.NextGID()
+			}
+			db.AddGroup(u.Name, gid)
+		}
+
+		for _, group := range u.Groups {
+			if db.Group(group) == nil {
+				b.logger.Warn("Group %s does not exist in the base system, creating it", group)
+				db.AddGroup(group, 0)
+			}
+			if err := db.AddMember(group, u.Name); err != nil {
+				return err
+			}
+		}
+
+		home := u.Home
+		if home == "" {
+			home = "/home/" + u.Name
+		}
+		shell := u.Shell
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		password := u.PasswordHash
+		if password == "" {
+			password = "*"
+		}
+
+		db.SetUser(sysconf.PasswdEntry{
+			Name:     u.Name,
+			Password: password,
+			UID:      uid,
+			GID:      gid,
+			Change:   "0",
+			Expire:   "0",
+			Gecos:    u.Comment,
+			Home:     home,
+			Shell:    shell,
+		})
+
+		if err := b.createHomeDir(rootMount, home, uid, gid); err != nil {
+			return fmt.Errorf("failed to create home for %s: %w", u.Name, err)
+		}
+
+		b.logger.Debug("Added user %s (uid %d, groups %v)", u.Name, uid, u.Groups)
+	}
+
+	if err := util.EnsureDir(filepath.Join(rootMount, "etc")); err != nil {
+		return err
+	}
+	if err := db.Write(rootMount); err != nil {
+		return err
+	}
+
+	return b.regeneratePasswordDB(ctx, rootMount)
+}
+
+// createHomeDir creates a home directory populated from /etc/skel.
+func (b *Builder) createHomeDir(rootMount, home string, uid, gid int) error {
+	homePath := filepath.Join(rootMount, home)
+	// The recipe check keeps home absolute and clean, but a symlink in the
+	// root could still lead out of it
+	if ok, err := util.IsWithin(rootMount, homePath); err != nil || !ok {
+		return fmt.Errorf("home directory %s is not inside the image root %s", home, rootMount)
+	}
+	if err := util.EnsureDir(homePath); err != nil {
+		return err
+	}
+
+	skel := filepath.Join(rootMount, "etc", "skel")
+	if util.DirExists(skel) {
+		if err := util.CopyDir(skel, homePath); err != nil {
+			return err
+		}
+	}
+
+	// Ownership can only be set when building as root
+	if os.Geteuid() != 0 {
+		b.logger.Warn("Not running as root, %s will not be owned by uid %d", home, uid)
+		return nil
+	}
+	return filepath.Walk(homePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// regeneratePasswordDB rebuilds pwd.db and spwd.db from master.passwd.
+func (b *Builder) regeneratePasswordDB(ctx context.Context, rootMount string) error {
+	etcDir := filepath.Join(rootMount, "etc")
+
+	// On FreeBSD: pwd_mkdb -p -d <root>/etc <root>/etc/master.passwd. A
+	// dry run finds every tool and only prints the command
+	pwdMkdb, err := b.exec.LookPath("pwd_mkdb")
+	if err != nil {
+		return fmt.Errorf("pwd_mkdb not found; it is needed to regenerate the password databases in %s\nHint: Use --dry-run to check the build without it", etcDir)
+	}
+
+	cmd := executor.Cmd(pwdMkdb, "-p", "-d", etcDir, filepath.Join(etcDir, "master.passwd"))
+	if output, err := b.exec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("pwd_mkdb failed: %w\nOutput: %s", err, string(output))
+	}
+
+	b.logger.Debug("Regenerated password databases")
+	return nil
+}
+
+// applyLoaderConf merges the recipe's boot.loader_conf tunables into
+// /boot/loader.conf in the root mount.
+func (b *Builder) applyLoaderConf(cfg config.ImageConfig, rootMount string) error {
+	if len(cfg.Boot.LoaderConf) == 0 {
+		return nil
+	}
+
+	loaderConfPath := filepath.Join(rootMount, "boot", "loader.conf")
+	if err := util.EnsureDir(filepath.Dir(loaderConfPath)); err != nil {
+		return err
+	}
+
+	lc, err := sysconf.LoadLoaderConf(loaderConfPath)
+	if err != nil {
+		return err
+	}
+	lc.Merge(cfg.Boot.LoaderConf, "image recipe "+cfg.ID)
+
+	if err := lc.Write(loaderConfPath, 0644); err != nil {
+		return err
+	}
+
+	b.logger.Debug("Merged %d loader.conf tunables", len(cfg.Boot.LoaderConf))
+	return nil
+}
@@ -0,0 +1,105 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// A symlink in the image root cannot lead a home directory out of it.
+func TestCreateHomeDirSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "home")); err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{logger: util.NewLogger(io.Discard, util.LevelError, false, "")}
+
+	if err := b.createHomeDir(root, "/home/alice", 1001, 1001); err == nil {
+		t.Fatal("home directory was created through the symlink")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("%d entries written outside the root", len(entries))
+	}
+
+	// A relative link that stays inside the root is followed
+	if err := os.Remove(filepath.Join(root, "home")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "usr", "home"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("usr/home", filepath.Join(root, "home")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.createHomeDir(root, "/home/alice", os.Getuid(), os.Getgid()); err != nil {
+		t.Fatal(err)
+	}
+	if !util.DirExists(filepath.Join(root, "usr", "home", "alice")) {
+		t.Error("home directory was not created")
+	}
+}
+
+// Users are only added when the password databases can be regenerated; a
+// dry run prints the pwd_mkdb command instead.
+func TestConfigureUsersPwdMkdb(t *testing.T) {
+	users := []config.UserConfig{{Name: "alice", Groups: []string{"wheel"}}}
+	var plan bytes.Buffer
+	tests := []struct {
+		name string
+		exec executor.Executor
+		err  string
+	}{
+		{name: "missing", exec: executor.NewReplayer(&executor.Recording{Tools: map[string]string{"pwd_mkdb": ""}}), err: "pwd_mkdb not found"},
+		{
+			name: "fails",
+			exec: executor.NewReplayer(&executor.Recording{Commands: []executor.Entry{
+				{Argv: [][]string{{"pwd_mkdb", "-p", "-d", "*", "*"}}, ExitCode: 1, Output: "pwd_mkdb: corrupted entry\n"},
+			}}),
+			err: "pwd_mkdb failed",
+		},
+		{
+			name: "replayed",
+			exec: executor.NewReplayer(&executor.Recording{Commands: []executor.Entry{
+				{Argv: [][]string{{"pwd_mkdb", "-p", "-d", "*", "*"}}},
+			}}),
+		},
+		{name: "dry run", exec: executor.DryRun{Out: &plan}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			b := &Builder{exec: tt.exec, logger: util.NewLogger(io.Discard, util.LevelError, false, "")}
+			err := b.configureUsers(context.Background(), users, root)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x, ok := tt.exec.(*executor.Replayer); ok {
+				if err := x.Done(); err != nil {
+					t.Error(err)
+				}
+			}
+			passwd, err := os.ReadFile(filepath.Join(root, "etc", "master.passwd"))
+			if err != nil || !strings.Contains(string(passwd), "alice:") {
+				t.Errorf("master.passwd = %q, %v", passwd, err)
+			}
+		})
+	}
+	if !strings.Contains(plan.String(), "+ pwd_mkdb -p -d ") {
+		t.Errorf("dry run printed %q", plan.String())
+	}
+}
@@ -0,0 +1,266 @@
+package iso
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/pgsdf/pgsdbuild/internal/gpt"
+	"github.com/pgsdf/pgsdbuild/internal/iso9660"
+	"github.com/pgsdf/pgsdbuild/internal/sysconf"
+)
+
+// Report describes the boot structures of a finished ISO, for tracking
+// down why an image does not boot.
+type Report struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	VolumeID  string `json:"volume_id"`
+	System    string `json:"system,omitempty"`
+	Publisher string `json:"publisher,omitempty"`
+	Sectors   uint32 `json:"sectors"`
+	Joliet    bool   `json:"joliet"`
+	RockRidge bool   `json:"rock_ridge"`
+
+	BootCatalog uint32      `json:"boot_catalog,omitempty"`
+	BootEntries []BootEntry `json:"boot_entries,omitempty"`
+	BIOS        bool        `json:"bios"`
+	EFI         bool        `json:"efi"`
+
+	MBR               *MBRReport `json:"mbr,omitempty"`
+	GPT               *GPTReport `json:"gpt,omitempty"`
+	GPTBackup         *GPTReport `json:"gpt_backup,omitempty"`
+	RootMount         string     `json:"root_mount,omitempty"`
+	ExpectedRootMount string     `json:"expected_root_mount"`
+	RootMountMatches  bool       `json:"root_mount_matches"`
+
+	Problems []string `json:"problems,omitempty"`
+}
+
+// BootEntry is an El Torito boot catalog entry.
+type BootEntry struct {
+	Platform    string `json:"platform"`
+	Bootable    bool   `json:"bootable"`
+	Emulation   byte   `json:"emulation"`
+	LoadSegment uint16 `json:"load_segment"`
+	LoadSectors uint16 `json:"load_sectors"`
+	Sector      uint32 `json:"sector"`
+}
+
+// MBRReport describes the master boot record.
+type MBRReport struct {
+	BootCode   bool           `json:"boot_code"`
+	Partitions []MBRPartition `json:"partitions"`
+}
+
+// MBRPartition is a used MBR partition entry.
+type MBRPartition struct {
+	Index   int    `json:"index"`
+	Active  bool   `json:"active"`
+	Type    string `json:"type"`
+	Start   uint32 `json:"start"`
+	Sectors uint32 `json:"sectors"`
+}
+
+// GPTReport describes one copy of the GPT.
+type GPTReport struct {
+	LBA             uint64         `json:"lba"`
+	Alternate       uint64         `json:"alternate"`
+	DiskGUID        string         `json:"disk_guid"`
+	HeaderCRCValid  bool           `json:"header_crc_valid"`
+	EntriesCRCValid bool           `json:"entries_crc_valid"`
+	Partitions      []GPTPartition `json:"partitions"`
+}
+
+// GPTPartition is a GPT partition entry.
+type GPTPartition struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Start   uint64 `json:"start"`
+	Sectors uint64 `json:"sectors"`
+}
+
+// Inspect reads the volume descriptors, boot catalog, partition tables and
+// boot/loader.conf of an ISO. Structural faults that would keep it from
+// booting are listed in the report's Problems; the error is for images
+// that cannot be read as ISO 9660 at all.
+func Inspect(path string) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := iso9660.Open(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r := &Report{
+		Path:              path,
+		Size:              info.Size(),
+		VolumeID:          vol.ID,
+		System:            vol.System,
+		Publisher:         vol.Publisher,
+		Sectors:           vol.Sectors,
+		Joliet:            vol.Joliet,
+		RockRidge:         vol.RockRidge,
+		BootCatalog:       vol.BootCatalog,
+		ExpectedRootMount: RootMountFrom(vol.ID),
+	}
+	if int64(vol.Sectors)*iso9660.SectorSize > info.Size() {
+		r.problem("volume of %d sectors is larger than the file; the image is truncated", vol.Sectors)
+	}
+
+	entries, err := vol.BootEntries()
+	if err != nil {
+		r.problem("%v", err)
+	}
+	var efiEntry *iso9660.BootEntry
+	for i, e := range entries {
+		r.BootEntries = append(r.BootEntries, BootEntry{
+			Platform:    iso9660.PlatformName(e.Platform),
+			Bootable:    e.Bootable,
+			Emulation:   e.Emulation,
+			LoadSegment: e.LoadSegment,
+			LoadSectors: e.LoadSectors,
+			Sector:      e.Sector,
+		})
+		if !e.Bootable {
+			continue
+		}
+		switch e.Platform {
+		case iso9660.PlatformX86:
+			r.BIOS = true
+		case iso9660.PlatformEFI:
+			r.EFI = true
+			efiEntry = &entries[i]
+		}
+	}
+
+	disk, err := gpt.Read(f, info.Size())
+	if err != nil {
+		r.problem("%v", err)
+	} else {
+		r.inspectTables(disk, efiEntry)
+	}
+
+	data, err := vol.ReadFile("boot/loader.conf")
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if r.BIOS || r.EFI {
+			r.problem("boot/loader.conf not found; the kernel will stop at mountroot>")
+		}
+	case err != nil:
+		r.problem("cannot read boot/loader.conf: %v", err)
+	default:
+		conf := &sysconf.LoaderConf{File: sysconf.Parse(data)}
+		r.RootMount = conf.RootMountFrom()
+		r.RootMountMatches = r.RootMount == r.ExpectedRootMount
+		switch {
+		case r.RootMount == "":
+			r.problem("boot/loader.conf does not set %s", sysconf.RootMountKey)
+		case !r.RootMountMatches:
+			r.problem("%s is %q but the volume label gives %q", sysconf.RootMountKey, r.RootMount, r.ExpectedRootMount)
+		}
+	}
+	return r, nil
+}
+
+// inspectTables reports the MBR and GPT, checking that both GPT copies
+// are intact and that the EFI partition is the El Torito EFI image.
+func (r *Report) inspectTables(disk *gpt.Disk, efiEntry *iso9660.BootEntry) {
+	if disk.MBR != nil {
+		r.MBR = &MBRReport{BootCode: disk.MBR.BootCode}
+		for _, p := range disk.MBR.Partitions {
+			r.MBR.Partitions = append(r.MBR.Partitions, MBRPartition{
+				Index:   p.Index,
+				Active:  p.Active,
+				Type:    fmt.Sprintf("0x%02x", p.Type),
+				Start:   p.Start,
+				Sectors: p.Sectors,
+			})
+		}
+	}
+	r.GPT, r.GPTBackup = gptReport(disk.Primary), gptReport(disk.Backup)
+
+	switch {
+	case disk.Primary == nil && disk.Backup == nil:
+		if r.BIOS || r.EFI {
+			r.problem("no partition tables; the ISO boots from CD/DVD but not from a USB drive")
+		}
+		return
+	case disk.Primary == nil:
+		r.problem("primary GPT header missing; only the backup is present")
+	case disk.Backup == nil:
+		r.problem("backup GPT header missing at sector %d", disk.Primary.Alternate)
+	}
+	for _, c := range []struct {
+		name string
+		h    *gpt.Header
+	}{{"primary", disk.Primary}, {"backup", disk.Backup}} {
+		switch {
+		case c.h == nil:
+		case !c.h.HeaderCRCValid:
+			r.problem("%s GPT header CRC is invalid", c.name)
+		case !c.h.EntriesCRCValid:
+			r.problem("%s GPT partition entries CRC is invalid", c.name)
+		}
+	}
+	if disk.MBR == nil || len(disk.MBR.Partitions) == 0 || disk.MBR.Partitions[0].Type != 0xee {
+		r.problem("no protective MBR; firmware may not recognize the GPT")
+	}
+
+	h := disk.Primary
+	if h == nil {
+		h = disk.Backup
+	}
+	var efiPart *gpt.Partition
+	for i, p := range h.Partitions {
+		switch p.Type {
+		case gpt.TypeEFI:
+			efiPart = &h.Partitions[i]
+		case gpt.TypeFreeBSDBoot:
+			if disk.MBR != nil && !disk.MBR.BootCode {
+				r.problem("freebsd-boot partition present but the MBR has no boot code")
+			}
+		}
+	}
+	switch {
+	case efiEntry != nil && efiPart == nil:
+		r.problem("El Torito has an EFI entry but the GPT has no EFI partition; UEFI USB boot will fail")
+	case efiEntry != nil && efiPart.Start != uint64(efiEntry.Sector)*iso9660.SectorSize/gpt.SectorSize:
+		r.problem("EFI partition starts at sector %d but the EFI boot image is at ISO sector %d",
+			efiPart.Start, efiEntry.Sector)
+	}
+}
+
+func gptReport(h *gpt.Header) *GPTReport {
+	if h == nil {
+		return nil
+	}
+	g := &GPTReport{
+		LBA:             h.LBA,
+		Alternate:       h.Alternate,
+		DiskGUID:        h.DiskGUID.String(),
+		HeaderCRCValid:  h.HeaderCRCValid,
+		EntriesCRCValid: h.EntriesCRCValid,
+	}
+	for _, p := range h.Partitions {
+		g.Partitions = append(g.Partitions, GPTPartition{
+			Type:    gpt.TypeName(p.Type),
+			Name:    p.Name,
+			Start:   p.Start,
+			Sectors: p.Sectors,
+		})
+	}
+	return g
+}
+
+func (r *Report) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,197 @@
+package iso
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/gpt"
+	"github.com/pgsdf/pgsdbuild/internal/iso9660"
+)
+
+const testLabel = "PGSD_TEST"
+
+// writeHybridISO writes a BIOS and EFI bootable ISO labelled testLabel
+// with the given boot/loader.conf, and partition tables laid out as
+// addPartitionTables does unless tables is false. It returns the ISO and
+// the last 512-byte sector of its GPT.
+func writeHybridISO(t *testing.T, loaderConf string, tables bool) (string, uint64) {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"boot/cdboot":      strings.Repeat("cdboot", 1000),
+		"boot/efiboot.img": strings.Repeat("efi", 20000),
+		"boot/loader.conf": loaderConf,
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.iso")
+	epoch := time.Unix(1740832210, 0).UTC()
+	img, err := iso9660.Write(context.Background(), path, root, iso9660.Options{
+		VolumeID: testLabel,
+		System:   "FREEBSD",
+		Time:     epoch,
+		MaxTime:  epoch,
+		BIOSBoot: "boot/cdboot",
+		EFIBoot:  "boot/efiboot.img",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tables {
+		return path, 0
+	}
+	table := gpt.Table{
+		Sectors:  (uint64(img.Sectors) + gptBackupSectors) * iso9660.SectorSize / gpt.SectorSize,
+		BootCode: make([]byte, 440),
+		Partitions: []gpt.Partition{{
+			Type:    gpt.TypeEFI,
+			Name:    "efiboot",
+			Start:   uint64(img.EFIBoot.Sector) * iso9660.SectorSize / gpt.SectorSize,
+			Sectors: (uint64(img.EFIBoot.Size) + gpt.SectorSize - 1) / gpt.SectorSize,
+		}},
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := table.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return path, table.Sectors - 1
+}
+
+// flipByte inverts the byte at off in path.
+func flipByte(t *testing.T, path string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Inspect reports the faults that keep a hybrid ISO from booting: a
+// loader.conf that mounts another label and damaged partition tables.
+func TestInspect(t *testing.T) {
+	matching := `vfs.root.mountfrom="` + RootMountFrom(testLabel) + `"` + "\n"
+	tests := []struct {
+		name       string
+		loaderConf string
+		tables     bool
+		corrupt    func(t *testing.T, path string, last uint64)
+		problems   []string
+	}{
+		{
+			name:       "bootable",
+			loaderConf: "autoboot_delay=\"3\"\n" + matching,
+			tables:     true,
+		},
+		{
+			name:       "label mismatch",
+			loaderConf: `vfs.root.mountfrom="cd9660:iso9660/PGSD_OLD"` + "\n",
+			tables:     true,
+			problems:   []string{`vfs.root.mountfrom is "cd9660:iso9660/PGSD_OLD" but the volume label gives "cd9660:iso9660/PGSD_TEST"`},
+		},
+		{
+			name:       "no root mount",
+			loaderConf: "autoboot_delay=\"3\"\n",
+			tables:     true,
+			problems:   []string{"boot/loader.conf does not set vfs.root.mountfrom"},
+		},
+		{
+			// The disk GUID is covered by the header CRC only
+			name:       "primary header CRC",
+			loaderConf: matching,
+			tables:     true,
+			corrupt: func(t *testing.T, path string, last uint64) {
+				flipByte(t, path, 1*gpt.SectorSize+56)
+			},
+			problems: []string{"primary GPT header CRC is invalid"},
+		},
+		{
+			name:       "backup header CRC",
+			loaderConf: matching,
+			tables:     true,
+			corrupt: func(t *testing.T, path string, last uint64) {
+				flipByte(t, path, int64(last)*gpt.SectorSize+56)
+			},
+			problems: []string{"backup GPT header CRC is invalid"},
+		},
+		{
+			// A byte of the EFI partition's name
+			name:       "primary entries CRC",
+			loaderConf: matching,
+			tables:     true,
+			corrupt: func(t *testing.T, path string, last uint64) {
+				flipByte(t, path, 2*gpt.SectorSize+60)
+			},
+			problems: []string{"primary GPT partition entries CRC is invalid"},
+		},
+		{
+			name:       "mismatch and damaged table",
+			loaderConf: `vfs.root.mountfrom="cd9660:/dev/cd0"` + "\n",
+			tables:     true,
+			corrupt: func(t *testing.T, path string, last uint64) {
+				flipByte(t, path, 1*gpt.SectorSize+56)
+			},
+			problems: []string{
+				"primary GPT header CRC is invalid",
+				`vfs.root.mountfrom is "cd9660:/dev/cd0" but the volume label gives "cd9660:iso9660/PGSD_TEST"`,
+			},
+		},
+		{
+			name:       "no partition tables",
+			loaderConf: matching,
+			problems:   []string{"no partition tables; the ISO boots from CD/DVD but not from a USB drive"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, last := writeHybridISO(t, tt.loaderConf, tt.tables)
+			if tt.corrupt != nil {
+				tt.corrupt(t, path, last)
+			}
+			r, err := Inspect(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(r.Problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(r.Problems, "\n"), strings.Join(tt.problems, "\n"))
+			}
+
+			if r.VolumeID != testLabel || !r.BIOS || !r.EFI || len(r.BootEntries) != 2 {
+				t.Errorf("volume %q, BIOS %v, EFI %v, %d boot entries", r.VolumeID, r.BIOS, r.EFI, len(r.BootEntries))
+			}
+			if r.ExpectedRootMount != "cd9660:iso9660/PGSD_TEST" {
+				t.Errorf("expected root mount = %q", r.ExpectedRootMount)
+			}
+			if wantMatch := tt.loaderConf == matching || strings.HasSuffix(tt.loaderConf, matching); r.RootMountMatches != wantMatch {
+				t.Errorf("root mount %q matches = %v", r.RootMount, r.RootMountMatches)
+			}
+			if tt.tables && (r.GPT == nil || r.GPTBackup == nil || len(r.GPTBackup.Partitions) != 1 || r.GPTBackup.Partitions[0].Name != "efiboot") {
+				t.Errorf("GPT = %+v, backup %+v", r.GPT, r.GPTBackup)
+			}
+		})
+	}
+}
@@ -1,20 +1,29 @@
 package iso
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/pgsdf/pgsdbuild/internal/build"
 	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/fat"
 	"github.com/pgsdf/pgsdbuild/internal/fetch"
+	"github.com/pgsdf/pgsdbuild/internal/gpt"
+	"github.com/pgsdf/pgsdbuild/internal/iso9660"
+	"github.com/pgsdf/pgsdbuild/internal/pipeline"
+	"github.com/pgsdf/pgsdbuild/internal/pkginstall"
+	"github.com/pgsdf/pgsdbuild/internal/pkglist"
+	"github.com/pgsdf/pgsdbuild/internal/repro"
+	"github.com/pgsdf/pgsdbuild/internal/sbom"
+	"github.com/pgsdf/pgsdbuild/internal/sign"
+	"github.com/pgsdf/pgsdbuild/internal/sysconf"
+	"github.com/pgsdf/pgsdbuild/internal/teardown"
 	"github.com/pgsdf/pgsdbuild/internal/util"
 )
 
@@ -22,6 +31,7 @@ import (
 type Builder struct {
 	config      *build.Config
 	logger      *util.Logger
+	exec        executor.Executor
 	freebsdRoot string // Root directory for FreeBSD files (for cross-building)
 }
 
@@ -54,17 +64,32 @@ func NewBuilder(cfg *build.Config, logger *util.Logger) *Builder {
 	return &Builder{
 		config:      cfg,
 		logger:      logger,
+		exec:        cfg.GetExecutor(),
 		freebsdRoot: freebsdRoot,
 	}
 }
 
-// Build implements the boot environment ISO build pipeline.
-func (b *Builder) Build(cfg config.VariantConfig) error {
+// Build implements the boot environment ISO build pipeline. When ctx is
+// cancelled the running command is killed and any partially written output
+// is removed before Build returns.
+//
+// The build runs as named stages recorded in the work directory. A failed
+// or partial build keeps the extracted root so a later run with the
+// config's stage options can continue without re-extracting base.txz.
+func (b *Builder) Build(ctx context.Context, cfg config.VariantConfig) (err error) {
 	b.logger.Info("Starting bootenv ISO build for %s", cfg.ID)
 
+	// Resolve package lists up front: a broken list fails the build
+	// immediately, and the resolved names key the packages stage, so
+	// editing a list file invalidates its cache entry and marker
+	packages, err := pkglist.NewResolver(b.config.GetPkgListsDir(), b.config.FreeBSDArch).Resolve(cfg.PkgLists)
+	if err != nil {
+		return fmt.Errorf("failed to resolve package lists: %w", err)
+	}
+
 	// Warn if not running as root - file ownership may not be preserved correctly
 	if os.Geteuid() != 0 {
-		_, sudoErr := exec.LookPath("sudo")
+		_, sudoErr := b.exec.LookPath("sudo")
 		if sudoErr != nil {
 			b.logger.Warn("Not running as root and sudo not available")
 			b.logger.Warn("File ownership in the ISO may be incorrect")
@@ -78,78 +103,288 @@ func (b *Builder) Build(cfg config.VariantConfig) error {
 		return err
 	}
 
-	if !b.config.KeepWork {
-		defer func() {
-			if err := util.CleanupDir(workPath); err != nil {
-				b.logger.Warn("Failed to cleanup work directory %s: %v", workPath, err)
-			}
-		}()
+	// Partial output is released when the build ends, including when it
+	// is interrupted. The work directory is only removed once every stage
+	// has run and the teardown succeeded.
+	td := teardown.New(b.logger)
+
+	opts := b.config.StageOptions(b.logger)
+	opts.Build = "iso/" + cfg.ID
+	if opts.Cache != nil {
+		opts.Cache.Command = b.rootCommand
 	}
+	finished := false
+	defer func() {
+		tdErr := td.Run(ctx)
+		err = errors.Join(err, tdErr)
+		if b.config.KeepWork {
+			return
+		}
+		if tdErr != nil {
+			b.logger.Warn("Leaving work directory %s in place because teardown failed", workPath)
+			return
+		}
+		if !finished && !opts.DryRun {
+			b.logger.Info("Work directory kept for --resume: %s", workPath)
+			return
+		}
+		if err := b.config.CleanupWorkPath(workPath); err != nil {
+			b.logger.Warn("Failed to cleanup work directory %s: %v", workPath, err)
+		}
+	}()
 
 	outputPath := filepath.Join(b.config.GetISODir(), cfg.ID+".iso")
 	if err := util.EnsureDir(b.config.GetISODir()); err != nil {
 		return err
 	}
 
-	// Step 1: Build root filesystem for ISO
 	isoRoot := filepath.Join(workPath, "root")
 	if err := util.EnsureDir(isoRoot); err != nil {
 		return err
 	}
 
-	b.logger.Debug("Building root filesystem...")
-	if err := b.buildISOFilesystem(cfg, isoRoot); err != nil {
-		return fmt.Errorf("failed to build ISO filesystem: %w", err)
-	}
+	p := pipeline.New(workPath, b.logger)
+	p.Add(b.stages(cfg, packages, td, workPath, isoRoot, outputPath)...)
 
-	// Step 2: Install packages
-	b.logger.Debug("Installing packages...")
-	if err := b.installISOPackages(cfg, isoRoot); err != nil {
-		return fmt.Errorf("failed to install packages: %w", err)
+	finished, err = p.Run(ctx, opts)
+	if err != nil {
+		return err
 	}
-
-	// Step 2.5: Install FreeBSD boot infrastructure
-	b.logger.Debug("Installing boot infrastructure...")
-	if err := b.installBootInfrastructure(isoRoot); err != nil {
-		return fmt.Errorf("failed to install boot infrastructure: %w", err)
+	if !finished {
+		return nil
 	}
 
-	// Step 3: Apply overlays
-	b.logger.Debug("Applying overlays...")
-	if err := b.applyISOOverlays(cfg, isoRoot); err != nil {
-		return fmt.Errorf("failed to apply overlays: %w", err)
+	b.logger.Info("ISO build complete! Output: %s", outputPath)
+	return nil
+}
+
+// distDir returns the directory holding base.txz and kernel.txz: the parent
+// of FREEBSD_ROOT (e.g. freebsd-dist/ for freebsd-dist/root).
+func (b *Builder) distDir() string {
+	distDir := filepath.Dir(b.freebsdRoot)
+
+	// If distDir is root (/) - which happens on native FreeBSD where FREEBSD_ROOT=/
+	// then we can't write there without root permissions. Use work directory instead.
+	if distDir == "/" || distDir == "." || distDir == "" {
+		distDir = filepath.Join(b.config.GetWorkDir(), "cache")
 	}
+	return distDir
+}
 
-	// Step 3.5: Configure boot loader with ISO-specific settings
-	b.logger.Debug("Configuring boot loader...")
-	if err := b.configureBootLoader(cfg, isoRoot); err != nil {
-		return fmt.Errorf("failed to configure boot loader: %w", err)
+// stages lists the ISO pipeline. The base and packages stages are cached:
+// the extracted root is stored under a key covering the distribution
+// archives and package settings, so a variant whose base and packages did
+// not change skips extraction and pkg entirely.
+func (b *Builder) stages(cfg config.VariantConfig, packages *pkglist.Set, td *teardown.Stack, workPath, isoRoot, outputPath string) []pipeline.Stage {
+	distDir := b.distDir()
+	return []pipeline.Stage{
+		{
+			// Create the root and install the FreeBSD base system
+			Name: "base",
+			Inputs: []string{
+				filepath.Join(distDir, "base.txz"),
+				filepath.Join(distDir, "kernel.txz"),
+			},
+			Params:  []string{b.config.FreeBSDVersion, b.config.FreeBSDArch, b.freebsdRoot},
+			Outputs: []string{isoRoot},
+			Cache:   isoRoot,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Building root filesystem...")
+				if err := b.buildISOFilesystem(cfg, isoRoot); err != nil {
+					return fmt.Errorf("failed to build ISO filesystem: %w", err)
+				}
+
+				b.logger.Debug("Installing packages...")
+				if err := b.installISOPackages(ctx, cfg, isoRoot); err != nil {
+					return fmt.Errorf("failed to install packages: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "packages",
+			Params: []any{packages.Names(), cfg.Pkg, b.config.PkgRepo},
+			Cache:  isoRoot,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Installing variant packages...")
+				if err := b.installVariantPackages(ctx, cfg, packages, isoRoot, workPath); err != nil {
+					return fmt.Errorf("failed to install variant packages: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "boot",
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Installing boot infrastructure...")
+				if err := b.installBootInfrastructure(isoRoot); err != nil {
+					return fmt.Errorf("failed to install boot infrastructure: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "overlays",
+			Inputs: overlayPaths(b.config.GetOverlaysDir(), cfg.Overlays),
+			Params: cfg.Overlays,
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Applying overlays...")
+				if err := b.applyISOOverlays(cfg, isoRoot); err != nil {
+					return fmt.Errorf("failed to apply overlays: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			// Configure the boot loader with ISO-specific settings
+			Name:   "bootloader",
+			Params: []any{cfg.Boot, volumeID(cfg)},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Configuring boot loader...")
+				if err := b.configureBootLoader(cfg, isoRoot); err != nil {
+					return fmt.Errorf("failed to configure boot loader: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "images",
+			Inputs: []string{b.config.GetArtifactsDir(), b.config.GetKeysDir()},
+			Params: []any{cfg.ImagesDir, cfg.EmbeddedImages},
+			Run: func(ctx context.Context) error {
+				if err := b.installTrustedKeys(isoRoot); err != nil {
+					return fmt.Errorf("failed to install trusted keys: %w", err)
+				}
+				if cfg.ImagesDir == "" {
+					return nil
+				}
+				b.logger.Debug("Copying system images...")
+				if err := b.copySystemImages(cfg, isoRoot); err != nil {
+					return fmt.Errorf("failed to copy system images: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "arcan",
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Registering Arcan installer target...")
+				if err := b.registerArcanTarget(isoRoot); err != nil {
+					return fmt.Errorf("failed to register Arcan target: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "sbom",
+			Inputs:  overlayPaths(b.config.GetOverlaysDir(), cfg.Overlays),
+			Outputs: []string{sbomPath(outputPath, sbom.SPDXFile), sbomPath(outputPath, sbom.CycloneDXFile)},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Creating SBOM...")
+				if err := b.createSBOM(ctx, cfg, packages, isoRoot, workPath, outputPath); err != nil {
+					return fmt.Errorf("failed to create SBOM: %w", err)
+				}
+				return nil
+			},
+		},
+		{
+			// An interrupted or failed assembly must not leave a truncated
+			// ISO behind that looks like a finished build
+			Name:    "assemble",
+			Params:  cfg.ISO,
+			Outputs: []string{outputPath},
+			Run: func(ctx context.Context) error {
+				b.logger.Debug("Assembling ISO image...")
+				const partialName = "partial ISO"
+				td.Push(partialName, func(context.Context) error {
+					return removePartial(outputPath)
+				})
+				if err := b.normalizeRoot(isoRoot); err != nil {
+					return err
+				}
+				if err := b.assembleISO(ctx, cfg, isoRoot, outputPath); err != nil {
+					return fmt.Errorf("failed to assemble ISO: %w", err)
+				}
+				td.Forget(partialName)
+				return nil
+			},
+		},
 	}
+}
+
+// sbomPath returns where an SBOM is written next to the ISO: name is
+// sbom.SPDXFile or sbom.CycloneDXFile, e.g. pgsd-bootenv-arcan.sbom.spdx.json.
+func sbomPath(outputPath, name string) string {
+	return strings.TrimSuffix(outputPath, ".iso") + "." + name
+}
 
-	// Step 4: Copy system images
-	if cfg.ImagesDir != "" {
-		b.logger.Debug("Copying system images...")
-		if err := b.copySystemImages(cfg, isoRoot); err != nil {
-			return fmt.Errorf("failed to copy system images: %w", err)
+// createSBOM writes the SPDX and CycloneDX SBOMs for the ISO root: the base
+// system with the distribution archives it was extracted from, the
+// packages in its database and the overlay files.
+func (b *Builder) createSBOM(ctx context.Context, cfg config.VariantConfig, packages *pkglist.Set, isoRoot, workPath, outputPath string) error {
+	archives, err := sbom.Archives(b.distDir(), "base.txz", "kernel.txz")
+	if err != nil {
+		return err
+	}
+	files, err := sbom.OverlayFiles(b.config.GetOverlaysDir(), cfg.Overlays)
+	if err != nil {
+		return err
+	}
+	var installed []pkginstall.InstalledPackage
+	if pkginstall.Available(b.exec) {
+		installed, err = pkginstall.New(b.exec, isoRoot, workPath, cfg.Pkg, b.logger).Query(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read installed packages: %w", err)
 		}
 	}
 
-	// Step 5: Register Arcan target
-	b.logger.Debug("Registering Arcan installer target...")
-	if err := b.registerArcanTarget(isoRoot); err != nil {
-		return fmt.Errorf("failed to register Arcan target: %w", err)
+	doc := &sbom.Document{
+		Name:     cfg.ID,
+		Kind:     "iso",
+		Created:  b.config.BuildTime(),
+		Tool:     b.config.BuilderVersion,
+		Base:     sbom.Base{Version: b.config.FreeBSDVersion, Arch: b.config.FreeBSDArch, Archives: archives},
+		Packages: sbom.Packages(installed, packages.Names()),
+		Files:    files,
 	}
-
-	// Step 6: Assemble ISO image
-	b.logger.Debug("Assembling ISO image...")
-	if err := b.assembleISO(cfg, isoRoot, outputPath); err != nil {
-		return fmt.Errorf("failed to assemble ISO: %w", err)
+	spdxPath := sbomPath(outputPath, sbom.SPDXFile)
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would write SBOM %s (%d packages, %d overlay files)", spdxPath, len(doc.Packages), len(doc.Files))
+		return nil
+	}
+	if err := doc.Write(spdxPath, sbomPath(outputPath, sbom.CycloneDXFile)); err != nil {
+		return err
 	}
+	b.logger.Info("SBOM written to %s (%d packages, %d overlay files)", spdxPath, len(doc.Packages), len(doc.Files))
+	return nil
+}
 
-	b.logger.Info("ISO build complete! Output: %s", outputPath)
+// normalizeRoot clamps file times in root to SOURCE_DATE_EPOCH before it
+// is packaged. It does nothing unless the build is reproducible.
+func (b *Builder) normalizeRoot(root string) error {
+	if !b.config.Reproducible() || executor.IsDryRun(b.exec) {
+		return nil
+	}
+	st, err := repro.NormalizeTree(root, b.config.SourceDateEpoch)
+	if err != nil {
+		return err
+	}
+	b.logger.Debug("Normalized %s: %d file times clamped", root, st.Clamped)
+	if st.Skipped > 0 {
+		b.logger.Warn("%d files in %s could not be normalized; run as root for a reproducible ISO", st.Skipped, root)
+	}
 	return nil
 }
 
+// overlayPaths returns the directories of the named overlays.
+func overlayPaths(overlaysDir string, overlays []string) []string {
+	paths := make([]string, len(overlays))
+	for i, o := range overlays {
+		paths[i] = filepath.Join(overlaysDir, o)
+	}
+	return paths
+}
+
 // buildISOFilesystem creates the base directory structure for the ISO.
 func (b *Builder) buildISOFilesystem(cfg config.VariantConfig, isoRoot string) error {
 	// Create standard FreeBSD directory structure
@@ -173,7 +408,7 @@ func (b *Builder) buildISOFilesystem(cfg config.VariantConfig, isoRoot string) e
 }
 
 // installISOPackages installs packages into the ISO root.
-func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) error {
+func (b *Builder) installISOPackages(ctx context.Context, cfg config.VariantConfig, isoRoot string) error {
 	b.logger.Info("Installing FreeBSD base system from distribution archives...")
 
 	// Use FreeBSD distribution archives (base.txz, kernel.txz) instead of manual copying
@@ -187,12 +422,8 @@ func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) e
 	// This approach is used by GhostBSD and other FreeBSD-based distributions
 
 	// Determine distribution directory
-	distDir := filepath.Dir(b.freebsdRoot) // Parent of freebsd-dist/root
-
-	// Fix: If distDir is root (/) - which happens on native FreeBSD where FREEBSD_ROOT=/
-	// then we can't write there without root permissions. Use work directory instead.
-	if distDir == "/" || distDir == "." || distDir == "" {
-		distDir = filepath.Join(b.config.GetWorkDir(), "cache")
+	distDir := b.distDir()
+	if distDir != filepath.Dir(b.freebsdRoot) {
 		b.logger.Info("FREEBSD_ROOT is system root, using cache directory: %s", distDir)
 		if err := util.EnsureDir(distDir); err != nil {
 			return fmt.Errorf("failed to create cache directory: %w", err)
@@ -212,7 +443,10 @@ func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) e
 			b.logger,
 		)
 
-		fetchedBase, fetchedKernel, err := fetcher.FetchArchives()
+		fetchedBase, fetchedKernel, err := fetcher.FetchArchives(ctx)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
 			b.logger.Warn("Failed to fetch archives: %v", err)
 			b.logger.Warn("Falling back to manual archive detection...")
@@ -248,7 +482,7 @@ func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) e
 		// This avoids the bug where extracting kernel.txz would delete base.txz files
 		if util.DirExists(isoRoot) {
 			b.logger.Debug("Cleaning ISO root before extraction...")
-			if err := util.CleanupDir(isoRoot); err != nil {
+			if err := b.config.CleanupWorkPath(isoRoot); err != nil {
 				b.logger.Warn("Failed to clean ISO root: %v", err)
 			} else {
 				b.logger.Debug("ISO root cleaned successfully")
@@ -259,12 +493,12 @@ func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) e
 			}
 		}
 
-		if err := b.extractTxzArchive(baseTxz, isoRoot); err != nil {
+		if err := b.extractTxzArchive(ctx, baseTxz, isoRoot); err != nil {
 			return fmt.Errorf("failed to extract base.txz: %w", err)
 		}
 		b.logger.Info("Extracted base.txz successfully")
 
-		if err := b.extractTxzArchive(kernelTxz, isoRoot); err != nil {
+		if err := b.extractTxzArchive(ctx, kernelTxz, isoRoot); err != nil {
 			return fmt.Errorf("failed to extract kernel.txz: %w", err)
 		}
 		b.logger.Info("Extracted kernel.txz successfully")
@@ -298,8 +532,19 @@ func (b *Builder) installISOPackages(cfg config.VariantConfig, isoRoot string) e
 	return b.installFromFreeBSDRoot(isoRoot)
 }
 
+// rootCommand runs a tar command under sudo when not running as root and
+// sudo is available, so cached roots keep their ownership.
+func (b *Builder) rootCommand(name string, args ...string) *executor.Command {
+	if os.Geteuid() != 0 {
+		if sudoPath, err := b.exec.LookPath("sudo"); err == nil {
+			return executor.Cmd(sudoPath, append([]string{name}, args...)...)
+		}
+	}
+	return executor.Cmd(name, args...)
+}
+
 // extractTxzArchive extracts a .txz (xz-compressed tar) archive to the target directory
-func (b *Builder) extractTxzArchive(archivePath, targetDir string) error {
+func (b *Builder) extractTxzArchive(ctx context.Context, archivePath, targetDir string) error {
 	b.logger.Debug("Extracting %s to %s...", archivePath, targetDir)
 
 	// Note: Directory cleanup is handled by the caller to avoid deleting
@@ -310,32 +555,32 @@ func (b *Builder) extractTxzArchive(archivePath, targetDir string) error {
 	// tar -xJpf <archive> -C <target> --numeric-owner
 	// -p: preserve permissions and ownership (only works when running as root)
 	// --numeric-owner: use numeric UIDs/GIDs (e.g., root=0) instead of looking up names
-	tarPath, err := exec.LookPath("tar")
+	tarPath, err := b.exec.LookPath("tar")
 	if err != nil {
 		return fmt.Errorf("tar command not found: %w", err)
 	}
 
 	// If not running as root, try to use sudo for the extraction
 	// This preserves root ownership in the extracted files
-	var cmd *exec.Cmd
+	var cmd *executor.Command
 	if os.Geteuid() != 0 {
 		// Try to use sudo for extraction to preserve ownership
-		sudoPath, sudoErr := exec.LookPath("sudo")
+		sudoPath, sudoErr := b.exec.LookPath("sudo")
 		if sudoErr == nil {
 			b.logger.Info("Using sudo for archive extraction to preserve file ownership")
 			b.logger.Info("You may be prompted for your password")
-			cmd = exec.Command(sudoPath, tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
+			cmd = executor.Cmd(sudoPath, tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
 		} else {
 			b.logger.Warn("Not running as root and sudo not available")
 			b.logger.Warn("Extracted files will be owned by current user, which may cause boot issues")
-			cmd = exec.Command(tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
+			cmd = executor.Cmd(tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
 		}
 	} else {
 		// Running as root, extract with ownership preservation
-		cmd = exec.Command(tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
+		cmd = executor.Cmd(tarPath, "-xJpf", archivePath, "-C", targetDir, "--numeric-owner")
 	}
 
-	output, err := cmd.CombinedOutput()
+	output, err := b.exec.Run(ctx, cmd)
 	if err != nil {
 		return fmt.Errorf("tar extraction failed: %w\nOutput: %s", err, string(output))
 	}
@@ -425,6 +670,36 @@ func (b *Builder) installFromFreeBSDRoot(isoRoot string) error {
 	return nil
 }
 
+// installVariantPackages installs the packages from the variant's
+// pkg_lists into the ISO root on top of the base system.
+func (b *Builder) installVariantPackages(ctx context.Context, cfg config.VariantConfig, packages *pkglist.Set, isoRoot, workPath string) error {
+	if len(packages.Packages) == 0 {
+		return nil
+	}
+
+	if !pkginstall.Available(b.exec) {
+		return fmt.Errorf("pkg(8) not found on this host; it is needed to install %d packages\nHint: Use --dry-run to check the build without it", len(packages.Packages))
+	}
+
+	installer := pkginstall.New(b.exec, isoRoot, workPath, cfg.Pkg, b.logger)
+	if b.config.PkgRepo != "" {
+		b.logger.Info("Using package repository override: %s", b.config.PkgRepo)
+		if err := installer.OverrideRepository(b.config.PkgRepo); err != nil {
+			return err
+		}
+	}
+	if err := installer.Install(ctx, packages.Names()); err != nil {
+		return err
+	}
+
+	installed, err := installer.Query(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read installed packages: %w", err)
+	}
+	b.logger.Info("Boot environment contains %d packages", len(installed))
+	return nil
+}
+
 // applyISOOverlays applies filesystem overlays to the ISO root.
 func (b *Builder) applyISOOverlays(cfg config.VariantConfig, isoRoot string) error {
 	overlaysDir := b.config.GetOverlaysDir()
@@ -449,50 +724,46 @@ func (b *Builder) applyISOOverlays(cfg config.VariantConfig, isoRoot string) err
 
 // configureBootLoader configures the boot loader with ISO-specific settings
 func (b *Builder) configureBootLoader(cfg config.VariantConfig, isoRoot string) error {
-	// Use a short, simple label: "PGSD" for all variants
-	// This avoids issues with long labels and makes it easier for users
-	label := "PGSD"
+	// The root is mounted by the volume label assembleISO writes
+	label := volumeID(cfg)
 
 	// Update loader.conf to use ISO9660 label for root mount
 	// For USB boot compatibility, we use "cd9660:iso9660/LABEL" format
 	// which lets the loader auto-detect the boot device
 	loaderConfPath := filepath.Join(isoRoot, "boot/loader.conf")
 	if _, err := os.Stat(loaderConfPath); err != nil {
-		if os.IsNotExist(err) {
-			b.logger.Warn("loader.conf not found at %s - boot configuration may be incomplete", loaderConfPath)
-			return nil
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to access loader.conf: %w", err)
+		}
+		b.logger.Warn("loader.conf not found at %s - creating it", loaderConfPath)
+		if err := util.EnsureDir(filepath.Dir(loaderConfPath)); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to access loader.conf: %w", err)
 	}
 
-	// Read current loader.conf
-	content, err := os.ReadFile(loaderConfPath)
+	loaderConf, err := sysconf.LoadLoaderConf(loaderConfPath)
 	if err != nil {
 		return fmt.Errorf("failed to read loader.conf: %w", err)
 	}
 
-	loaderConf := string(content)
-
-	// Use the format "cd9660:iso9660/LABEL" which works for both CD/DVD and USB
-	// This allows the boot loader to auto-detect the boot device
-	// The "/dev/" prefix is not needed and can cause issues with USB boot
-	newLine := fmt.Sprintf(`vfs.root.mountfrom="cd9660:iso9660/%s"`, label)
+	// Merge tunables from the variant recipe
+	if len(cfg.Boot.LoaderConf) > 0 {
+		if v, ok := cfg.Boot.LoaderConf[sysconf.RootMountKey]; ok {
+			b.logger.Warn("Ignoring %s=%q from variant: the ISO root is always the cd9660 volume", sysconf.RootMountKey, v)
+		}
+		loaderConf.Merge(cfg.Boot.LoaderConf, "variant recipe "+cfg.ID)
+		b.logger.Debug("Merged %d loader.conf tunables from variant", len(cfg.Boot.LoaderConf))
+	}
 
-	// Replace any existing vfs.root.mountfrom line (empty, ZFS, or other)
-	// Use regex to match vfs.root.mountfrom="..." with any value
-	re := regexp.MustCompile(`vfs\.root\.mountfrom="[^"]*"`)
-	if re.MatchString(loaderConf) {
-		loaderConf = re.ReplaceAllString(loaderConf, newLine)
-		b.logger.Info("Configured root mount: cd9660:iso9660/%s (USB/CD compatible)", label)
-	} else {
-		// Add the configuration if not present
-		loaderConf += "\n# Root mount configuration for ISO boot (USB and CD/DVD compatible)\n"
-		loaderConf += fmt.Sprintf("%s\n", newLine)
-		b.logger.Info("Added root mount configuration: cd9660:iso9660/%s", label)
+	rootMount := RootMountFrom(label)
+	if _, ok := loaderConf.Get(sysconf.RootMountKey); !ok {
+		loaderConf.AddComment("Root mount configuration for ISO boot (USB and CD/DVD compatible)")
 	}
+	loaderConf.Set(sysconf.RootMountKey, rootMount)
+	b.logger.Info("Configured root mount: %s (USB/CD compatible)", rootMount)
 
 	// Write updated loader.conf
-	if err := os.WriteFile(loaderConfPath, []byte(loaderConf), 0644); err != nil {
+	if err := loaderConf.Write(loaderConfPath, 0644); err != nil {
 		return fmt.Errorf("failed to write loader.conf: %w", err)
 	}
 
@@ -500,6 +771,27 @@ func (b *Builder) configureBootLoader(cfg config.VariantConfig, isoRoot string)
 	return nil
 }
 
+// defaultVolumeID is the volume label of variants that do not set
+// bootenv.iso.volume_id. Short and simple, it avoids issues with long labels
+// and is easy to type at a mountroot> prompt.
+const defaultVolumeID = "PGSD"
+
+// volumeID returns the ISO volume label of a variant.
+func volumeID(cfg config.VariantConfig) string {
+	if cfg.ISO.VolumeID != "" {
+		return cfg.ISO.VolumeID
+	}
+	return defaultVolumeID
+}
+
+// RootMountFrom returns the vfs.root.mountfrom value for an ISO with the
+// given volume label. The format "cd9660:iso9660/LABEL" works for both
+// CD/DVD and USB, letting the kernel find the boot device by its label;
+// the "/dev/" prefix is not needed and can cause issues with USB boot.
+func RootMountFrom(label string) string {
+	return "cd9660:iso9660/" + label
+}
+
 // copySystemImages copies built system images into the ISO.
 func (b *Builder) copySystemImages(cfg config.VariantConfig, isoRoot string) error {
 	imagesDestDir := filepath.Join(isoRoot, cfg.ImagesDir[1:]) // Remove leading /
@@ -542,6 +834,34 @@ func (b *Builder) copySystemImages(cfg config.VariantConfig, isoRoot string) err
 	return nil
 }
 
+// installTrustedKeys copies the public keys in the keys directory into the
+// ISO, where the installer uses them to verify image signatures. Private
+// keys are never copied.
+func (b *Builder) installTrustedKeys(isoRoot string) error {
+	keys, err := sign.LoadKeyring(b.config.GetKeysDir())
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		b.logger.Debug("No public keys in %s; the installer will not check image signatures", b.config.GetKeysDir())
+		return nil
+	}
+
+	destDir := filepath.Join(isoRoot, strings.TrimPrefix(sign.TrustedKeysDir, "/"))
+	if err := util.EnsureDir(destDir); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		name := k.Name + sign.PublicKeyExt
+		if err := util.CopyFile(filepath.Join(b.config.GetKeysDir(), name), filepath.Join(destDir, name), 0644); err != nil {
+			return err
+		}
+		b.logger.Debug("Trusting key %s (%s)", k.ID, k.Name)
+	}
+	b.logger.Info("Installed %d trusted key(s) in %s", len(keys), sign.TrustedKeysDir)
+	return nil
+}
+
 // installBootInfrastructure verifies boot files and sets up EFI boot structure
 func (b *Builder) installBootInfrastructure(isoRoot string) error {
 	// When using kernel.txz extraction, all boot files are already present
@@ -552,10 +872,10 @@ func (b *Builder) installBootInfrastructure(isoRoot string) error {
 	// Verify critical boot files are present (they should be from kernel.txz)
 	bootDir := filepath.Join(isoRoot, "boot")
 	criticalBootFiles := []string{
-		"cdboot",           // CD/DVD boot loader
-		"loader",           // Boot loader
-		"kernel/kernel",    // Kernel
-		"lua/loader.lua",   // Lua boot loader
+		"cdboot",         // CD/DVD boot loader
+		"loader",         // Boot loader
+		"kernel/kernel",  // Kernel
+		"lua/loader.lua", // Lua boot loader
 	}
 
 	for _, file := range criticalBootFiles {
@@ -622,7 +942,7 @@ func (b *Builder) registerArcanTarget(isoRoot string) error {
 		"target_type: BINARY\n"+
 		"target_path: /usr/local/bin/Inst\n"+
 		"config: default\n",
-		time.Now().Format(time.RFC3339))
+		b.config.BuildTime().Format(time.RFC3339))
 
 	if err := util.WriteStringToFile(targetFile, content, 0644); err != nil {
 		return err
@@ -633,857 +953,210 @@ func (b *Builder) registerArcanTarget(isoRoot string) error {
 }
 
 // assembleISO creates the final ISO image.
-func (b *Builder) assembleISO(cfg config.VariantConfig, isoRoot, outputPath string) error {
-	// Create bootable ISO using makefs
-	// This requires FreeBSD with makefs utility
-
-	// Use a short, simple label: "PGSD" for all variants
+func (b *Builder) assembleISO(ctx context.Context, cfg config.VariantConfig, isoRoot, outputPath string) error {
 	// This must match the label used in configureBootLoader
-	label := "PGSD"
+	label := volumeID(cfg)
 
 	b.logger.Debug("Creating ISO filesystem...")
 	b.logger.Debug("ISO label: %s", label)
 
+	opts := iso9660.Options{
+		VolumeID:    label,
+		System:      "FREEBSD",
+		Publisher:   cfg.ISO.Publisher,
+		Application: "PGSDBUILD",
+		Time:        b.config.BuildTime(),
+		Joliet:      true,
+	}
+	if b.config.Reproducible() {
+		opts.MaxTime = b.config.SourceDateEpoch
+	}
+
 	// Check if cdboot file exists before configuring boot
 	cdbootPath := filepath.Join(isoRoot, "boot/cdboot")
-	hasCdboot := false
-	if stat, err := os.Stat(cdbootPath); err == nil && !stat.IsDir() {
-		hasCdboot = true
+	if !cfg.ISO.BIOS() {
+		b.logger.Info("BIOS boot disabled by bootenv.iso.boot_mode")
+	} else if stat, err := os.Stat(cdbootPath); err == nil && !stat.IsDir() {
+		opts.BIOSBoot = "boot/cdboot"
 		b.logger.Info("BIOS boot file found: boot/cdboot (size: %d bytes)", stat.Size())
 	} else {
 		b.logger.Warn("BIOS boot file not found at %s - ISO will NOT be bootable in BIOS mode", cdbootPath)
-		b.logger.Warn("To create bootable ISOs, this must run on FreeBSD with boot files installed")
 	}
 
-	// Detect which ISO creation tool is available
-	isoTool, isoToolPath := b.detectISOTool()
-	if isoTool == "" {
-		b.logger.Warn("No ISO creation tool found (tried: makefs, xorriso, genisoimage, mkisofs)")
-		b.logger.Warn("Creating tar archive instead - convert to ISO on a system with ISO tools")
-
-		// Fallback: create a tar.gz archive of the ISO contents
-		tarPath := strings.TrimSuffix(outputPath, ".iso") + ".tar.gz"
-		if err := b.createTarArchive(tarPath, isoRoot); err != nil {
-			return fmt.Errorf("tar archive creation failed: %w", err)
-		}
-
-		b.logger.Info("Created tar archive: %s", tarPath)
-		b.logger.Info("To convert to ISO, use: genisoimage -r -V %s -o %s -graft-points <extracted-contents>", label, outputPath)
-
+	if executor.IsDryRun(b.exec) {
+		b.logger.Info("Would write ISO image %s (label %s)", outputPath, label)
 		return nil
 	}
 
-	b.logger.Info("Using ISO creation tool: %s (%s)", isoTool, isoToolPath)
-
-	// Convert paths to absolute to avoid working directory issues
-	absIsoRoot, err := filepath.Abs(isoRoot)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path for ISO root: %w", err)
-	}
-
-	absOutputPath, err := filepath.Abs(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path for output: %w", err)
-	}
-
-	b.logger.Debug("ISO root (absolute): %s", absIsoRoot)
-	b.logger.Debug("Output path (absolute): %s", absOutputPath)
-
-	// Create ISO using the detected tool
-	if err := b.createISOWithTool(isoTool, isoToolPath, absOutputPath, absIsoRoot, label, hasCdboot); err != nil {
-		return fmt.Errorf("%s failed: %w", isoTool, err)
-	}
-
-	b.logger.Debug("Created ISO image: %s", outputPath)
-
-	// Verify the ISO was created
-	if info, err := os.Stat(outputPath); err != nil {
-		return fmt.Errorf("ISO verification failed: %w", err)
-	} else {
-		b.logger.Info("ISO size: %.2f MB", float64(info.Size())/(1024*1024))
-	}
-
-	return nil
-}
-
-// detectISOTool detects which ISO creation tool is available on the system
-// Returns the tool name and full path to the executable
-func (b *Builder) detectISOTool() (string, string) {
-	// Try common tools with explicit paths for FreeBSD/Linux systems
-	toolPaths := map[string][]string{
-		"makefs":      {"/usr/sbin/makefs", "/sbin/makefs"},
-		"xorriso":     {"/usr/bin/xorriso"},
-		"genisoimage": {"/usr/bin/genisoimage"},
-		"mkisofs":     {"/usr/bin/mkisofs"},
-	}
-
-	// Check explicit paths first (for FreeBSD where tools may not be in PATH)
-	for tool, paths := range toolPaths {
-		for _, path := range paths {
-			if _, err := os.Stat(path); err == nil {
-				b.logger.Debug("Found ISO tool at %s", path)
-				return tool, path
-			}
-		}
-	}
-
-	// Fall back to PATH search
-	tools := []string{"makefs", "xorriso", "genisoimage", "mkisofs"}
-	for _, tool := range tools {
-		if path, err := exec.LookPath(tool); err == nil {
-			return tool, path
+	// UEFI firmware boots the El Torito EFI entry, a FAT image holding
+	// EFI/BOOT/BOOTX64.EFI
+	efiBootPath := filepath.Join(isoRoot, "EFI/BOOT/BOOTX64.EFI")
+	efiImgPath := filepath.Join(isoRoot, "boot/efiboot.img")
+	if !cfg.ISO.UEFI() {
+		b.logger.Info("UEFI boot disabled by bootenv.iso.boot_mode")
+		// An earlier assembly may have left one behind
+		if err := os.Remove(efiImgPath); err != nil && !os.IsNotExist(err) {
+			return err
 		}
-	}
-
-	return "", ""
-}
-
-// createISOWithTool creates an ISO using the specified tool
-func (b *Builder) createISOWithTool(tool, toolPath, outputPath, isoRoot, label string, hasCdboot bool) error {
-	switch tool {
-	case "makefs":
-		return b.createISOWithMakefs(toolPath, outputPath, isoRoot, label, hasCdboot)
-	case "xorriso":
-		return b.createISOWithXorriso(toolPath, outputPath, isoRoot, label, hasCdboot)
-	case "genisoimage", "mkisofs":
-		return b.createISOWithGenisoimage(toolPath, outputPath, isoRoot, label, hasCdboot)
-	default:
-		return fmt.Errorf("unsupported ISO tool: %s", tool)
-	}
-}
-
-// createISOWithMakefs creates an ISO using FreeBSD's makefs utility
-func (b *Builder) createISOWithMakefs(toolPath, outputPath, isoRoot, label string, hasCdboot bool) error {
-	// Verify boot files exist in isoRoot before calling makefs
-	if hasCdboot {
-		bootPath := filepath.Join(isoRoot, "boot/cdboot")
-		if stat, err := os.Stat(bootPath); err != nil {
-			b.logger.Error("Boot file check failed: %v", err)
-			b.logger.Error("Expected boot file at: %s", bootPath)
-			return fmt.Errorf("boot file not found at %s: %w", bootPath, err)
+	} else if stat, err := os.Stat(efiBootPath); err == nil && !stat.IsDir() {
+		if err := b.createEFIBootImage(ctx, efiImgPath, efiBootPath); err != nil {
+			b.logger.Warn("Failed to create EFI boot image: %v - UEFI boot may not work", err)
 		} else {
-			b.logger.Debug("Verified boot file exists: %s (size: %d bytes)", bootPath, stat.Size())
-		}
-
-		// List contents of boot directory for debugging
-		bootDir := filepath.Join(isoRoot, "boot")
-		if entries, err := os.ReadDir(bootDir); err == nil {
-			b.logger.Debug("Contents of boot directory:")
-			for _, entry := range entries {
-				info, _ := entry.Info()
-				if info != nil {
-					b.logger.Debug("  - %s (%d bytes)", entry.Name(), info.Size())
-				} else {
-					b.logger.Debug("  - %s", entry.Name())
-				}
-			}
+			opts.EFIBoot = "boot/efiboot.img"
+			b.logger.Info("Configured for UEFI boot with boot/efiboot.img")
 		}
 	}
-
-	// Build makefs command arguments
-	// -t cd9660: ISO 9660 filesystem
-	// -o rockridge (R): Rock Ridge extensions (long filenames, permissions)
-	// -o L=<label>: Volume label (must be d-characters: alphanumeric only)
-	// -o B=<bootimage>: Boot image for BIOS boot
-	// -o no-emul-boot: No emulation boot mode
-	// -o no-trailing-padding: Omit padding for smaller file
-	args := []string{
-		"-t", "cd9660",
-		"-o", "rockridge",
-		"-o", fmt.Sprintf("L=%s", label),
-	}
-
-	// Add boot image configuration if cdboot exists
-	if hasCdboot {
-		args = append(args,
-			"-o", "B=i386;boot/cdboot", // Boot image specification
-			"-o", "no-emul-boot", // No emulation mode
-		)
-		b.logger.Info("Configured for BIOS boot with boot/cdboot")
-	} else {
+	if opts.BIOSBoot == "" && opts.EFIBoot == "" {
 		b.logger.Info("Creating non-bootable ISO (no boot files available)")
 	}
 
-	// makefs needs to run from the isoRoot directory so it can find boot/cdboot
-	// The -B option expects paths relative to the working directory
-	// So we:
-	//   1. Change to isoRoot directory
-	//   2. Use "." as the source directory (current dir = isoRoot)
-	//   3. Make outputPath relative to isoRoot or absolute
-
-	// Ensure outputPath is absolute or relative to isoRoot
-	finalOutputPath := outputPath
-	if !filepath.IsAbs(outputPath) {
-		// outputPath is relative to current dir, need to make it relative to isoRoot
-		// or convert to absolute
-		absOutput, err := filepath.Abs(outputPath)
-		if err != nil {
-			return fmt.Errorf("failed to get absolute path for output: %w", err)
-		}
-		finalOutputPath = absOutput
-	}
-
-	// Add final options and paths
-	args = append(args,
-		"-o", "no-trailing-padding",
-		finalOutputPath, // Absolute path to output ISO
-		".",             // Source directory (current dir = isoRoot)
-	)
-
-	b.logger.Debug("Calling makefs from isoRoot: %s", isoRoot)
-	b.logger.Debug("Output will be written to: %s", finalOutputPath)
-
-	if err := b.runCommandInDir(toolPath, isoRoot, args...); err != nil {
-		return err
+	img, err := iso9660.Write(ctx, outputPath, isoRoot, opts)
+	if err != nil {
+		return fmt.Errorf("failed to write ISO image: %w", err)
 	}
+	b.logger.Debug("Created ISO image: %s", outputPath)
 
-	// For USB boot support, add MBR boot code to create a hybrid ISO
+	// For USB boot support, add partition tables to create a hybrid ISO
 	// This makes the ISO bootable from both CD/DVD and USB drives
-	if hasCdboot {
-		if err := b.addMBRBootCode(finalOutputPath, isoRoot); err != nil {
-			b.logger.Warn("Failed to add MBR boot code (USB boot may not work): %v", err)
+	if opts.BIOSBoot != "" || opts.EFIBoot != "" {
+		if err := b.addPartitionTables(outputPath, isoRoot, img, opts.BIOSBoot != ""); err != nil {
+			b.logger.Warn("Failed to add partition tables (USB boot may not work): %v", err)
 			b.logger.Info("ISO is still bootable from CD/DVD")
 		} else {
 			b.logger.Info("Created hybrid ISO (bootable from CD/DVD and USB)")
 		}
 	}
 
+	if info, err := os.Stat(outputPath); err == nil {
+		b.logger.Info("ISO size: %.2f MB", float64(info.Size())/(1024*1024))
+	}
 	return nil
 }
 
-// addMBRBootCode creates a hybrid GPT/MBR boot structure using mkimg (FreeBSD method)
-// This is how FreeBSD creates hybrid ISOs that boot from both CD/DVD and USB in BIOS and UEFI modes
-func (b *Builder) addMBRBootCode(isoPath, isoRoot string) error {
-	// Find required boot files
-	pmbrPath := filepath.Join(b.freebsdRoot, "boot/pmbr")
-	isobootPath := filepath.Join(b.freebsdRoot, "boot/isoboot")
-
-	// Check if required files exist
-	if _, err := os.Stat(pmbrPath); err != nil {
-		b.logger.Warn("pmbr not found at %s - trying fallback method", pmbrPath)
-		return b.addMBRBootCodeFallback(isoPath, isoRoot)
-	}
-	if _, err := os.Stat(isobootPath); err != nil {
-		b.logger.Warn("isoboot not found at %s - trying fallback method", isobootPath)
-		return b.addMBRBootCodeFallback(isoPath, isoRoot)
-	}
-
-	// Check if mkimg is available
-	mkimgPath, err := exec.LookPath("mkimg")
-	if err != nil {
-		b.logger.Warn("mkimg not found - trying fallback method")
-		return b.addMBRBootCodeFallback(isoPath, isoRoot)
-	}
-
-	b.logger.Info("Creating hybrid GPT/MBR boot structure with mkimg (FreeBSD method)")
-
-	// Get ISO size for capacity parameter
-	isoInfo, err := os.Stat(isoPath)
-	if err != nil {
-		return fmt.Errorf("failed to stat ISO: %w", err)
-	}
-	isoSize := isoInfo.Size()
-
-	// Check if EFI boot image exists
-	efiBootPath := filepath.Join(isoRoot, "boot/boot1.efi")
-	hasEFI := false
-	if _, err := os.Stat(efiBootPath); err == nil {
-		hasEFI = true
-		b.logger.Debug("Found EFI bootloader at %s", efiBootPath)
-	}
-
-	// Build mkimg command
-	// -s gpt: GPT partition scheme
-	// --capacity: ISO size
-	// -b pmbr: Protective MBR
-	// -p freebsd-boot: Boot partition with isoboot
-	// -p efi: EFI system partition (if available)
-	args := []string{
-		"-s", "gpt",
-		"--capacity", fmt.Sprintf("%d", isoSize),
-		"-b", pmbrPath,
-		"-p", fmt.Sprintf("freebsd-boot:=%s", isobootPath),
-	}
-
-	// Add EFI partition if available
-	if hasEFI {
-		// Create temporary EFI boot image
-		efiImgPath := filepath.Join(filepath.Dir(isoPath), "efiboot.img")
-		if err := b.createEFIBootImage(efiImgPath, efiBootPath); err != nil {
-			b.logger.Warn("Failed to create EFI boot image: %v", err)
-		} else {
-			defer os.Remove(efiImgPath)
-			args = append(args, "-p", fmt.Sprintf("efi:=%s", efiImgPath))
-			b.logger.Debug("Added EFI system partition")
+// addPartitionTables makes the ISO bootable from a USB drive: a
+// protective MBR with FreeBSD's pmbr, and a GPT whose freebsd-boot
+// partition holds isoboot in the ISO's system area and whose EFI partition
+// is the El Torito EFI image. The BIOS pieces are left out unless bios is
+// set. The backup GPT is appended after the ISO data.
+func (b *Builder) addPartitionTables(isoPath, isoRoot string, img *iso9660.Image, bios bool) error {
+	table := gpt.Table{
+		Sectors: (uint64(img.Sectors) + gptBackupSectors) * iso9660.SectorSize / gpt.SectorSize,
+	}
+
+	pmbr, isoboot := b.findBootFile(isoRoot, "pmbr"), b.findBootFile(isoRoot, "isoboot")
+	var bootData []byte
+	switch {
+	case !bios:
+	case pmbr != "" && isoboot != "":
+		var err error
+		if table.BootCode, err = os.ReadFile(pmbr); err != nil {
+			return err
 		}
-	}
-
-	// Output hybrid image
-	hybridPath := filepath.Join(filepath.Dir(isoPath), "hybrid.img")
-	args = append(args, "-o", hybridPath)
-
-	// Run mkimg
-	cmd := exec.Command(mkimgPath, args...)
-	b.logger.Debug("Running: %s %v", mkimgPath, args)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		b.logger.Warn("mkimg failed: %v\nOutput: %s", err, string(output))
-		return b.addMBRBootCodeFallback(isoPath, isoRoot)
-	}
-	defer os.Remove(hybridPath)
-
-	if len(output) > 0 {
-		b.logger.Debug("mkimg output: %s", string(output))
-	}
-
-	// Write the hybrid image to the ISO's system area (first 32KB)
-	// This is the standard FreeBSD approach
-	hybridData, err := os.ReadFile(hybridPath)
-	if err != nil {
-		return fmt.Errorf("failed to read hybrid image: %w", err)
-	}
-
-	// Open ISO for writing
-	iso, err := os.OpenFile(isoPath, os.O_RDWR, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open ISO: %w", err)
-	}
-	defer iso.Close()
-
-	// Write first 32KB of hybrid image to ISO (MBR + primary GPT)
-	writeSize := 32768 // 32KB
-	if len(hybridData) < writeSize {
-		writeSize = len(hybridData)
-	}
-
-	n, err := iso.WriteAt(hybridData[:writeSize], 0)
-	if err != nil {
-		return fmt.Errorf("failed to write hybrid boot structure: %w", err)
-	}
-
-	b.logger.Debug("Wrote %d bytes of primary GPT/MBR boot structure to ISO", n)
-
-	// Write secondary GPT table at the end of the ISO
-	// GPT secondary consists of:
-	// - Partition entries array: 32 sectors (128 entries × 128 bytes = 16KB)
-	// - GPT header: 1 sector (512 bytes)
-	// Total: 33 sectors = 16896 bytes
-	secondaryGPTSize := 33 * 512 // 16896 bytes
-
-	if len(hybridData) >= secondaryGPTSize {
-		// Read secondary GPT from end of hybrid image
-		secondaryGPTData := hybridData[len(hybridData)-secondaryGPTSize:]
-
-		// Write secondary GPT to end of ISO
-		secondaryOffset := isoSize - int64(secondaryGPTSize)
-		n2, err := iso.WriteAt(secondaryGPTData, secondaryOffset)
-		if err != nil {
-			b.logger.Warn("Failed to write secondary GPT table: %v", err)
-			b.logger.Warn("ISO will still boot, but may show GEOM warnings when copied to USB")
-		} else {
-			b.logger.Debug("Wrote %d bytes of secondary GPT table at offset %d", n2, secondaryOffset)
-			b.logger.Info("Wrote complete hybrid GPT/MBR boot structure (primary + secondary)")
+		if bootData, err = os.ReadFile(isoboot); err != nil {
+			return err
 		}
-	} else {
-		b.logger.Warn("Hybrid image too small to contain secondary GPT")
-		b.logger.Warn("ISO will still boot, but may show GEOM warnings when copied to USB")
-	}
-
-	return nil
-}
-
-// createEFIBootImage creates a FAT filesystem image containing the EFI bootloader
-// This is used for hybrid ISOs created with makefs + mkimg
-func (b *Builder) createEFIBootImage(outputPath, efiBootPath string) error {
-	// Create a 4MB FAT16 image for EFI boot
-	// Needs to be large enough to hold EFI bootloader and directory structure
-	imageSize := 4096 * 1024 // 4MB
-
-	// Try using mformat (from mtools) to create a FAT filesystem
-	// This is the most reliable cross-platform method
-	mformatPath, err := exec.LookPath("mformat")
-	if err != nil {
-		b.logger.Debug("mformat not found - trying dd + newfs_msdos/mkfs.vfat method")
-		return b.createEFIBootImageDirect(outputPath, efiBootPath, imageSize)
-	}
-
-	// Create the image file
-	img, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create EFI image: %w", err)
-	}
-	img.Close()
-
-	// Use mformat to create FAT filesystem
-	// -i: specify image file
-	// -C: create image
-	// -T: total sectors
-	// -h: heads
-	// -s: sectors per track
-	cmd := exec.Command(mformatPath, "-i", outputPath, "-C", "-T", fmt.Sprintf("%d", imageSize/512), "-h", "64", "-s", "32", "::")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		b.logger.Warn("mformat failed: %v, output: %s - trying fallback", err, string(output))
-		return b.createEFIBootImageDirect(outputPath, efiBootPath, imageSize)
-	}
-
-	// Use mcopy to copy the EFI bootloader into the image
-	mcopyPath, err := exec.LookPath("mcopy")
-	if err != nil {
-		b.logger.Warn("mcopy not found - EFI image may not boot")
-		return fmt.Errorf("mcopy not available: %w", err)
-	}
-
-	// Create EFI/BOOT directory structure and copy bootloader
-	// mcopy -i image.img source ::destination
-	cmd = exec.Command(mcopyPath, "-i", outputPath, efiBootPath, "::BOOTX64.EFI")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		b.logger.Warn("mcopy failed: %v, output: %s", err, string(output))
-		return fmt.Errorf("failed to copy EFI bootloader into image: %w", err)
-	}
-
-	b.logger.Info("Created EFI boot image with FAT filesystem (%d KB)", imageSize/1024)
-	return nil
-}
-
-// createEFIBootImageForISO creates a proper FAT filesystem image with EFI bootloader for ISO El Torito
-func (b *Builder) createEFIBootImageForISO(outputPath, efiBootPath string) error {
-	// Create a 4MB FAT16 image for EFI boot (larger to accommodate BOOTX64.EFI)
-	imageSize := 4096 * 1024 // 4MB
-
-	// Try using mformat (from mtools) to create a FAT filesystem
-	// This is the most reliable cross-platform method
-	mformatPath, err := exec.LookPath("mformat")
-	if err != nil {
-		b.logger.Warn("mformat not found - trying dd + mkfs.vfat method")
-		return b.createEFIBootImageDirect(outputPath, efiBootPath, imageSize)
-	}
-
-	// Create the image file
-	img, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create EFI image: %w", err)
-	}
-	img.Close()
-
-	// Use mformat to create FAT filesystem
-	// -i: specify image file
-	// -C: create image
-	// -f: format (1440 = 1.44MB, 2880 = 2.88MB floppy formats)
-	// We'll use custom size
-	cmd := exec.Command(mformatPath, "-i", outputPath, "-C", "-T", fmt.Sprintf("%d", imageSize/512), "-h", "64", "-s", "32", "::")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		b.logger.Warn("mformat failed: %v, output: %s - trying fallback", err, string(output))
-		return b.createEFIBootImageDirect(outputPath, efiBootPath, imageSize)
+		sectors := (uint64(len(bootData)) + gpt.SectorSize - 1) / gpt.SectorSize
+		if gpt.FirstUsableLBA+sectors > isoSystemAreaSectors {
+			return fmt.Errorf("%s does not fit the ISO system area", isoboot)
+		}
+		table.Partitions = append(table.Partitions, gpt.Partition{
+			Type:    gpt.TypeFreeBSDBoot,
+			Name:    "isoboot",
+			Start:   gpt.FirstUsableLBA,
+			Sectors: sectors,
+		})
+	default:
+		b.logger.Warn("boot/pmbr or boot/isoboot not found - USB drives will not boot in BIOS mode")
 	}
 
-	// Use mcopy to copy the EFI bootloader into the image
-	mcopyPath, err := exec.LookPath("mcopy")
-	if err != nil {
-		b.logger.Warn("mcopy not found - EFI image may not boot")
-		return nil
+	if img.EFIBoot.Size > 0 {
+		table.Partitions = append(table.Partitions, gpt.Partition{
+			Type:    gpt.TypeEFI,
+			Name:    "efiboot",
+			Start:   uint64(img.EFIBoot.Sector) * iso9660.SectorSize / gpt.SectorSize,
+			Sectors: (uint64(img.EFIBoot.Size) + gpt.SectorSize - 1) / gpt.SectorSize,
+		})
 	}
-
-	// Create EFI/BOOT directory structure and copy bootloader
-	// mcopy -i image.img source ::destination
-	cmd = exec.Command(mcopyPath, "-i", outputPath, efiBootPath, "::BOOTX64.EFI")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		b.logger.Warn("mcopy failed: %v, output: %s", err, string(output))
-		return fmt.Errorf("failed to copy EFI bootloader into image: %w", err)
+	if len(table.Partitions) == 0 {
+		return fmt.Errorf("no boot code or EFI image to partition")
 	}
 
-	b.logger.Info("Created EFI boot image with FAT filesystem (%d KB)", imageSize/1024)
-	return nil
-}
-
-// createEFIBootImageDirect creates EFI boot image using dd and newfs_msdos/mkfs.vfat (fallback method)
-func (b *Builder) createEFIBootImageDirect(outputPath, efiBootPath string, imageSize int) error {
-	// Create empty image file
-	ddPath, err := exec.LookPath("dd")
+	f, err := os.OpenFile(isoPath, os.O_RDWR, 0)
 	if err != nil {
-		return fmt.Errorf("dd command not found: %w", err)
+		return err
 	}
-
-	cmd := exec.Command(ddPath, "if=/dev/zero", fmt.Sprintf("of=%s", outputPath),
-		"bs=1024", fmt.Sprintf("count=%d", imageSize/1024))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("dd failed: %w, output: %s", err, string(output))
+	if bootData != nil {
+		_, err = f.WriteAt(bootData, gpt.FirstUsableLBA*gpt.SectorSize)
 	}
-
-	// Try FreeBSD's newfs_msdos first (native FreeBSD tool)
-	newfsPath, err := exec.LookPath("newfs_msdos")
 	if err == nil {
-		// Use newfs_msdos (FreeBSD)
-		// -F 16: FAT16
-		// -L EFIBOOT: volume label
-		// -@ offset: start offset in bytes (0 for file)
-		cmd = exec.Command(newfsPath, "-F", "16", "-L", "EFIBOOT", outputPath)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			b.logger.Warn("newfs_msdos failed: %v, output: %s", err, string(output))
-		} else {
-			b.logger.Debug("Formatted EFI image with newfs_msdos (FreeBSD)")
-			// Still need mtools to copy files into the image
-			b.logger.Warn("Created FAT filesystem - EFI bootloader not copied (requires mtools)")
-			b.logger.Warn("Install mtools package for proper EFI boot support: pkg install mtools")
-			return nil
-		}
+		err = table.Write(f)
 	}
-
-	// Fallback to Linux mkfs.vfat/mkfs.msdos
-	mkfsPath, err := exec.LookPath("mkfs.vfat")
-	if err != nil {
-		// Try mkfs.msdos as fallback
-		mkfsPath, err = exec.LookPath("mkfs.msdos")
-		if err != nil {
-			b.logger.Warn("No FAT filesystem tools found (tried: newfs_msdos, mkfs.vfat, mkfs.msdos)")
-			return fmt.Errorf("FAT filesystem tools not available")
-		}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-
-	cmd = exec.Command(mkfsPath, "-F", "16", "-n", "EFIBOOT", outputPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("mkfs.vfat failed: %w, output: %s", err, string(output))
-	}
-
-	b.logger.Debug("Formatted EFI image with %s", filepath.Base(mkfsPath))
-	// Mount and copy (requires root or fuse)
-	b.logger.Warn("Created FAT filesystem - EFI bootloader not copied (requires mtools)")
-	b.logger.Warn("Install mtools package for proper EFI boot support")
-	return nil
-}
-
-// addMBRBootCodeFallback is the fallback method when mkimg is not available
-// This writes a simple MBR boot structure (original method)
-func (b *Builder) addMBRBootCodeFallback(isoPath, isoRoot string) error {
-	b.logger.Info("Using fallback MBR boot code method")
-
-	// FreeBSD uses /boot/isoboot for hybrid ISOs
-	// isoboot contains the MBR boot code that allows USB boot
-	isobootPaths := []string{
-		filepath.Join(b.freebsdRoot, "boot/isoboot"), // From FREEBSD_ROOT
-		filepath.Join(isoRoot, "boot/isoboot"),       // From ISO root
-		filepath.Join(b.freebsdRoot, "boot/cdboot"),  // Fallback
-	}
-
-	var isobootPath string
-	for _, path := range isobootPaths {
-		if _, err := os.Stat(path); err == nil {
-			isobootPath = path
-			b.logger.Debug("Found isoboot at: %s", path)
-			break
-		}
-	}
-
-	if isobootPath == "" {
-		return fmt.Errorf("isoboot file not found (checked: %v)", isobootPaths)
-	}
-
-	// Read the isoboot file (contains MBR boot code)
-	isoboot, err := os.ReadFile(isobootPath)
-	if err != nil {
-		return fmt.Errorf("failed to read isoboot: %w", err)
-	}
-
-	// Open the ISO file for writing at the beginning
-	iso, err := os.OpenFile(isoPath, os.O_RDWR, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open ISO: %w", err)
-	}
-	defer iso.Close()
-
-	// Write the first 432 bytes of isoboot to the ISO (MBR boot code)
-	// This doesn't overwrite the ISO 9660 structures, only adds boot code
-	bootCodeSize := 432
-	if len(isoboot) < bootCodeSize {
-		bootCodeSize = len(isoboot)
-	}
-
-	n, err := iso.WriteAt(isoboot[:bootCodeSize], 0)
 	if err != nil {
-		return fmt.Errorf("failed to write boot code: %w", err)
+		return fmt.Errorf("failed to write partition tables: %w", err)
 	}
-	b.logger.Debug("Wrote %d bytes of MBR boot code to ISO", n)
-
-	// Get ISO file size for partition table
-	isoInfo, err := iso.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to stat ISO: %w", err)
-	}
-	isoSize := isoInfo.Size()
-	isoSectors := (isoSize + 511) / 512 // Round up to sector boundary
-
-	// Create MBR partition table for USB boot detection
-	// Partition table starts at byte 446 (0x1BE)
-	partitionTable := make([]byte, 64) // 4 partition entries * 16 bytes each
-
-	// First partition entry (bytes 0-15 of partition table)
-	// This tells BIOS where the bootable data is
-	partitionTable[0] = 0x80 // Bootable flag (0x80 = bootable, 0x00 = not bootable)
-	partitionTable[1] = 0x00 // Starting head
-	partitionTable[2] = 0x01 // Starting sector
-	partitionTable[3] = 0x00 // Starting cylinder
-	partitionTable[4] = 0xcd // Partition type (0xcd = ISO 9660 filesystem)
-	partitionTable[5] = 0xFE // Ending head
-	partitionTable[6] = 0xFF // Ending sector
-	partitionTable[7] = 0xFF // Ending cylinder
-
-	// LBA of first sector (little-endian, 4 bytes)
-	partitionTable[8] = 0x00
-	partitionTable[9] = 0x00
-	partitionTable[10] = 0x00
-	partitionTable[11] = 0x00
-
-	// Number of sectors (little-endian, 4 bytes)
-	// Limit to 32-bit max for compatibility
-	sectors := uint32(isoSectors)
-	if isoSectors > 0xFFFFFFFF {
-		sectors = 0xFFFFFFFF
-	}
-	partitionTable[12] = byte(sectors & 0xFF)
-	partitionTable[13] = byte((sectors >> 8) & 0xFF)
-	partitionTable[14] = byte((sectors >> 16) & 0xFF)
-	partitionTable[15] = byte((sectors >> 24) & 0xFF)
-
-	// Write partition table at offset 446 (0x1BE)
-	if _, err := iso.WriteAt(partitionTable, 446); err != nil {
-		return fmt.Errorf("failed to write partition table: %w", err)
-	}
-	b.logger.Debug("Created MBR partition table (ISO size: %d MB, sectors: %d)", isoSize/(1024*1024), sectors)
-
-	// Write MBR boot signature at bytes 510-511 (0x55 0xAA)
-	bootSig := []byte{0x55, 0xAA}
-	if _, err := iso.WriteAt(bootSig, 510); err != nil {
-		return fmt.Errorf("failed to write boot signature: %w", err)
-	}
-	b.logger.Debug("Wrote MBR boot signature (0x55AA)")
-
+	b.logger.Debug("Wrote GPT with %d partitions to %s", len(table.Partitions), isoPath)
 	return nil
 }
 
-// createISOWithXorriso creates an ISO using xorriso (modern Linux ISO tool)
-func (b *Builder) createISOWithXorriso(toolPath, outputPath, isoRoot, label string, hasCdboot bool) error {
-	// xorriso command arguments for creating a hybrid BIOS+UEFI bootable ISO
-	// This creates an ISO that boots from CD/DVD/USB in both BIOS and UEFI modes
-	// -as mkisofs: Compatibility mode
-	// -r: Rock Ridge extensions
-	// -J: Joliet extensions (Windows compatibility)
-	// -joliet-long: Long filenames in Joliet
-	// -V <label>: Volume label
-	// -o <output>: Output file
-	args := []string{
-		"-as", "mkisofs",
-		"-r",            // Rock Ridge
-		"-J",            // Joliet
-		"-joliet-long",  // Long filenames
-		"-cache-inodes", // Optimize hard links
-		"-V", label,     // Volume label
-		"-o", outputPath, // Output file
-	}
-
-	if hasCdboot {
-		// Check if EFI bootloader exists for UEFI support
-		efiBootPath := filepath.Join(isoRoot, "EFI/BOOT/BOOTX64.EFI")
-		hasEFI := false
-		if stat, err := os.Stat(efiBootPath); err == nil && !stat.IsDir() {
-			hasEFI = true
-		}
-
-		// Check if isoboot exists for hybrid USB boot
-		isobootPath := filepath.Join(isoRoot, "boot/isoboot")
-		hasIsoboot := false
-		if stat, err := os.Stat(isobootPath); err == nil && !stat.IsDir() {
-			hasIsoboot = true
-		}
-
-		// Add hybrid MBR boot code for USB boot (BIOS mode)
-		if hasIsoboot {
-			args = append(args, "-isohybrid-mbr", filepath.Join(isoRoot, "boot/isoboot"))
-			b.logger.Info("Configured for hybrid USB boot (BIOS mode)")
-		}
-
-		// Add BIOS boot configuration (CD/DVD and USB)
-		args = append(args,
-			"-b", "boot/cdboot", // Boot image
-			"-c", "boot.catalog", // Boot catalog
-			"-boot-load-size", "4", // Load size
-			"-boot-info-table", // Create boot info table
-			"-no-emul-boot",    // No emulation
-		)
-		b.logger.Info("Configured for BIOS boot with boot/cdboot")
-
-		// Add UEFI boot configuration
-		if hasEFI {
-			args = append(args,
-				"-eltorito-alt-boot",         // Alternative boot entry
-				"-e", "EFI/BOOT/BOOTX64.EFI", // EFI boot loader
-				"-no-emul-boot",         // No emulation
-				"-isohybrid-gpt-basdat", // GPT partition for hybrid boot
-			)
-			b.logger.Info("Configured for UEFI boot with EFI/BOOT/BOOTX64.EFI")
-		}
-	} else {
-		b.logger.Info("Creating non-bootable ISO (no boot files available)")
-	}
-
-	args = append(args, isoRoot)
-
-	return b.runCommand(toolPath, args...)
-}
+const (
+	// isoSystemAreaSectors are the 512-byte sectors before the ISO 9660
+	// volume descriptors, which hold the MBR, the GPT and isoboot
+	isoSystemAreaSectors = 16 * iso9660.SectorSize / gpt.SectorSize
 
-// createISOWithGenisoimage creates an ISO using genisoimage or mkisofs (legacy Linux tools)
-func (b *Builder) createISOWithGenisoimage(toolPath, outputPath, isoRoot, label string, hasCdboot bool) error {
-	// genisoimage/mkisofs command arguments
-	// -r: Rock Ridge extensions
-	// -V <label>: Volume label
-	// -o <output>: Output file
-	args := []string{
-		"-r",        // Rock Ridge
-		"-V", label, // Volume label
-		"-o", outputPath, // Output file
-	}
-
-	if hasCdboot {
-		// Check if EFI bootloader exists for UEFI support
-		efiBootPath := filepath.Join(isoRoot, "EFI/BOOT/BOOTX64.EFI")
-		hasEFI := false
-		if stat, err := os.Stat(efiBootPath); err == nil && !stat.IsDir() {
-			hasEFI = true
-		}
+	// gptBackupSectors are the 2048-byte sectors appended for the backup
+	// GPT
+	gptBackupSectors = 9
+)
 
-		// Add BIOS boot configuration (CD/DVD and USB)
-		args = append(args,
-			"-b", "boot/cdboot", // Boot image
-			"-c", "boot.catalog", // Boot catalog
-			"-no-emul-boot",        // No emulation
-			"-boot-load-size", "4", // Load size
-			"-boot-info-table", // Create boot info table
-		)
-		b.logger.Info("Configured for BIOS boot with boot/cdboot")
-
-		// Add UEFI boot configuration
-		if hasEFI {
-			// Create EFI boot image for El Torito
-			efiImgPath := filepath.Join(isoRoot, "boot/efiboot.img")
-			if err := b.createEFIBootImageForISO(efiImgPath, efiBootPath); err != nil {
-				b.logger.Warn("Failed to create EFI boot image: %v - UEFI boot may not work", err)
-			} else {
-				args = append(args,
-					"-eltorito-alt-boot",                    // Alternative boot entry
-					"-eltorito-platform", "efi",             // EFI platform
-					"-eltorito-boot", "boot/efiboot.img",    // EFI boot image
-					"-no-emul-boot",                         // No emulation
-				)
-				b.logger.Info("Configured for UEFI boot with boot/efiboot.img")
-			}
+// findBootFile returns the path of boot/<name> in the ISO root or, when
+// cross-building, in FREEBSD_ROOT; empty if neither has it.
+func (b *Builder) findBootFile(isoRoot, name string) string {
+	for _, root := range []string{isoRoot, b.freebsdRoot} {
+		path := filepath.Join(root, "boot", name)
+		if util.FileExists(path) {
+			return path
 		}
-	} else {
-		b.logger.Info("Creating non-bootable ISO (no boot files available)")
 	}
-
-	args = append(args, isoRoot)
-
-	return b.runCommand(toolPath, args...)
+	return ""
 }
 
-// createTarArchive creates a compressed tar archive of the ISO root directory
-func (b *Builder) createTarArchive(tarPath, isoRoot string) error {
-	b.logger.Debug("Creating tar archive: %s", tarPath)
-
-	// Create the output file
-	outFile, err := os.Create(tarPath)
+// createEFIBootImage writes a FAT image holding loader as
+// EFI/BOOT/BOOTX64.EFI, for the El Torito EFI entry and the EFI partition
+// of hybrid ISOs. The image is at least 4MB and grows with the loader.
+func (b *Builder) createEFIBootImage(ctx context.Context, outputPath, loader string) error {
+	info, err := os.Stat(loader)
 	if err != nil {
-		return fmt.Errorf("failed to create tar file: %w", err)
+		return err
+	}
+	const mb = 1 << 20
+	size := int64(4 * mb)
+	if need := (info.Size()+mb-1)/mb*mb + mb; need > size {
+		size = need
 	}
-	defer outFile.Close()
-
-	// Create gzip writer
-	gzWriter := gzip.NewWriter(outFile)
-	defer gzWriter.Close()
-
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
-
-	// Walk the ISO root directory and add all files
-	return filepath.Walk(isoRoot, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path for the tar header
-		relPath, err := filepath.Rel(isoRoot, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip the root directory itself
-		if relPath == "." {
-			return nil
-		}
-
-		// Create tar header from file info
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return fmt.Errorf("failed to create tar header for %s: %w", path, err)
-		}
-
-		// Use the relative path as the name in the archive
-		header.Name = relPath
-
-		// Write the header
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header for %s: %w", path, err)
-		}
-
-		// If it's a regular file, write its contents
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", path, err)
-			}
-			defer file.Close()
-
-			if _, err := io.Copy(tarWriter, file); err != nil {
-				return fmt.Errorf("failed to write file %s to tar: %w", path, err)
-			}
-		}
 
-		return nil
+	err = fat.Write(ctx, outputPath, []fat.File{{Path: "EFI/BOOT/BOOTX64.EFI", Src: loader}}, fat.Options{
+		Size:     size,
+		Label:    "EFIBOOT",
+		VolumeID: uint32(b.config.BuildTime().Unix()),
+		Time:     b.config.BuildTime(),
 	})
-}
-
-// runCommand executes a command and returns an error if it fails
-func (b *Builder) runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-
-	b.logger.Debug("Running: %s %v", name, args)
-
-	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("command failed: %w\nOutput: %s", err, string(output))
-	}
-
-	if len(output) > 0 {
-		b.logger.Debug("Command output: %s", string(output))
+		return fmt.Errorf("failed to write EFI boot image: %w", err)
 	}
-
+	b.logger.Info("Created EFI boot image with FAT filesystem (%d KB)", size/1024)
 	return nil
 }
 
-// runCommandInDir executes a command in a specific working directory
-func (b *Builder) runCommandInDir(name, dir string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Dir = dir
-
-	b.logger.Debug("Running in %s: %s %v", dir, name, args)
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command failed: %w\nOutput: %s", err, string(output))
-	}
-
-	if len(output) > 0 {
-		b.logger.Debug("Command output: %s", string(output))
+// removePartial removes output files left by an unfinished assembly.
+func removePartial(paths ...string) error {
+	var errs []error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
 	}
-
-	return nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,83 @@
+package iso
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pgsdf/pgsdbuild/internal/build"
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/pipeline"
+	"github.com/pgsdf/pgsdbuild/internal/pkglist"
+	"github.com/pgsdf/pgsdbuild/internal/teardown"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// Editing a package list, including one pulled in by @include, changes
+// the cache key and fingerprint of the packages stage.
+func TestPackagesStageKey(t *testing.T) {
+	cfg := build.NewDefaultConfig()
+	cfg.RootDir = t.TempDir()
+	lists := cfg.GetPkgListsDir()
+	if err := os.MkdirAll(lists, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(lists, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("bootenv.txt", "sudo\n@include tools\n")
+	write("tools.txt", "tmux\n")
+
+	logger := util.NewLogger(io.Discard, util.LevelError, false, "")
+	b := NewBuilder(cfg, logger)
+	variant := config.VariantConfig{ID: "test", PkgLists: []string{"bootenv"}}
+
+	keys := func() (string, string) {
+		t.Helper()
+		packages, err := pkglist.NewResolver(lists, cfg.FreeBSDArch).Resolve(variant.PkgLists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		work := t.TempDir()
+		for _, s := range b.stages(variant, packages, teardown.New(logger), work, filepath.Join(work, "root"), filepath.Join(work, "test.iso")) {
+			if s.Name != "packages" {
+				continue
+			}
+			key, err := pipeline.ContentKey(s, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp, err := pipeline.Fingerprint(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return key, fp
+		}
+		t.Fatal("no packages stage")
+		return "", ""
+	}
+
+	key, fp := keys()
+	if k, f := keys(); k != key || f != fp {
+		t.Fatal("key is not stable")
+	}
+
+	write("tools.txt", "tmux\nrsync\n")
+	key2, fp2 := keys()
+	if key2 == key {
+		t.Error("cache key did not change when an included list changed")
+	}
+	if fp2 == fp {
+		t.Error("fingerprint did not change when an included list changed")
+	}
+
+	// Comments do not change the package set, so the entry is reused
+	write("tools.txt", "# terminal tools\ntmux\nrsync\n")
+	if k, _ := keys(); k != key2 {
+		t.Error("cache key changed for a comment")
+	}
+}
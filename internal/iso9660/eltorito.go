@@ -0,0 +1,82 @@
+package iso9660
+
+import "encoding/binary"
+
+// El Torito platform IDs.
+const (
+	PlatformX86 = 0x00
+	PlatformEFI = 0xef
+)
+
+const (
+	elToritoID        = "EL TORITO SPECIFICATION"
+	bootIndicator     = 0x88 // bootable entry
+	noEmulation       = 0x00
+	sectionHeader     = 0x90
+	sectionHeaderLast = 0x91
+	catalogEntrySize  = 32
+)
+
+// bootRecord returns the El Torito boot record volume descriptor pointing
+// to the boot catalog.
+func bootRecord(catalogSector uint32) []byte {
+	d := descriptorHeader(0)
+	copy(d[7:39], elToritoID)
+	binary.LittleEndian.PutUint32(d[71:], catalogSector)
+	return d
+}
+
+// bootCatalog returns the boot catalog. The first image is the default
+// entry; an EFI image after a BIOS image gets a section of its own, which
+// is how firmware finds it.
+func bootCatalog(bios, efi *node) []byte {
+	c := make([]byte, SectorSize)
+
+	// Validation entry
+	platform := byte(PlatformX86)
+	if bios == nil {
+		platform = PlatformEFI
+	}
+	c[0] = 1
+	c[1] = platform
+	c[30], c[31] = 0x55, 0xaa
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(c[i:])
+	}
+	binary.LittleEndian.PutUint16(c[28:], -sum)
+
+	first := bios
+	if first == nil {
+		first = efi
+	}
+	bootEntry(c[32:64], first)
+
+	if bios != nil && efi != nil {
+		h := c[64:96]
+		h[0] = sectionHeaderLast
+		h[1] = PlatformEFI
+		binary.LittleEndian.PutUint16(h[2:], 1)
+		bootEntry(c[96:128], efi)
+	}
+	return c
+}
+
+// bootEntry fills a no-emulation entry loading the whole image at the
+// default segment.
+func bootEntry(e []byte, image *node) {
+	e[0] = bootIndicator
+	e[1] = noEmulation
+	binary.LittleEndian.PutUint16(e[6:], loadSectors(image.data.size))
+	binary.LittleEndian.PutUint32(e[8:], image.data.sector)
+}
+
+// loadSectors returns the size of a boot image in 512-byte sectors, as the
+// catalog records it.
+func loadSectors(size int64) uint16 {
+	n := (size + 511) / 512
+	if n > 0xffff {
+		return 0xffff
+	}
+	return uint16(n)
+}
@@ -0,0 +1,804 @@
+// Package iso9660 writes ISO 9660 images of a directory tree without
+// external tools. Images carry Rock Ridge extensions (POSIX modes,
+// ownership, symbolic links, hard links and device nodes), an optional
+// Joliet hierarchy for systems without Rock Ridge, and an optional El
+// Torito boot catalog with a BIOS entry, an EFI entry or both.
+//
+// The image depends only on the tree and the Options: directories are
+// written in sorted order and every timestamp comes from the files or
+// Options.Time, so the same tree always produces the same bytes.
+//
+// Directories deeper than the eight levels of plain ISO 9660 are written in
+// place rather than relocated; FreeBSD, Linux and libarchive read them.
+// Files of 4 GiB and more are split into multiple extents.
+//
+// Open reads back enough of an image to check it: the volume descriptors,
+// the boot catalog, and individual files with their Rock Ridge attributes.
+package iso9660
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SectorSize is the logical block size of the images written.
+const SectorSize = 2048
+
+// systemAreaSectors precede the volume descriptors. They are left zero for
+// boot code and partition tables.
+const systemAreaSectors = 16
+
+// maxSection is the largest extent of a file; larger files get several.
+const maxSection = 0xffffffff / SectorSize * SectorSize
+
+// Options describe the volume.
+type Options struct {
+	VolumeID    string    // d-characters (A-Z, 0-9, _), at most 32
+	System      string    // system identifier, e.g. "FREEBSD"
+	Publisher   string    // up to 128 characters
+	Preparer    string    // up to 128 characters
+	Application string    // up to 128 characters
+	Time        time.Time // volume creation time; zero for now
+
+	// MaxTime, if set, caps the file times recorded, for reproducible
+	// builds with trees holding symbolic links whose times cannot be set.
+	MaxTime time.Time
+
+	// Joliet adds a second hierarchy with Unicode names.
+	Joliet bool
+
+	// El Torito boot images, as paths relative to the tree. BIOSBoot is a
+	// no-emulation image such as FreeBSD's boot/cdboot; EFIBoot is a FAT
+	// image holding EFI/BOOT/BOOTX64.EFI. The boot catalog is added to
+	// the tree as BootCatalog, "boot.catalog" if empty.
+	BIOSBoot    string
+	EFIBoot     string
+	BootCatalog string
+}
+
+// Image describes a written image, for tools that add partition tables.
+type Image struct {
+	Sectors  uint32 // size in 2048-byte sectors
+	BIOSBoot Extent // zero if there is none
+	EFIBoot  Extent
+}
+
+// Extent is a contiguous range of the image.
+type Extent struct {
+	Sector uint32
+	Size   int64
+}
+
+type extent struct {
+	sector uint32
+	size   uint32
+}
+
+// ValidVolumeID checks that id can be written as a volume identifier:
+// 1 to 32 d-characters (upper-case letters, digits and underscores).
+func ValidVolumeID(id string) error {
+	if id == "" || len(id) > 32 {
+		return fmt.Errorf("volume ID %q must be 1 to 32 characters", id)
+	}
+	if dChars(id) != id {
+		return fmt.Errorf("volume ID %q may only contain A-Z, 0-9 and _", id)
+	}
+	return nil
+}
+
+// Write writes an image of the tree at root to path.
+func Write(ctx context.Context, path, root string, opts Options) (*Image, error) {
+	if err := ValidVolumeID(opts.VolumeID); err != nil {
+		return nil, err
+	}
+	if opts.Time.IsZero() {
+		opts.Time = time.Now()
+	}
+
+	tree, err := scan(root)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.MaxTime.IsZero() {
+		tree.clampTimes(opts.MaxTime)
+	}
+	l := &layout{opts: opts, root: tree}
+	if err := l.addBoot(); err != nil {
+		return nil, err
+	}
+	assignNames(tree, opts.Joliet)
+	l.plan()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &sectorWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	err = l.write(ctx, w)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{Sectors: l.sectors}
+	if l.bios != nil {
+		img.BIOSBoot = Extent{Sector: l.bios.data.sector, Size: l.bios.data.size}
+	}
+	if l.efi != nil {
+		img.EFIBoot = Extent{Sector: l.efi.data.sector, Size: l.efi.data.size}
+	}
+	return img, nil
+}
+
+// layout assigns every structure of the image its sectors.
+type layout struct {
+	opts Options
+	root *node
+
+	bios, efi, catalog *node
+
+	isoDirs, jolietDirs []*node // in path table order
+	files               []*file // in data order
+
+	pvd, bootRecord, svd, terminator uint32
+	catalogSector                    uint32
+	isoPathL, isoPathM               uint32
+	jolietPathL, jolietPathM         uint32
+	isoPathSize, jolietPathSize      uint32
+	sectors                          uint32
+}
+
+// addBoot finds the boot images and adds the boot catalog to the tree.
+func (l *layout) addBoot() error {
+	find := func(p string) (*node, error) {
+		n := l.root.lookup(p)
+		if n == nil || !n.isRegular() {
+			return nil, fmt.Errorf("boot image %s is not a file in the tree", p)
+		}
+		return n, nil
+	}
+	var err error
+	if l.opts.BIOSBoot != "" {
+		if l.bios, err = find(l.opts.BIOSBoot); err != nil {
+			return err
+		}
+	}
+	if l.opts.EFIBoot != "" {
+		if l.efi, err = find(l.opts.EFIBoot); err != nil {
+			return err
+		}
+	}
+	if l.bios == nil && l.efi == nil {
+		return nil
+	}
+
+	catalogPath := l.opts.BootCatalog
+	if catalogPath == "" {
+		catalogPath = "boot.catalog"
+	}
+	dirPath, name := "", catalogPath
+	if i := strings.LastIndexByte(catalogPath, '/'); i >= 0 {
+		dirPath, name = catalogPath[:i], catalogPath[i+1:]
+	}
+	dir := l.root.lookup(dirPath)
+	if dir == nil || !dir.isDir() {
+		return fmt.Errorf("directory of boot catalog %s is not in the tree", catalogPath)
+	}
+	if dir.lookup(name) != nil {
+		return fmt.Errorf("boot catalog %s already exists in the tree", catalogPath)
+	}
+	l.catalog = &node{
+		name:   name,
+		mode:   sIFREG | 0444,
+		mtime:  l.opts.Time,
+		data:   &file{size: SectorSize, links: 1, catalog: true},
+		parent: dir,
+	}
+	dir.children = append(dir.children, l.catalog)
+	return nil
+}
+
+// plan computes the records of every directory and the location of every
+// structure. Record sizes depend only on names, so sizes are known before
+// locations.
+func (l *layout) plan() {
+	l.isoDirs = pathTableOrder(l.root, func(n *node) []*node { return n.isoOrder })
+	for i, d := range l.isoDirs {
+		d.isoNumber = i + 1
+	}
+	if l.opts.Joliet {
+		l.jolietDirs = pathTableOrder(l.root, func(n *node) []*node { return n.jolietOrder })
+		for i, d := range l.jolietDirs {
+			d.jolietNum = i + 1
+		}
+	}
+
+	sector := uint32(systemAreaSectors)
+	next := func(n uint32) uint32 {
+		s := sector
+		sector += n
+		return s
+	}
+	l.pvd = next(1)
+	if l.catalog != nil {
+		l.bootRecord = next(1)
+	}
+	if l.opts.Joliet {
+		l.svd = next(1)
+	}
+	l.terminator = next(1)
+	if l.catalog != nil {
+		l.catalogSector = next(1)
+	}
+
+	l.isoPathSize = pathTableSize(l.isoDirs, false)
+	l.isoPathL = next(sectorsFor(int64(l.isoPathSize)))
+	l.isoPathM = next(sectorsFor(int64(l.isoPathSize)))
+	if l.opts.Joliet {
+		l.jolietPathSize = pathTableSize(l.jolietDirs, true)
+		l.jolietPathL = next(sectorsFor(int64(l.jolietPathSize)))
+		l.jolietPathM = next(sectorsFor(int64(l.jolietPathSize)))
+	}
+
+	// Each directory's continuation areas follow its extent, packed into
+	// sectors without crossing a sector boundary; libarchive only reads
+	// them there
+	for _, d := range l.isoDirs {
+		d.isoRecords = isoRecords(d, d == l.root)
+		size := directorySize(d.isoRecords)
+		d.isoExtent = extent{sector: next(size / SectorSize), size: size}
+
+		offset := uint32(0)
+		for _, r := range d.isoRecords {
+			if r.cont == nil {
+				continue
+			}
+			if offset+uint32(len(r.cont)) > SectorSize {
+				d.contSectors++
+				offset = 0
+			}
+			r.contSector, r.contOffset = sector+d.contSectors, offset
+			offset += uint32(len(r.cont))
+		}
+		if offset > 0 {
+			d.contSectors++
+		}
+		next(d.contSectors)
+	}
+	for _, d := range l.jolietDirs {
+		d.jolietRecords = jolietRecords(d)
+		size := directorySize(d.jolietRecords)
+		d.jolietExt = extent{sector: next(size / SectorSize), size: size}
+	}
+
+	// File data in directory order; hard links share their first extent
+	seen := make(map[*file]bool)
+	var walk func(d *node)
+	walk = func(d *node) {
+		for _, c := range d.isoOrder {
+			switch {
+			case c.isDir():
+				walk(c)
+			case c.data != nil && !seen[c.data]:
+				seen[c.data] = true
+				switch {
+				case c.data.catalog:
+					c.data.sector = l.catalogSector
+				case c.data.size == 0:
+					c.data.sector = 0
+				default:
+					c.data.sector = next(sectorsFor(c.data.size))
+					l.files = append(l.files, c.data)
+				}
+			}
+		}
+	}
+	walk(l.root)
+	l.sectors = sector
+}
+
+// pathTableOrder lists directories breadth first, children in hierarchy
+// order: by level, then parent, then identifier, as path tables require.
+func pathTableOrder(root *node, children func(*node) []*node) []*node {
+	dirs := []*node{root}
+	for i := 0; i < len(dirs); i++ {
+		for _, c := range children(dirs[i]) {
+			if c.isDir() {
+				dirs = append(dirs, c)
+			}
+		}
+	}
+	return dirs
+}
+
+func sectorsFor(size int64) uint32 {
+	return uint32((size + SectorSize - 1) / SectorSize)
+}
+
+// record is a directory record.
+type record struct {
+	target  *node
+	id      []byte
+	section int // extent of a multi-extent file
+	last    bool
+
+	inline     []byte // system use entries
+	cont       []byte // continuation area, nil if none
+	contSector uint32
+	contOffset uint32
+}
+
+// length returns the encoded size: the fixed part, the identifier padded
+// to an even length, the system use area and a CE entry if needed, padded
+// to an even length.
+func (r *record) length() int {
+	n := recordBase(len(r.id)) + len(r.inline)
+	if r.cont != nil {
+		n += ceLength
+	}
+	return n + n%2
+}
+
+func recordBase(idLen int) int {
+	n := 33 + idLen
+	if idLen%2 == 0 {
+		n++
+	}
+	return n
+}
+
+// maxSystemUse is the room for system use entries in a record, keeping
+// the record within 255 bytes after padding.
+func maxSystemUse(idLen int) int {
+	return 254 - recordBase(idLen)
+}
+
+// isoRecords returns the records of directory d in the primary hierarchy,
+// with Rock Ridge entries. The root's "." record carries the SP and ER
+// entries that announce Rock Ridge.
+func isoRecords(d *node, root bool) []*record {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+
+	self := rockRidge(d, "")
+	if root {
+		self = append([][]byte{suspSP()}, self...)
+		self = append(self, suspER())
+	}
+	records := []*record{
+		newRecord(d, []byte{0}, self),
+		newRecord(parent, []byte{1}, rockRidge(parent, "")),
+	}
+	for _, c := range d.isoOrder {
+		entries := rockRidge(c, c.name)
+		sections := 1
+		if c.data != nil && c.data.size > maxSection {
+			sections = int((c.data.size + maxSection - 1) / maxSection)
+		}
+		for s := 0; s < sections; s++ {
+			r := newRecord(c, []byte(c.isoID), entries)
+			r.section, r.last = s, s == sections-1
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// jolietRecords returns the records of directory d in the Joliet
+// hierarchy, which carries no system use entries.
+func jolietRecords(d *node) []*record {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	records := []*record{
+		{target: d, id: []byte{0}, last: true},
+		{target: parent, id: []byte{1}, last: true},
+	}
+	for _, c := range d.jolietOrder {
+		sections := 1
+		if c.data != nil && c.data.size > maxSection {
+			sections = int((c.data.size + maxSection - 1) / maxSection)
+		}
+		for s := 0; s < sections; s++ {
+			records = append(records, &record{target: c, id: c.jolietID, section: s, last: s == sections-1})
+		}
+	}
+	return records
+}
+
+func newRecord(target *node, id []byte, entries [][]byte) *record {
+	r := &record{target: target, id: id, last: true}
+	r.inline, r.cont = splitSUSP(entries, maxSystemUse(len(id)))
+	return r
+}
+
+// directorySize returns the size of a directory's extent. Records do not
+// cross sector boundaries.
+func directorySize(records []*record) uint32 {
+	size, used := uint32(SectorSize), 0
+	for _, r := range records {
+		if used+r.length() > SectorSize {
+			size += SectorSize
+			used = 0
+		}
+		used += r.length()
+	}
+	return size
+}
+
+// encode returns the directory record. joliet selects which hierarchy a
+// directory target's extent is taken from.
+func (r *record) encode(joliet bool) []byte {
+	b := make([]byte, r.length())
+	b[0] = byte(len(b))
+
+	var loc, size uint32
+	var flags byte
+	n := r.target
+	switch {
+	case n.isDir():
+		flags |= 0x02
+		e := n.isoExtent
+		if joliet {
+			e = n.jolietExt
+		}
+		loc, size = e.sector, e.size
+	case n.data != nil:
+		remaining := n.data.size - int64(r.section)*maxSection
+		if remaining > maxSection {
+			remaining = maxSection
+		}
+		loc = n.data.sector + uint32(r.section)*(maxSection/SectorSize)
+		size = uint32(remaining)
+		if n.data.size == 0 {
+			loc = 0
+		}
+	}
+	if !r.last {
+		flags |= 0x80
+	}
+
+	putBoth32(b[2:], loc)
+	putBoth32(b[10:], size)
+	copy(b[18:25], recordTime(n.mtime))
+	b[25] = flags
+	putBoth16(b[28:], 1) // volume sequence number
+	b[32] = byte(len(r.id))
+	copy(b[33:], r.id)
+
+	su := b[recordBase(len(r.id)):]
+	copy(su, r.inline)
+	if r.cont != nil {
+		copy(su[len(r.inline):], suspCE(r.contSector, r.contOffset, uint32(len(r.cont))))
+	}
+	return b
+}
+
+// pathTableSize returns the size of a path table in bytes.
+func pathTableSize(dirs []*node, joliet bool) uint32 {
+	size := uint32(0)
+	for _, d := range dirs {
+		n := len(dirID(d, joliet))
+		size += uint32(8 + n + n%2)
+	}
+	return size
+}
+
+func dirID(d *node, joliet bool) []byte {
+	switch {
+	case d.parent == nil:
+		return []byte{0}
+	case joliet:
+		return d.jolietID
+	}
+	return []byte(d.isoID)
+}
+
+// pathTable returns a path table in little- or big-endian byte order.
+func pathTable(dirs []*node, joliet, bigEndian bool) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	var t []byte
+	for _, d := range dirs {
+		id := dirID(d, joliet)
+		e := make([]byte, 8+len(id)+len(id)%2)
+		e[0] = byte(len(id))
+		parent := d.parent
+		if parent == nil {
+			parent = d
+		}
+		if joliet {
+			order.PutUint32(e[2:], d.jolietExt.sector)
+			order.PutUint16(e[6:], uint16(parent.jolietNum))
+		} else {
+			order.PutUint32(e[2:], d.isoExtent.sector)
+			order.PutUint16(e[6:], uint16(parent.isoNumber))
+		}
+		copy(e[8:], id)
+		t = append(t, e...)
+	}
+	return t
+}
+
+// Volume descriptor types.
+const (
+	vdBoot          = 0
+	vdPrimary       = 1
+	vdSupplementary = 2
+	vdTerminator    = 255
+)
+
+func descriptorHeader(typ byte) []byte {
+	d := make([]byte, SectorSize)
+	d[0] = typ
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	return d
+}
+
+// volumeDescriptor returns the primary or, for Joliet, the supplementary
+// volume descriptor.
+func (l *layout) volumeDescriptor(joliet bool) []byte {
+	typ := byte(vdPrimary)
+	if joliet {
+		typ = vdSupplementary
+	}
+	d := descriptorHeader(typ)
+
+	text := func(field []byte, s string) {
+		if joliet {
+			units := ucs2(truncateUTF16(utf16.Encode([]rune(s)), len(field)/2))
+			for i := len(units); i+1 < len(field); i += 2 {
+				units = append(units, 0, ' ')
+			}
+			copy(field, units)
+			return
+		}
+		s = aChars(s)
+		if len(s) > len(field) {
+			s = s[:len(field)]
+		}
+		copy(field, s+strings.Repeat(" ", len(field)-len(s)))
+	}
+
+	text(d[8:40], l.opts.System)
+	text(d[40:72], l.opts.VolumeID)
+	putBoth32(d[80:], l.sectors)
+	if joliet {
+		copy(d[88:], "%/E") // UCS-2 level 3
+	}
+	putBoth16(d[120:], 1) // volume set size
+	putBoth16(d[124:], 1) // volume sequence number
+	putBoth16(d[128:], SectorSize)
+
+	root := &record{target: l.root, id: []byte{0}, last: true}
+	if joliet {
+		putBoth32(d[132:], l.jolietPathSize)
+		binary.LittleEndian.PutUint32(d[140:], l.jolietPathL)
+		binary.BigEndian.PutUint32(d[148:], l.jolietPathM)
+	} else {
+		putBoth32(d[132:], l.isoPathSize)
+		binary.LittleEndian.PutUint32(d[140:], l.isoPathL)
+		binary.BigEndian.PutUint32(d[148:], l.isoPathM)
+	}
+	copy(d[156:190], root.encode(joliet))
+
+	text(d[190:318], "") // volume set
+	text(d[318:446], l.opts.Publisher)
+	text(d[446:574], l.opts.Preparer)
+	text(d[574:702], l.opts.Application)
+	text(d[702:739], "") // copyright, abstract and bibliographic files
+	text(d[739:776], "")
+	text(d[776:813], "")
+
+	copy(d[813:830], descriptorTime(l.opts.Time))
+	copy(d[830:847], descriptorTime(l.opts.Time))
+	copy(d[847:864], descriptorTime(time.Time{}))
+	copy(d[864:881], descriptorTime(l.opts.Time))
+	d[881] = 1 // file structure version
+	return d
+}
+
+// descriptorTime encodes t in the 17-byte form of volume descriptors; the
+// zero time is "not specified".
+func descriptorTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte(strings.Repeat("0", 16)), 0)
+	}
+	t = t.UTC()
+	s := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000)
+	return append([]byte(s), 0)
+}
+
+// aChars upper-cases s and replaces characters outside the ISO 9660
+// a-character set.
+func aChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune(" !\"%&'()*+,-./:;<=>?_", r):
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// write writes the image in sector order.
+func (l *layout) write(ctx context.Context, w *sectorWriter) error {
+	if err := w.zero(systemAreaSectors * SectorSize); err != nil {
+		return err
+	}
+	sections := []struct {
+		sector uint32
+		data   func() []byte
+		skip   bool
+	}{
+		{l.pvd, func() []byte { return l.volumeDescriptor(false) }, false},
+		{l.bootRecord, func() []byte { return bootRecord(l.catalogSector) }, l.catalog == nil},
+		{l.svd, func() []byte { return l.volumeDescriptor(true) }, !l.opts.Joliet},
+		{l.terminator, func() []byte { return descriptorHeader(vdTerminator) }, false},
+		{l.catalogSector, func() []byte { return bootCatalog(l.bios, l.efi) }, l.catalog == nil},
+		{l.isoPathL, func() []byte { return pathTable(l.isoDirs, false, false) }, false},
+		{l.isoPathM, func() []byte { return pathTable(l.isoDirs, false, true) }, false},
+		{l.jolietPathL, func() []byte { return pathTable(l.jolietDirs, true, false) }, !l.opts.Joliet},
+		{l.jolietPathM, func() []byte { return pathTable(l.jolietDirs, true, true) }, !l.opts.Joliet},
+	}
+	for _, s := range sections {
+		if s.skip {
+			continue
+		}
+		if err := w.sector(s.sector, s.data()); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range l.isoDirs {
+		if err := w.sector(d.isoExtent.sector, directory(d.isoRecords, false)); err != nil {
+			return err
+		}
+		if d.contSectors == 0 {
+			continue
+		}
+		start := d.isoExtent.sector + d.isoExtent.size/SectorSize
+		cont := make([]byte, d.contSectors*SectorSize)
+		for _, r := range d.isoRecords {
+			if r.cont != nil {
+				copy(cont[(r.contSector-start)*SectorSize+r.contOffset:], r.cont)
+			}
+		}
+		if err := w.sector(start, cont); err != nil {
+			return err
+		}
+	}
+	for _, d := range l.jolietDirs {
+		if err := w.sector(d.jolietExt.sector, directory(d.jolietRecords, true)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range l.files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.file(f); err != nil {
+			return err
+		}
+	}
+	if w.n != int64(l.sectors)*SectorSize {
+		return fmt.Errorf("internal error: wrote %d bytes, planned %d sectors", w.n, l.sectors)
+	}
+	return nil
+}
+
+// directory returns the encoded extent of a directory.
+func directory(records []*record, joliet bool) []byte {
+	b := make([]byte, directorySize(records))
+	pos := 0
+	for _, r := range records {
+		if pos%SectorSize+r.length() > SectorSize {
+			pos += SectorSize - pos%SectorSize
+		}
+		pos += copy(b[pos:], r.encode(joliet))
+	}
+	return b
+}
+
+// sectorWriter writes an image sequentially, checking that each structure
+// lands on the sector planned for it.
+type sectorWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (w *sectorWriter) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return err
+}
+
+func (w *sectorWriter) zero(n int64) error {
+	var buf [SectorSize]byte
+	for n > 0 {
+		chunk := int64(len(buf))
+		if n < chunk {
+			chunk = n
+		}
+		if err := w.write(buf[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// padSector pads the output to the next sector boundary.
+func (w *sectorWriter) padSector() error {
+	if rem := w.n % SectorSize; rem != 0 {
+		return w.zero(SectorSize - rem)
+	}
+	return nil
+}
+
+// sector writes data at sector, which must be the current position.
+func (w *sectorWriter) sector(sector uint32, data []byte) error {
+	if w.n != int64(sector)*SectorSize {
+		return fmt.Errorf("internal error: sector %d written at offset %d", sector, w.n)
+	}
+	if err := w.write(data); err != nil {
+		return err
+	}
+	return w.padSector()
+}
+
+// file copies a file's data, failing if it changed size since the tree was
+// read.
+func (w *sectorWriter) file(f *file) error {
+	if w.n != int64(f.sector)*SectorSize {
+		return fmt.Errorf("internal error: %s written at offset %d, planned sector %d", f.src, w.n, f.sector)
+	}
+	in, err := os.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	n, err := io.CopyN(w.w, in, f.size)
+	w.n += n
+	if err == io.EOF {
+		return fmt.Errorf("%s shrank while the image was written", f.src)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot copy %s: %w", f.src, err)
+	}
+	return w.padSector()
+}
+
+// putBoth16 and putBoth32 write both-endian numbers: little-endian
+// followed by big-endian.
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
@@ -0,0 +1,485 @@
+package iso9660
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+var buildTime = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// makeTree creates files below a new directory; a value starting with
+// "->" makes a symbolic link to the rest.
+func makeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			err = os.Symlink(target, path)
+		} else {
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// writeImage writes the tree at root and opens the image.
+func writeImage(t *testing.T, root string, opts Options) (*Volume, *Image, string) {
+	t.Helper()
+	if opts.VolumeID == "" {
+		opts.VolumeID = "PGSD_TEST"
+	}
+	if opts.Time.IsZero() {
+		opts.Time = buildTime
+	}
+	path := filepath.Join(t.TempDir(), "test.iso")
+	img, err := Write(context.Background(), path, root, opts)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	v, err := Open(f)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return v, img, path
+}
+
+func TestRoundTrip(t *testing.T) {
+	longName := strings.Repeat("long-component-", 12) + "end"
+	root := makeTree(t, map[string]string{
+		"boot/loader.conf":           "vfs.root.mountfrom=\"cd9660:/dev/iso9660/PGSD_TEST\"\n",
+		"etc/rc.conf":                "hostname=\"pgsd\"\n",
+		"empty":                      "",
+		"Mixed Case.name.tx":         "case is kept\n",
+		longName:                     "long\n",
+		"a/b/c/d/e/f/g/h/i/deep.txt": "nine levels down\n",
+		"bin/sh":                     "->../rescue/sh",
+		"rescue/sh":                  "#!/bin/sh\n",
+		"etc/localtime":              "->/usr/share/zoneinfo/UTC",
+		"dot":                        "->./etc/./rc.conf",
+		"long-link":                  "->" + strings.Repeat("x", 300) + "/" + strings.Repeat("y/", 60) + "z",
+	})
+	if err := os.Link(filepath.Join(root, "rescue/sh"), filepath.Join(root, "rescue/tcsh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "rescue/sh"), 0555); err != nil {
+		t.Fatal(err)
+	}
+
+	v, img, path := writeImage(t, root, Options{
+		VolumeID:    "PGSD_TEST",
+		System:      "FREEBSD",
+		Publisher:   "PGSD Foundation",
+		Application: "pgsdbuild",
+	})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(img.Sectors)*SectorSize != info.Size() || v.Sectors != img.Sectors {
+		t.Errorf("image is %d bytes, Image.Sectors %d, volume space %d", info.Size(), img.Sectors, v.Sectors)
+	}
+	if v.ID != "PGSD_TEST" || v.System != "FREEBSD" || v.Publisher != "PGSD FOUNDATION" || v.Application != "PGSDBUILD" {
+		t.Errorf("descriptor fields: %q %q %q %q", v.ID, v.System, v.Publisher, v.Application)
+	}
+	if v.Created != "2025030112000000" {
+		t.Errorf("Created = %q", v.Created)
+	}
+	if !v.RockRidge || v.Joliet || v.BootCatalog != 0 {
+		t.Errorf("RockRidge %v, Joliet %v, BootCatalog %d", v.RockRidge, v.Joliet, v.BootCatalog)
+	}
+
+	for name, want := range map[string]string{
+		"boot/loader.conf":           "vfs.root.mountfrom=\"cd9660:/dev/iso9660/PGSD_TEST\"\n",
+		"Mixed Case.name.tx":         "case is kept\n",
+		longName:                     "long\n",
+		"a/b/c/d/e/f/g/h/i/deep.txt": "nine levels down\n",
+		"rescue/tcsh":                "#!/bin/sh\n",
+		"empty":                      "",
+	} {
+		got, err := v.ReadFile(name)
+		if err != nil {
+			t.Errorf("ReadFile(%s): %v", name, err)
+		} else if string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := v.ReadFile("etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+	if _, err := v.ReadFile("etc"); err == nil {
+		t.Error("ReadFile of a directory succeeded")
+	}
+
+	// Symbolic links keep their targets, including ones spread over
+	// several SL entries and a continuation area
+	for name, want := range map[string]string{
+		"bin/sh":        "../rescue/sh",
+		"etc/localtime": "/usr/share/zoneinfo/UTC",
+		"dot":           "./etc/./rc.conf",
+		"long-link":     strings.Repeat("x", 300) + "/" + strings.Repeat("y/", 60) + "z",
+	} {
+		fi, err := v.Stat(name)
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", name, err)
+		}
+		if fi.Mode&sIFMT != sIFLNK || fi.Target != want {
+			t.Errorf("%s: mode %o, target %q, want a link to %q", name, fi.Mode, fi.Target, want)
+		}
+	}
+
+	// Hard links share their data and record the link count
+	sh, err := v.Stat("rescue/sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcsh, err := v.Stat("rescue/tcsh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.Sector != tcsh.Sector || sh.Links != 2 || tcsh.Links != 2 {
+		t.Errorf("hard links: sectors %d and %d, links %d and %d", sh.Sector, tcsh.Sector, sh.Links, tcsh.Links)
+	}
+	if sh.Mode != sIFREG|0555 {
+		t.Errorf("rescue/sh mode %o", sh.Mode)
+	}
+	rc, err := v.Stat("etc/rc.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc.Links != 1 || rc.Mode != sIFREG|0644 || rc.Size != int64(len("hostname=\"pgsd\"\n")) {
+		t.Errorf("etc/rc.conf: %+v", rc)
+	}
+	if rc.UID != uint32(os.Getuid()) {
+		t.Errorf("etc/rc.conf owned by %d, want %d", rc.UID, os.Getuid())
+	}
+	etc, err := v.Stat("etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etc.Mode&sIFMT != sIFDIR || etc.Links != 2 {
+		t.Errorf("etc: mode %o, links %d", etc.Mode, etc.Links)
+	}
+	if empty, err := v.Stat("empty"); err != nil || empty.Sector != 0 || empty.Size != 0 {
+		t.Errorf("empty file: %+v, %v", empty, err)
+	}
+}
+
+// isoIDs returns the ISO 9660 identifiers in the root directory.
+func isoIDs(t *testing.T, v *Volume) []string {
+	t.Helper()
+	raw, err := v.readDir(v.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, b := range raw[2:] {
+		ids = append(ids, parseRecord(b).name)
+	}
+	return ids
+}
+
+// jolietNames returns the names in the root directory of the Joliet
+// hierarchy.
+func jolietNames(t *testing.T, v *Volume) []string {
+	t.Helper()
+	for sector := int64(systemAreaSectors); ; sector++ {
+		d := make([]byte, SectorSize)
+		if _, err := v.r.ReadAt(d, sector*SectorSize); err != nil {
+			t.Fatal(err)
+		}
+		switch d[0] {
+		case vdTerminator:
+			t.Fatal("no Joliet volume descriptor")
+		case vdSupplementary:
+			raw, err := v.readDir(parseRecord(d[156:190]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, b := range raw[2:] {
+				id := parseRecord(b).name
+				units := make([]uint16, len(id)/2)
+				for i := range units {
+					units[i] = binary.BigEndian.Uint16([]byte(id[2*i:]))
+				}
+				names = append(names, string(utf16.Decode(units)))
+			}
+			return names
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	long := strings.Repeat("0123456789", 7)
+	root := makeTree(t, map[string]string{
+		"café.txt":           "",
+		"a:b":                "",
+		"a;b":                "",
+		"a_b":                "",
+		long:                 "",
+		long + "-2":          "",
+		"日本語のファイル名.conf":     "",
+		"link":               "->café.txt",
+		"loader.conf":        "",
+		"loader-conf":        "",
+		"archive.tar.gz":     "",
+		"subdir.with.dots/x": "",
+	})
+
+	v, _, _ := writeImage(t, root, Options{Joliet: true})
+	if !v.Joliet {
+		t.Fatal("no Joliet hierarchy")
+	}
+
+	// Joliet names keep Unicode, replace forbidden characters, are cut to
+	// 64 units and are made unique; symbolic links are left out
+	got := jolietNames(t, v)
+	want := []string{"a_b", "a_b_1", "a_b_2", long[:64], long[:62] + "_1", "archive.tar.gz",
+		"café.txt", "loader-conf", "loader.conf", "subdir.with.dots", "日本語のファイル名.conf"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Joliet names:\n got %q\nwant %q", got, want)
+	}
+
+	// ISO 9660 identifiers are d-characters, unique and in sorted order
+	ids := isoIDs(t, v)
+	if !sort.SliceIsSorted(ids, func(i, j int) bool {
+		return strings.TrimSuffix(ids[i], ";1") < strings.TrimSuffix(ids[j], ";1")
+	}) {
+		t.Errorf("identifiers not sorted: %q", ids)
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("duplicate identifier %s", id)
+		}
+		seen[id] = true
+		base := strings.TrimSuffix(id, ";1")
+		if strings.Trim(base, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.") != "" || strings.Count(base, ".") > 1 {
+			t.Errorf("identifier %q is not level 2", id)
+		}
+	}
+	for _, id := range []string{"ARCHIVE_TAR.GZ;1", "LOADER.CONF;1", "LOADER_CONF.;1", "SUBDIR_WITH_DOTS", "CAF_.TXT;1", "A_B.;1", "A_B_1.;1", "A_B_2.;1"} {
+		if !seen[id] {
+			t.Errorf("no identifier %s in %q", id, ids)
+		}
+	}
+
+	// Rock Ridge names are exact
+	for _, name := range []string{"café.txt", "日本語のファイル名.conf", long, "a:b"} {
+		if _, err := v.ReadFile(name); err != nil {
+			t.Errorf("ReadFile(%s): %v", name, err)
+		}
+	}
+}
+
+func TestElTorito(t *testing.T) {
+	bios := bytes.Repeat([]byte{0xcd}, 4000)
+	efi := bytes.Repeat([]byte{0xef}, 10000)
+	tests := []struct {
+		name      string
+		opts      Options
+		platforms []byte
+	}{
+		{"bios", Options{BIOSBoot: "boot/cdboot"}, []byte{PlatformX86}},
+		{"efi", Options{EFIBoot: "boot/efiboot.img"}, []byte{PlatformEFI}},
+		{"bios+efi", Options{BIOSBoot: "boot/cdboot", EFIBoot: "boot/efiboot.img", BootCatalog: "boot/boot.catalog"},
+			[]byte{PlatformX86, PlatformEFI}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := makeTree(t, map[string]string{
+				"boot/cdboot":      string(bios),
+				"boot/efiboot.img": string(efi),
+			})
+			v, img, _ := writeImage(t, root, tc.opts)
+			if v.BootCatalog == 0 {
+				t.Fatal("no boot record")
+			}
+			entries, err := v.BootEntries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tc.platforms) {
+				t.Fatalf("%d boot entries, want %d: %+v", len(entries), len(tc.platforms), entries)
+			}
+			for i, e := range entries {
+				want := BootEntry{Platform: tc.platforms[i], Bootable: true, LoadSectors: 8, Sector: img.BIOSBoot.Sector}
+				if e.Platform == PlatformEFI {
+					want.LoadSectors, want.Sector = 20, img.EFIBoot.Sector
+				}
+				if e != want {
+					t.Errorf("entry %d = %+v, want %+v", i, e, want)
+				}
+			}
+			if (tc.opts.BIOSBoot == "") != (img.BIOSBoot == Extent{}) || (tc.opts.EFIBoot == "") != (img.EFIBoot == Extent{}) {
+				t.Errorf("Image = %+v", img)
+			}
+
+			// The entries point at the boot images
+			for _, e := range entries {
+				want := bios
+				if e.Platform == PlatformEFI {
+					want = efi
+				}
+				got := make([]byte, len(want))
+				if _, err := v.r.ReadAt(got, int64(e.Sector)*SectorSize); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s entry does not point at its image", PlatformName(e.Platform))
+				}
+			}
+
+			// The catalog is a file in the tree
+			catalogPath := tc.opts.BootCatalog
+			if catalogPath == "" {
+				catalogPath = "boot.catalog"
+			}
+			fi, err := v.Stat(catalogPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Sector != v.BootCatalog || fi.Size != SectorSize {
+				t.Errorf("%s at sector %d (%d bytes), boot record points at %d", catalogPath, fi.Sector, fi.Size, v.BootCatalog)
+			}
+		})
+	}
+
+	root := makeTree(t, map[string]string{"boot/cdboot": "x", "boot.catalog": "taken"})
+	for _, tc := range []struct {
+		opts Options
+		want string
+	}{
+		{Options{BIOSBoot: "boot/missing"}, "boot image boot/missing is not a file in the tree"},
+		{Options{BIOSBoot: "boot"}, "boot image boot is not a file in the tree"},
+		{Options{BIOSBoot: "boot/cdboot"}, "boot catalog boot.catalog already exists in the tree"},
+		{Options{BIOSBoot: "boot/cdboot", BootCatalog: "nodir/boot.catalog"}, "directory of boot catalog nodir/boot.catalog is not in the tree"},
+	} {
+		tc.opts.VolumeID = "PGSD"
+		_, err := Write(context.Background(), filepath.Join(t.TempDir(), "x.iso"), root, tc.opts)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("Write(%+v) error = %v, want %q", tc.opts, err, tc.want)
+		}
+	}
+}
+
+func TestLoadSectors(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want uint16
+	}{
+		{0, 0},
+		{1, 1},
+		{512, 1},
+		{513, 2},
+		{0xffff * 512, 0xffff},
+		{0xffff*512 + 1, 0xffff},
+		{32 << 20, 0xffff},
+		{1 << 40, 0xffff},
+	} {
+		if got := loadSectors(tc.size); got != tc.want {
+			t.Errorf("loadSectors(%d) = %#x, want %#x", tc.size, got, tc.want)
+		}
+	}
+
+	// An EFI image over 32 MiB saturates its entry; firmware reads the
+	// image from the partition table or the FAT filesystem instead
+	root := makeTree(t, map[string]string{"boot/cdboot": "boot"})
+	f, err := os.Create(filepath.Join(root, "efiboot.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 40 << 20
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	v, img, _ := writeImage(t, root, Options{BIOSBoot: "boot/cdboot", EFIBoot: "efiboot.img"})
+	entries, err := v.BootEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].LoadSectors != 1 || entries[1].LoadSectors != 0xffff {
+		t.Errorf("entries = %+v", entries)
+	}
+	if img.EFIBoot.Size != size {
+		t.Errorf("EFI extent of %d bytes, want %d", img.EFIBoot.Size, size)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	root := makeTree(t, map[string]string{
+		"boot/cdboot":   "boot",
+		"etc/rc.conf":   "hostname=\"pgsd\"\n",
+		"etc/localtime": "->/usr/share/zoneinfo/UTC",
+	})
+	epoch := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{Joliet: true, BIOSBoot: "boot/cdboot", Time: epoch, MaxTime: epoch}
+	read := func(path string) []byte {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	_, _, first := writeImage(t, root, opts)
+
+	// Later times, as a second build of the same tree would leave, are
+	// clamped; the symbolic link gets a new time that cannot be reset
+	later := time.Now().Add(time.Hour)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chtimes(path, later, later)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(root, "etc/localtime")
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/share/zoneinfo/UTC", link); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, second := writeImage(t, root, opts)
+	if !bytes.Equal(read(first), read(second)) {
+		t.Error("images of the same tree differ with MaxTime set")
+	}
+
+	opts.MaxTime = time.Time{}
+	_, _, unclamped := writeImage(t, root, opts)
+	if bytes.Equal(read(first), read(unclamped)) {
+		t.Error("file times were not recorded without MaxTime")
+	}
+}
@@ -0,0 +1,426 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Volume is an ISO 9660 image opened for reading, such as to check a
+// finished build.
+type Volume struct {
+	ID          string
+	System      string
+	Publisher   string
+	Preparer    string
+	Application string
+	Sectors     uint32 // volume space size
+	BlockSize   uint16
+	Created     string // as recorded, YYYYMMDDhhmmsscc
+	Joliet      bool
+	RockRidge   bool
+
+	// BootCatalog is the sector of the El Torito boot catalog, zero if the
+	// volume has no boot record.
+	BootCatalog uint32
+
+	r    io.ReaderAt
+	root dirRecord
+	skip int // SUSP bytes to skip in system use areas
+}
+
+// dirRecord is a directory record as read.
+type dirRecord struct {
+	name   string // Rock Ridge name, or the ISO 9660 identifier
+	rrName bool
+	extent uint32
+	size   uint32
+	flags  byte
+	raw    []byte
+}
+
+func (d dirRecord) isDir() bool { return d.flags&0x02 != 0 }
+
+// Open reads the volume descriptors of an image.
+func Open(r io.ReaderAt) (*Volume, error) {
+	v := &Volume{r: r}
+	primary := false
+	for sector := int64(systemAreaSectors); ; sector++ {
+		d := make([]byte, SectorSize)
+		if _, err := r.ReadAt(d, sector*SectorSize); err != nil {
+			return nil, fmt.Errorf("cannot read volume descriptor %d: %w", sector, err)
+		}
+		if string(d[1:6]) != "CD001" {
+			return nil, fmt.Errorf("sector %d is not an ISO 9660 volume descriptor", sector)
+		}
+		switch d[0] {
+		case vdPrimary:
+			primary = true
+			v.System = trimField(d[8:40])
+			v.ID = trimField(d[40:72])
+			v.Sectors = binary.LittleEndian.Uint32(d[80:])
+			v.BlockSize = binary.LittleEndian.Uint16(d[128:])
+			v.Publisher = trimField(d[318:446])
+			v.Preparer = trimField(d[446:574])
+			v.Application = trimField(d[574:702])
+			v.Created = string(d[813:829])
+			v.root = parseRecord(d[156:190])
+		case vdSupplementary:
+			if bytes.HasPrefix(d[88:91], []byte("%/")) {
+				v.Joliet = true
+			}
+		case vdBoot:
+			if strings.TrimRight(string(d[7:39]), "\x00") == elToritoID {
+				v.BootCatalog = binary.LittleEndian.Uint32(d[71:])
+			}
+		}
+		if d[0] == vdTerminator {
+			break
+		}
+	}
+	if !primary {
+		return nil, errors.New("no primary volume descriptor")
+	}
+	if v.BlockSize != SectorSize {
+		return nil, fmt.Errorf("unsupported logical block size %d", v.BlockSize)
+	}
+
+	// Rock Ridge is announced by an SP entry at the start of the root's
+	// "." record
+	records, err := v.readDir(v.root)
+	if err == nil && len(records) > 0 {
+		dot := records[0]
+		su := systemUse(dot)
+		if len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			v.RockRidge = true
+			v.skip = int(su[6])
+		}
+	}
+	return v, nil
+}
+
+func trimField(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
+
+func parseRecord(b []byte) dirRecord {
+	idLen := int(b[32])
+	return dirRecord{
+		name:   string(b[33 : 33+idLen]),
+		extent: binary.LittleEndian.Uint32(b[2:]),
+		size:   binary.LittleEndian.Uint32(b[10:]),
+		flags:  b[25],
+		raw:    b,
+	}
+}
+
+// systemUse returns the system use area of a raw directory record.
+func systemUse(b []byte) []byte {
+	return b[recordBase(int(b[32])):]
+}
+
+// readDir returns the raw records of a directory.
+func (v *Volume) readDir(dir dirRecord) ([][]byte, error) {
+	data := make([]byte, dir.size)
+	if _, err := v.r.ReadAt(data, int64(dir.extent)*SectorSize); err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	for pos := 0; pos < len(data); {
+		n := int(data[pos])
+		if n == 0 {
+			// Records do not cross sectors; the rest of this one is padding
+			pos = (pos/SectorSize + 1) * SectorSize
+			continue
+		}
+		if n < 34 || pos+n > len(data) {
+			return nil, fmt.Errorf("malformed directory record at sector %d", dir.extent)
+		}
+		records = append(records, data[pos:pos+n])
+		pos += n
+	}
+	return records, nil
+}
+
+// entries returns the records of a directory other than "." and "..",
+// named by their Rock Ridge names if the volume has them.
+func (v *Volume) entries(dir dirRecord) ([]dirRecord, error) {
+	raw, err := v.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var records []dirRecord
+	for _, b := range raw {
+		if b[32] == 1 && (b[33] == 0 || b[33] == 1) {
+			continue
+		}
+		r := parseRecord(b)
+		if v.RockRidge {
+			if name, ok := v.rrName(b); ok {
+				r.name, r.rrName = name, true
+			}
+		}
+		if !r.rrName {
+			r.name = strings.TrimSuffix(strings.TrimSuffix(r.name, ";1"), ".")
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// susp returns the system use entries of a record, following a
+// continuation area if there is one. CE and ST entries are consumed.
+func (v *Volume) susp(b []byte) [][]byte {
+	su := systemUse(b)
+	if len(su) < v.skip {
+		return nil
+	}
+	su = su[v.skip:]
+
+	var entries [][]byte
+	for i := 0; i < 8 && su != nil; i++ { // a bound on continuation chains
+		var next []byte
+		for len(su) >= 4 && su[2] >= 4 && int(su[2]) <= len(su) {
+			e := su[:su[2]]
+			su = su[su[2]:]
+			switch string(e[0:2]) {
+			case "CE":
+				if len(e) >= 28 {
+					loc := binary.LittleEndian.Uint32(e[4:])
+					off := binary.LittleEndian.Uint32(e[12:])
+					n := binary.LittleEndian.Uint32(e[20:])
+					next = make([]byte, n)
+					if _, err := v.r.ReadAt(next, int64(loc)*SectorSize+int64(off)); err != nil {
+						next = nil
+					}
+				}
+			case "ST":
+				su = nil
+			default:
+				entries = append(entries, e)
+			}
+		}
+		su = next
+	}
+	return entries
+}
+
+// rrName assembles the NM entries of a record.
+func (v *Volume) rrName(b []byte) (string, bool) {
+	var name strings.Builder
+	found := false
+	for _, e := range v.susp(b) {
+		if string(e[0:2]) == "NM" && len(e) >= 5 && e[4]&0x06 == 0 {
+			name.Write(e[5:])
+			found = true
+		}
+	}
+	return name.String(), found
+}
+
+// ReadFile returns the contents of the file at a slash-separated path.
+// Rock Ridge names are matched exactly, ISO 9660 identifiers without
+// regard to case.
+func (v *Volume) ReadFile(path string) ([]byte, error) {
+	sections, err := v.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if sections[0].isDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	var data []byte
+	for _, s := range sections {
+		b := make([]byte, s.size)
+		if _, err := v.r.ReadAt(b, int64(s.extent)*SectorSize); err != nil {
+			return nil, err
+		}
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// lookup returns the records of the file or directory at path: one, or
+// the sections of a multi-extent file.
+func (v *Volume) lookup(path string) ([]dirRecord, error) {
+	dir := v.root
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, part := range parts {
+		records, err := v.entries(dir)
+		if err != nil {
+			return nil, err
+		}
+		var sections []dirRecord
+		for j, r := range records {
+			if r.name == part || (!r.rrName && strings.EqualFold(r.name, part)) {
+				// A multi-extent file continues in the records that follow
+				sections = append(sections, r)
+				for k := j; records[k].flags&0x80 != 0 && k+1 < len(records); k++ {
+					sections = append(sections, records[k+1])
+				}
+				break
+			}
+		}
+		switch {
+		case sections == nil:
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		case i == len(parts)-1:
+			return sections, nil
+		case !sections[0].isDir():
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		dir = sections[0]
+	}
+	return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+}
+
+// FileInfo describes a file as recorded in the image.
+type FileInfo struct {
+	Name   string
+	Mode   uint32 // POSIX st_mode; without Rock Ridge only the type is set
+	Links  uint32
+	UID    uint32
+	GID    uint32
+	Target string // symbolic link target
+	Size   int64
+	Sector uint32 // start of the data, zero for empty files
+}
+
+// Stat returns the attributes of the file at path. A symbolic link is
+// described itself rather than followed.
+func (v *Volume) Stat(path string) (*FileInfo, error) {
+	sections, err := v.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	r := sections[0]
+	fi := &FileInfo{Name: r.name, Mode: sIFREG, Links: 1, Sector: r.extent}
+	if r.isDir() {
+		fi.Mode = sIFDIR
+	}
+	for _, s := range sections {
+		fi.Size += int64(s.size)
+	}
+	if !v.RockRidge {
+		return fi, nil
+	}
+
+	var target strings.Builder
+	sep := false
+	for _, e := range v.susp(r.raw) {
+		switch string(e[0:2]) {
+		case "PX":
+			if len(e) >= 36 {
+				fi.Mode = binary.LittleEndian.Uint32(e[4:])
+				fi.Links = binary.LittleEndian.Uint32(e[12:])
+				fi.UID = binary.LittleEndian.Uint32(e[20:])
+				fi.GID = binary.LittleEndian.Uint32(e[28:])
+			}
+		case "SL":
+			if len(e) < 5 {
+				continue
+			}
+			for c := e[5:]; len(c) >= 2 && 2+int(c[1]) <= len(c); c = c[2+c[1]:] {
+				if sep {
+					target.WriteByte('/')
+				}
+				switch flags := c[0]; {
+				case flags&slRoot != 0:
+					target.WriteByte('/')
+				case flags&slCurrent != 0:
+					target.WriteByte('.')
+				case flags&slParent != 0:
+					target.WriteString("..")
+				default:
+					target.Write(c[2 : 2+c[1]])
+				}
+				sep = c[0]&(slContinue|slRoot) == 0
+			}
+		}
+	}
+	fi.Target = target.String()
+	return fi, nil
+}
+
+// BootEntry is an El Torito boot catalog entry.
+type BootEntry struct {
+	Platform    byte // PlatformX86, PlatformEFI, ...
+	Bootable    bool
+	Emulation   byte   // 0 for no emulation
+	LoadSegment uint16 // zero for the default, 0x7c0
+	LoadSectors uint16 // 512-byte sectors loaded
+	Sector      uint32 // start of the boot image
+}
+
+// PlatformName returns the name of an El Torito platform ID.
+func PlatformName(p byte) string {
+	switch p {
+	case PlatformX86:
+		return "x86 BIOS"
+	case 1:
+		return "PowerPC"
+	case 2:
+		return "Mac"
+	case PlatformEFI:
+		return "EFI"
+	}
+	return fmt.Sprintf("unknown (0x%02x)", p)
+}
+
+// BootEntries reads the boot catalog. The default entry has the platform
+// of the validation entry; section entries have their section's.
+func (v *Volume) BootEntries() ([]BootEntry, error) {
+	if v.BootCatalog == 0 {
+		return nil, nil
+	}
+	c := make([]byte, SectorSize)
+	if _, err := v.r.ReadAt(c, int64(v.BootCatalog)*SectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read boot catalog: %w", err)
+	}
+	if c[0] != 1 || c[30] != 0x55 || c[31] != 0xaa {
+		return nil, errors.New("boot catalog has no validation entry")
+	}
+	var sum uint16
+	for i := 0; i < catalogEntrySize; i += 2 {
+		sum += binary.LittleEndian.Uint16(c[i:])
+	}
+	if sum != 0 {
+		return nil, errors.New("boot catalog validation entry has a bad checksum")
+	}
+
+	entry := func(e []byte, platform byte) BootEntry {
+		return BootEntry{
+			Platform:    platform,
+			Bootable:    e[0] == bootIndicator,
+			Emulation:   e[1] & 0x0f,
+			LoadSegment: binary.LittleEndian.Uint16(e[2:]),
+			LoadSectors: binary.LittleEndian.Uint16(e[6:]),
+			Sector:      binary.LittleEndian.Uint32(e[8:]),
+		}
+	}
+	entries := []BootEntry{entry(c[32:64], c[1])}
+
+	for pos := 64; pos+catalogEntrySize <= len(c); {
+		h := c[pos : pos+catalogEntrySize]
+		if h[0] != sectionHeader && h[0] != sectionHeaderLast {
+			break
+		}
+		platform, n := h[1], int(binary.LittleEndian.Uint16(h[2:]))
+		pos += catalogEntrySize
+		for i := 0; i < n && pos+catalogEntrySize <= len(c); pos += catalogEntrySize {
+			if c[pos] == 0x44 { // extension entry
+				continue
+			}
+			entries = append(entries, entry(c[pos:pos+catalogEntrySize], platform))
+			i++
+		}
+		if h[0] == sectionHeaderLast {
+			break
+		}
+	}
+	return entries, nil
+}
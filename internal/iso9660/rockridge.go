@@ -0,0 +1,204 @@
+package iso9660
+
+import (
+	"strings"
+	"time"
+)
+
+// System Use Sharing Protocol (IEEE P1281) and Rock Ridge Interchange
+// Protocol 1.10 entries. Each entry is a two-letter signature, its length,
+// version 1 and its data.
+
+// Rock Ridge identification, in the ER entry of the root directory.
+const (
+	rripID     = "RRIP_1991A"
+	rripDesc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rripSource = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// Flags of the RR entry naming the Rock Ridge entries present.
+const (
+	rrPX = 0x01
+	rrPN = 0x02
+	rrSL = 0x04
+	rrNM = 0x08
+	rrTF = 0x80
+)
+
+const ceLength = 28 // length of a CE entry
+
+func suspEntry(sig string, data []byte) []byte {
+	e := make([]byte, 4, 4+len(data))
+	e[0], e[1], e[2], e[3] = sig[0], sig[1], byte(4+len(data)), 1
+	return append(e, data...)
+}
+
+// suspSP marks the use of SUSP; it starts the root's "." record.
+func suspSP() []byte {
+	return suspEntry("SP", []byte{0xbe, 0xef, 0})
+}
+
+// suspCE points to the continuation area holding the remaining entries.
+func suspCE(sector, offset, length uint32) []byte {
+	d := make([]byte, 24)
+	putBoth32(d[0:], sector)
+	putBoth32(d[8:], offset)
+	putBoth32(d[16:], length)
+	return suspEntry("CE", d)
+}
+
+// suspER identifies Rock Ridge as the extension in use.
+func suspER() []byte {
+	d := []byte{byte(len(rripID)), byte(len(rripDesc)), byte(len(rripSource)), 1}
+	d = append(d, rripID...)
+	d = append(d, rripDesc...)
+	d = append(d, rripSource...)
+	return suspEntry("ER", d)
+}
+
+// rockRidge returns the Rock Ridge entries for n. name is empty for the
+// "." and ".." records, which take their name from the hierarchy.
+func rockRidge(n *node, name string) [][]byte {
+	var flags byte = rrPX | rrTF
+	var extra [][]byte
+	if name != "" {
+		flags |= rrNM
+		extra = append(extra, rrNames(name)...)
+	}
+	switch n.mode & sIFMT {
+	case sIFLNK:
+		flags |= rrSL
+		extra = append(extra, rrSymlink(n.target)...)
+	case sIFCHR, sIFBLK:
+		flags |= rrPN
+		d := make([]byte, 16)
+		putBoth32(d[0:], uint32(n.rdev>>32))
+		putBoth32(d[8:], uint32(n.rdev))
+		extra = append(extra, suspEntry("PN", d))
+	}
+
+	px := make([]byte, 32)
+	putBoth32(px[0:], n.mode)
+	putBoth32(px[8:], n.nlink())
+	putBoth32(px[16:], n.uid)
+	putBoth32(px[24:], n.gid)
+
+	// Modification, access and attribute change times, all the file's
+	// modification time so reading the tree does not change the image
+	tf := []byte{0x0e}
+	for i := 0; i < 3; i++ {
+		tf = append(tf, recordTime(n.mtime)...)
+	}
+
+	entries := [][]byte{suspEntry("RR", []byte{flags}), suspEntry("PX", px), suspEntry("TF", tf)}
+	return append(entries, extra...)
+}
+
+// rrNames returns NM entries for name, split when longer than one entry
+// holds.
+func rrNames(name string) [][]byte {
+	const max = 255 - 5
+	var entries [][]byte
+	for len(name) > max {
+		entries = append(entries, suspEntry("NM", append([]byte{0x01}, name[:max]...)))
+		name = name[max:]
+	}
+	return append(entries, suspEntry("NM", append([]byte{0}, name...)))
+}
+
+// Symbolic link component flags.
+const (
+	slContinue = 0x01
+	slCurrent  = 0x02
+	slParent   = 0x04
+	slRoot     = 0x08
+)
+
+// rrSymlink returns SL entries for a symbolic link to target. A
+// component that does not fit an entry is split with the continue flag
+// rather than starting the next entry, since libarchive joins components
+// of consecutive entries without a separator.
+func rrSymlink(target string) [][]byte {
+	const maxArea = 255 - 5 // component area of one SL entry
+
+	type component struct {
+		flags byte
+		text  string
+	}
+	var components []component
+	if strings.HasPrefix(target, "/") {
+		components = append(components, component{flags: slRoot})
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "":
+		case ".":
+			components = append(components, component{flags: slCurrent})
+		case "..":
+			components = append(components, component{flags: slParent})
+		default:
+			components = append(components, component{text: part})
+		}
+	}
+
+	// Pack components into entries, flagging all but the last entry as
+	// continued
+	var entries [][]byte
+	area := []byte{}
+	for _, c := range components {
+		for {
+			room := maxArea - len(area) - 2
+			if len(c.text) <= room {
+				area = append(area, c.flags, byte(len(c.text)))
+				area = append(area, c.text...)
+				break
+			}
+			if c.text != "" && room > 0 {
+				area = append(area, slContinue, byte(room))
+				area = append(area, c.text[:room]...)
+				c.text = c.text[room:]
+			}
+			entries = append(entries, suspEntry("SL", append([]byte{slContinue}, area...)))
+			area = []byte{}
+		}
+	}
+	return append(entries, suspEntry("SL", append([]byte{0}, area...)))
+}
+
+// splitSUSP fits entries into a record's system use area of size max,
+// moving those that do not fit to a continuation area. The CE entry
+// pointing there is added when the record is encoded.
+func splitSUSP(entries [][]byte, max int) (inline, cont []byte) {
+	total := 0
+	for _, e := range entries {
+		total += len(e)
+	}
+	if total <= max {
+		for _, e := range entries {
+			inline = append(inline, e...)
+		}
+		return inline, nil
+	}
+	i := 0
+	for ; i < len(entries) && len(inline)+len(entries[i]) <= max-ceLength; i++ {
+		inline = append(inline, entries[i]...)
+	}
+	for _, e := range entries[i:] {
+		cont = append(cont, e...)
+	}
+	return inline, cont
+}
+
+// recordTime encodes t in the 7-byte form of directory records: years
+// since 1900, month, day, hour, minute, second and the offset from UTC.
+func recordTime(t time.Time) []byte {
+	t = t.UTC()
+	year := t.Year() - 1900
+	switch {
+	case year < 0:
+		return []byte{0, 1, 1, 0, 0, 0, 0}
+	case year > 255:
+		return []byte{255, 12, 31, 23, 59, 59, 0}
+	}
+	return []byte{byte(year), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
@@ -0,0 +1,393 @@
+package iso9660
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+// POSIX file types as stored in Rock Ridge PX entries.
+const (
+	sIFMT   = 0170000
+	sIFSOCK = 0140000
+	sIFLNK  = 0120000
+	sIFREG  = 0100000
+	sIFBLK  = 0060000
+	sIFDIR  = 0040000
+	sIFCHR  = 0020000
+	sIFIFO  = 0010000
+)
+
+// node is a file in the tree being written.
+type node struct {
+	name     string // name in the source tree, "" for the root
+	mode     uint32 // POSIX st_mode
+	uid, gid uint32
+	rdev     uint64
+	mtime    time.Time
+	target   string // symbolic link target
+	data     *file  // regular files; shared by hard links
+	parent   *node
+	children []*node // sorted by name
+
+	isoID    string // ISO 9660 identifier, e.g. "LOADER.CON;1"
+	jolietID []byte // UCS-2 identifier, nil if not in the Joliet tree
+
+	// Directories only
+	isoOrder, jolietOrder []*node   // children in each hierarchy's order
+	isoRecords            []*record // including "." and ".."
+	jolietRecords         []*record
+	isoNumber, jolietNum  int // path table numbers
+	isoExtent, jolietExt  extent
+	contSectors           uint32 // continuation areas after isoExtent
+}
+
+// file is the data of a regular file.
+type file struct {
+	src     string
+	size    int64
+	links   uint32
+	sector  uint32
+	catalog bool // the El Torito boot catalog, written from memory
+}
+
+func (n *node) isDir() bool     { return n.mode&sIFMT == sIFDIR }
+func (n *node) isRegular() bool { return n.mode&sIFMT == sIFREG }
+
+// nlink returns the link count recorded in Rock Ridge: the links within
+// the image for files, two plus the subdirectories for directories.
+func (n *node) nlink() uint32 {
+	switch {
+	case n.isDir():
+		count := uint32(2)
+		for _, c := range n.children {
+			if c.isDir() {
+				count++
+			}
+		}
+		return count
+	case n.data != nil:
+		return n.data.links
+	}
+	return 1
+}
+
+// path returns the node's path relative to the root.
+func (n *node) path() string {
+	if n.parent == nil {
+		return ""
+	}
+	if p := n.parent.path(); p != "" {
+		return p + "/" + n.name
+	}
+	return n.name
+}
+
+// scan reads the tree at root. Hard links share one file, found by device
+// and inode.
+func scan(root string) (*node, error) {
+	links := make(map[[2]uint64]*file)
+
+	var walk func(path string, n *node) error
+	walk = func(path string, n *node) error {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			child, err := newNode(filepath.Join(path, e.Name()), e.Name(), links)
+			if err != nil {
+				return err
+			}
+			child.parent = n
+			n.children = append(n.children, child)
+			if child.isDir() {
+				if err := walk(filepath.Join(path, e.Name()), child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	n, err := newNode(root, "", links)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	if err := walk(root, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func newNode(path, name string, links map[[2]uint64]*file) (*node, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{name: name, mode: posixMode(info.Mode()), mtime: info.ModTime()}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if ok {
+		n.mode = uint32(st.Mode)
+		n.uid, n.gid = st.Uid, st.Gid
+		n.rdev = uint64(st.Rdev)
+	}
+
+	switch n.mode & sIFMT {
+	case sIFLNK:
+		if n.target, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	case sIFREG:
+		var key [2]uint64
+		if ok && st.Nlink > 1 {
+			key = [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if f := links[key]; f != nil {
+				f.links++
+				n.data = f
+				return n, nil
+			}
+		}
+		n.data = &file{src: path, size: info.Size(), links: 1}
+		if ok && st.Nlink > 1 {
+			links[key] = n.data
+		}
+	}
+	return n, nil
+}
+
+// posixMode converts a FileMode for systems without a raw st_mode.
+func posixMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	default:
+		mode |= sIFREG
+	}
+	return mode
+}
+
+// clampTimes sets times after max in the tree below n to max.
+func (n *node) clampTimes(max time.Time) {
+	if n.mtime.After(max) {
+		n.mtime = max
+	}
+	for _, c := range n.children {
+		c.clampTimes(max)
+	}
+}
+
+// lookup returns the node at a slash-separated path relative to n.
+func (n *node) lookup(path string) *node {
+	cur := n
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		var next *node
+		for _, c := range cur.children {
+			if c.name == part {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+// Identifier limits: level 2 allows 31 characters, and file names and
+// extensions together at most 30. Joliet allows 64 UCS-2 characters.
+const (
+	maxDirID    = 31
+	maxFileID   = 30
+	maxExt      = 8
+	maxJolietID = 64
+)
+
+// assignNames gives every node in the tree its ISO 9660 and Joliet
+// identifiers, unique within the directory, and orders the children of
+// each directory for both hierarchies.
+func assignNames(dir *node, joliet bool) {
+	used := make(map[string]bool)
+	jused := make(map[string]bool)
+	for _, c := range dir.children {
+		base, ext := isoName(c.name, c.isDir())
+		id := formatISOName(base, ext, c.isDir())
+		for i := 1; used[id]; i++ {
+			id = formatISOName(mangle(base, ext, i, c.isDir()), ext, c.isDir())
+		}
+		used[id] = true
+		c.isoID = id
+		if !c.isDir() {
+			c.isoID += ";1"
+		}
+
+		// Joliet has no symbolic links or special files
+		if joliet && (c.isDir() || c.isRegular()) {
+			units := jolietName(c.name)
+			jid := units
+			for i := 1; jused[string(utf16.Decode(jid))]; i++ {
+				suffix := utf16.Encode([]rune(fmt.Sprintf("_%d", i)))
+				jid = append(truncateUTF16(units, maxJolietID-len(suffix)), suffix...)
+			}
+			jused[string(utf16.Decode(jid))] = true
+			c.jolietID = ucs2(jid)
+		}
+	}
+
+	dir.isoOrder = append([]*node{}, dir.children...)
+	sort.SliceStable(dir.isoOrder, func(i, j int) bool {
+		return strings.TrimSuffix(dir.isoOrder[i].isoID, ";1") < strings.TrimSuffix(dir.isoOrder[j].isoID, ";1")
+	})
+	dir.jolietOrder = nil
+	for _, c := range dir.children {
+		if c.jolietID != nil {
+			dir.jolietOrder = append(dir.jolietOrder, c)
+		}
+	}
+	sort.SliceStable(dir.jolietOrder, func(i, j int) bool {
+		return bytes.Compare(dir.jolietOrder[i].jolietID, dir.jolietOrder[j].jolietID) < 0
+	})
+
+	for _, c := range dir.children {
+		if c.isDir() {
+			assignNames(c, joliet)
+		}
+	}
+}
+
+// isoName maps a name to d-characters, split into name and extension for
+// files and truncated to the level 2 limits.
+func isoName(name string, dir bool) (string, string) {
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+	}
+	base, ext = dChars(base), dChars(ext)
+	if dir {
+		if len(base) > maxDirID {
+			base = base[:maxDirID]
+		}
+		if base == "" {
+			base = "_"
+		}
+		return base, ""
+	}
+	if len(ext) > maxExt {
+		ext = ext[:maxExt]
+	}
+	if len(base)+len(ext) > maxFileID {
+		base = base[:maxFileID-len(ext)]
+	}
+	if base == "" && ext == "" {
+		base = "_"
+	}
+	return base, ext
+}
+
+// mangle shortens base to make room for a numeric suffix.
+func mangle(base, ext string, i int, dir bool) string {
+	suffix := fmt.Sprintf("_%d", i)
+	limit := maxFileID - len(ext)
+	if dir {
+		limit = maxDirID
+	}
+	if len(base)+len(suffix) > limit {
+		base = base[:limit-len(suffix)]
+	}
+	return base + suffix
+}
+
+func formatISOName(base, ext string, dir bool) string {
+	if dir {
+		return base
+	}
+	return base + "." + ext
+}
+
+// dChars upper-cases s and replaces characters outside A-Z, 0-9 and _.
+func dChars(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// jolietName returns name in UTF-16 without the characters Joliet forbids,
+// truncated to 64 code units.
+func jolietName(name string) []uint16 {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`*/:;?\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return truncateUTF16(utf16.Encode([]rune(name)), maxJolietID)
+}
+
+// truncateUTF16 returns a copy of at most n units of s, without splitting a
+// surrogate pair.
+func truncateUTF16(s []uint16, n int) []uint16 {
+	if len(s) > n {
+		if n > 0 && s[n-1] >= 0xd800 && s[n-1] < 0xdc00 {
+			n--
+		}
+		s = s[:n]
+	}
+	return append([]uint16{}, s...)
+}
+
+// ucs2 encodes UTF-16 code units big-endian, as Joliet stores them.
+func ucs2(units []uint16) []byte {
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		b[2*i] = byte(u >> 8)
+		b[2*i+1] = byte(u)
+	}
+	return b
+}
@@ -0,0 +1,323 @@
+// Package lint checks recipes, overlays and package lists for problems that
+// would otherwise only show up in the middle of a build.
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/build"
+	"github.com/pgsdf/pgsdbuild/internal/catalog"
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/pkglist"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// Severity levels used in findings.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Check names identify which rule produced a finding.
+const (
+	CheckLoad          = "load"
+	CheckSchema        = "schema"
+	CheckDuplicateID   = "duplicate-id"
+	CheckFileName      = "file-name"
+	CheckOverlay       = "overlay"
+	CheckOverlayMode   = "overlay-mode"
+	CheckPkgList       = "pkg-list"
+	CheckEmbeddedImage = "embedded-image"
+	CheckCatalog       = "catalog"
+)
+
+// Finding is a single problem reported by the linter.
+type Finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// String formats the finding as file[:line]: severity: [check] message.
+func (f Finding) String() string {
+	loc := f.File
+	if f.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", f.File, f.Line)
+	}
+	if loc == "" {
+		return fmt.Sprintf("%s: [%s] %s", f.Severity, f.Check, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: [%s] %s", loc, f.Severity, f.Check, f.Message)
+}
+
+// Report is the result of a lint run.
+type Report struct {
+	Images   int       `json:"images"`
+	Variants int       `json:"variants"`
+	Findings []Finding `json:"findings"`
+}
+
+// Errors returns the number of error findings.
+func (r *Report) Errors() int {
+	return r.count(SeverityError)
+}
+
+// Warnings returns the number of warning findings.
+func (r *Report) Warnings() int {
+	return r.count(SeverityWarning)
+}
+
+func (r *Report) count(severity string) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Report) add(severity, check, file string, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, Finding{
+		Severity: severity,
+		Check:    check,
+		File:     file,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Run lints every image and variant recipe under the configured directories.
+func Run(cfg *build.Config) *Report {
+	r := &Report{Findings: []Finding{}}
+
+	images, err := config.ListImages(cfg.GetImagesDir())
+	r.addLoadErrors(err)
+	variants, err := config.ListVariants(cfg.GetVariantsDir())
+	r.addLoadErrors(err)
+	r.Images = len(images)
+	r.Variants = len(variants)
+
+	// Package availability is only checked when a catalog is configured
+	var cat *catalog.Catalog
+	if path := cfg.GetPkgCatalog(); path != "" {
+		cat, err = catalog.Load(path)
+		if err != nil {
+			r.add(SeverityError, CheckCatalog, path, "%v", err)
+		}
+	}
+
+	imageIDs := make(map[string]string)
+	for _, img := range images {
+		r.addWarnings(img.Warnings)
+		r.checkID("image", img.ID, img.Path, imageIDs)
+		r.checkPkgLists(cfg, img.Path, img.PkgLists)
+		r.checkCatalog(cfg, cat, img.Path, img.PkgLists)
+		r.checkOverlays(cfg, img.Path, img.Overlays)
+	}
+
+	variantIDs := make(map[string]string)
+	for _, v := range variants {
+		r.addWarnings(v.Warnings)
+		r.checkID("variant", v.ID, v.Path, variantIDs)
+		r.checkPkgLists(cfg, v.Path, v.PkgLists)
+		r.checkCatalog(cfg, cat, v.Path, v.PkgLists)
+		r.checkOverlays(cfg, v.Path, v.Overlays)
+		for _, name := range v.EmbeddedImages {
+			if _, ok := imageIDs[name]; !ok {
+				r.add(SeverityError, CheckEmbeddedImage, v.Path,
+					"embedded_images: %q is not a known image", name)
+			}
+		}
+	}
+
+	// Each overlay directory is checked once, however many recipes use it
+	for _, name := range usedOverlays(images, variants) {
+		dir := filepath.Join(cfg.GetOverlaysDir(), name)
+		if util.DirExists(dir) {
+			r.checkOverlayModes(dir)
+		}
+	}
+
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		a, b := r.Findings[i], r.Findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return r
+}
+
+// addLoadErrors reports recipe files that could not be loaded at all.
+func (r *Report) addLoadErrors(err error) {
+	if err == nil {
+		return
+	}
+	var loadErr *config.LoadError
+	if !errors.As(err, &loadErr) {
+		r.add(SeverityError, CheckLoad, "", "%v", err)
+		return
+	}
+	for _, f := range loadErr.Files {
+		r.add(SeverityError, CheckLoad, f.Path, "%v", f.Err)
+	}
+}
+
+// addWarnings converts recipe schema warnings into findings.
+func (r *Report) addWarnings(warnings []config.Diagnostic) {
+	for _, w := range warnings {
+		r.Findings = append(r.Findings, Finding{
+			Severity: SeverityWarning,
+			Check:    CheckSchema,
+			File:     w.File,
+			Line:     w.Line,
+			Message:  fmt.Sprintf("%s: %s", w.Field, w.Message),
+		})
+	}
+}
+
+// checkID reports duplicate IDs and IDs that do not match the file name,
+// since commands look recipes up as <id>.lua.
+func (r *Report) checkID(kind, id, path string, seen map[string]string) {
+	if other, ok := seen[id]; ok {
+		r.add(SeverityError, CheckDuplicateID, path, "%s id %q is also used by %s", kind, id, other)
+	} else {
+		seen[id] = path
+	}
+
+	if base := strings.TrimSuffix(filepath.Base(path), ".lua"); base != id {
+		r.add(SeverityWarning, CheckFileName, path,
+			"%s id %q does not match file name; 'pgsdbuild %s %s' will not find it", kind, id, kind, id)
+	}
+}
+
+// checkPkgLists resolves each package list on its own so every broken list
+// (missing file, bad include, syntax error) is reported.
+func (r *Report) checkPkgLists(cfg *build.Config, path string, lists []string) {
+	resolver := pkglist.NewResolver(cfg.GetPkgListsDir(), cfg.FreeBSDArch)
+	for _, name := range lists {
+		set, err := resolver.Resolve([]string{name})
+		if err != nil {
+			r.add(SeverityError, CheckPkgList, path, "pkg_lists: %v", err)
+			continue
+		}
+		if len(set.Packages) == 0 {
+			r.add(SeverityWarning, CheckPkgList, path, "pkg_lists: %q contains no packages for %s", name, cfg.FreeBSDArch)
+		}
+	}
+}
+
+// checkCatalog resolves a recipe's packages against the catalog and reports
+// packages that pkg would not be able to install.
+func (r *Report) checkCatalog(cfg *build.Config, cat *catalog.Catalog, path string, lists []string) {
+	if cat == nil {
+		return
+	}
+	set, err := pkglist.NewResolver(cfg.GetPkgListsDir(), cfg.FreeBSDArch).Resolve(lists)
+	if err != nil {
+		// Already reported per list by checkPkgLists
+		return
+	}
+
+	requests := make([]catalog.Request, len(set.Packages))
+	for i, p := range set.Packages {
+		requests[i] = catalog.Request{Name: p.Name, From: p.Origin()}
+	}
+	plan := cat.Resolve(requests)
+	for _, m := range plan.Missing {
+		r.add(SeverityError, CheckCatalog, path, "package %q (required by %s) is not in the catalog", m.Name, m.RequiredBy)
+	}
+	for _, c := range plan.Conflicts {
+		r.add(SeverityWarning, CheckCatalog, path, "%s: %s", c.Package, c.Reason)
+	}
+}
+
+// checkOverlays reports overlays that do not exist in the overlays directory.
+func (r *Report) checkOverlays(cfg *build.Config, path string, overlays []string) {
+	for _, name := range overlays {
+		dir := filepath.Join(cfg.GetOverlaysDir(), name)
+		if !util.DirExists(dir) {
+			r.add(SeverityError, CheckOverlay, path, "overlays: %q not found at %s", name, dir)
+		}
+	}
+}
+
+// checkOverlayModes walks an overlay and reports file modes that are
+// unlikely to be intended once the files land in an image.
+func (r *Report) checkOverlayModes(dir string) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			r.add(SeverityError, CheckOverlayMode, path, "cannot read: %v", err)
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			r.add(SeverityError, CheckOverlayMode, path, "cannot stat: %v", err)
+			return nil
+		}
+		mode := info.Mode()
+		rel, _ := filepath.Rel(dir, path)
+
+		if mode.Perm()&0002 != 0 && !(mode.IsDir() && mode&os.ModeSticky != 0) {
+			r.add(SeverityError, CheckOverlayMode, path, "world-writable (%04o)", mode.Perm())
+		}
+		if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			r.add(SeverityWarning, CheckOverlayMode, path, "setuid/setgid bit set")
+		}
+		if mode.IsRegular() && isRCScript(rel) && mode.Perm()&0111 == 0 {
+			r.add(SeverityError, CheckOverlayMode, path, "rc.d script is not executable (%04o)", mode.Perm())
+		}
+		if mode.IsRegular() && isPrivateKey(rel) && mode.Perm()&0044 != 0 {
+			r.add(SeverityError, CheckOverlayMode, path, "private key is readable by group or others (%04o)", mode.Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		r.add(SeverityError, CheckOverlayMode, dir, "cannot walk overlay: %v", err)
+	}
+}
+
+// isRCScript reports whether rel is an rc.d script.
+func isRCScript(rel string) bool {
+	dir := filepath.ToSlash(filepath.Dir(rel))
+	return dir == "etc/rc.d" || dir == "usr/local/etc/rc.d"
+}
+
+// isPrivateKey reports whether rel looks like a private key file.
+func isPrivateKey(rel string) bool {
+	base := filepath.Base(rel)
+	return strings.HasSuffix(base, "_key") || strings.HasSuffix(base, ".key")
+}
+
+// usedOverlays returns the overlays referenced by any recipe, sorted.
+func usedOverlays(images []*config.ImageConfig, variants []*config.VariantConfig) []string {
+	seen := make(map[string]bool)
+	for _, img := range images {
+		for _, o := range img.Overlays {
+			seen[o] = true
+		}
+	}
+	for _, v := range variants {
+		for _, o := range v.Overlays {
+			seen[o] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
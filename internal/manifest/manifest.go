@@ -0,0 +1,267 @@
+// Package manifest defines manifest.toml, the description of an image that
+// the image builder writes next to its artifacts and the installer reads
+// back. It records what the image was built from and the size and SHA-256
+// of every artifact file, so the installer can refuse a damaged image
+// before it touches a disk.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FileName is the manifest's name in an image directory.
+const FileName = "manifest.toml"
+
+// Version is the manifest format written by this package. Readers reject
+// newer formats, since they may depend on fields they do not understand.
+const Version = 1
+
+// Dataset roles.
+const (
+	RoleRoot      = "root"      // the boot environment
+	RoleData      = "data"      // a declared dataset with its own stream
+	RoleContainer = "container" // an implied parent that is never mounted
+)
+
+// Manifest describes an image.
+type Manifest struct {
+	Version   int        `toml:"manifest_version"`
+	Image     Image      `toml:"image"`
+	Build     Build      `toml:"build"`
+	SBOM      SBOM       `toml:"sbom,omitempty"`
+	Artifacts []Artifact `toml:"artifacts"`
+	Datasets  []Dataset  `toml:"datasets"`
+	Packages  []Package  `toml:"packages"`
+}
+
+// Image identifies the image and the recipe it was built from.
+type Image struct {
+	ID           string   `toml:"id"`
+	Version      string   `toml:"version"`
+	ZpoolName    string   `toml:"zpool_name"`
+	RootDataset  string   `toml:"root_dataset"`
+	Extends      []string `toml:"extends,omitempty"`
+	PackageLists []string `toml:"package_lists"`
+	Overlays     []string `toml:"overlays"`
+}
+
+// Build records how the image was built.
+type Build struct {
+	Builder        string    `toml:"builder"` // e.g. "pgsdbuild 0.1.0"
+	FreeBSDVersion string    `toml:"freebsd_version"`
+	FreeBSDArch    string    `toml:"freebsd_arch"`
+	Date           time.Time `toml:"date"` // SOURCE_DATE_EPOCH in reproducible builds
+}
+
+// SBOM names the software bills of materials written with the image. Both
+// are also listed as artifacts, so they are covered by the checksums and
+// the manifest signature.
+type SBOM struct {
+	SPDX      string `toml:"spdx,omitempty"`      // SPDX 2.3 JSON
+	CycloneDX string `toml:"cyclonedx,omitempty"` // CycloneDX 1.5 JSON
+}
+
+// Artifact is a file of the image.
+type Artifact struct {
+	Path   string `toml:"path"` // relative to the image directory
+	Size   int64  `toml:"size"`
+	SHA256 string `toml:"sha256"`
+}
+
+// Dataset is a ZFS dataset of the image. Name is relative to the pool so
+// the layout can be recreated under any pool name.
+type Dataset struct {
+	Name       string `toml:"name"`
+	Role       string `toml:"role"`
+	Mountpoint string `toml:"mountpoint,omitempty"`
+	CanMount   string `toml:"canmount,omitempty"`
+	Stream     string `toml:"stream,omitempty"` // artifact path, empty for containers
+}
+
+// Package is an installed package.
+type Package struct {
+	Name       string   `toml:"name"`
+	Version    string   `toml:"version,omitempty"`
+	Origin     string   `toml:"origin,omitempty"`
+	Lists      []string `toml:"lists,omitempty"` // package lists that named the package
+	Dependency bool     `toml:"dependency,omitempty"`
+}
+
+// Encode returns the manifest as TOML.
+func (m *Manifest) Encode() ([]byte, error) {
+	data, err := Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("# PGSD image manifest for %s\n\n", m.Image.ID)
+	return append([]byte(header), data...), nil
+}
+
+// Write writes the manifest to path.
+func (m *Manifest) Write(path string) error {
+	data, err := m.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Decode parses and validates a manifest.
+func Decode(data []byte) (*Manifest, error) {
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	// Check the version first: older manifests use a different layout
+	// that would only produce confusing type errors
+	v, _ := doc["manifest_version"].(int64)
+	switch {
+	case v == 0:
+		return nil, fmt.Errorf("manifest has no manifest_version; it was written by an older pgsdbuild, rebuild the image")
+	case v > Version:
+		return nil, fmt.Errorf("manifest version %d is newer than the supported version %d", v, Version)
+	}
+
+	m := &Manifest{}
+	if err := decodeTable(doc, reflect.ValueOf(m).Elem(), ""); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load reads and validates the manifest at path.
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	m, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Validate checks that names and paths cannot escape the pool or the image
+// directory and that every stream is a listed artifact.
+func (m *Manifest) Validate() error {
+	if m.Image.ID == "" {
+		return fmt.Errorf("image id is missing")
+	}
+	for _, a := range m.Artifacts {
+		if !localPath(a.Path) {
+			return fmt.Errorf("artifact has an invalid path %q", a.Path)
+		}
+	}
+	for _, p := range []string{m.SBOM.SPDX, m.SBOM.CycloneDX} {
+		if p != "" && m.Artifact(p) == nil {
+			return fmt.Errorf("SBOM %q is not a listed artifact", p)
+		}
+	}
+	roots := 0
+	for i, ds := range m.Datasets {
+		if ds.Name == "" || strings.Contains(ds.Name, "..") || strings.HasPrefix(ds.Name, "/") {
+			return fmt.Errorf("dataset %d has an invalid name %q", i+1, ds.Name)
+		}
+		if ds.Stream != "" && m.Artifact(ds.Stream) == nil {
+			return fmt.Errorf("dataset %s: stream %q is not a listed artifact", ds.Name, ds.Stream)
+		}
+		if ds.Role == RoleRoot {
+			roots++
+		}
+	}
+	if len(m.Datasets) > 0 && roots != 1 {
+		return fmt.Errorf("expected one root dataset, found %d", roots)
+	}
+	return nil
+}
+
+// localPath reports whether p is a relative slash-separated path that stays
+// inside the image directory.
+func localPath(p string) bool {
+	return p != "" && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// Artifact returns the artifact with the given path, or nil.
+func (m *Manifest) Artifact(p string) *Artifact {
+	for i := range m.Artifacts {
+		if m.Artifacts[i].Path == p {
+			return &m.Artifacts[i]
+		}
+	}
+	return nil
+}
+
+// NewArtifact hashes the file rel in dir.
+func NewArtifact(dir, rel string) (Artifact, error) {
+	sum, size, err := hashFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return Artifact{}, fmt.Errorf("artifact %s: %w", rel, err)
+	}
+	return Artifact{Path: rel, Size: size, SHA256: sum}, nil
+}
+
+// Check verifies that every artifact exists in dir with its recorded size.
+// It is cheap enough to run when listing images.
+func (m *Manifest) Check(dir string) error {
+	for _, a := range m.Artifacts {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(a.Path)))
+		if err != nil {
+			return fmt.Errorf("artifact %s: %w", a.Path, err)
+		}
+		if info.Size() != a.Size {
+			return fmt.Errorf("artifact %s is %d bytes, manifest records %d", a.Path, info.Size(), a.Size)
+		}
+	}
+	return nil
+}
+
+// Verify checks every artifact in dir against its recorded size and
+// SHA-256. progress, if not nil, is called before each file is hashed.
+func (m *Manifest) Verify(dir string, progress func(a Artifact)) error {
+	if err := m.Check(dir); err != nil {
+		return err
+	}
+	for _, a := range m.Artifacts {
+		if progress != nil {
+			progress(a)
+		}
+		sum, _, err := hashFile(filepath.Join(dir, filepath.FromSlash(a.Path)))
+		if err != nil {
+			return fmt.Errorf("artifact %s: %w", a.Path, err)
+		}
+		if sum != a.SHA256 {
+			return fmt.Errorf("artifact %s is corrupt: sha256 %s, manifest records %s", a.Path, sum, a.SHA256)
+		}
+	}
+	return nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,912 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file implements the part of TOML v1.0.0 the manifest needs: a
+// struct encoder and a decoder that parses any TOML document and maps it
+// onto structs. Struct fields are named with `toml:"name"` tags; ",omitempty"
+// skips zero values when encoding. Keys that have no field are ignored when
+// decoding, so older readers accept newer manifests.
+
+// Marshal encodes v, a struct or pointer to a struct, as a TOML document.
+// Scalar fields are written first, then struct fields as [tables] and
+// slices of structs as [[arrays of tables]].
+func Marshal(v any) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("toml: cannot encode %s, expected a struct", rv.Type())
+	}
+	var buf bytes.Buffer
+	if err := encodeTable(&buf, rv, ""); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// field is a struct field with its TOML name.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func fieldsOf(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("toml")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isTable reports whether values of t are written as tables.
+func isTable(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// isTableArray reports whether values of t are written as arrays of tables.
+func isTableArray(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && isTable(t.Elem())
+}
+
+func encodeTable(buf *bytes.Buffer, rv reflect.Value, prefix string) error {
+	fields := fieldsOf(rv.Type())
+
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		if isTable(fv.Type()) || isTableArray(fv.Type()) || (f.omitEmpty && fv.IsZero()) {
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Len() == 0 && f.omitEmpty {
+			continue
+		}
+		value, err := encodeValue(fv)
+		if err != nil {
+			return fmt.Errorf("toml: %s: %w", joinKey(prefix, f.name), err)
+		}
+		fmt.Fprintf(buf, "%s = %s\n", quoteKey(f.name), value)
+	}
+
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		key := joinKey(prefix, f.name)
+		switch {
+		case isTable(fv.Type()):
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			fmt.Fprintf(buf, "\n[%s]\n", key)
+			if err := encodeTable(buf, fv, key); err != nil {
+				return err
+			}
+		case isTableArray(fv.Type()):
+			for i := 0; i < fv.Len(); i++ {
+				fmt.Fprintf(buf, "\n[[%s]]\n", key)
+				if err := encodeTable(buf, fv.Index(i), key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func encodeValue(v reflect.Value) (string, error) {
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return quoteString(v.String()), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > 1<<63-1 {
+			return "", fmt.Errorf("%d does not fit a TOML integer", v.Uint())
+		}
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		switch f := v.Float(); {
+		case math.IsNaN(f):
+			return "nan", nil
+		case math.IsInf(f, 1):
+			return "inf", nil
+		case math.IsInf(f, -1):
+			return "-inf", nil
+		}
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			s, err := encodeValue(v.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+	return "", fmt.Errorf("cannot encode %s", v.Type())
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return quoteKey(name)
+	}
+	return prefix + "." + quoteKey(name)
+}
+
+func quoteKey(k string) string {
+	if k != "" && strings.IndexFunc(k, func(r rune) bool { return !isBareKeyChar(r) }) < 0 {
+		return k
+	}
+	return quoteString(k)
+}
+
+// quoteString writes s as a TOML basic string.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\u%04X`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// Unmarshal parses a TOML document and stores it in v, a pointer to a
+// struct.
+func Unmarshal(data []byte, v any) error {
+	doc, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("toml: cannot decode into %T, expected a pointer to a struct", v)
+	}
+	return decodeTable(doc, rv.Elem(), "")
+}
+
+func decodeTable(tbl map[string]any, rv reflect.Value, path string) error {
+	for _, f := range fieldsOf(rv.Type()) {
+		value, ok := tbl[f.name]
+		if !ok {
+			continue
+		}
+		key := f.name
+		if path != "" {
+			key = path + "." + f.name
+		}
+		if err := decodeValue(value, rv.Field(f.index), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeValue(value any, rv reflect.Value, key string) error {
+	mismatch := func() error {
+		return fmt.Errorf("toml: %s: cannot use %s as %s", key, typeName(value), rv.Type())
+	}
+
+	if rv.Type() == timeType {
+		t, ok := value.(time.Time)
+		if !ok {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if rv.OverflowInt(n) {
+			return fmt.Errorf("toml: %s: %d overflows %s", key, n, rv.Type())
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(int64)
+		if !ok {
+			return mismatch()
+		}
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return fmt.Errorf("toml: %s: %d overflows %s", key, n, rv.Type())
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case float64:
+			rv.SetFloat(n)
+		case int64:
+			rv.SetFloat(float64(n))
+		default:
+			return mismatch()
+		}
+	case reflect.Struct:
+		tbl, ok := value.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		return decodeTable(tbl, rv, key)
+	case reflect.Slice:
+		items, ok := value.([]any)
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(item, slice.Index(i), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+	default:
+		return fmt.Errorf("toml: %s: cannot decode into %s", key, rv.Type())
+	}
+	return nil
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "integer"
+	case float64:
+		return "float"
+	case bool:
+		return "boolean"
+	case time.Time:
+		return "datetime"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "table"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Parse parses a TOML document into tables (map[string]any), arrays
+// ([]any, including arrays of tables), strings, int64, float64, bool and
+// time.Time values.
+func Parse(data []byte) (map[string]any, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("toml: document is not valid UTF-8")
+	}
+	p := &parser{src: string(data), line: 1, root: map[string]any{}, explicit: map[uintptr]bool{}, inline: map[uintptr]bool{}}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	finish(p.root)
+	return p.root, nil
+}
+
+// tableArray is an array of tables while it is being parsed. Unlike an
+// array value it can still be extended by [[headers]].
+type tableArray []map[string]any
+
+// finish replaces every *tableArray below tbl with a plain []any.
+func finish(tbl map[string]any) {
+	for k, v := range tbl {
+		switch v := v.(type) {
+		case *tableArray:
+			items := make([]any, len(*v))
+			for i, t := range *v {
+				finish(t)
+				items[i] = t
+			}
+			tbl[k] = items
+		case map[string]any:
+			finish(v)
+		}
+	}
+}
+
+func tableID(tbl map[string]any) uintptr {
+	return reflect.ValueOf(tbl).Pointer()
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+
+	root    map[string]any
+	current map[string]any
+
+	// Tables opened by a [header] or defined by dotted keys cannot be
+	// opened by a header again, and inline tables cannot be extended at
+	// all.
+	explicit map[uintptr]bool
+	inline   map[uintptr]bool
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("toml: line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) advance() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpace skips spaces and tabs.
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment up to the end of the line.
+func (p *parser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// endLine requires the rest of the line to be blank or a comment.
+func (p *parser) endLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.eof() {
+		return nil
+	}
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if p.eof() || p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	p.advance()
+	return nil
+}
+
+// skipBlank skips whitespace, newlines and comments, as allowed in arrays.
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.advance()
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		if p.peek() == '[' {
+			if err := p.parseHeader(); err != nil {
+				return err
+			}
+		} else if err := p.parseKeyValue(p.current); err != nil {
+			return err
+		}
+		if err := p.endLine(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *parser) parseHeader() error {
+	p.advance()
+	array := p.peek() == '['
+	if array {
+		p.advance()
+	}
+	p.skipSpace()
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	// Check before consuming so a newline does not move the error line
+	for n := 0; n == 0 || array && n == 1; n++ {
+		if p.eof() || p.peek() != ']' {
+			return p.errorf("unterminated table header")
+		}
+		p.advance()
+	}
+
+	// Walk to the parent, creating implicit tables on the way
+	tbl := p.root
+	for _, k := range keys[:len(keys)-1] {
+		if tbl, err = p.descend(tbl, k); err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+
+	if array {
+		existing, ok := tbl[last]
+		if !ok {
+			existing = &tableArray{}
+			tbl[last] = existing
+		}
+		arr, isArr := existing.(*tableArray)
+		if !isArr {
+			return p.errorf("%s is not an array of tables", strings.Join(keys, "."))
+		}
+		next := map[string]any{}
+		*arr = append(*arr, next)
+		p.explicit[tableID(next)] = true
+		p.current = next
+		return nil
+	}
+
+	switch existing := tbl[last].(type) {
+	case nil:
+		next := map[string]any{}
+		tbl[last] = next
+		p.explicit[tableID(next)] = true
+		p.current = next
+	case map[string]any:
+		if p.explicit[tableID(existing)] || p.inline[tableID(existing)] {
+			return p.errorf("table %s defined twice", strings.Join(keys, "."))
+		}
+		p.explicit[tableID(existing)] = true
+		p.current = existing
+	case *tableArray:
+		return p.errorf("%s is an array of tables", strings.Join(keys, "."))
+	default:
+		return p.errorf("%s is already defined as a value", strings.Join(keys, "."))
+	}
+	return nil
+}
+
+// descend returns the table at key k in tbl, creating an implicit table if
+// k is not defined. The last element of an array of tables is used.
+func (p *parser) descend(tbl map[string]any, k string) (map[string]any, error) {
+	switch v := tbl[k].(type) {
+	case nil:
+		next := map[string]any{}
+		tbl[k] = next
+		return next, nil
+	case map[string]any:
+		if p.inline[tableID(v)] {
+			return nil, p.errorf("cannot extend inline table %s", k)
+		}
+		return v, nil
+	case *tableArray:
+		return (*v)[len(*v)-1], nil
+	}
+	return nil, p.errorf("%s is not a table", k)
+}
+
+// parseKeyValue parses key = value into tbl. Dotted keys create nested
+// tables.
+func (p *parser) parseKeyValue(tbl map[string]any) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.eof() || p.advance() != '=' {
+		return p.errorf("expected '=' after key %s", strings.Join(keys, "."))
+	}
+	p.skipSpace()
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys[:len(keys)-1] {
+		if tbl, err = p.descend(tbl, k); err != nil {
+			return err
+		}
+		p.explicit[tableID(tbl)] = true
+	}
+	last := keys[len(keys)-1]
+	if _, ok := tbl[last]; ok {
+		return p.errorf("key %s defined twice", strings.Join(keys, "."))
+	}
+	tbl[last] = value
+	return nil
+}
+
+// parseKey parses a possibly dotted key.
+func (p *parser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		var k string
+		switch p.peek() {
+		case '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			k = s
+		case '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			k = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(rune(p.peek())) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("expected a key, found %q", p.peek())
+			}
+			k = p.src[start:p.pos]
+		}
+		keys = append(keys, k)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.advance()
+	}
+}
+
+func isBareKeyChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+func (p *parser) parseValue() (any, error) {
+	if p.eof() {
+		return nil, p.errorf("missing value")
+	}
+	switch c := p.peek(); {
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.parseMultilineString(`"""`)
+	case strings.HasPrefix(p.src[p.pos:], `'''`):
+		return p.parseMultilineString(`'''`)
+	case c == '"':
+		return p.parseBasicString()
+	case c == '\'':
+		return p.parseLiteralString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+		p.pos++
+	}
+	// A datetime may separate date and time with a space
+	if p.pos-start == 10 && p.peek() == ' ' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9' {
+		p.pos++
+		for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+			p.pos++
+		}
+	}
+	return p.parseScalar(p.src[start:p.pos])
+}
+
+func (p *parser) parseScalar(tok string) (any, error) {
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	}
+	if t, ok := parseDatetime(tok); ok {
+		return t, nil
+	}
+
+	clean := strings.ReplaceAll(tok, "_", "")
+	if strings.Contains(tok, "__") || strings.HasPrefix(tok, "_") || strings.HasSuffix(tok, "_") {
+		return nil, p.errorf("invalid number %q", tok)
+	}
+	for _, prefix := range []struct {
+		s    string
+		base int
+	}{{"0x", 16}, {"0o", 8}, {"0b", 2}} {
+		if digits, ok := strings.CutPrefix(clean, prefix.s); ok {
+			n, err := strconv.ParseInt(digits, prefix.base, 64)
+			if err != nil {
+				return nil, p.errorf("invalid integer %q", tok)
+			}
+			return n, nil
+		}
+	}
+	if n, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		digits := strings.TrimLeft(clean, "+-")
+		if len(digits) > 1 && digits[0] == '0' {
+			return nil, p.errorf("invalid integer %q: leading zero", tok)
+		}
+		return n, nil
+	}
+	if strings.ContainsAny(clean, ".eE") {
+		if f, err := strconv.ParseFloat(clean, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, p.errorf("invalid value %q", tok)
+}
+
+// parseDatetime parses the TOML date and time forms. Local date-times and
+// dates are returned in UTC.
+func parseDatetime(tok string) (time.Time, bool) {
+	if len(tok) < 10 || tok[4] != '-' {
+		return time.Time{}, false
+	}
+	s := tok
+	if len(s) > 10 && (s[10] == ' ' || s[10] == 't') {
+		s = s[:10] + "T" + s[11:]
+	}
+	s = strings.ToUpper(s)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (p *parser) parseBasicString() (string, error) {
+	p.advance()
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.advance()
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (p *parser) parseEscape(sb *strings.Builder) error {
+	if p.eof() {
+		return p.errorf("unterminated escape")
+	}
+	c := p.advance()
+	switch c {
+	case 'b':
+		sb.WriteByte('\b')
+	case 't':
+		sb.WriteByte('\t')
+	case 'n':
+		sb.WriteByte('\n')
+	case 'f':
+		sb.WriteByte('\f')
+	case 'r':
+		sb.WriteByte('\r')
+	case '"':
+		sb.WriteByte('"')
+	case '\\':
+		sb.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return p.errorf("short unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape \\%c%s", c, p.src[p.pos:p.pos+n])
+		}
+		p.pos += n
+		sb.WriteRune(rune(code))
+	default:
+		return p.errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+func (p *parser) parseLiteralString() (string, error) {
+	p.advance()
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.src[start:p.pos]
+	p.advance()
+	return s, nil
+}
+
+func (p *parser) parseMultilineString(delim string) (string, error) {
+	p.pos += 3
+	// A newline directly after the opening delimiter is trimmed
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos++
+	}
+	if p.peek() == '\n' {
+		p.advance()
+	}
+
+	var sb strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated multi-line string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += 3
+			// Up to two quotes may directly precede the closing delimiter
+			for i := 0; i < 2 && strings.HasPrefix(p.src[p.pos:], delim[:1]); i++ {
+				sb.WriteByte(delim[0])
+				p.pos++
+			}
+			return sb.String(), nil
+		}
+		c := p.advance()
+		if c == '\\' && delim == `"""` {
+			// A backslash at the end of a line trims following whitespace
+			rest := strings.TrimLeft(p.src[p.pos:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+					p.advance()
+				}
+				continue
+			}
+			if err := p.parseEscape(&sb); err != nil {
+				return "", err
+			}
+			continue
+		}
+		sb.WriteByte(c)
+	}
+}
+
+func (p *parser) parseArray() (any, error) {
+	p.advance()
+	items := []any{}
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.advance()
+			return items, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.advance()
+		case ']':
+		default:
+			if p.eof() {
+				return nil, p.errorf("unterminated array")
+			}
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *parser) parseInlineTable() (any, error) {
+	p.advance()
+	tbl := map[string]any{}
+	p.skipSpace()
+	p.inline[tableID(tbl)] = true
+	if p.peek() == '}' {
+		p.advance()
+		return tbl, nil
+	}
+	for {
+		if err := p.parseKeyValue(tbl); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.eof() {
+			return nil, p.errorf("unterminated inline table")
+		}
+		switch p.advance() {
+		case ',':
+			p.skipSpace()
+		case '}':
+			return tbl, nil
+		default:
+			return nil, p.errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package manifest
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sample struct {
+	Name    string    `toml:"name"`
+	Odd     string    `toml:"odd key"`
+	Count   int       `toml:"count"`
+	Small   int8      `toml:"small"`
+	Big     uint64    `toml:"big"`
+	Ratio   float64   `toml:"ratio"`
+	On      bool      `toml:"on"`
+	When    time.Time `toml:"when"`
+	Tags    []string  `toml:"tags"`
+	Matrix  [][]int   `toml:"matrix"`
+	Skipped string    `toml:"skipped,omitempty"`
+	Ignored string    `toml:"-"`
+	Inner   inner     `toml:"inner"`
+	Dotted  inner     `toml:"a.b"`
+	Missing inner     `toml:"missing,omitempty"`
+	Items   []item    `toml:"items"`
+}
+
+type inner struct {
+	Value  string `toml:"value"`
+	Deeper struct {
+		N int `toml:"n"`
+	} `toml:"deeper"`
+}
+
+type item struct {
+	ID   string `toml:"id"`
+	Sub  inner  `toml:"sub,omitempty"`
+	Opts []item `toml:"opts"`
+}
+
+// Marshal and Unmarshal are inverses for every supported field type.
+func TestRoundTrip(t *testing.T) {
+	in := sample{
+		Name:   "quote \" backslash \\ tab \t newline \n del \x7f nul \x00 é 日本",
+		Odd:    "spaces in the key",
+		Count:  -42,
+		Small:  -128,
+		Big:    1<<63 - 1,
+		Ratio:  0.1,
+		On:     true,
+		When:   time.Date(2025, 3, 1, 12, 30, 10, 123456789, time.FixedZone("", -7*3600)),
+		Tags:   []string{"a", "b,c", "[d]"},
+		Matrix: [][]int{{1, 2}, {3}},
+		Inner:  inner{Value: "x"},
+		Dotted: inner{Value: "y"},
+		Items: []item{
+			{ID: "first", Sub: inner{Value: "z"}},
+			{ID: "second", Opts: []item{{ID: "nested"}}},
+		},
+	}
+	in.Inner.Deeper.N = 7
+
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out sample
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	if !out.When.Equal(in.When) {
+		t.Errorf("when = %v, want %v", out.When, in.When)
+	}
+	out.When = in.When
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip changed the value\n got %+v\nwant %+v\n%s", out, in, data)
+	}
+
+	for _, s := range []string{"skipped", "missing", "Ignored"} {
+		if strings.Contains(string(data), s) {
+			t.Errorf("%s was encoded:\n%s", s, data)
+		}
+	}
+	for _, s := range []string{`"odd key" = `, `["a.b"]`, `["a.b".deeper]`, "[[items]]", "[items.sub]", "[[items.opts]]"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("%s is missing:\n%s", s, data)
+		}
+	}
+}
+
+// Infinities and NaN are written in TOML's spelling.
+func TestRoundTripSpecialFloats(t *testing.T) {
+	type floats struct {
+		Values []float64 `toml:"values"`
+	}
+	data, err := Marshal(floats{Values: []float64{math.Inf(1), math.Inf(-1), math.NaN()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "values = [inf, -inf, nan]\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	var out floats
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Values) != 3 || !math.IsInf(out.Values[0], 1) || !math.IsInf(out.Values[1], -1) || !math.IsNaN(out.Values[2]) {
+		t.Errorf("got %v", out.Values)
+	}
+}
+
+// A manifest survives Write and Load unchanged.
+func TestManifestRoundTrip(t *testing.T) {
+	in := &Manifest{
+		Version: Version,
+		Image: Image{
+			ID:           "pgsd-desktop",
+			Version:      "0.1.0",
+			ZpoolName:    "zroot",
+			RootDataset:  "ROOT/default",
+			Extends:      []string{"pgsd-base"},
+			PackageLists: []string{"base", "desktop"},
+			Overlays:     []string{"overlays/common"},
+		},
+		Build: Build{
+			Builder:        "pgsdbuild 0.1.0",
+			FreeBSDVersion: "15.0-RELEASE",
+			FreeBSDArch:    "amd64",
+			Date:           time.Unix(1740832210, 0).UTC(),
+		},
+		SBOM: SBOM{SPDX: "sbom.spdx.json"},
+		Artifacts: []Artifact{
+			{Path: "root.zfs", Size: 1 << 30, SHA256: strings.Repeat("ab", 32)},
+			{Path: "sbom.spdx.json", Size: 12, SHA256: strings.Repeat("cd", 32)},
+		},
+		Datasets: []Dataset{
+			{Name: "ROOT", Role: RoleContainer, CanMount: "off"},
+			{Name: "ROOT/default", Role: RoleRoot, Mountpoint: "/", Stream: "root.zfs"},
+		},
+		Packages: []Package{
+			{Name: "sudo", Version: "1.9.16", Origin: "security/sudo", Lists: []string{"base"}},
+			{Name: "gettext-runtime", Version: "0.22.5", Dependency: true},
+		},
+	}
+	path := t.TempDir() + "/" + FileName
+	if err := in.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got  %+v\nwant %+v", out, in)
+	}
+}
+
+// Parse accepts the TOML forms the encoder never writes.
+func TestParse(t *testing.T) {
+	doc, err := Parse([]byte(`# comment
+bare = 'literal \n'
+"quoted key" = "é\U0001F600"
+multi = """
+first \
+    second"""
+raw = '''
+a\b'''
+ints = [1_000, 0x1f, 0o17, 0b101, +7, -0]
+floats = [1.5, -2e3, 6.02E+23, inf, -nan]
+dates = [1979-05-27T07:32:00Z, 1979-05-27 07:32:00.5-07:00, 1979-05-27T07:32:00, 1979-05-27]
+trailing = [
+  "a", # comment
+  "b",
+]
+inline = { x = 1, y.z = "deep" }
+site."google.com" = true
+
+[a.b.c]
+n = 1
+
+[a]
+m = 2
+
+[[fruit]]
+name = "apple"
+[fruit.physical]
+color = "red"
+[[fruit.variety]]
+name = "red delicious"
+[[fruit]]
+name = "banana"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utc := time.Date(1979, 5, 27, 7, 32, 0, 0, time.UTC)
+	want := map[string]any{
+		"bare":       `literal \n`,
+		"quoted key": "é😀",
+		"multi":      "first second",
+		"raw":        `a\b`,
+		"ints":       []any{int64(1000), int64(31), int64(15), int64(5), int64(7), int64(0)},
+		"dates": []any{
+			utc,
+			time.Date(1979, 5, 27, 7, 32, 0, 5e8, time.FixedZone("", -7*3600)),
+			utc,
+			time.Date(1979, 5, 27, 0, 0, 0, 0, time.UTC),
+		},
+		"trailing": []any{"a", "b"},
+		"inline":   map[string]any{"x": int64(1), "y": map[string]any{"z": "deep"}},
+		"site":     map[string]any{"google.com": true},
+		"a":        map[string]any{"m": int64(2), "b": map[string]any{"c": map[string]any{"n": int64(1)}}},
+		"fruit": []any{
+			map[string]any{
+				"name":     "apple",
+				"physical": map[string]any{"color": "red"},
+				"variety":  []any{map[string]any{"name": "red delicious"}},
+			},
+			map[string]any{"name": "banana"},
+		},
+	}
+	floats, _ := doc["floats"].([]any)
+	delete(doc, "floats")
+	for k, v := range want {
+		got := doc[k]
+		if k == "dates" {
+			for i, d := range got.([]any) {
+				if !d.(time.Time).Equal(v.([]any)[i].(time.Time)) {
+					t.Errorf("dates[%d] = %v, want %v", i, d, v.([]any)[i])
+				}
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("%s = %#v, want %#v", k, got, v)
+		}
+	}
+	if len(doc) != len(want) {
+		t.Errorf("got %d keys, want %d", len(doc), len(want))
+	}
+	if len(floats) != 5 || floats[0] != 1.5 || floats[1] != -2e3 || floats[2] != 6.02e23 ||
+		!math.IsInf(floats[3].(float64), 1) || !math.IsNaN(floats[4].(float64)) {
+		t.Errorf("floats = %v", floats)
+	}
+}
+
+// Malformed documents are rejected with the line of the error.
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, doc, err string
+	}{
+		// Duplicate keys
+		{"duplicate key", "a = 1\na = 2", "line 2: key a defined twice"},
+		{"duplicate quoted key", "a = 1\n\"a\" = 2", "line 2: key a defined twice"},
+		{"duplicate dotted key", "a.b = 1\na.b = 2", "line 2: key a.b defined twice"},
+		{"duplicate inline key", "t = { x = 1, x = 2 }", "line 1: key x defined twice"},
+		{"duplicate key in table", "[t]\nx = 1\nx = 2", "line 3: key x defined twice"},
+		{"key over table", "[t.u]\n[t]\nu = 1", "line 3: key u defined twice"},
+		{"dotted key through value", "a = 1\na.b = 2", "line 2: a is not a table"},
+
+		// Table redefinition
+		{"table twice", "[t]\n[t]", "line 2: table t defined twice"},
+		{"subtable twice", "[t.u]\n[t]\n[t.u]", "line 3: table t.u defined twice"},
+		{"table over value", "t = 1\n[t]", "line 2: t is already defined as a value"},
+		{"table over inline table", "t = { x = 1 }\n[t]", "line 2: table t defined twice"},
+		{"table over dotted keys", "t.x = 1\n[t]", "line 2: table t defined twice"},
+		{"subtable over dotted keys", "[t]\nu.x = 1\n[t.u]", "line 3: table t.u defined twice"},
+		{"extend inline table", "t = { x = 1 }\nt.y = 2", "line 2: cannot extend inline table t"},
+		{"subtable of inline table", "t = { x = 1 }\n[t.u]", "line 2: cannot extend inline table t"},
+		{"header through value", "t = 1\n[t.u]", "line 2: t is not a table"},
+
+		// Arrays of tables and tables
+		{"array of tables after table", "[t]\n[[t]]", "line 2: t is not an array of tables"},
+		{"table after array of tables", "[[t]]\n[t]", "line 2: t is an array of tables"},
+		{"array of tables over array", "t = [1]\n[[t]]", "line 2: t is not an array of tables"},
+		{"table over static array", "t = [{ x = 1 }]\n[t]", "line 2: t is already defined as a value"},
+		{"subtable of static array", "t = [{ x = 1 }]\n[t.u]", "line 2: t is not a table"},
+
+		// Escapes
+		{"unknown escape", `s = "\q"`, `line 1: invalid escape \q`},
+		{"escaped space", `s = "\ "`, `line 1: invalid escape \ `},
+		{"bad unicode escape", `s = "\u12G4"`, `line 1: invalid unicode escape \u12G4`},
+		{"surrogate escape", `s = "\uD800"`, `line 1: invalid unicode escape \uD800`},
+		{"out of range escape", `s = "\U00110000"`, `line 1: invalid unicode escape \U00110000`},
+		{"short unicode escape", `s = "\u12`, "line 1: short unicode escape"},
+
+		// Unterminated constructs
+		{"unterminated string", "s = \"abc\nt = 1", "line 1: unterminated string"},
+		{"unterminated literal string", "s = 'abc", "line 1: unterminated string"},
+		{"unterminated multi-line string", "s = \"\"\"abc\n", "unterminated multi-line string"},
+		{"unterminated array", "a = [1, 2", "unterminated array"},
+		{"unterminated inline table", "t = { x = 1", "unterminated inline table"},
+		{"unterminated header", "[t\nx = 1", "line 1: unterminated table header"},
+		{"unterminated array header", "[[t]\nx = 1", "line 1: unterminated table header"},
+
+		// Keys and values
+		{"missing equals", "a 1", "line 1: expected '=' after key a"},
+		{"missing value", "a =", "line 1: missing value"},
+		{"trailing garbage", "a = 1 2", `line 1: unexpected '2' after value`},
+		{"leading zero", "a = 007", `line 1: invalid integer "007": leading zero`},
+		{"double underscore", "a = 1__0", `line 1: invalid number "1__0"`},
+		{"bad hex", "a = 0xZZ", `line 1: invalid integer "0xZZ"`},
+		{"bare word", "a = yes", `line 1: invalid value "yes"`},
+		{"invalid utf-8", "a = \"\xff\"", "document is not valid UTF-8"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.doc))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.HasPrefix(err.Error(), "toml: ") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Unmarshal reports values that do not fit their fields.
+func TestUnmarshalErrors(t *testing.T) {
+	var s sample
+	for _, tt := range []struct {
+		doc string
+		v   any
+		err string
+	}{
+		{`name = 1`, &s, "toml: name: cannot use integer as string"},
+		{`small = 128`, &s, "toml: small: 128 overflows int8"},
+		{`big = -1`, &s, "toml: big: -1 overflows uint64"},
+		{`tags = ["a", 2]`, &s, "toml: tags[1]: cannot use integer as string"},
+		{"[inner.deeper]\nn = 'x'", &s, "toml: inner.deeper.n: cannot use string as int"},
+		{"items = 1", &s, "toml: items: cannot use integer as []manifest.item"},
+		{`name = "x"`, s, "toml: cannot decode into manifest.sample, expected a pointer to a struct"},
+	} {
+		err := Unmarshal([]byte(tt.doc), tt.v)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got %v, want %q", tt.doc, err, tt.err)
+		}
+	}
+
+	if _, err := Marshal(struct{ N uint64 }{1 << 63}); err == nil || err.Error() != "toml: n: 9223372036854775808 does not fit a TOML integer" {
+		t.Errorf("got %v", err)
+	}
+	if _, err := Marshal(1); err == nil || err.Error() != "toml: cannot encode int, expected a struct" {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,489 @@
+// Package pipeline runs a build as a sequence of named stages. Each
+// completed stage leaves a marker in the work directory recording what it
+// was built from, so a failed or partial build can be resumed without
+// repeating finished work.
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/cache"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// markerDir is where completion markers are kept, relative to the work
+// directory of a build.
+const markerDir = ".stages"
+
+// Stage is one step of a build.
+type Stage struct {
+	Name string
+
+	// Inputs are files and directories the stage reads from outside the
+	// work directory. Their names, sizes and modification times are part
+	// of the stage fingerprint. Paths that do not exist are allowed.
+	Inputs []string
+
+	// Params are the recipe settings the stage depends on. They are
+	// encoded as JSON into the stage fingerprint.
+	Params any
+
+	// Outputs are files and directories the stage produces. A completed
+	// stage whose outputs have disappeared is run again.
+	Outputs []string
+
+	// Run performs the stage.
+	Run func(ctx context.Context) error
+
+	// Reopen restores host state a completed stage left behind, such as
+	// an attached disk or imported pool, when the build resumes after it.
+	Reopen func(ctx context.Context) error
+
+	// Cache is the directory holding everything this stage and the stages
+	// before it produced. When set and the pipeline has a cache, the
+	// directory is saved under the stage's cache key after the stage runs,
+	// and restored instead of running the stage when the key is found.
+	Cache string
+}
+
+// Options select which stages run.
+type Options struct {
+	Resume bool   // skip stages that completed with the same fingerprint
+	From   string // run from this stage; earlier stages must be complete
+	Until  string // stop after this stage
+	DryRun bool   // run stages but do not read or write markers
+
+	// Cache stores the output of stages with a Cache directory. nil
+	// disables caching.
+	Cache *cache.Store
+	Build string // recorded in cache entries, e.g. "iso/pgsd-bootenv-arcan"
+}
+
+// Pipeline is an ordered list of stages sharing a work directory.
+type Pipeline struct {
+	workDir string
+	stages  []Stage
+	logger  *util.Logger
+	keys    map[int]string // cache keys computed so far
+}
+
+// marker is the content of a completion marker.
+type marker struct {
+	Stage       string    `json:"stage"`
+	Fingerprint string    `json:"fingerprint"`
+	Completed   time.Time `json:"completed"`
+}
+
+// New creates an empty Pipeline that keeps its markers in workDir.
+func New(workDir string, logger *util.Logger) *Pipeline {
+	return &Pipeline{workDir: workDir, logger: logger}
+}
+
+// Add appends stages to the pipeline.
+func (p *Pipeline) Add(stages ...Stage) {
+	p.stages = append(p.stages, stages...)
+}
+
+// Names returns the stage names in order.
+func (p *Pipeline) Names() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Run runs the stages selected by opts. It returns false if the build
+// stopped early because of opts.Until, in which case the work directory
+// must be kept so the build can be continued.
+func (p *Pipeline) Run(ctx context.Context, opts Options) (bool, error) {
+	from, until, err := p.bounds(opts)
+	if err != nil {
+		return false, err
+	}
+
+	start := from
+	if !opts.DryRun {
+		switch {
+		case opts.From != "":
+			for i := 0; i < from; i++ {
+				if ok, reason := p.completed(p.stages[i]); !ok {
+					return false, fmt.Errorf("cannot start at stage %s: stage %s %s\nHint: Use --resume to run the missing stages first", opts.From, p.stages[i].Name, reason)
+				}
+			}
+		case opts.Resume:
+			for start < len(p.stages) {
+				ok, reason := p.completed(p.stages[start])
+				if !ok {
+					p.logger.Debug("Resuming at stage %s: %s", p.stages[start].Name, reason)
+					break
+				}
+				start++
+			}
+		}
+		// Everything from the first stage that runs is rebuilt
+		for i := start; i < len(p.stages); i++ {
+			if err := p.clearMarker(p.stages[i].Name); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if start > until {
+		p.logger.Info("Stages up to %s already complete, nothing to do", p.stages[until].Name)
+		return until == len(p.stages)-1, nil
+	}
+
+	for i := 0; i < start; i++ {
+		s := p.stages[i]
+		p.logger.Info("Stage %s: already complete", s.Name)
+		if s.Reopen != nil {
+			if err := s.Reopen(ctx); err != nil {
+				return false, fmt.Errorf("stage %s: failed to reopen: %w", s.Name, err)
+			}
+		}
+	}
+
+	useCache := opts.Cache != nil && !opts.DryRun
+	p.keys = make(map[int]string)
+	for i := start; i <= until; i++ {
+		s := p.stages[i]
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		if useCache && s.Cache != "" {
+			last, err := p.restore(ctx, opts.Cache, i, until)
+			if err != nil {
+				return false, err
+			}
+			if last >= i {
+				i = last
+				continue
+			}
+		}
+
+		p.logger.Info("Stage %d/%d: %s", i+1, len(p.stages), s.Name)
+		if err := s.Run(ctx); err != nil {
+			return false, err
+		}
+		if useCache && s.Cache != "" {
+			p.save(ctx, opts, i)
+		}
+		if opts.DryRun {
+			continue
+		}
+		if err := p.writeMarker(s); err != nil {
+			return false, err
+		}
+	}
+
+	if until < len(p.stages)-1 {
+		p.logger.Info("Stopped after stage %s; continue with --resume", p.stages[until].Name)
+		return false, nil
+	}
+	return true, nil
+}
+
+// restore looks up stage i and the cached stages directly following it, up
+// to until, and restores the last one found. A corrupt entry is removed and
+// the one before it is tried instead. It returns the index of the restored
+// stage, or -1 on a cache miss.
+func (p *Pipeline) restore(ctx context.Context, store *cache.Store, i, until int) (int, error) {
+	var found []*cache.Entry
+	for j := i; j <= until && p.stages[j].Cache != ""; j++ {
+		key, err := p.key(j)
+		if err != nil {
+			p.logger.Debug("Stage %s: no cache key: %v", p.stages[j].Name, err)
+			break
+		}
+		e := store.Lookup(key)
+		if e == nil {
+			break
+		}
+		found = append(found, e)
+	}
+
+	for n := len(found) - 1; n >= 0; n-- {
+		last, entry := i+n, found[n]
+		dir := p.stages[last].Cache
+		p.logger.Debug("Restoring cache entry %s into %s", cache.ShortKey(entry.Key), dir)
+		if err := util.CleanupDirWithin(p.workDir, dir); err != nil {
+			return -1, err
+		}
+		err := store.Restore(ctx, entry, dir)
+		if errors.Is(err, cache.ErrCorrupt) {
+			p.logger.Warn("Stage %s: %v, removing it", p.stages[last].Name, err)
+			if err := store.Remove(entry); err != nil {
+				p.logger.Warn("Failed to remove cache entry: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			return -1, fmt.Errorf("stage %s: %w", p.stages[last].Name, err)
+		}
+
+		for j := i; j <= last; j++ {
+			p.logger.Info("Stage %d/%d: %s restored from cache", j+1, len(p.stages), p.stages[j].Name)
+			if err := p.writeMarker(p.stages[j]); err != nil {
+				return -1, err
+			}
+		}
+		return last, nil
+	}
+	return -1, nil
+}
+
+// save stores the cache directory of stage i after it ran. The key is
+// computed again because the stage may have created its own inputs, such
+// as downloaded archives. Failures only cost the next build time, so they
+// are logged and the build goes on.
+func (p *Pipeline) save(ctx context.Context, opts Options, i int) {
+	s := p.stages[i]
+	for j := range p.keys {
+		if j >= i {
+			delete(p.keys, j)
+		}
+	}
+	key, err := p.key(i)
+	if err == nil {
+		_, err = opts.Cache.Save(ctx, key, s.Name, opts.Build, s.Cache)
+	}
+	if err != nil && ctx.Err() == nil {
+		p.logger.Warn("Stage %s: not cached: %v", s.Name, err)
+	}
+}
+
+// key returns the cache key of stage i: a hash of the stage's parameters,
+// the content of its inputs and the key of the stage before it, so a key
+// covers everything that led up to the stage.
+func (p *Pipeline) key(i int) (string, error) {
+	if k, ok := p.keys[i]; ok {
+		return k, nil
+	}
+	prev := ""
+	if i > 0 {
+		var err error
+		if prev, err = p.key(i - 1); err != nil {
+			return "", err
+		}
+	}
+	k, err := ContentKey(p.stages[i], prev)
+	if err != nil {
+		return "", err
+	}
+	p.keys[i] = k
+	return k, nil
+}
+
+// bounds resolves opts.From and opts.Until to stage indexes.
+func (p *Pipeline) bounds(opts Options) (from, until int, err error) {
+	from, until = 0, len(p.stages)-1
+	if opts.From != "" {
+		if from = p.index(opts.From); from < 0 {
+			return 0, 0, p.unknown(opts.From)
+		}
+	}
+	if opts.Until != "" {
+		if until = p.index(opts.Until); until < 0 {
+			return 0, 0, p.unknown(opts.Until)
+		}
+	}
+	if from > until {
+		return 0, 0, fmt.Errorf("stage %s comes after stage %s", opts.From, opts.Until)
+	}
+	return from, until, nil
+}
+
+func (p *Pipeline) index(name string) int {
+	for i, s := range p.stages {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Pipeline) unknown(name string) error {
+	return fmt.Errorf("unknown stage %q (stages: %s)", name, strings.Join(p.Names(), ", "))
+}
+
+// completed reports whether s has a marker matching its current
+// fingerprint and all its outputs exist. If not, reason says why.
+func (p *Pipeline) completed(s Stage) (bool, string) {
+	data, err := os.ReadFile(p.markerPath(s.Name))
+	if err != nil {
+		return false, "has not completed"
+	}
+	var m marker
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, "has an unreadable marker"
+	}
+	fp, err := Fingerprint(s)
+	if err != nil {
+		return false, fmt.Sprintf("cannot be fingerprinted: %v", err)
+	}
+	if fp != m.Fingerprint {
+		return false, "has changed inputs"
+	}
+	for _, out := range s.Outputs {
+		if _, err := os.Stat(out); err != nil {
+			return false, fmt.Sprintf("is missing output %s", out)
+		}
+	}
+	return true, ""
+}
+
+func (p *Pipeline) markerPath(name string) string {
+	return filepath.Join(p.workDir, markerDir, name+".done")
+}
+
+func (p *Pipeline) writeMarker(s Stage) error {
+	fp, err := Fingerprint(s)
+	if err != nil {
+		return fmt.Errorf("stage %s: %w", s.Name, err)
+	}
+	data, err := json.MarshalIndent(marker{Stage: s.Name, Fingerprint: fp, Completed: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.EnsureDir(filepath.Join(p.workDir, markerDir)); err != nil {
+		return err
+	}
+	return util.WriteStringToFile(p.markerPath(s.Name), string(data)+"\n", 0644)
+}
+
+func (p *Pipeline) clearMarker(name string) error {
+	if err := os.Remove(p.markerPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear marker for stage %s: %w", name, err)
+	}
+	return nil
+}
+
+// ContentKey hashes a stage's name, parameters, the content of its inputs
+// and prev, the key of the previous stage. Unlike Fingerprint it reads every
+// input file, so it only changes when content does.
+func ContentKey(s Stage, prev string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "pgsdbuild stage cache v1\nprev %s\nstage %s\n", prev, s.Name)
+
+	params, err := json.Marshal(s.Params)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode parameters: %w", err)
+	}
+	fmt.Fprintf(h, "params %s\n", params)
+
+	for i, input := range s.Inputs {
+		// A stage whose inputs are not there yet (archives that are
+		// fetched by the stage itself) cannot be looked up
+		if _, err := os.Lstat(input); err != nil {
+			return "", fmt.Errorf("input %s: %w", input, err)
+		}
+		// Inputs are hashed relative to their root so moving a checkout
+		// does not change the key
+		fmt.Fprintf(h, "input %d\n", i)
+		err := filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(input, path)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "link %s %s\n", rel, target)
+			case d.IsDir():
+				fmt.Fprintf(h, "dir %s %s\n", rel, info.Mode())
+			case info.Mode().IsRegular():
+				sum, err := hashFile(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "file %s %s %s\n", rel, info.Mode(), sum)
+			default:
+				fmt.Fprintf(h, "other %s %s\n", rel, info.Mode())
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("cannot read input %s: %w", input, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Fingerprint hashes a stage's name, parameters and the metadata of its
+// inputs.
+func Fingerprint(s Stage) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "stage %s\n", s.Name)
+
+	params, err := json.Marshal(s.Params)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode parameters: %w", err)
+	}
+	fmt.Fprintf(h, "params %s\n", params)
+
+	for _, input := range s.Inputs {
+		info, err := os.Stat(input)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(h, "missing %s\n", input)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			fmt.Fprintf(h, "file %s %d %d\n", input, info.Size(), info.ModTime().UnixNano())
+			continue
+		}
+		err = filepath.WalkDir(input, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "entry %s %s %d %d\n", path, info.Mode(), info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("cannot read input %s: %w", input, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,362 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+var testLogger = util.NewLogger(io.Discard, util.LevelError, false, "")
+
+var stageNames = []string{"fetch", "extract", "build", "pack"}
+
+// fixture builds pipelines of stub stages that write <name>.out to a
+// temporary work directory and record what they did.
+type fixture struct {
+	work   string
+	input  string            // read by fetch
+	params map[string]string // Params of each stage
+	fail   string            // stage whose Run fails
+	log    []string          // "run <stage>" and "reopen <stage>" in order
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	f := &fixture{work: t.TempDir(), params: map[string]string{}}
+	f.input = filepath.Join(t.TempDir(), "sources.txt")
+	if err := os.WriteFile(f.input, []byte("v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fixture) output(name string) string {
+	return filepath.Join(f.work, name+".out")
+}
+
+func (f *fixture) pipeline() *Pipeline {
+	p := New(f.work, testLogger)
+	for _, name := range stageNames {
+		s := Stage{
+			Name:    name,
+			Params:  f.params[name],
+			Outputs: []string{f.output(name)},
+			Run: func(ctx context.Context) error {
+				f.log = append(f.log, "run "+name)
+				if f.fail == name {
+					return errors.New(name + " failed")
+				}
+				return os.WriteFile(f.output(name), []byte(name+"\n"), 0644)
+			},
+			Reopen: func(ctx context.Context) error {
+				f.log = append(f.log, "reopen "+name)
+				return nil
+			},
+		}
+		if name == "fetch" {
+			s.Inputs = []string{f.input}
+		}
+		p.Add(s)
+	}
+	return p
+}
+
+// markers returns the stages that have a completion marker, in order.
+func (f *fixture) markers() []string {
+	var done []string
+	for _, name := range stageNames {
+		if _, err := os.Stat(filepath.Join(f.work, markerDir, name+".done")); err == nil {
+			done = append(done, name)
+		}
+	}
+	return done
+}
+
+// Which stages run, and which markers are left, for each way of resuming
+// or restricting a build after an earlier one.
+func TestRun(t *testing.T) {
+	all := []string{"fetch", "extract", "build", "pack"}
+	tests := []struct {
+		name    string
+		before  *Options                   // an earlier build, if any
+		change  func(*testing.T, *fixture) // applied between the builds
+		opts    Options                    // the build under test
+		log     []string                   // what it did
+		done    bool                       // whether it reported the build complete
+		err     string
+		markers []string
+	}{
+		{
+			name:    "fresh",
+			log:     []string{"run fetch", "run extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "without resume everything reruns",
+			before:  &Options{},
+			log:     []string{"run fetch", "run extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "resume complete build",
+			before:  &Options{},
+			opts:    Options{Resume: true},
+			log:     []string{},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "resume after until",
+			before:  &Options{Until: "extract"},
+			opts:    Options{Resume: true},
+			log:     []string{"reopen fetch", "reopen extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "resume after failure",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { f.params["build"] = "-O2"; f.fail = "pack" },
+			opts:    Options{Resume: true},
+			log:     []string{"reopen fetch", "reopen extract", "run build", "run pack"},
+			err:     "pack failed",
+			markers: []string{"fetch", "extract", "build"},
+		},
+		{
+			name:    "changed parameters",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { f.params["build"] = "-O2" },
+			opts:    Options{Resume: true},
+			log:     []string{"reopen fetch", "reopen extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:   "changed input",
+			before: &Options{},
+			change: func(t *testing.T, f *fixture) {
+				if err := os.WriteFile(f.input, []byte("v2 with more\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			opts:    Options{Resume: true},
+			log:     []string{"run fetch", "run extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "missing output",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { os.Remove(f.output("extract")) },
+			opts:    Options{Resume: true},
+			log:     []string{"reopen fetch", "run extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			// Stages after the first one that reruns lose their markers
+			// even though this build stops before them
+			name:    "invalidated stages after until",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { f.params["extract"] = "--strip" },
+			opts:    Options{Resume: true, Until: "extract"},
+			log:     []string{"reopen fetch", "run extract"},
+			markers: []string{"fetch", "extract"},
+		},
+		{
+			name:    "failed stage is not marked",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { f.params["extract"] = "--strip"; f.fail = "build" },
+			opts:    Options{Resume: true},
+			log:     []string{"reopen fetch", "run extract", "run build"},
+			err:     "build failed",
+			markers: []string{"fetch", "extract"},
+		},
+		{
+			name:    "until",
+			opts:    Options{Until: "extract"},
+			log:     []string{"run fetch", "run extract"},
+			markers: []string{"fetch", "extract"},
+		},
+		{
+			name:    "resume up to completed stage",
+			before:  &Options{},
+			opts:    Options{Resume: true, Until: "build"},
+			log:     []string{},
+			markers: all,
+		},
+		{
+			name:    "from",
+			before:  &Options{},
+			opts:    Options{From: "build"},
+			log:     []string{"reopen fetch", "reopen extract", "run build", "run pack"},
+			done:    true,
+			markers: all,
+		},
+		{
+			name:    "from and until",
+			before:  &Options{},
+			opts:    Options{From: "extract", Until: "build"},
+			log:     []string{"reopen fetch", "run extract", "run build"},
+			markers: []string{"fetch", "extract", "build"},
+		},
+		{
+			name:    "from incomplete stage",
+			before:  &Options{Until: "fetch"},
+			opts:    Options{From: "build"},
+			log:     []string{},
+			err:     "cannot start at stage build: stage extract has not completed",
+			markers: []string{"fetch"},
+		},
+		{
+			name:    "from changed stage",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { f.params["fetch"] = "mirror" },
+			opts:    Options{From: "build"},
+			log:     []string{},
+			err:     "stage fetch has changed inputs",
+			markers: all,
+		},
+		{
+			name:    "from stage with missing output",
+			before:  &Options{},
+			change:  func(t *testing.T, f *fixture) { os.Remove(f.output("extract")) },
+			opts:    Options{From: "pack"},
+			log:     []string{},
+			err:     "stage extract is missing output",
+			markers: all,
+		},
+		{
+			name: "from after until",
+			opts: Options{From: "pack", Until: "fetch"},
+			log:  []string{},
+			err:  "stage pack comes after stage fetch",
+		},
+		{
+			name: "unknown stage",
+			opts: Options{Until: "install"},
+			log:  []string{},
+			err:  `unknown stage "install" (stages: fetch, extract, build, pack)`,
+		},
+		{
+			name:   "dry run leaves markers alone",
+			before: &Options{Until: "extract"},
+			opts:   Options{DryRun: true, Resume: true},
+			log:    []string{"run fetch", "run extract", "run build", "run pack"},
+			done:   true,
+			// The dry run neither clears nor writes markers
+			markers: []string{"fetch", "extract"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture(t)
+			if tt.before != nil {
+				if _, err := f.pipeline().Run(context.Background(), *tt.before); err != nil {
+					t.Fatalf("earlier build: %v", err)
+				}
+			}
+			if tt.change != nil {
+				tt.change(t, f)
+			}
+
+			f.log = []string{}
+			done, err := f.pipeline().Run(context.Background(), tt.opts)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			if done != tt.done {
+				t.Errorf("done = %v, want %v", done, tt.done)
+			}
+			if !reflect.DeepEqual(f.log, tt.log) {
+				t.Errorf("log = %q, want %q", f.log, tt.log)
+			}
+			if got := f.markers(); !reflect.DeepEqual(got, tt.markers) {
+				t.Errorf("markers = %v, want %v", got, tt.markers)
+			}
+		})
+	}
+}
+
+// A stage is complete only with a readable marker matching its current
+// fingerprint and all of its outputs.
+func TestCompleted(t *testing.T) {
+	f := newFixture(t)
+	p := f.pipeline()
+	if _, err := p.Run(context.Background(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	fetch := p.stages[0]
+	if ok, reason := p.completed(fetch); !ok {
+		t.Fatalf("fetch is not complete: %s", reason)
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		reason string
+	}{
+		{
+			name: "unreadable marker",
+			change: func(t *testing.T) {
+				if err := os.WriteFile(p.markerPath("fetch"), []byte("{"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "has an unreadable marker",
+		},
+		{
+			name: "no marker",
+			change: func(t *testing.T) {
+				if err := os.Remove(p.markerPath("fetch")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "has not completed",
+		},
+		{
+			name: "removed input",
+			change: func(t *testing.T) {
+				if err := os.Remove(f.input); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "has changed inputs",
+		},
+		{
+			name: "missing output",
+			change: func(t *testing.T) {
+				if err := os.Remove(f.output("fetch")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "is missing output " + f.output("fetch"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.writeMarker(fetch); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(f.output("fetch"), []byte("fetch\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t)
+			if ok, reason := p.completed(fetch); ok || reason != tt.reason {
+				t.Errorf("completed = %v, %q; want false, %q", ok, reason, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+// Package pkginstall installs packages into an image or ISO root with
+// pkg(8), using a repository configuration generated from the recipe.
+package pkginstall
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// Installation modes.
+const (
+	ModeRootDir = "rootdir" // pkg -r <root>: run the host pkg against the root
+	ModeChroot  = "chroot"  // pkg -c <root>: run pkg inside the root
+)
+
+// chrootReposDir is where repository files are written for chroot mode,
+// relative to the root.
+const chrootReposDir = "var/cache/pgsdbuild/repos"
+
+// DefaultRepositories are used when a recipe declares no repositories:
+// the ports tree, and the base system packages (FreeBSD-kernel-generic,
+// FreeBSD-runtime, ...) that images get their base system from. Both are
+// configured as in FreeBSD's own /etc/pkg/FreeBSD.conf.
+var DefaultRepositories = []config.Repository{
+	{
+		Name:          "FreeBSD",
+		URL:           "pkg+https://pkg.FreeBSD.org/${ABI}/quarterly",
+		MirrorType:    "srv",
+		SignatureType: "fingerprints",
+		Fingerprints:  "/usr/share/keys/pkg",
+	},
+	{
+		Name:          "FreeBSD-base",
+		URL:           "pkg+https://pkg.FreeBSD.org/${ABI}/base_release_${VERSION_MINOR}",
+		MirrorType:    "srv",
+		SignatureType: "fingerprints",
+		Fingerprints:  "/usr/share/keys/pkgbase-${VERSION_MAJOR}",
+	},
+}
+
+// missingPattern matches pkg's report of a package that no repository has.
+var missingPattern = regexp.MustCompile(`No packages available to install matching '([^']+)'`)
+
+// InstalledPackage is a package recorded in the root's package database.
+type InstalledPackage struct {
+	Name    string
+	Version string
+	Origin  string // ports origin, e.g. "x11/arcan"
+
+	Licenses     []string // as named by the port, e.g. "BSD2CLAUSE"
+	LicenseLogic string   // how Licenses combine: "single", "and" or "or"
+	Checksum     string   // SHA-256 recorded by pkg
+}
+
+// Installer runs pkg(8) against a target root.
+type Installer struct {
+	Root         string
+	Mode         string
+	Repositories []config.Repository
+	WorkDir      string // where repository configuration is written in rootdir mode
+	Exec         executor.Executor
+	logger       *util.Logger
+}
+
+// New creates an Installer for root that runs pkg with x. If repos is empty
+// the default FreeBSD repositories are used.
+func New(x executor.Executor, root, workDir string, pc config.PkgConfig, logger *util.Logger) *Installer {
+	mode := pc.Mode
+	if mode == "" {
+		mode = ModeRootDir
+	}
+	repos := pc.Repositories
+	if len(repos) == 0 {
+		repos = DefaultRepositories
+	}
+	return &Installer{
+		Root:         root,
+		Mode:         mode,
+		Repositories: repos,
+		WorkDir:      workDir,
+		Exec:         x,
+		logger:       logger,
+	}
+}
+
+// OverrideRepository replaces the configured repositories with a single
+// repository at url. This is how builds are pointed at a local file://
+// mirror when working air-gapped, so the mirror must serve the packages of
+// every repository it replaces, including the FreeBSD-base packages of the
+// defaults. Local repositories are used unsigned, as pkg repo creates them.
+// A remote mirror is checked with the signature settings of the
+// repositories it replaces, which must therefore all be signed alike.
+func (i *Installer) OverrideRepository(url string) error {
+	replaced := i.Repositories
+	r := config.Repository{Name: "override", URL: url, SignatureType: "none"}
+	if !strings.HasPrefix(url, "file://") {
+		for _, o := range replaced[1:] {
+			if o.SignatureType != replaced[0].SignatureType || o.Fingerprints != replaced[0].Fingerprints || o.PubKey != replaced[0].PubKey {
+				return fmt.Errorf("package repository %s replaces repositories with different signing keys (%s)\nHint: Declare the mirror's repositories in the recipe's pkg block instead",
+					url, i.repositoryNames())
+			}
+		}
+		r.SignatureType = replaced[0].SignatureType
+		r.Fingerprints = replaced[0].Fingerprints
+		r.PubKey = replaced[0].PubKey
+		if strings.HasPrefix(url, "pkg+") {
+			r.MirrorType = "srv"
+		}
+		if r.SignatureType == "" || r.SignatureType == "none" {
+			i.logger.Warn("Package repository %s is not signature-checked", url)
+		}
+	}
+	if len(replaced) > 1 {
+		i.logger.Warn("Package repository %s replaces %s and must provide the packages of all of them", url, i.repositoryNames())
+	}
+	i.Repositories = []config.Repository{r}
+	return nil
+}
+
+// Available reports whether pkg(8) can be run with x.
+func Available(x executor.Executor) bool {
+	_, err := x.LookPath("pkg")
+	return err == nil
+}
+
+// Install installs packages into the root. Packages that no repository
+// provides are reported together in a single error.
+func (i *Installer) Install(ctx context.Context, packages []string) error {
+	if len(packages) == 0 {
+		return nil
+	}
+	if err := i.checkRepositories(); err != nil {
+		return err
+	}
+
+	reposDir, err := i.writeRepoConfig()
+	if err != nil {
+		return err
+	}
+
+	args := append(i.globalArgs(reposDir), "install", "-y")
+	args = append(args, packages...)
+	i.logger.Debug("Running: pkg %s", strings.Join(args, " "))
+
+	cmd := executor.Cmd("pkg", args...)
+	cmd.Env = []string{"ASSUME_ALWAYS_YES=yes", "IGNORE_OSVERSION=yes"}
+	output, err := i.Exec.Run(ctx, cmd)
+	if err != nil {
+		if missing := missingPackages(output); len(missing) > 0 {
+			return fmt.Errorf("packages not found in any repository (%s): %s",
+				i.repositoryNames(), strings.Join(missing, ", "))
+		}
+		return fmt.Errorf("pkg install failed: %w\nOutput: %s", err, output)
+	}
+
+	i.logger.Info("Installed %d packages into %s", len(packages), i.Root)
+	return nil
+}
+
+// Query returns every package in the root's package database, sorted by name.
+func (i *Installer) Query(ctx context.Context) ([]InstalledPackage, error) {
+	lines, err := i.query(ctx, "%n\t%v\t%o\t%l\t%X")
+	if err != nil {
+		return nil, err
+	}
+	var installed []InstalledPackage
+	byName := make(map[string]int)
+	for _, fields := range lines {
+		if len(fields) < 3 {
+			continue
+		}
+		p := InstalledPackage{Name: fields[0], Version: fields[1], Origin: fields[2]}
+		if len(fields) >= 5 {
+			p.LicenseLogic, p.Checksum = fields[3], fields[4]
+		}
+		byName[p.Name] = len(installed)
+		installed = append(installed, p)
+	}
+
+	// %L prints one line per license
+	lines, err = i.query(ctx, "%n\t%L")
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range lines {
+		if n, ok := byName[fields[0]]; ok && len(fields) == 2 && fields[1] != "" {
+			installed[n].Licenses = append(installed[n].Licenses, fields[1])
+		}
+	}
+
+	sort.Slice(installed, func(a, b int) bool { return installed[a].Name < installed[b].Name })
+	return installed, nil
+}
+
+// query runs pkg query -a with format and splits its output into lines of
+// tab-separated fields.
+func (i *Installer) query(ctx context.Context, format string) ([][]string, error) {
+	args := append(i.rootArgs(), "query", "-a", format)
+	var stdout bytes.Buffer
+	cmd := executor.Cmd("pkg", args...)
+	cmd.Stdout = &stdout
+	if stderr, err := i.Exec.Run(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("pkg query failed: %w\nOutput: %s", err, stderr)
+	}
+	var lines [][]string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" {
+			lines = append(lines, strings.Split(line, "\t"))
+		}
+	}
+	return lines, nil
+}
+
+// rootArgs selects the target root.
+func (i *Installer) rootArgs() []string {
+	if i.Mode == ModeChroot {
+		return []string{"-c", i.Root}
+	}
+	return []string{"-r", i.Root}
+}
+
+// globalArgs returns the pkg options that select the root and repositories.
+func (i *Installer) globalArgs(reposDir string) []string {
+	return append(i.rootArgs(), "-R", reposDir)
+}
+
+// writeRepoConfig writes one pkg.conf(5) repository file per repository and
+// returns the directory to pass to pkg -R. In chroot mode the directory is
+// inside the root and the returned path is relative to it.
+func (i *Installer) writeRepoConfig() (string, error) {
+	base := i.WorkDir
+	dir := filepath.Join(i.WorkDir, "pkg-repos")
+	pkgPath := dir
+	if i.Mode == ModeChroot {
+		base = i.Root
+		dir = filepath.Join(i.Root, chrootReposDir)
+		pkgPath = "/" + chrootReposDir
+	}
+
+	if err := util.CleanupDirWithin(base, dir); err != nil {
+		return "", err
+	}
+	if err := util.EnsureDir(dir); err != nil {
+		return "", err
+	}
+
+	for _, r := range i.Repositories {
+		path := filepath.Join(dir, r.Name+".conf")
+		if err := util.WriteStringToFile(path, formatRepository(r), 0644); err != nil {
+			return "", fmt.Errorf("failed to write repository %s: %w", r.Name, err)
+		}
+		i.logger.Debug("Configured repository %s: %s", r.Name, r.URL)
+	}
+	return pkgPath, nil
+}
+
+// checkRepositories verifies that local repositories exist before pkg is run,
+// so an air-gapped build fails with a clear message.
+func (i *Installer) checkRepositories() error {
+	for _, r := range i.Repositories {
+		path, ok := strings.CutPrefix(r.URL, "file://")
+		if !ok {
+			continue
+		}
+		if !util.DirExists(path) {
+			return fmt.Errorf("repository %s: local repository %s does not exist", r.Name, path)
+		}
+		if !util.FileExists(filepath.Join(path, "meta.conf")) && !util.FileExists(filepath.Join(path, "packagesite.pkg")) &&
+			!util.FileExists(filepath.Join(path, "packagesite.txz")) {
+			return fmt.Errorf("repository %s: %s is not a pkg repository (no meta.conf or packagesite)\nHint: Create it with 'pkg repo %s'", r.Name, path, path)
+		}
+	}
+	return nil
+}
+
+// repositoryNames lists the configured repositories for error messages.
+func (i *Installer) repositoryNames() string {
+	names := make([]string, len(i.Repositories))
+	for n, r := range i.Repositories {
+		names[n] = r.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatRepository renders a repository in pkg.conf(5) syntax.
+func formatRepository(r config.Repository) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s: {\n", r.Name))
+	sb.WriteString(fmt.Sprintf("  url: %q,\n", r.URL))
+	if r.MirrorType != "" {
+		sb.WriteString(fmt.Sprintf("  mirror_type: %q,\n", r.MirrorType))
+	}
+	signature := r.SignatureType
+	if signature == "" {
+		signature = "none"
+	}
+	sb.WriteString(fmt.Sprintf("  signature_type: %q,\n", signature))
+	if r.Fingerprints != "" {
+		sb.WriteString(fmt.Sprintf("  fingerprints: %q,\n", r.Fingerprints))
+	}
+	if r.PubKey != "" {
+		sb.WriteString(fmt.Sprintf("  pubkey: %q,\n", r.PubKey))
+	}
+	if r.Priority != 0 {
+		sb.WriteString(fmt.Sprintf("  priority: %d,\n", r.Priority))
+	}
+	sb.WriteString("  enabled: yes\n")
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// missingPackages extracts the names pkg could not find from its output.
+func missingPackages(output []byte) []string {
+	var missing []string
+	for _, m := range missingPattern.FindAllSubmatch(output, -1) {
+		missing = append(missing, string(m[1]))
+	}
+	return missing
+}
@@ -0,0 +1,222 @@
+package pkginstall
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pgsdf/pgsdbuild/internal/config"
+	"github.com/pgsdf/pgsdbuild/internal/executor"
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+var testLogger = util.NewLogger(io.Discard, util.LevelError, false, "")
+
+// newInstaller returns an Installer for a temporary root that runs the
+// commands in rec.
+func newInstaller(t *testing.T, pc config.PkgConfig, rec *executor.Recording) (*Installer, *executor.Replayer) {
+	t.Helper()
+	x := executor.NewReplayer(rec)
+	return New(x, t.TempDir(), t.TempDir(), pc, testLogger), x
+}
+
+// The override replaces every repository with one, keeping the signature
+// settings only when all replaced repositories share them.
+func TestOverrideRepository(t *testing.T) {
+	signed := config.Repository{Name: "ports", URL: "https://pkg.example.org/ports", SignatureType: "pubkey", PubKey: "/keys/pgsd.pub"}
+	tests := []struct {
+		name  string
+		repos []config.Repository
+		url   string
+		want  config.Repository
+		err   string
+	}{
+		{
+			name: "local",
+			url:  "file:///srv/pkg",
+			want: config.Repository{Name: "override", URL: "file:///srv/pkg", SignatureType: "none"},
+		},
+		{
+			name:  "remote",
+			repos: []config.Repository{signed},
+			url:   "pkg+https://mirror.example.org/pkg",
+			want: config.Repository{Name: "override", URL: "pkg+https://mirror.example.org/pkg", MirrorType: "srv",
+				SignatureType: "pubkey", PubKey: "/keys/pgsd.pub"},
+		},
+		{
+			name:  "remote same keys",
+			repos: []config.Repository{signed, {Name: "extra", URL: "https://pkg.example.org/extra", SignatureType: "pubkey", PubKey: "/keys/pgsd.pub"}},
+			url:   "https://mirror.example.org/pkg",
+			want:  config.Repository{Name: "override", URL: "https://mirror.example.org/pkg", SignatureType: "pubkey", PubKey: "/keys/pgsd.pub"},
+		},
+		{
+			// FreeBSD and FreeBSD-base are signed with different keys
+			name: "remote defaults",
+			url:  "pkg+https://mirror.example.org/pkg",
+			err:  "replaces repositories with different signing keys (FreeBSD, FreeBSD-base)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, _ := newInstaller(t, config.PkgConfig{Repositories: tt.repos}, &executor.Recording{})
+			before := i.Repositories
+			err := i.OverrideRepository(tt.url)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				if !reflect.DeepEqual(i.Repositories, before) {
+					t.Errorf("repositories changed on error: %+v", i.Repositories)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []config.Repository{tt.want}; !reflect.DeepEqual(i.Repositories, want) {
+				t.Errorf("repositories = %+v, want %+v", i.Repositories, want)
+			}
+		})
+	}
+}
+
+// Install writes one pkg.conf file per repository and passes their
+// directory to pkg -R.
+func TestInstall(t *testing.T) {
+	i, x := newInstaller(t, config.PkgConfig{}, &executor.Recording{Commands: []executor.Entry{
+		{Argv: [][]string{{"pkg", "-r", "*", "-R", "*", "install", "-y", "sudo", "zsh"}}},
+	}})
+	if err := i.Install(context.Background(), []string{"sudo", "zsh"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Done(); err != nil {
+		t.Error(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(i.WorkDir, "pkg-repos", "FreeBSD-base.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `FreeBSD-base: {
+  url: "pkg+https://pkg.FreeBSD.org/${ABI}/base_release_${VERSION_MINOR}",
+  mirror_type: "srv",
+  signature_type: "fingerprints",
+  fingerprints: "/usr/share/keys/pkgbase-${VERSION_MAJOR}",
+  enabled: yes
+}
+`
+	if string(data) != want {
+		t.Errorf("FreeBSD-base.conf =\n%s\nwant\n%s", data, want)
+	}
+	if _, err := os.Stat(filepath.Join(i.WorkDir, "pkg-repos", "FreeBSD.conf")); err != nil {
+		t.Error(err)
+	}
+}
+
+// In chroot mode the repository files are written inside the root and pkg
+// is given their path as seen from it.
+func TestInstallChroot(t *testing.T) {
+	i, x := newInstaller(t, config.PkgConfig{Mode: ModeChroot}, &executor.Recording{Commands: []executor.Entry{
+		{Argv: [][]string{{"pkg", "-c", "*", "-R", "/" + chrootReposDir, "install", "-y", "sudo"}}},
+	}})
+	if err := i.Install(context.Background(), []string{"sudo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Done(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(i.Root, chrootReposDir, "FreeBSD.conf")); err != nil {
+		t.Error(err)
+	}
+}
+
+// Packages that pkg cannot find are listed together with the repositories
+// that were searched.
+func TestInstallMissing(t *testing.T) {
+	i, _ := newInstaller(t, config.PkgConfig{}, &executor.Recording{Commands: []executor.Entry{
+		{
+			Argv:     [][]string{{"pkg", "**"}},
+			ExitCode: 1,
+			Output: "pkg: No packages available to install matching 'zsh' have been found in the repositories\n" +
+				"pkg: No packages available to install matching 'fish' have been found in the repositories\n",
+		},
+	}})
+	err := i.Install(context.Background(), []string{"sudo", "zsh", "fish"})
+	want := "packages not found in any repository (FreeBSD, FreeBSD-base): zsh, fish"
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+// A local repository is checked before pkg runs.
+func TestInstallLocalRepository(t *testing.T) {
+	repo := t.TempDir()
+	tests := []struct {
+		name  string
+		files []string
+		err   string
+	}{
+		{name: "missing", err: "does not exist"},
+		{name: "empty", files: []string{}, err: "is not a pkg repository"},
+		{name: "meta.conf", files: []string{"meta.conf"}},
+		{name: "packagesite", files: []string{"packagesite.pkg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(repo, tt.name)
+			if tt.files != nil {
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, f := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			i, _ := newInstaller(t, config.PkgConfig{}, &executor.Recording{Commands: []executor.Entry{
+				{Argv: [][]string{{"pkg", "**"}}},
+			}})
+			if err := i.OverrideRepository("file://" + dir); err != nil {
+				t.Fatal(err)
+			}
+			err := i.Install(context.Background(), []string{"sudo"})
+			if tt.err == "" {
+				if err != nil {
+					t.Error(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// Query joins the package fields with their licenses and sorts by name.
+func TestQuery(t *testing.T) {
+	i, _ := newInstaller(t, config.PkgConfig{}, &executor.Recording{Commands: []executor.Entry{
+		{
+			Argv:   [][]string{{"pkg", "-r", "*", "query", "-a", "%n\t%v\t%o\t%l\t%X"}},
+			Stdout: "zsh\t5.9_6\tshells/zsh\tsingle\tbbbb\ngettext-runtime\t0.22.5\tdevel/gettext-runtime\tor\taaaa\n",
+		},
+		{
+			Argv:   [][]string{{"pkg", "-r", "*", "query", "-a", "%n\t%L"}},
+			Stdout: "gettext-runtime\tGPLv3+\ngettext-runtime\tLGPL21\nzsh\tMIT\n",
+		},
+	}})
+	got, err := i.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []InstalledPackage{
+		{Name: "gettext-runtime", Version: "0.22.5", Origin: "devel/gettext-runtime", Licenses: []string{"GPLv3+", "LGPL21"}, LicenseLogic: "or", Checksum: "aaaa"},
+		{Name: "zsh", Version: "5.9_6", Origin: "shells/zsh", Licenses: []string{"MIT"}, LicenseLogic: "single", Checksum: "bbbb"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Query = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,256 @@
+// Package pkglist reads package list files and resolves the pkg_lists of a
+// recipe into a flat, deduplicated set of package names.
+//
+// A package list lives at <dir>/<name>.txt and contains one package per
+// line. Blank lines and comments (starting with '#') are ignored. Directives
+// start with '@':
+//
+//	@include desktop/arcan      # expand another list in place
+//	@if arch=amd64,i386         # following lines only apply on these arches
+//	gpu-firmware-intel-kmod
+//	@endif
+//	@if arch!=aarch64           # or on every arch except these
+//	...
+//	@endif
+//
+// Conditionals may be nested.
+package pkglist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Ext is the file extension of package list files.
+const Ext = ".txt"
+
+// maxIncludeDepth bounds nested @include directives.
+const maxIncludeDepth = 16
+
+var (
+	// packagePattern matches a package name or a category/port origin
+	packagePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.+@-]*(/[A-Za-z0-9][A-Za-z0-9_.+@-]*)?$`)
+	listPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*(/[A-Za-z0-9_][A-Za-z0-9_.+-]*)*$`)
+)
+
+// Package is a resolved package together with the lists that named it.
+type Package struct {
+	Name string
+
+	// Origins lists every package list that contains the package, in the
+	// order they were encountered. The first entry is the list that
+	// introduced it.
+	Origins []string
+}
+
+// Origin returns the list that first introduced the package.
+func (p Package) Origin() string {
+	if len(p.Origins) == 0 {
+		return ""
+	}
+	return p.Origins[0]
+}
+
+// Set is a resolved, deduplicated package set in first-seen order.
+type Set struct {
+	Packages []Package
+	index    map[string]int
+}
+
+// Names returns the package names in the set.
+func (s *Set) Names() []string {
+	names := make([]string, len(s.Packages))
+	for i, p := range s.Packages {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// add records name as coming from list.
+func (s *Set) add(name, list string) {
+	if s.index == nil {
+		s.index = make(map[string]int)
+	}
+	if i, ok := s.index[name]; ok {
+		for _, o := range s.Packages[i].Origins {
+			if o == list {
+				return
+			}
+		}
+		s.Packages[i].Origins = append(s.Packages[i].Origins, list)
+		return
+	}
+	s.index[name] = len(s.Packages)
+	s.Packages = append(s.Packages, Package{Name: name, Origins: []string{list}})
+}
+
+// Resolver expands package lists stored under Dir for a target architecture.
+type Resolver struct {
+	Dir  string // directory holding <name>.txt files
+	Arch string // target architecture for @if arch conditionals, e.g. "amd64"
+}
+
+// NewResolver creates a resolver for the lists in dir.
+func NewResolver(dir, arch string) *Resolver {
+	return &Resolver{Dir: dir, Arch: arch}
+}
+
+// Path returns the file that holds the named list.
+func (r *Resolver) Path(name string) string {
+	return filepath.Join(r.Dir, filepath.FromSlash(name)+Ext)
+}
+
+// Resolve expands the named lists, including everything they @include,
+// into a single package set. A list included from several places is only
+// expanded once.
+func (r *Resolver) Resolve(lists []string) (*Set, error) {
+	set := &Set{}
+	done := make(map[string]bool)
+	for _, name := range lists {
+		if err := r.expand(set, name, nil, done); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// expand adds the packages of one list to set. stack holds the lists being
+// expanded, used to detect include cycles.
+func (r *Resolver) expand(set *Set, name string, stack []string, done map[string]bool) error {
+	if !listPattern.MatchString(name) {
+		return fmt.Errorf("invalid package list name %q", name)
+	}
+	for _, s := range stack {
+		if s == name {
+			return fmt.Errorf("package list include cycle: %s -> %s", strings.Join(stack, " -> "), name)
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return fmt.Errorf("package list %s: includes nested too deep (max %d levels)", name, maxIncludeDepth)
+	}
+	if done[name] {
+		return nil
+	}
+	stack = append(stack, name)
+
+	path := r.Path(name)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if len(stack) > 1 {
+				return fmt.Errorf("package list %q (included from %s) not found at %s", name, stack[len(stack)-2], path)
+			}
+			return fmt.Errorf("package list %q not found at %s", name, path)
+		}
+		return fmt.Errorf("cannot open package list %s: %w", path, err)
+	}
+	defer f.Close()
+
+	// active tracks the enclosing @if blocks; a line applies only if all are true
+	var active []bool
+	enabled := func() bool {
+		for _, a := range active {
+			if !a {
+				return false
+			}
+		}
+		return true
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "@if":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected @if arch=<list> or @if arch!=<list>", path, lineNo)
+			}
+			match, err := r.evalCondition(fields[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			active = append(active, match)
+			continue
+		case "@endif":
+			if len(active) == 0 {
+				return fmt.Errorf("%s:%d: @endif without @if", path, lineNo)
+			}
+			active = active[:len(active)-1]
+			continue
+		}
+
+		if !enabled() {
+			continue
+		}
+
+		if fields[0] == "@include" {
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expected @include <list>", path, lineNo)
+			}
+			if err := r.expand(set, fields[1], stack, done); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(fields[0], "@") {
+			return fmt.Errorf("%s:%d: unknown directive %s", path, lineNo, fields[0])
+		}
+
+		if len(fields) != 1 {
+			return fmt.Errorf("%s:%d: expected one package per line, got %q", path, lineNo, strings.Join(fields, " "))
+		}
+		if !packagePattern.MatchString(fields[0]) {
+			return fmt.Errorf("%s:%d: %q is not a valid package name", path, lineNo, fields[0])
+		}
+		set.add(fields[0], name)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read package list %s: %w", path, err)
+	}
+	if len(active) > 0 {
+		return fmt.Errorf("%s: missing @endif", path)
+	}
+
+	done[name] = true
+	return nil
+}
+
+// evalCondition evaluates an arch=a,b or arch!=a,b condition.
+func (r *Resolver) evalCondition(cond string) (bool, error) {
+	var values string
+	negate := false
+	switch {
+	case strings.HasPrefix(cond, "arch!="):
+		values = strings.TrimPrefix(cond, "arch!=")
+		negate = true
+	case strings.HasPrefix(cond, "arch="):
+		values = strings.TrimPrefix(cond, "arch=")
+	default:
+		return false, fmt.Errorf("unsupported condition %q (expected arch=<list> or arch!=<list>)", cond)
+	}
+	if values == "" {
+		return false, fmt.Errorf("condition %q names no architectures", cond)
+	}
+
+	match := false
+	for _, arch := range strings.Split(values, ",") {
+		if arch == r.Arch {
+			match = true
+		}
+	}
+	return match != negate, nil
+}
@@ -0,0 +1,246 @@
+package pkglist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeLists writes each list to dir/<name>.txt and returns dir.
+func writeLists(t *testing.T, lists map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range lists {
+		path := filepath.Join(dir, filepath.FromSlash(name)+Ext)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Lists expand includes in place and apply arch conditionals, and every
+// package records the lists that named it.
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		lists    map[string]string
+		arch     string
+		resolve  []string
+		packages []Package
+	}{
+		{
+			name:     "comments and blank lines",
+			lists:    map[string]string{"base": "# base system\n\nsudo   # for admins\n  zsh\n"},
+			resolve:  []string{"base"},
+			packages: []Package{{"sudo", []string{"base"}}, {"zsh", []string{"base"}}},
+		},
+		{
+			name: "include in place",
+			lists: map[string]string{
+				"desktop":       "arcan\n@include desktop/fonts\ndurden\n",
+				"desktop/fonts": "noto-basic\nx11-fonts/dejavu\n",
+			},
+			resolve: []string{"desktop"},
+			packages: []Package{
+				{"arcan", []string{"desktop"}},
+				{"noto-basic", []string{"desktop/fonts"}},
+				{"x11-fonts/dejavu", []string{"desktop/fonts"}},
+				{"durden", []string{"desktop"}},
+			},
+		},
+		{
+			// common is expanded once; sudo is named by two lists
+			name: "shared include and origins",
+			lists: map[string]string{
+				"base":   "@include common\nsudo\n",
+				"server": "@include common\nsudo\nnginx\n",
+				"common": "tmux\nsudo\n",
+				"unused": "@include missing\n",
+			},
+			resolve: []string{"base", "server"},
+			packages: []Package{
+				{"tmux", []string{"common"}},
+				{"sudo", []string{"common", "base", "server"}},
+				{"nginx", []string{"server"}},
+			},
+		},
+		{
+			name: "arch match",
+			lists: map[string]string{"drivers": "" +
+				"@if arch=amd64,i386\ngpu-firmware-intel-kmod\n@endif\n" +
+				"@if arch!=amd64\nu-boot\n@endif\n" +
+				"mesa-libs\n"},
+			arch:    "amd64",
+			resolve: []string{"drivers"},
+			packages: []Package{
+				{"gpu-firmware-intel-kmod", []string{"drivers"}},
+				{"mesa-libs", []string{"drivers"}},
+			},
+		},
+		{
+			name: "arch mismatch",
+			lists: map[string]string{"drivers": "" +
+				"@if arch=amd64,i386\ngpu-firmware-intel-kmod\n@endif\n" +
+				"@if arch!=amd64\nu-boot\n@endif\n" +
+				"mesa-libs\n"},
+			arch:    "aarch64",
+			resolve: []string{"drivers"},
+			packages: []Package{
+				{"u-boot", []string{"drivers"}},
+				{"mesa-libs", []string{"drivers"}},
+			},
+		},
+		{
+			name: "nested conditionals",
+			lists: map[string]string{"drivers": "" +
+				"@if arch!=aarch64\n" +
+				"  @if arch=amd64\n  amd64-only\n  @endif\n" +
+				"  x86\n" +
+				"@endif\n"},
+			arch:     "i386",
+			resolve:  []string{"drivers"},
+			packages: []Package{{"x86", []string{"drivers"}}},
+		},
+		{
+			// A disabled include is not read, so it may not exist for
+			// this arch
+			name: "conditional include",
+			lists: map[string]string{
+				"base":     "@if arch=aarch64\n@include arm/boot\n@endif\n@if arch=amd64\n@include x86/boot\n@endif\n",
+				"x86/boot": "intel-ucode\n",
+			},
+			arch:     "amd64",
+			resolve:  []string{"base"},
+			packages: []Package{{"intel-ucode", []string{"x86/boot"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeLists(t, tt.lists)
+			set, err := NewResolver(dir, tt.arch).Resolve(tt.resolve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(set.Packages, tt.packages) {
+				t.Errorf("packages = %v, want %v", set.Packages, tt.packages)
+			}
+			for _, p := range set.Packages {
+				if p.Origin() != p.Origins[0] {
+					t.Errorf("%s: origin %q, want %q", p.Name, p.Origin(), p.Origins[0])
+				}
+			}
+		})
+	}
+}
+
+// Errors name the file and line, or the chain of includes, that caused
+// them.
+func TestResolveErrors(t *testing.T) {
+	// l0 includes l1, ..., one level deeper each time
+	deep := map[string]string{}
+	for i := 0; i <= maxIncludeDepth; i++ {
+		deep[fmt.Sprintf("l%d", i)] = fmt.Sprintf("@include l%d\n", i+1)
+	}
+
+	tests := []struct {
+		name  string
+		lists map[string]string
+		err   string
+	}{
+		{
+			name:  "include cycle",
+			lists: map[string]string{"base": "@include a\n", "a": "sudo\n@include b\n", "b": "@include a\n"},
+			err:   "package list include cycle: base -> a -> b -> a",
+		},
+		{
+			name:  "self include",
+			lists: map[string]string{"base": "@include base\n"},
+			err:   "package list include cycle: base -> base",
+		},
+		{
+			name:  "include depth",
+			lists: deep,
+			err:   fmt.Sprintf("includes nested too deep (max %d levels)", maxIncludeDepth),
+		},
+		{
+			name:  "missing list",
+			lists: map[string]string{},
+			err:   `package list "base" not found at`,
+		},
+		{
+			name:  "missing include",
+			lists: map[string]string{"base": "@include desktop/fonts\n"},
+			err:   `package list "desktop/fonts" (included from base) not found`,
+		},
+		{
+			name:  "invalid include",
+			lists: map[string]string{"base": "@include ../secrets\n"},
+			err:   `invalid package list name "../secrets"`,
+		},
+		{
+			name:  "include without list",
+			lists: map[string]string{"base": "sudo\n@include\n"},
+			err:   "base.txt:2: expected @include <list>",
+		},
+		{
+			name:  "missing endif",
+			lists: map[string]string{"base": "@if arch=amd64\nsudo\n"},
+			err:   "base.txt: missing @endif",
+		},
+		{
+			name:  "endif without if",
+			lists: map[string]string{"base": "sudo\n@endif\n"},
+			err:   "base.txt:2: @endif without @if",
+		},
+		{
+			name:  "unsupported condition",
+			lists: map[string]string{"base": "@if os=freebsd\n@endif\n"},
+			err:   `base.txt:1: unsupported condition "os=freebsd"`,
+		},
+		{
+			name:  "empty condition",
+			lists: map[string]string{"base": "@if arch!=\n@endif\n"},
+			err:   `base.txt:1: condition "arch!=" names no architectures`,
+		},
+		{
+			name:  "if with spaces",
+			lists: map[string]string{"base": "@if arch = amd64\n@endif\n"},
+			err:   "base.txt:1: expected @if arch=<list> or @if arch!=<list>",
+		},
+		{
+			name:  "unknown directive",
+			lists: map[string]string{"base": "@require sudo\n"},
+			err:   "base.txt:1: unknown directive @require",
+		},
+		{
+			name:  "two packages on a line",
+			lists: map[string]string{"base": "sudo zsh\n"},
+			err:   `base.txt:1: expected one package per line, got "sudo zsh"`,
+		},
+		{
+			name:  "invalid package",
+			lists: map[string]string{"base": "sudo\n-zsh\n"},
+			err:   `base.txt:2: "-zsh" is not a valid package name`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeLists(t, tt.lists)
+			start := "base"
+			if _, ok := tt.lists["l0"]; ok {
+				start = "l0"
+			}
+			_, err := NewResolver(dir, "amd64").Resolve([]string{start})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Package repro supports reproducible builds: timestamps are clamped to
+// SOURCE_DATE_EPOCH (https://reproducible-builds.org/specs/source-date-epoch/)
+// and the files of a root are normalized before it is packaged, so two
+// builds of the same commit produce the same artifacts.
+package repro
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvVar is the environment variable holding the build timestamp.
+const EnvVar = "SOURCE_DATE_EPOCH"
+
+// ParseEpoch parses a SOURCE_DATE_EPOCH value: seconds since the Unix epoch.
+func ParseEpoch(s string) (time.Time, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s %q: expected seconds since 1970-01-01", EnvVar, s)
+	}
+	return time.Unix(n, 0).UTC(), nil
+}
+
+// Clamp returns t, or epoch if t is later.
+func Clamp(t, epoch time.Time) time.Time {
+	if t.After(epoch) {
+		return epoch
+	}
+	return t
+}
+
+// Stats summarizes what NormalizeTree changed.
+type Stats struct {
+	Clamped int // files whose modification time was clamped
+	Skipped int // files that could not be changed
+}
+
+// NormalizeTree prepares root for packaging. Modification times later than
+// epoch are clamped to it, so files written during the build (overlays,
+// generated configuration) carry the same time in every build. Ownership
+// is left alone: the root holds users whose IDs may equal the build host's.
+//
+// Symbolic links are left alone: Go cannot set their times without
+// following them. The ISO writer clamps them when packaging.
+// Files NormalizeTree may not change, such as root-owned files in a build
+// run without privileges, are counted in Stats.Skipped.
+func NormalizeTree(root string, epoch time.Time) (Stats, error) {
+	var st Stats
+
+	// Directories are collected and changed last, after their entries
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		return normalize(path, d, epoch, &st)
+	})
+	if err != nil {
+		return st, fmt.Errorf("failed to normalize %s: %w", root, err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d, err := os.Lstat(dirs[i])
+		if err != nil {
+			return st, err
+		}
+		if err := normalize(dirs[i], fs.FileInfoToDirEntry(d), epoch, &st); err != nil {
+			return st, fmt.Errorf("failed to normalize %s: %w", root, err)
+		}
+	}
+	return st, nil
+}
+
+func normalize(path string, d fs.DirEntry, epoch time.Time, st *Stats) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	if d.Type()&fs.ModeSymlink != 0 || !info.ModTime().After(epoch) {
+		return nil
+	}
+	if err := os.Chtimes(path, epoch, epoch); err != nil {
+		if os.IsPermission(err) {
+			st.Skipped++
+			return nil
+		}
+		return err
+	}
+	st.Clamped++
+	return nil
+}
+
+// Difference is a file that differs between two builds.
+type Difference struct {
+	Path   string // relative to the compared directories
+	Reason string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: %s", d.Path, d.Reason)
+}
+
+// CompareDirs compares every file below a and b by content and returns the
+// differences sorted by path. Files present on one side only are reported
+// as differences.
+func CompareDirs(a, b string) ([]Difference, error) {
+	filesA, err := listFiles(a)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := listFiles(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []Difference
+	for rel, infoA := range filesA {
+		infoB, ok := filesB[rel]
+		if !ok {
+			diffs = append(diffs, Difference{Path: rel, Reason: "only in first build"})
+			continue
+		}
+		if reason, err := compareFile(filepath.Join(a, rel), filepath.Join(b, rel), infoA, infoB); err != nil {
+			return nil, err
+		} else if reason != "" {
+			diffs = append(diffs, Difference{Path: rel, Reason: reason})
+		}
+	}
+	for rel := range filesB {
+		if _, ok := filesA[rel]; !ok {
+			diffs = append(diffs, Difference{Path: rel, Reason: "only in second build"})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs, nil
+}
+
+func listFiles(root string) (map[string]fs.FileInfo, error) {
+	files := make(map[string]fs.FileInfo)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", root, err)
+	}
+	return files, nil
+}
+
+func compareFile(pathA, pathB string, infoA, infoB fs.FileInfo) (string, error) {
+	if infoA.Mode().Type() != infoB.Mode().Type() {
+		return fmt.Sprintf("file type %s != %s", infoA.Mode().Type(), infoB.Mode().Type()), nil
+	}
+	if infoA.Mode()&fs.ModeSymlink != 0 {
+		targetA, err := os.Readlink(pathA)
+		if err != nil {
+			return "", err
+		}
+		targetB, err := os.Readlink(pathB)
+		if err != nil {
+			return "", err
+		}
+		if targetA != targetB {
+			return fmt.Sprintf("link target %s != %s", targetA, targetB), nil
+		}
+		return "", nil
+	}
+	if infoA.Size() != infoB.Size() {
+		return fmt.Sprintf("size %d != %d", infoA.Size(), infoB.Size()), nil
+	}
+
+	sumA, err := hashFile(pathA)
+	if err != nil {
+		return "", err
+	}
+	sumB, err := hashFile(pathB)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(sumA, sumB) {
+		return fmt.Sprintf("sha256 %x != %x", sumA[:6], sumB[:6]), nil
+	}
+	return "", nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
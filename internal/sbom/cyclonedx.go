@@ -0,0 +1,188 @@
+package sbom
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// CycloneDX 1.5 JSON (https://cyclonedx.org/docs/1.5/json/).
+
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber,omitempty"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies,omitempty"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Supplier   *cdxSupplier  `json:"supplier,omitempty"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Licenses   []cdxLicense  `json:"licenses,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxSupplier struct {
+	Name string `json:"name"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// cdxLicense holds either a single license or an SPDX expression.
+type cdxLicense struct {
+	License    *cdxLicenseID `json:"license,omitempty"`
+	Expression string        `json:"expression,omitempty"`
+}
+
+type cdxLicenseID struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// CycloneDX returns the document in CycloneDX 1.5 JSON.
+func (d *Document) CycloneDX() ([]byte, error) {
+	const rootRef = "root"
+	const baseRef = "freebsd-base"
+	tool := cdxComponent{Type: "application", Name: d.Tool}
+	if name, version, ok := strings.Cut(d.Tool, " "); ok {
+		tool.Name, tool.Version = name, version
+	}
+
+	bom := cdxBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Version:     1,
+		Metadata: cdxMetadata{
+			Timestamp: d.Created.UTC().Format("2006-01-02T15:04:05Z"),
+			Tools:     cdxTools{Components: []cdxComponent{tool}},
+			Component: cdxComponent{
+				Type:       "operating-system",
+				BOMRef:     rootRef,
+				Supplier:   &cdxSupplier{Name: "PGSD"},
+				Name:       d.Name,
+				Version:    d.Version,
+				Properties: []cdxProperty{{Name: "pgsd:kind", Value: d.Kind}},
+			},
+		},
+	}
+	root := cdxDependency{Ref: rootRef, DependsOn: []string{baseRef}}
+
+	base := cdxComponent{
+		Type:       "operating-system",
+		BOMRef:     baseRef,
+		Supplier:   &cdxSupplier{Name: "The FreeBSD Project"},
+		Name:       "FreeBSD",
+		Version:    d.Base.Version,
+		Licenses:   []cdxLicense{{License: &cdxLicenseID{ID: "BSD-2-Clause"}}},
+		Properties: []cdxProperty{{Name: "freebsd:arch", Value: d.Base.Arch}},
+	}
+	bom.Components = append(bom.Components, base)
+	baseDep := cdxDependency{Ref: baseRef, DependsOn: []string{}}
+	for _, a := range d.Base.Archives {
+		ref := "freebsd-dist:" + a.Path
+		bom.Components = append(bom.Components, cdxComponent{
+			Type:    "file",
+			BOMRef:  ref,
+			Name:    a.Path,
+			Version: d.Base.Version,
+			Hashes:  fileHashes(a),
+		})
+		baseDep.DependsOn = append(baseDep.DependsOn, ref)
+	}
+
+	for _, p := range d.Packages {
+		ref := "pkg:" + p.Name
+		c := cdxComponent{
+			Type:     "application",
+			BOMRef:   ref,
+			Name:     p.Name,
+			Version:  p.Version,
+			Licenses: cdxLicenses(p),
+		}
+		if p.Checksum != "" {
+			c.Hashes = []cdxHash{{Alg: "SHA-256", Content: p.Checksum}}
+		}
+		if p.Origin != "" {
+			c.Properties = append(c.Properties, cdxProperty{Name: "freebsd:origin", Value: p.Origin})
+		}
+		if p.Dependency {
+			c.Properties = append(c.Properties, cdxProperty{Name: "pgsd:dependency", Value: "true"})
+		}
+		bom.Components = append(bom.Components, c)
+		root.DependsOn = append(root.DependsOn, ref)
+	}
+
+	for _, f := range d.Files {
+		ref := "file:" + f.Path
+		bom.Components = append(bom.Components, cdxComponent{
+			Type:       "file",
+			BOMRef:     ref,
+			Name:       f.Path,
+			Hashes:     fileHashes(f),
+			Properties: []cdxProperty{{Name: "pgsd:overlay", Value: f.Overlay}},
+		})
+		root.DependsOn = append(root.DependsOn, ref)
+	}
+	bom.Dependencies = []cdxDependency{root, baseDep}
+
+	content, err := json.Marshal(bom)
+	if err != nil {
+		return nil, err
+	}
+	bom.SerialNumber = "urn:uuid:" + contentUUID(content)
+	return marshalIndent(bom)
+}
+
+// cdxLicenses returns a package's licenses: a single license by SPDX ID or
+// name, or an SPDX expression for several.
+func cdxLicenses(p Package) []cdxLicense {
+	switch len(p.Licenses) {
+	case 0:
+		return nil
+	case 1:
+		id, ok := spdxLicense(p.Licenses[0])
+		if !ok {
+			return []cdxLicense{{License: &cdxLicenseID{Name: p.Licenses[0]}}}
+		}
+		if !strings.Contains(id, " WITH ") {
+			return []cdxLicense{{License: &cdxLicenseID{ID: id}}}
+		}
+	}
+	return []cdxLicense{{Expression: licenseExpression(p)}}
+}
+
+func fileHashes(f File) []cdxHash {
+	return []cdxHash{
+		{Alg: "SHA-1", Content: f.SHA1},
+		{Alg: "SHA-256", Content: f.SHA256},
+	}
+}
@@ -0,0 +1,308 @@
+// Package sbom writes software bills of materials for images and ISOs in
+// SPDX 2.3 and CycloneDX 1.5 JSON. A Document lists the FreeBSD base
+// system and the distribution archives it was installed from, every
+// package in the root's package database and the files added by overlays.
+//
+// Output is deterministic: the document namespace and serial number are
+// derived from the content, and the creation time is the build time, so a
+// reproducible build produces identical SBOMs.
+package sbom
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pgsdf/pgsdbuild/internal/pkginstall"
+)
+
+// File names of the SBOMs written next to an image's manifest.
+const (
+	SPDXFile      = "sbom.spdx.json"
+	CycloneDXFile = "sbom.cdx.json"
+)
+
+// Document is the content of an SBOM.
+type Document struct {
+	Name    string // image or variant ID
+	Version string
+	Kind    string // "image" or "iso"
+	Created time.Time
+	Tool    string // e.g. "pgsdbuild 0.1.0"
+
+	Base     Base
+	Packages []Package
+	Files    []File // overlay files
+}
+
+// Base is the FreeBSD base system.
+type Base struct {
+	Version  string
+	Arch     string
+	Archives []File // distribution archives, e.g. base.txz
+}
+
+// Package is an installed package.
+type Package struct {
+	Name         string
+	Version      string
+	Origin       string
+	Licenses     []string
+	LicenseLogic string
+	Checksum     string // SHA-256
+	Dependency   bool   // installed only as a dependency
+}
+
+// File is a file with its checksums.
+type File struct {
+	Path    string // path in the root for overlay files, file name for archives
+	Overlay string // overlay that provided the file
+	Size    int64
+	SHA1    string // required by SPDX for files
+	SHA256  string
+}
+
+// Packages lists the installed packages, marking those not named in
+// requested (package names or port origins) as dependencies. Without a
+// package database (pkg not available) the requested names are listed
+// without versions.
+func Packages(installed []pkginstall.InstalledPackage, requested []string) []Package {
+	if len(installed) == 0 {
+		pkgs := make([]Package, len(requested))
+		for i, name := range requested {
+			pkgs[i] = Package{Name: name}
+		}
+		return pkgs
+	}
+
+	want := make(map[string]bool, len(requested))
+	for _, name := range requested {
+		want[name] = true
+	}
+	pkgs := make([]Package, 0, len(installed))
+	for _, p := range installed {
+		pkgs = append(pkgs, Package{
+			Name:         p.Name,
+			Version:      p.Version,
+			Origin:       p.Origin,
+			Licenses:     p.Licenses,
+			LicenseLogic: p.LicenseLogic,
+			Checksum:     p.Checksum,
+			Dependency:   !want[p.Name] && !want[p.Origin],
+		})
+	}
+	return pkgs
+}
+
+// HashFile returns the checksums of the file at path, recorded under name.
+func HashFile(path, name string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	h1, h256 := sha1.New(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(h1, h256), f)
+	if err != nil {
+		return File{}, fmt.Errorf("cannot hash %s: %w", path, err)
+	}
+	return File{
+		Path:   name,
+		Size:   n,
+		SHA1:   hex.EncodeToString(h1.Sum(nil)),
+		SHA256: hex.EncodeToString(h256.Sum(nil)),
+	}, nil
+}
+
+// Archives hashes the named distribution archives in dir. Archives that do
+// not exist, because the base system was copied from FREEBSD_ROOT instead,
+// are skipped.
+func Archives(dir string, names ...string) ([]File, error) {
+	var files []File
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		f, err := HashFile(path, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// OverlayFiles hashes the regular files of the named overlays in
+// overlaysDir. A file provided by several overlays is listed once, from
+// the last one, as it is applied last.
+func OverlayFiles(overlaysDir string, overlays []string) ([]File, error) {
+	byPath := make(map[string]File)
+	for _, overlay := range overlays {
+		root := filepath.Join(overlaysDir, overlay)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			name := "/" + filepath.ToSlash(rel)
+			f, err := HashFile(path, name)
+			if err != nil {
+				return err
+			}
+			f.Overlay = overlay
+			byPath[name] = f
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("overlay %s: %w", overlay, err)
+		}
+	}
+
+	files := make([]File, 0, len(byPath))
+	for _, f := range byPath {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// Write writes the SPDX and CycloneDX documents to spdxPath and cdxPath.
+func (d *Document) Write(spdxPath, cdxPath string) error {
+	spdx, err := d.SPDX()
+	if err != nil {
+		return fmt.Errorf("failed to encode SPDX: %w", err)
+	}
+	if err := os.WriteFile(spdxPath, spdx, 0644); err != nil {
+		return fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	cdx, err := d.CycloneDX()
+	if err != nil {
+		return fmt.Errorf("failed to encode CycloneDX: %w", err)
+	}
+	if err := os.WriteFile(cdxPath, cdx, 0644); err != nil {
+		return fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	return nil
+}
+
+// spdxLicenses maps the license names used by FreeBSD ports to SPDX
+// identifiers. Other names become LicenseRef- identifiers.
+var spdxLicenses = map[string]string{
+	"AGPLv3":     "AGPL-3.0-only",
+	"AGPLv3+":    "AGPL-3.0-or-later",
+	"APACHE10":   "Apache-1.0",
+	"APACHE11":   "Apache-1.1",
+	"APACHE20":   "Apache-2.0",
+	"ART10":      "Artistic-1.0",
+	"ART20":      "Artistic-2.0",
+	"ARTPERL10":  "Artistic-1.0-Perl",
+	"BSD0CLAUSE": "0BSD",
+	"BSD2CLAUSE": "BSD-2-Clause",
+	"BSD3CLAUSE": "BSD-3-Clause",
+	"BSD4CLAUSE": "BSD-4-Clause",
+	"BSL":        "BSL-1.0",
+	"CC0-1.0":    "CC0-1.0",
+	"CDDL":       "CDDL-1.0",
+	"EPL":        "EPL-1.0",
+	"GPLv1":      "GPL-1.0-only",
+	"GPLv1+":     "GPL-1.0-or-later",
+	"GPLv2":      "GPL-2.0-only",
+	"GPLv2+":     "GPL-2.0-or-later",
+	"GPLv3":      "GPL-3.0-only",
+	"GPLv3+":     "GPL-3.0-or-later",
+	"GPLv3RLE":   "GPL-3.0-only WITH GCC-exception-3.1",
+	"GPLv3RLE+":  "GPL-3.0-or-later WITH GCC-exception-3.1",
+	"ISCL":       "ISC",
+	"LGPL20":     "LGPL-2.0-only",
+	"LGPL20+":    "LGPL-2.0-or-later",
+	"LGPL21":     "LGPL-2.1-only",
+	"LGPL21+":    "LGPL-2.1-or-later",
+	"LGPL3":      "LGPL-3.0-only",
+	"LGPL3+":     "LGPL-3.0-or-later",
+	"LPPL13c":    "LPPL-1.3c",
+	"MIT":        "MIT",
+	"MPL10":      "MPL-1.0",
+	"MPL11":      "MPL-1.1",
+	"MPL20":      "MPL-2.0",
+	"NCSA":       "NCSA",
+	"OFL10":      "OFL-1.0",
+	"OFL11":      "OFL-1.1",
+	"OpenSSL":    "OpenSSL",
+	"PHP30":      "PHP-3.0",
+	"PHP301":     "PHP-3.01",
+	"PSFL":       "PSF-2.0",
+	"PostgreSQL": "PostgreSQL",
+	"RUBY":       "Ruby",
+	"UNLICENSE":  "Unlicense",
+	"WTFPL":      "WTFPL",
+	"ZLIB":       "Zlib",
+	"ZPL21":      "ZPL-2.1",
+}
+
+// spdxLicense returns the SPDX identifier for a ports license name and
+// whether it is a standard SPDX license.
+func spdxLicense(name string) (string, bool) {
+	if id, ok := spdxLicenses[name]; ok {
+		return id, true
+	}
+	return "LicenseRef-" + spdxIDPart(name), false
+}
+
+// licenseExpression combines a package's licenses according to its logic,
+// or returns "" if it declares none.
+func licenseExpression(p Package) string {
+	if len(p.Licenses) == 0 {
+		return ""
+	}
+	ids := make([]string, len(p.Licenses))
+	for i, l := range p.Licenses {
+		ids[i], _ = spdxLicense(l)
+		if strings.Contains(ids[i], " WITH ") && len(p.Licenses) > 1 {
+			ids[i] = "(" + ids[i] + ")"
+		}
+	}
+	// LICENSE_COMB=dual is recorded as "or", multi as "and"
+	op := " AND "
+	if p.LicenseLogic == "or" || p.LicenseLogic == "dual" {
+		op = " OR "
+	}
+	return strings.Join(ids, op)
+}
+
+// spdxIDPart reduces s to the characters allowed in SPDX identifiers.
+func spdxIDPart(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('-')
+		}
+	}
+	return sb.String()
+}
+
+// contentUUID derives a version 5 style UUID from data, so identifiers are
+// stable across identical builds.
+func contentUUID(data []byte) string {
+	sum := sha1.Sum(data)
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
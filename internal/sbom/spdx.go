@@ -0,0 +1,197 @@
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SPDX 2.3 JSON (https://spdx.github.io/spdx-spec/v2.3/).
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string         `json:"SPDXID"`
+	Name                  string         `json:"name"`
+	VersionInfo           string         `json:"versionInfo,omitempty"`
+	PackageFileName       string         `json:"packageFileName,omitempty"`
+	Supplier              string         `json:"supplier,omitempty"`
+	DownloadLocation      string         `json:"downloadLocation"`
+	FilesAnalyzed         bool           `json:"filesAnalyzed"`
+	Checksums             []spdxChecksum `json:"checksums,omitempty"`
+	LicenseConcluded      string         `json:"licenseConcluded"`
+	LicenseDeclared       string         `json:"licenseDeclared"`
+	CopyrightText         string         `json:"copyrightText"`
+	SourceInfo            string         `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string         `json:"primaryPackagePurpose,omitempty"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+const noAssertion = "NOASSERTION"
+
+// SPDX returns the document in SPDX 2.3 JSON.
+func (d *Document) SPDX() ([]byte, error) {
+	const rootID = "SPDXRef-Root"
+	name := d.Name
+	if d.Version != "" {
+		name += "-" + d.Version
+	}
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        name,
+		CreationInfo: spdxCreationInfo{
+			Created:  d.Created.UTC().Format("2006-01-02T15:04:05Z"),
+			Creators: []string{"Tool: " + strings.ReplaceAll(d.Tool, " ", "-"), "Organization: PGSD"},
+		},
+	}
+	rel := func(a, typ, b string) {
+		doc.Relationships = append(doc.Relationships, spdxRelationship{Element: a, Type: typ, Related: b})
+	}
+
+	doc.Packages = append(doc.Packages, spdxPackage{
+		SPDXID:                rootID,
+		Name:                  d.Name,
+		VersionInfo:           d.Version,
+		Supplier:              "Organization: PGSD",
+		DownloadLocation:      noAssertion,
+		LicenseConcluded:      noAssertion,
+		LicenseDeclared:       noAssertion,
+		CopyrightText:         noAssertion,
+		PrimaryPackagePurpose: "OPERATING-SYSTEM",
+		SourceInfo:            fmt.Sprintf("PGSD %s %s", d.Kind, d.Name),
+	})
+	rel("SPDXRef-DOCUMENT", "DESCRIBES", rootID)
+
+	const baseID = "SPDXRef-FreeBSD-base"
+	doc.Packages = append(doc.Packages, spdxPackage{
+		SPDXID:                baseID,
+		Name:                  "FreeBSD",
+		VersionInfo:           d.Base.Version,
+		Supplier:              "Organization: The FreeBSD Project",
+		DownloadLocation:      noAssertion,
+		LicenseConcluded:      noAssertion,
+		LicenseDeclared:       "BSD-2-Clause",
+		CopyrightText:         noAssertion,
+		PrimaryPackagePurpose: "OPERATING-SYSTEM",
+		SourceInfo:            "FreeBSD base system for " + d.Base.Arch,
+	})
+	rel(rootID, "CONTAINS", baseID)
+	for i, a := range d.Base.Archives {
+		id := fmt.Sprintf("SPDXRef-Archive-%d-%s", i+1, spdxIDPart(a.Path))
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:                id,
+			Name:                  "FreeBSD " + a.Path,
+			VersionInfo:           d.Base.Version,
+			PackageFileName:       a.Path,
+			Supplier:              "Organization: The FreeBSD Project",
+			DownloadLocation:      noAssertion,
+			Checksums:             fileChecksums(a),
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+			PrimaryPackagePurpose: "ARCHIVE",
+		})
+		rel(baseID, "GENERATED_FROM", id)
+	}
+
+	for i, p := range d.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d-%s", i+1, spdxIDPart(p.Name))
+		sp := spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: noAssertion,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+		}
+		if expr := licenseExpression(p); expr != "" {
+			sp.LicenseDeclared = expr
+		}
+		if p.Checksum != "" {
+			sp.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: p.Checksum}}
+		}
+		if p.Origin != "" {
+			sp.SourceInfo = "FreeBSD port " + p.Origin
+		}
+		doc.Packages = append(doc.Packages, sp)
+		if p.Dependency {
+			rel(id, "DEPENDENCY_OF", rootID)
+		} else {
+			rel(rootID, "CONTAINS", id)
+		}
+	}
+
+	for i, f := range d.Files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i+1)
+		doc.Files = append(doc.Files, spdxFile{
+			SPDXID:           id,
+			FileName:         "." + f.Path,
+			Checksums:        fileChecksums(f),
+			LicenseConcluded: noAssertion,
+			CopyrightText:    noAssertion,
+			Comment:          "from overlay " + f.Overlay,
+		})
+		rel(rootID, "CONTAINS", id)
+	}
+
+	// The namespace must be unique per document; deriving it from the
+	// content keeps reproducible builds identical
+	content, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	doc.DocumentNamespace = fmt.Sprintf("https://pgsdf.org/spdx/%s-%s", spdxIDPart(name), contentUUID(content))
+	return marshalIndent(doc)
+}
+
+func fileChecksums(f File) []spdxChecksum {
+	return []spdxChecksum{
+		{Algorithm: "SHA1", ChecksumValue: f.SHA1},
+		{Algorithm: "SHA256", ChecksumValue: f.SHA256},
+	}
+}
+
+func marshalIndent(v any) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,256 @@
+// Package sign creates and checks detached ed25519 signatures of image
+// manifests. The manifest pins the size and SHA-256 of every artifact, so a
+// valid signature over it covers the whole image.
+//
+// Keys are PEM files: the private key in PKCS #8 ("PRIVATE KEY") and the
+// public key in PKIX form ("PUBLIC KEY"), readable by OpenSSL. A signature
+// is a "PGSD SIGNATURE" PEM block whose Key-Id header names the public key
+// that verifies it:
+//
+//	-----BEGIN PGSD SIGNATURE-----
+//	Key-Id: 3f2a9c1b7d4e6f80
+//
+//	<base64 ed25519 signature>
+//	-----END PGSD SIGNATURE-----
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// PrivateKeyExt and PublicKeyExt name the files written by keygen.
+	PrivateKeyExt = ".key"
+	PublicKeyExt  = ".pub"
+
+	// SignatureExt is appended to the signed file's name.
+	SignatureExt = ".sig"
+
+	// TrustedKeysDir is where boot environments keep the public keys the
+	// installer trusts.
+	TrustedKeysDir = "/usr/local/etc/pgsd/keys"
+
+	signatureType = "PGSD SIGNATURE"
+	keyIDHeader   = "Key-Id"
+)
+
+// ErrUnsigned is returned by VerifyFile when the file has no signature.
+var ErrUnsigned = errors.New("file is not signed")
+
+// PublicKey is a key trusted to verify signatures.
+type PublicKey struct {
+	ID   string // see KeyID
+	Name string // file name without extension
+	Key  ed25519.PublicKey
+}
+
+// PrivateKey signs files.
+type PrivateKey struct {
+	ID   string
+	Name string
+	Key  ed25519.PrivateKey
+}
+
+// Public returns the public half of k.
+func (k *PrivateKey) Public() PublicKey {
+	pub := k.Key.Public().(ed25519.PublicKey)
+	return PublicKey{ID: k.ID, Name: k.Name, Key: pub}
+}
+
+// KeyID returns the ID of a public key: the first 8 bytes of its SHA-256
+// in hex.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey writes a new key pair to dir/name.key and dir/name.pub.
+// Existing files are only replaced when force is set.
+func GenerateKey(dir, name string, force bool) (*PrivateKey, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	keyPath := filepath.Join(dir, name+PrivateKeyExt)
+	pubPath := filepath.Join(dir, name+PublicKeyExt)
+	if !force {
+		for _, p := range []string{keyPath, pubPath} {
+			if _, err := os.Stat(p); err == nil {
+				return nil, fmt.Errorf("%s already exists", p)
+			}
+		}
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	// The private key is written first and never readable by others
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	if err := writeFile(keyPath, privPEM, 0600); err != nil {
+		return nil, err
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	if err := writeFile(pubPath, pubPEM, 0644); err != nil {
+		return nil, err
+	}
+	return &PrivateKey{ID: KeyID(pub), Name: name, Key: priv}, nil
+}
+
+// writeFile replaces path with data, forcing perm even if path existed.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	os.Remove(path)
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return os.Chmod(path, perm)
+}
+
+// LoadPrivateKey reads a private key written by GenerateKey.
+func LoadPrivateKey(path string) (*PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an ed25519 key", path)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	return &PrivateKey{ID: KeyID(pub), Name: keyName(path), Key: priv}, nil
+}
+
+// LoadPublicKey reads a public key written by GenerateKey.
+func LoadPublicKey(path string) (PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return PublicKey{}, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid public key %s: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return PublicKey{}, fmt.Errorf("public key %s is not an ed25519 key", path)
+	}
+	return PublicKey{ID: KeyID(pub), Name: keyName(path), Key: pub}, nil
+}
+
+// LoadKeyring reads every *.pub file in dir, sorted by name. A missing
+// directory is an empty keyring.
+func LoadKeyring(dir string) ([]PublicKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+PublicKeyExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var keys []PublicKey
+	for _, p := range paths {
+		k, err := LoadPublicKey(p)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func readPEM(path, typ string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s does not contain a PEM %q block", path, typ)
+	}
+	return block, nil
+}
+
+func keyName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Sign returns the signature of data as a PEM block.
+func Sign(key *PrivateKey, data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    signatureType,
+		Headers: map[string]string{keyIDHeader: key.ID},
+		Bytes:   ed25519.Sign(key.Key, data),
+	})
+}
+
+// Verify checks sig, a PEM block written by Sign, over data against keys and
+// returns the key that verified it.
+func Verify(keys []PublicKey, data, sig []byte) (PublicKey, error) {
+	block, _ := pem.Decode(sig)
+	if block == nil || block.Type != signatureType {
+		return PublicKey{}, fmt.Errorf("malformed signature: no PEM %q block", signatureType)
+	}
+	id := block.Headers[keyIDHeader]
+	for _, k := range keys {
+		if k.ID != id {
+			continue
+		}
+		if !ed25519.Verify(k.Key, data, block.Bytes) {
+			return PublicKey{}, fmt.Errorf("signature by key %s (%s) does not match", k.ID, k.Name)
+		}
+		return k, nil
+	}
+	return PublicKey{}, fmt.Errorf("signed by key %s, which is not trusted", id)
+}
+
+// SignFile writes the signature of path to path.sig.
+func SignFile(key *PrivateKey, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	if err := os.WriteFile(path+SignatureExt, Sign(key, data), 0644); err != nil {
+		return fmt.Errorf("failed to write signature: %w", err)
+	}
+	return nil
+}
+
+// VerifyFile checks the signature in path.sig over data, the contents of
+// path, against keys. Callers pass data so the bytes they go on to use are
+// the bytes that were verified. It returns ErrUnsigned if path.sig does not
+// exist.
+func VerifyFile(keys []PublicKey, path string, data []byte) (PublicKey, error) {
+	sig, err := os.ReadFile(path + SignatureExt)
+	if os.IsNotExist(err) {
+		return PublicKey{}, ErrUnsigned
+	}
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("cannot read signature: %w", err)
+	}
+	return Verify(keys, data, sig)
+}
@@ -0,0 +1,129 @@
+package sign
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A file signed with a generated key verifies against the key loaded back
+// from disk, and fails once it is changed or checked against other keys.
+func TestVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	release, err := GenerateKey(dir, "release", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKey(t.TempDir(), "other", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trusted) != 1 || trusted[0].ID != release.ID || trusted[0].Name != "release" {
+		t.Fatalf("keyring = %+v", trusted)
+	}
+
+	path := filepath.Join(t.TempDir(), "manifest.toml")
+	data := []byte("[image]\nid = \"pgsd-test\"\n")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SignFile(release, path); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(path + SignatureExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys []PublicKey
+		data []byte
+		sig  []byte // replaces the signature file when set
+		err  string
+	}{
+		{name: "valid", keys: trusted, data: data},
+		{name: "tampered", keys: trusted, data: []byte("[image]\nid = \"pgsd-evil\"\n"), err: "does not match"},
+		{name: "untrusted key", keys: []PublicKey{other.Public()}, data: data, err: "signed by key " + release.ID + ", which is not trusted"},
+		{name: "not PEM", keys: trusted, data: data, sig: []byte("garbage\n"), err: "malformed signature"},
+		{name: "wrong block", keys: trusted, data: data, sig: []byte("-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"), err: "malformed signature"},
+		{
+			name: "truncated",
+			keys: trusted,
+			data: data,
+			sig:  []byte("-----BEGIN PGSD SIGNATURE-----\nKey-Id: " + release.ID + "\n\nAAAA\n-----END PGSD SIGNATURE-----\n"),
+			err:  "does not match",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := sig
+			if tt.sig != nil {
+				want = tt.sig
+			}
+			if err := os.WriteFile(path+SignatureExt, want, 0644); err != nil {
+				t.Fatal(err)
+			}
+			key, err := VerifyFile(tt.keys, path, tt.data)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key.ID != release.ID {
+					t.Errorf("verified by %s, want %s", key.ID, release.ID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	if err := os.Remove(path + SignatureExt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(trusted, path, data); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned file: err = %v, want ErrUnsigned", err)
+	}
+}
+
+// Keys are not overwritten without force, and the private key is only
+// readable by its owner.
+func TestGenerateKey(t *testing.T) {
+	dir := t.TempDir()
+	key, err := GenerateKey(dir, "release", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateKey(dir, "release", false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("second GenerateKey: err = %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "release"+PrivateKeyExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("private key mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	loaded, err := LoadPrivateKey(filepath.Join(dir, "release"+PrivateKeyExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != key.ID || !loaded.Key.Equal(key.Key) {
+		t.Error("loaded private key differs from the generated one")
+	}
+
+	for _, name := range []string{"", "../release", ".hidden"} {
+		if _, err := GenerateKey(dir, name, false); err == nil {
+			t.Errorf("GenerateKey(%q) succeeded", name)
+		}
+	}
+}
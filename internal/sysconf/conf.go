@@ -0,0 +1,180 @@
+package sysconf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// File is a shell-style key="value" configuration file such as rc.conf.
+// Comments, blank lines and unrecognized lines are preserved verbatim so
+// that editing a file only touches the assignments that change.
+type File struct {
+	lines []line
+}
+
+// line is a single line of a File. key is empty for non-assignment lines.
+// comment holds a trailing comment (including the leading spaces and '#')
+// so it survives when the value is rewritten.
+type line struct {
+	raw     string
+	key     string
+	value   string
+	comment string
+}
+
+// Parse parses the contents of a key="value" configuration file.
+func Parse(data []byte) *File {
+	f := &File{}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return f
+	}
+	for _, raw := range strings.Split(text, "\n") {
+		key, value, comment, ok := parseAssignment(raw)
+		if !ok {
+			f.lines = append(f.lines, line{raw: raw})
+			continue
+		}
+		f.lines = append(f.lines, line{raw: raw, key: key, value: value, comment: comment})
+	}
+	return f
+}
+
+// Load reads and parses a configuration file. A missing file yields an
+// empty File so callers can create it on Write.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &File{}, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return Parse(data), nil
+}
+
+// Get returns the value of the last assignment to key.
+func (f *File) Get(key string) (string, bool) {
+	for i := len(f.lines) - 1; i >= 0; i-- {
+		if f.lines[i].key == key {
+			return f.lines[i].value, true
+		}
+	}
+	return "", false
+}
+
+// Set assigns value to key. The first existing assignment is rewritten in
+// place and any later duplicates are dropped; otherwise a new line is appended.
+func (f *File) Set(key, value string) {
+	formatted := fmt.Sprintf("%s=%q", key, value)
+	found := false
+	kept := f.lines[:0]
+	for _, l := range f.lines {
+		if l.key == key {
+			if found {
+				continue
+			}
+			found = true
+			if l.value != value {
+				l = line{raw: formatted + l.comment, key: key, value: value, comment: l.comment}
+			}
+		}
+		kept = append(kept, l)
+	}
+	f.lines = kept
+	if !found {
+		f.lines = append(f.lines, line{raw: formatted, key: key, value: value})
+	}
+}
+
+// Delete removes every assignment to key.
+func (f *File) Delete(key string) {
+	kept := f.lines[:0]
+	for _, l := range f.lines {
+		if l.key != key {
+			kept = append(kept, l)
+		}
+	}
+	f.lines = kept
+}
+
+// AddComment appends a comment line.
+func (f *File) AddComment(text string) {
+	f.lines = append(f.lines, line{raw: "# " + text})
+}
+
+// Keys returns the assigned keys in file order.
+func (f *File) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, l := range f.lines {
+		if l.key != "" && !seen[l.key] {
+			seen[l.key] = true
+			keys = append(keys, l.key)
+		}
+	}
+	return keys
+}
+
+// Bytes renders the file contents.
+func (f *File) Bytes() []byte {
+	var sb strings.Builder
+	for _, l := range f.lines {
+		sb.WriteString(l.raw)
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}
+
+// Write writes the file to path with the given permissions.
+func (f *File) Write(path string, perm os.FileMode) error {
+	return util.WriteStringToFile(path, string(f.Bytes()), perm)
+}
+
+// parseAssignment parses a line of the form key="value", key='value' or
+// key=value, optionally followed by a comment.
+func parseAssignment(raw string) (key, value, comment string, ok bool) {
+	s := strings.TrimRight(raw, " \t")
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return "", "", "", false
+	}
+	eq := strings.IndexByte(s, '=')
+	if eq <= 0 {
+		return "", "", "", false
+	}
+	key = strings.TrimSpace(s[:eq])
+	if key == "" || strings.ContainsAny(key, " \t\"'") {
+		return "", "", "", false
+	}
+
+	rest := s[eq+1:]
+	var tail string
+	if r := strings.TrimLeft(rest, " \t"); r != "" && (r[0] == '"' || r[0] == '\'') {
+		end := strings.IndexByte(r[1:], r[0])
+		if end < 0 {
+			return "", "", "", false
+		}
+		value = r[1 : end+1]
+		tail = r[end+2:]
+	} else {
+		value = rest
+		if i := strings.IndexByte(rest, '#'); i >= 0 {
+			value = rest[:i]
+			tail = rest[i:]
+		}
+		value = strings.TrimSpace(value)
+	}
+
+	// Keep the whitespace before a trailing comment so alignment survives
+	if strings.Contains(tail, "#") {
+		comment = tail
+		if !strings.HasPrefix(comment, " ") && !strings.HasPrefix(comment, "\t") {
+			comment = " " + comment
+		}
+	}
+	return key, value, comment, true
+}
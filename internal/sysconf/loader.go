@@ -0,0 +1,50 @@
+package sysconf
+
+import (
+	"sort"
+)
+
+// RootMountKey is the loader.conf tunable naming the root filesystem.
+const RootMountKey = "vfs.root.mountfrom"
+
+// LoaderConf is a loader.conf(5) file. It keeps the comments and ordering of
+// the file it was parsed from; tunables merged from a recipe are applied in
+// sorted key order so the output does not depend on map iteration.
+type LoaderConf struct {
+	*File
+}
+
+// LoadLoaderConf reads a loader.conf file. A missing file yields an empty
+// configuration.
+func LoadLoaderConf(path string) (*LoaderConf, error) {
+	f, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &LoaderConf{File: f}, nil
+}
+
+// Merge sets every tunable in values. Existing assignments are updated in
+// place; new ones are appended after a comment naming their source.
+func (c *LoaderConf) Merge(values map[string]string, source string) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headerWritten := false
+	for _, k := range keys {
+		if _, ok := c.Get(k); !ok && !headerWritten && source != "" {
+			c.AddComment("Tunables from " + source)
+			headerWritten = true
+		}
+		c.Set(k, values[k])
+	}
+}
+
+// RootMountFrom returns the configured root filesystem, if any.
+func (c *LoaderConf) RootMountFrom() string {
+	v, _ := c.Get(RootMountKey)
+	return v
+}
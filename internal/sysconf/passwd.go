@@ -0,0 +1,261 @@
+package sysconf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// FreeBSD allocates regular user and group ids starting here (see adduser(8)).
+const firstRegularID = 1001
+
+// PasswdEntry is one line of master.passwd(5).
+type PasswdEntry struct {
+	Name     string
+	Password string
+	UID      int
+	GID      int
+	Class    string
+	Change   string
+	Expire   string
+	Gecos    string
+	Home     string
+	Shell    string
+}
+
+// GroupEntry is one line of group(5).
+type GroupEntry struct {
+	Name     string
+	Password string
+	GID      int
+	Members  []string
+}
+
+// UserDB holds the contents of master.passwd and group for a root tree.
+// Lines that are not entries (comments) are kept and written back first.
+type UserDB struct {
+	Users  []PasswdEntry
+	Groups []GroupEntry
+
+	passwdHeader []string
+	groupHeader  []string
+}
+
+// LoadUserDB reads etc/master.passwd and etc/group below root.
+func LoadUserDB(root string) (*UserDB, error) {
+	db := &UserDB{}
+
+	passwdLines, err := readLines(filepath.Join(root, "etc", "master.passwd"))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range passwdLines {
+		if l == "" || strings.HasPrefix(l, "#") {
+			db.passwdHeader = append(db.passwdHeader, l)
+			continue
+		}
+		e, err := parsePasswdLine(l)
+		if err != nil {
+			return nil, fmt.Errorf("master.passwd: %w", err)
+		}
+		db.Users = append(db.Users, e)
+	}
+
+	groupLines, err := readLines(filepath.Join(root, "etc", "group"))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range groupLines {
+		if l == "" || strings.HasPrefix(l, "#") {
+			db.groupHeader = append(db.groupHeader, l)
+			continue
+		}
+		g, err := parseGroupLine(l)
+		if err != nil {
+			return nil, fmt.Errorf("group: %w", err)
+		}
+		db.Groups = append(db.Groups, g)
+	}
+
+	return db, nil
+}
+
+// User returns the entry for name, or nil.
+func (db *UserDB) User(name string) *PasswdEntry {
+	for i := range db.Users {
+		if db.Users[i].Name == name {
+			return &db.Users[i]
+		}
+	}
+	return nil
+}
+
+// Group returns the entry for name, or nil.
+func (db *UserDB) Group(name string) *GroupEntry {
+	for i := range db.Groups {
+		if db.Groups[i].Name == name {
+			return &db.Groups[i]
+		}
+	}
+	return nil
+}
+
+// GroupByGID returns the entry with the given gid, or nil.
+func (db *UserDB) GroupByGID(gid int) *GroupEntry {
+	for i := range db.Groups {
+		if db.Groups[i].GID == gid {
+			return &db.Groups[i]
+		}
+	}
+	return nil
+}
+
+// NextUID returns the first free regular user id.
+func (db *UserDB) NextUID() int {
+	next := firstRegularID
+	for _, u := range db.Users {
+		if u.UID >= next && u.UID < 65534 {
+			next = u.UID + 1
+		}
+	}
+	return next
+}
+
+// NextGID returns the first free regular group id.
+func (db *UserDB) NextGID() int {
+	next := firstRegularID
+	for _, g := range db.Groups {
+		if g.GID >= next && g.GID < 65533 {
+			next = g.GID + 1
+		}
+	}
+	return next
+}
+
+// AddGroup adds a group with the given gid (0 allocates one) unless it
+// already exists, and returns the entry.
+func (db *UserDB) AddGroup(name string, gid int) *GroupEntry {
+	if g := db.Group(name); g != nil {
+		return g
+	}
+	if gid == 0 {
+		gid = db.NextGID()
+	}
+	db.Groups = append(db.Groups, GroupEntry{Name: name, Password: "*", GID: gid})
+	return &db.Groups[len(db.Groups)-1]
+}
+
+// AddMember adds user to group's member list if not already present.
+func (db *UserDB) AddMember(group, user string) error {
+	g := db.Group(group)
+	if g == nil {
+		return fmt.Errorf("group %s does not exist", group)
+	}
+	for _, m := range g.Members {
+		if m == user {
+			return nil
+		}
+	}
+	g.Members = append(g.Members, user)
+	return nil
+}
+
+// SetUser adds or replaces a user entry.
+func (db *UserDB) SetUser(e PasswdEntry) {
+	if u := db.User(e.Name); u != nil {
+		*u = e
+		return
+	}
+	db.Users = append(db.Users, e)
+}
+
+// Write writes etc/master.passwd (mode 0600) and etc/group (mode 0644)
+// below root. The hashed databases must be regenerated with pwd_mkdb(8)
+// afterwards.
+func (db *UserDB) Write(root string) error {
+	var passwd strings.Builder
+	for _, l := range db.passwdHeader {
+		passwd.WriteString(l + "\n")
+	}
+	for _, u := range db.Users {
+		passwd.WriteString(formatPasswdLine(u) + "\n")
+	}
+	if err := util.WriteStringToFile(filepath.Join(root, "etc", "master.passwd"), passwd.String(), 0600); err != nil {
+		return err
+	}
+
+	var group strings.Builder
+	for _, l := range db.groupHeader {
+		group.WriteString(l + "\n")
+	}
+	for _, g := range db.Groups {
+		group.WriteString(formatGroupLine(g) + "\n")
+	}
+	return util.WriteStringToFile(filepath.Join(root, "etc", "group"), group.String(), 0644)
+}
+
+func parsePasswdLine(l string) (PasswdEntry, error) {
+	f := strings.Split(l, ":")
+	if len(f) != 10 {
+		return PasswdEntry{}, fmt.Errorf("malformed entry (want 10 fields, got %d): %q", len(f), l)
+	}
+	uid, err := strconv.Atoi(f[2])
+	if err != nil {
+		return PasswdEntry{}, fmt.Errorf("invalid uid in %q", l)
+	}
+	gid, err := strconv.Atoi(f[3])
+	if err != nil {
+		return PasswdEntry{}, fmt.Errorf("invalid gid in %q", l)
+	}
+	return PasswdEntry{
+		Name: f[0], Password: f[1], UID: uid, GID: gid, Class: f[4],
+		Change: f[5], Expire: f[6], Gecos: f[7], Home: f[8], Shell: f[9],
+	}, nil
+}
+
+func formatPasswdLine(e PasswdEntry) string {
+	return strings.Join([]string{
+		e.Name, e.Password, strconv.Itoa(e.UID), strconv.Itoa(e.GID), e.Class,
+		e.Change, e.Expire, e.Gecos, e.Home, e.Shell,
+	}, ":")
+}
+
+func parseGroupLine(l string) (GroupEntry, error) {
+	f := strings.Split(l, ":")
+	if len(f) != 4 {
+		return GroupEntry{}, fmt.Errorf("malformed entry (want 4 fields, got %d): %q", len(f), l)
+	}
+	gid, err := strconv.Atoi(f[2])
+	if err != nil {
+		return GroupEntry{}, fmt.Errorf("invalid gid in %q", l)
+	}
+	var members []string
+	if f[3] != "" {
+		members = strings.Split(f[3], ",")
+	}
+	return GroupEntry{Name: f[0], Password: f[1], GID: gid, Members: members}, nil
+}
+
+func formatGroupLine(g GroupEntry) string {
+	return fmt.Sprintf("%s:%s:%d:%s", g.Name, g.Password, g.GID, strings.Join(g.Members, ","))
+}
+
+// readLines reads a file into lines. A missing file yields no lines.
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
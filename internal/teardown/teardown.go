@@ -0,0 +1,99 @@
+// Package teardown tracks resources created during a build (md devices,
+// imported pools, mounts, temporary files) so they are released in reverse
+// order whether the build succeeds, fails or is interrupted.
+package teardown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pgsdf/pgsdbuild/internal/util"
+)
+
+// Func releases a resource. The context it receives is never cancelled by
+// the build's cancellation, so an interrupted build still cleans up.
+type Func func(ctx context.Context) error
+
+// step is a registered release action.
+type step struct {
+	name string
+	fn   Func
+}
+
+// Stack is a LIFO list of release actions.
+type Stack struct {
+	mu     sync.Mutex
+	steps  []step
+	logger *util.Logger
+}
+
+// New creates an empty Stack that reports failed steps to logger.
+func New(logger *util.Logger) *Stack {
+	return &Stack{logger: logger}
+}
+
+// Push registers fn to release the resource called name.
+func (s *Stack) Push(name string, fn Func) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, step{name: name, fn: fn})
+}
+
+// Forget removes the most recently pushed step called name without running
+// it. It is used when a resource has been handed over, such as a temporary
+// file that was renamed into place.
+func (s *Stack) Forget(name string) {
+	s.take(name)
+}
+
+// Release runs and removes the most recently pushed step called name. It is
+// used when a resource is released during the build, such as a temporary
+// mount.
+func (s *Stack) Release(ctx context.Context, name string) error {
+	fn := s.take(name)
+	if fn == nil {
+		return nil
+	}
+	s.logger.Debug("Releasing %s", name)
+	return fn(context.WithoutCancel(ctx))
+}
+
+// Run releases every registered resource, most recent first. Failures are
+// logged and do not stop the remaining steps; the returned error joins them.
+// Steps run even if ctx has been cancelled.
+func (s *Stack) Run(ctx context.Context) error {
+	s.mu.Lock()
+	steps := s.steps
+	s.steps = nil
+	s.mu.Unlock()
+
+	if ctx.Err() != nil && len(steps) > 0 {
+		s.logger.Info("Build interrupted, releasing %d resource(s)", len(steps))
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		s.logger.Debug("Releasing %s", steps[i].name)
+		if err := steps[i].fn(ctx); err != nil {
+			s.logger.Warn("Failed to release %s: %v", steps[i].name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", steps[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Stack) take(name string) Func {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if s.steps[i].name == name {
+			fn := s.steps[i].fn
+			s.steps = append(s.steps[:i], s.steps[i+1:]...)
+			return fn
+		}
+	}
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // CopyFile copies a single file from src to dst with the specified mode.
@@ -222,3 +224,105 @@ func WriteStringToFile(path string, content string, perm os.FileMode) error {
 
 	return nil
 }
+
+// FormatSize converts a byte count to a human-readable size.
+func FormatSize(bytes int64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+	)
+
+	switch {
+	case bytes >= GB:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/float64(GB))
+	case bytes >= MB:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/float64(MB))
+	case bytes >= KB:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/float64(KB))
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
+
+// ParseSize parses a size such as "512M", "20G" or "1048576" (bytes).
+// Suffixes are binary, as in FormatSize; a trailing "B" is allowed.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// IsWithin reports whether path is strictly inside base once both are made
+// absolute and symlinks in their existing parts are resolved.
+func IsWithin(base, path string) (bool, error) {
+	absBase, err := resolvePath(base)
+	if err != nil {
+		return false, err
+	}
+	absPath, err := resolvePath(path)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil {
+		return false, nil
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// resolvePath makes path absolute and resolves symlinks in the longest
+// existing prefix, so a path that does not exist yet is still checked
+// against where it would be created.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := abs, ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(existing); err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// CleanupDirWithin removes path like CleanupDir, but refuses to do so
+// unless path lies strictly inside base. Build code uses it so a wrong or
+// empty path can never remove anything outside the work tree.
+func CleanupDirWithin(base, path string) error {
+	ok, err := IsWithin(base, path)
+	if err != nil {
+		return fmt.Errorf("refusing to remove %s: %w", path, err)
+	}
+	if !ok {
+		return fmt.Errorf("refusing to remove %s: not inside %s", path, base)
+	}
+	return CleanupDir(path)
+}
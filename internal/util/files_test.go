@@ -0,0 +1,134 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pathTree creates base/inside/file, a directory outside base and links
+// from base to both, and returns base and the outside directory.
+func pathTree(t *testing.T) (string, string) {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "work")
+	outside := filepath.Join(t.TempDir(), "outside")
+	for _, dir := range []string{filepath.Join(base, "inside"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "inside", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "keep"), []byte("keep\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("inside", filepath.Join(base, "alias")); err != nil {
+		t.Fatal(err)
+	}
+	return base, outside
+}
+
+// Only paths strictly below base count, after ".." and symlinks in the
+// existing part of either path are resolved.
+func TestIsWithin(t *testing.T) {
+	base, outside := pathTree(t)
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"child", filepath.Join(base, "inside"), true},
+		{"file", filepath.Join(base, "inside", "file"), true},
+		{"base itself", base, false},
+		{"base with trailing slash", base + "/", false},
+		{"base through dot-dot", filepath.Join(base, "inside") + "/..", false},
+		{"parent", filepath.Dir(base), false},
+		{"dot-dot escape", base + "/inside/../../outside", false},
+		{"dot-dot inside", base + "/inside/../alias/file", true},
+		{"sibling with common prefix", base + "2", false},
+		{"not yet created", filepath.Join(base, "new", "dir"), true},
+		{"not yet created escape", base + "/new/../../outside", false},
+		{"symlink out", filepath.Join(base, "escape"), false},
+		{"through symlink out", filepath.Join(base, "escape", "keep"), false},
+		{"not yet created through symlink out", filepath.Join(base, "escape", "new", "dir"), false},
+		{"symlink in", filepath.Join(base, "alias"), true},
+		{"through symlink in", filepath.Join(base, "alias", "file"), true},
+		{"outside", outside, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IsWithin(base, tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IsWithin(%s, %s) = %v, want %v", base, tt.path, got, tt.want)
+			}
+		})
+	}
+
+	// A base reached through a symlink contains the paths below its target
+	link := filepath.Join(t.TempDir(), "work-link")
+	if err := os.Symlink(base, link); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsWithin(link, filepath.Join(base, "inside")); err != nil || !ok {
+		t.Errorf("IsWithin through linked base = %v, %v", ok, err)
+	}
+
+	// Relative paths are taken from the working directory
+	t.Chdir(base)
+	if ok, err := IsWithin(".", "inside/file"); err != nil || !ok {
+		t.Errorf("IsWithin(., inside/file) = %v, %v", ok, err)
+	}
+	if ok, err := IsWithin(".", "../outside"); err != nil || ok {
+		t.Errorf("IsWithin(., ../outside) = %v, %v", ok, err)
+	}
+}
+
+// CleanupDirWithin removes directories below base and refuses anything
+// else, leaving it untouched.
+func TestCleanupDirWithin(t *testing.T) {
+	tests := []struct {
+		name string
+		path func(base string) string
+		err  string
+	}{
+		{name: "inside", path: func(base string) string { return filepath.Join(base, "inside") }},
+		{name: "not yet created", path: func(base string) string { return filepath.Join(base, "new") }},
+		{name: "base", path: func(base string) string { return base }, err: "not inside"},
+		{name: "empty", path: func(base string) string { return "" }, err: "not inside"},
+		{name: "dot-dot", path: func(base string) string { return base + "/inside/../.." }, err: "not inside"},
+		{name: "symlink out", path: func(base string) string { return filepath.Join(base, "escape") }, err: "not inside"},
+		{name: "through symlink out", path: func(base string) string { return filepath.Join(base, "escape", "keep") }, err: "not inside"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, outside := pathTree(t)
+			t.Chdir(base)
+			path := tt.path(base)
+			err := CleanupDirWithin(base, path)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					t.Errorf("%s was not removed: %v", path, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "refusing to remove") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			if !FileExists(filepath.Join(outside, "keep")) {
+				t.Error("a file outside base was removed")
+			}
+			if !DirExists(base) {
+				t.Error("base was removed")
+			}
+		})
+	}
+}
@@ -81,7 +81,7 @@ return {
   -- The installer will read images from this location
   images_dir = "/usr/local/share/pgsd/images",
 
-  -- Boot environment configuration (metadata)
+  -- Boot environment configuration (metadata, except iso)
   bootenv = {
     -- Live user configuration
     live_user = {
@@ -92,7 +92,7 @@ return {
       auto_login = true,           -- Auto-login on tty1
     },
 
-    -- ISO configuration
+    -- ISO configuration: volume label, publisher and boot entries
     iso = {
       volume_id = "PGSD_BOOT",
       publisher = "Pacific Grove Software Distribution Foundation",